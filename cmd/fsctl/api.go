@@ -0,0 +1,147 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// The API's responses, as far as fsctl reads them. They are kept apart
+// from the server's models so the client does not link the server.
+
+// apiFile is a file's metadata
+type apiFile struct {
+    ID            int               `json:"id"`
+    OrgID         *int              `json:"org_id,omitempty"`
+    Name          string            `json:"name"`
+    Folder        string            `json:"folder"`
+    Size          int64             `json:"size"`
+    ContentType   string            `json:"content_type"`
+    Checksum      string            `json:"checksum"`
+    ScanStatus    string            `json:"scan_status"`
+    PreviewStatus string            `json:"preview_status"`
+    UploadDate    time.Time         `json:"upload_date"`
+    Tags          []string          `json:"tags"`
+    Description   string            `json:"description"`
+    Metadata      map[string]string `json:"metadata"`
+    Version       int               `json:"version"`
+}
+
+// apiFilePage is a page of a file listing
+type apiFilePage struct {
+    Files      []apiFile `json:"files"`
+    NextCursor string    `json:"next_cursor,omitempty"`
+    Total      int       `json:"total"`
+}
+
+// apiSearchResult is a file matching a search
+type apiSearchResult struct {
+    apiFile
+    Rank       float32           `json:"rank"`
+    Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// apiShareLink is a link that lets anyone download a file until it expires
+type apiShareLink struct {
+    ID            int       `json:"id"`
+    FileID        int       `json:"file_id"`
+    CreatedAt     time.Time `json:"created_at"`
+    ExpiresAt     time.Time `json:"expires_at"`
+    DownloadCount int       `json:"download_count"`
+}
+
+// apiToken is an API token, without its secret
+type apiToken struct {
+    ID   int    `json:"id"`
+    Name string `json:"name"`
+}
+
+// apiUploadSession is a large upload sent as numbered parts
+type apiUploadSession struct {
+    ID        string `json:"id"`
+    Filename  string `json:"filename"`
+    Size      int64  `json:"size"`
+    ChunkSize int64  `json:"chunk_size"`
+    PartCount int    `json:"part_count"`
+    Folder    string `json:"folder"`
+}
+
+// partSize returns the size of a part; only the last may be short
+func (s apiUploadSession) partSize(partNumber int) int64 {
+    if partNumber == s.PartCount {
+        return s.Size - int64(s.PartCount-1)*s.ChunkSize
+    }
+    return s.ChunkSize
+}
+
+// apiUploadPart is a part the server has received
+type apiUploadPart struct {
+    PartNumber int    `json:"part_number"`
+    Size       int64  `json:"size"`
+    SHA256     string `json:"sha256"`
+}
+
+// Types of events in the event log
+const (
+    eventCreated           = "created"
+    eventRenamed           = "renamed"
+    eventMoved             = "moved"
+    eventDeleted           = "deleted"
+    eventLinkCreated       = "link_created"
+    eventPermissionGranted = "permission_granted"
+)
+
+// apiEvent is an entry of the event log
+type apiEvent struct {
+    Type      string          `json:"type"`
+    FileID    *int            `json:"file_id,omitempty"`
+    Folder    string          `json:"folder"`
+    Name      string          `json:"name,omitempty"`
+    OldFolder *string         `json:"old_folder,omitempty"`
+    OldName   *string         `json:"old_name,omitempty"`
+    Size      *int64          `json:"size,omitempty"`
+    Checksum  string          `json:"checksum,omitempty"`
+    Details   json.RawMessage `json:"details,omitempty"`
+    CreatedAt time.Time       `json:"created_at"`
+}
+
+// isFileChange reports whether an event changed the file itself, rather
+// than how it is shared
+func (e apiEvent) isFileChange() bool {
+    switch e.Type {
+    case eventCreated, eventRenamed, eventMoved, eventDeleted:
+        return true
+    }
+    return false
+}
+
+// apiEventsPage is a page of the event log
+type apiEventsPage struct {
+    Events  []apiEvent `json:"events"`
+    Cursor  string     `json:"cursor"`
+    HasMore bool       `json:"has_more"`
+}
+
+// parseSize parses a byte count with an optional KB/MB/GB/TB suffix (powers of 1024)
+func parseSize(s string) (int64, error) {
+    s = strings.ToUpper(strings.TrimSpace(s))
+    multiplier := int64(1)
+    for _, unit := range []struct {
+        suffix string
+        size   int64
+    }{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+        if strings.HasSuffix(s, unit.suffix) {
+            s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+            multiplier = unit.size
+            break
+        }
+    }
+    n, err := strconv.ParseInt(s, 10, 64)
+    if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+        return 0, fmt.Errorf("invalid size %q", s)
+    }
+    return n * multiplier, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+)
+
+var errNotLoggedIn = errors.New("not logged in: run fsctl login first")
+
+// apiError is an error response from the API
+type apiError struct {
+    Status  int
+    Message string
+}
+
+func (e *apiError) Error() string {
+    return fmt.Sprintf("%s (HTTP %d)", e.Message, e.Status)
+}
+
+// client calls the API at server, authenticated with token when it is set
+type client struct {
+    server string
+    token  string
+    http   *http.Client
+}
+
+func (c *client) url(path string) string {
+    return strings.TrimSuffix(c.server, "/") + path
+}
+
+// do sends a request, turning error responses into an *apiError
+func (c *client) do(req *http.Request) (*http.Response, error) {
+    if c.token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.token)
+    }
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode >= 400 {
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+        message := strings.TrimSpace(string(body))
+        if message == "" {
+            message = http.StatusText(resp.StatusCode)
+        }
+        return nil, &apiError{Status: resp.StatusCode, Message: message}
+    }
+    return resp, nil
+}
+
+// call sends in as a JSON body, when it is not nil, and decodes the JSON
+// response into out, when it is not nil
+func (c *client) call(method, path string, in, out interface{}) error {
+    var body io.Reader
+    if in != nil {
+        data, err := json.Marshal(in)
+        if err != nil {
+            return err
+        }
+        body = bytes.NewReader(data)
+    }
+    req, err := http.NewRequest(method, c.url(path), body)
+    if err != nil {
+        return err
+    }
+    if in != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    resp, err := c.do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if out == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// signIn exchanges an email and password for a JWT, which Login sets as
+// the token cookie
+func (c *client) signIn(email, password string) (string, error) {
+    data, _ := json.Marshal(map[string]string{"email": email, "password": password})
+    req, err := http.NewRequest("POST", c.url("/login"), bytes.NewReader(data))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := c.do(req)
+    if err != nil {
+        return "", err
+    }
+    resp.Body.Close()
+    for _, cookie := range resp.Cookies() {
+        if cookie.Name == "token" {
+            return cookie.Value, nil
+        }
+    }
+    return "", errors.New("the server did not return a token")
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+    "text/tabwriter"
+    "time"
+)
+
+// login signs in with an email and password and stores a new API token,
+// or stores an existing token given with --token
+func (a *app) login(args []string) error {
+    fs := a.flags("login", "[--server URL] [--email EMAIL] [--token TOKEN]")
+    server := fs.String("server", a.cfg.Server, "base URL of the API")
+    email := fs.String("email", a.cfg.Email, "account email, asked for when not given")
+    token := fs.String("token", "", "store an existing API token instead of signing in")
+    asJSON := fs.Bool("json", false, "print JSON")
+    if _, err := parse(fs, args, 0, 0); err != nil {
+        return err
+    }
+
+    c := &client{server: strings.TrimSuffix(*server, "/"), http: http.DefaultClient}
+    if *token != "" {
+        c.token = *token
+        if err := c.call("GET", "/me/usage", nil, nil); err != nil {
+            return fmt.Errorf("checking token: %w", err)
+        }
+        a.cfg.Token, a.cfg.TokenID = *token, 0
+    } else {
+        var err error
+        if *email == "" {
+            if *email, err = a.prompt("Email: ", false); err != nil {
+                return err
+            }
+        }
+        password, err := a.prompt("Password: ", true)
+        if err != nil {
+            return err
+        }
+        if c.token, err = c.signIn(*email, password); err != nil {
+            return err
+        }
+
+        // The JWT from signing in is short-lived, so keep an API token instead
+        name := "fsctl"
+        if host, err := os.Hostname(); err == nil {
+            name += " on " + host
+        }
+        var created struct {
+            Token    string   `json:"token"`
+            APIToken apiToken `json:"api_token"`
+        }
+        if err := c.call("POST", "/tokens", map[string]string{"name": name}, &created); err != nil {
+            return fmt.Errorf("creating API token: %w", err)
+        }
+        a.cfg.Email, a.cfg.Token, a.cfg.TokenID = *email, created.Token, created.APIToken.ID
+    }
+    a.cfg.Server = c.server
+    if err := a.cfg.save(); err != nil {
+        return err
+    }
+
+    if *asJSON {
+        return a.printJSON(map[string]string{"server": a.cfg.Server, "email": a.cfg.Email})
+    }
+    if a.cfg.Email != "" {
+        fmt.Fprintf(a.stdout, "Logged in to %s as %s\n", a.cfg.Server, a.cfg.Email)
+    } else {
+        fmt.Fprintf(a.stdout, "Logged in to %s\n", a.cfg.Server)
+    }
+    return nil
+}
+
+// logout revokes the API token created by login and forgets it
+func (a *app) logout(args []string) error {
+    fs := a.flags("logout", "")
+    if _, err := parse(fs, args, 0, 0); err != nil {
+        return err
+    }
+    if a.cfg.Token == "" {
+        return errNotLoggedIn
+    }
+
+    if a.cfg.TokenID != 0 {
+        // A token that was revoked elsewhere is rejected or not found
+        c, _ := a.client()
+        err := c.call("DELETE", "/tokens/"+strconv.Itoa(a.cfg.TokenID), nil, nil)
+        var apiErr *apiError
+        if err != nil && !(errors.As(err, &apiErr) && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusNotFound)) {
+            return fmt.Errorf("revoking API token: %w", err)
+        }
+    }
+    a.cfg.Token, a.cfg.TokenID = "", 0
+    if err := a.cfg.save(); err != nil {
+        return err
+    }
+    fmt.Fprintln(a.stdout, "Logged out")
+    return nil
+}
+
+// upload uploads files and directories, resuming interrupted uploads
+func (a *app) upload(args []string) error {
+    fs := a.flags("upload", "[--folder PATH] [--org ID] [--chunk-size SIZE] PATH...")
+    folder := fs.String("folder", "/", "folder to upload into")
+    orgID := fs.Int("org", 0, "upload into an organization's files")
+    chunkSize := fs.String("chunk-size", "8MB", "size of the parts files are sent in")
+    asJSON := fs.Bool("json", false, "print the uploaded files as JSON")
+    paths, err := parse(fs, args, 1, -1)
+    if err != nil {
+        return err
+    }
+    size, err := parseSize(*chunkSize)
+    if err != nil {
+        return err
+    }
+    c, err := a.client()
+    if err != nil {
+        return err
+    }
+    jobs, err := uploadJobs(paths, path.Join("/", *folder))
+    if err != nil {
+        return err
+    }
+
+    u := &uploader{app: a, c: c, orgID: *orgID, chunkSize: size}
+    uploaded := []apiFile{}
+    for _, job := range jobs {
+        file, err := u.upload(job)
+        if err != nil {
+            fmt.Fprintf(a.stderr, "fsctl: %s: %v\n", job.local, err)
+            continue
+        }
+        uploaded = append(uploaded, file)
+        if !*asJSON {
+            fmt.Fprintf(a.stdout, "%s -> %s (file %d)\n", job.local, path.Join(file.Folder, file.Name), file.ID)
+        }
+    }
+    if *asJSON {
+        if err := a.printJSON(uploaded); err != nil {
+            return err
+        }
+    }
+    if failed := len(jobs) - len(uploaded); failed > 0 {
+        return fmt.Errorf("%d of %d uploads failed; run the same command again to resume", failed, len(jobs))
+    }
+    return nil
+}
+
+// sync keeps a local directory and a remote folder in sync, once or until
+// it is interrupted
+func (a *app) sync(args []string) error {
+    fs := a.flags("sync", "[--folder PATH] [--org ID] [--once] [--interval DURATION] DIR")
+    folder := fs.String("folder", "/", "remote folder to sync with")
+    orgID := fs.Int("org", 0, "sync with an organization's folder")
+    once := fs.Bool("once", false, "sync once and exit instead of watching for changes")
+    interval := fs.Duration("interval", 30*time.Second, "how often to check for remote changes")
+    asJSON := fs.Bool("json", false, "print what sync does as JSON lines")
+    dirs, err := parse(fs, args, 1, 1)
+    if err != nil {
+        return err
+    }
+    if *interval <= 0 {
+        return fmt.Errorf("invalid interval %s", *interval)
+    }
+    c, err := a.client()
+    if err != nil {
+        return err
+    }
+    dir, err := filepath.Abs(dirs[0])
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return err
+    }
+    state, err := loadSyncState(dir, c.server, path.Join("/", *folder), *orgID)
+    if err != nil {
+        return err
+    }
+
+    host, _ := os.Hostname()
+    s := &syncer{app: a, c: c, dir: dir, state: state, asJSON: *asJSON, host: host}
+    if *once {
+        failed, err := s.pass()
+        if err == nil && failed > 0 {
+            err = fmt.Errorf("%d files could not be synced; run sync again to retry", failed)
+        }
+        return err
+    }
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    return s.watch(ctx, *interval)
+}
+
+// download saves a file given by ID, or by share link without logging in
+func (a *app) download(args []string) error {
+    fs := a.flags("download", "[-o PATH] FILE_ID|SHARE_URL")
+    output := fs.String("o", "", "where to save the file, a directory, or - for stdout")
+    asJSON := fs.Bool("json", false, "print JSON")
+    targets, err := parse(fs, args, 1, 1)
+    if err != nil {
+        return err
+    }
+
+    c, req, err := a.downloadRequest(targets[0])
+    if err != nil {
+        return err
+    }
+    resp, err := c.do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    name := downloadName(resp)
+    dest := *output
+    if dest == "" {
+        dest = name
+    } else if info, err := os.Stat(dest); err == nil && info.IsDir() {
+        dest = filepath.Join(dest, name)
+    }
+    n, err := a.saveDownload(resp, dest)
+    if err != nil {
+        return err
+    }
+
+    switch {
+    case *asJSON:
+        return a.printJSON(map[string]interface{}{"name": name, "path": dest, "size": n})
+    case dest != "-":
+        fmt.Fprintf(a.stdout, "Saved %s (%s)\n", dest, formatSize(n))
+    }
+    return nil
+}
+
+// list lists files a page at a time, or all of them with --all
+func (a *app) list(args []string) error {
+    fs := a.flags("ls", "[--org ID] [--name PREFIX] [--type TYPE] [--sort date|name|size] [--order asc|desc] [--limit N] [--all]")
+    orgID := fs.Int("org", 0, "list an organization's files")
+    name := fs.String("name", "", "only files whose name starts with this")
+    contentType := fs.String("type", "", `only files of this content type, e.g. "image/*"`)
+    sort := fs.String("sort", "", "sort by date, name or size")
+    order := fs.String("order", "", "asc or desc")
+    limit := fs.Int("limit", 0, "files per page")
+    all := fs.Bool("all", false, "list every page")
+    asJSON := fs.Bool("json", false, "print JSON")
+    if _, err := parse(fs, args, 0, 0); err != nil {
+        return err
+    }
+    c, err := a.client()
+    if err != nil {
+        return err
+    }
+
+    query := url.Values{}
+    for key, value := range map[string]string{"name": *name, "type": *contentType, "sort": *sort, "order": *order} {
+        if value != "" {
+            query.Set(key, value)
+        }
+    }
+    if *orgID != 0 {
+        query.Set("org", strconv.Itoa(*orgID))
+    }
+    if *limit > 0 {
+        query.Set("limit", strconv.Itoa(*limit))
+    }
+
+    var result apiFilePage
+    for {
+        var page apiFilePage
+        if err := c.call("GET", "/files?"+query.Encode(), nil, &page); err != nil {
+            return err
+        }
+        result.Files = append(result.Files, page.Files...)
+        result.Total, result.NextCursor = page.Total, page.NextCursor
+        if !*all || page.NextCursor == "" {
+            break
+        }
+        query.Set("cursor", page.NextCursor)
+    }
+    if result.Files == nil {
+        result.Files = []apiFile{}
+    }
+
+    if *asJSON {
+        return a.printJSON(result)
+    }
+    a.printFiles(result.Files)
+    if result.NextCursor != "" {
+        fmt.Fprintf(a.stderr, "Showing %d of %d files; use --all to list them all\n", len(result.Files), result.Total)
+    }
+    return nil
+}
+
+// search finds files matching every word of the query
+func (a *app) search(args []string) error {
+    fs := a.flags("search", "[--folder PATH] [--type TYPE] [--org ID] [--limit N] QUERY...")
+    folder := fs.String("folder", "", "only files in this folder or below it")
+    contentType := fs.String("type", "", `only files of this content type, e.g. "image/*"`)
+    orgID := fs.Int("org", 0, "search an organization's files")
+    limit := fs.Int("limit", 0, "at most this many results")
+    asJSON := fs.Bool("json", false, "print JSON")
+    words, err := parse(fs, args, 1, -1)
+    if err != nil {
+        return err
+    }
+    c, err := a.client()
+    if err != nil {
+        return err
+    }
+
+    query := url.Values{"q": {strings.Join(words, " ")}}
+    if *folder != "" {
+        query.Set("folder", *folder)
+    }
+    if *contentType != "" {
+        query.Set("type", *contentType)
+    }
+    if *orgID != 0 {
+        query.Set("org", strconv.Itoa(*orgID))
+    }
+    if *limit > 0 {
+        query.Set("limit", strconv.Itoa(*limit))
+    }
+
+    var results []apiSearchResult
+    if err := c.call("GET", "/files/search?"+query.Encode(), nil, &results); err != nil {
+        return err
+    }
+    if *asJSON {
+        return a.printJSON(results)
+    }
+    files := make([]apiFile, len(results))
+    for i, result := range results {
+        files[i] = result.apiFile
+    }
+    a.printFiles(files)
+    return nil
+}
+
+// share creates a share link that expires, or lists or revokes a file's links
+func (a *app) share(args []string) error {
+    fs := a.flags("share", "[--expires 7d] [--list] [--revoke LINK_ID] FILE_ID")
+    expires := fs.String("expires", "7d", "how long the link works, in hours or days, e.g. 12h or 30d")
+    list := fs.Bool("list", false, "list the file's share links")
+    revoke := fs.Int("revoke", 0, "revoke a share link")
+    asJSON := fs.Bool("json", false, "print JSON")
+    ids, err := parse(fs, args, 1, 1)
+    if err != nil {
+        return err
+    }
+    c, err := a.client()
+    if err != nil {
+        return err
+    }
+    links := "/files/" + url.PathEscape(ids[0]) + "/links"
+
+    switch {
+    case *revoke != 0:
+        if err := c.call("DELETE", links+"/"+strconv.Itoa(*revoke), nil, nil); err != nil {
+            return err
+        }
+        fmt.Fprintf(a.stdout, "Revoked share link %d\n", *revoke)
+        return nil
+
+    case *list:
+        var shares []apiShareLink
+        if err := c.call("GET", links, nil, &shares); err != nil {
+            return err
+        }
+        if *asJSON {
+            return a.printJSON(shares)
+        }
+        w := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "ID\tEXPIRES\tDOWNLOADS")
+        for _, share := range shares {
+            fmt.Fprintf(w, "%d\t%s\t%d\n", share.ID, share.ExpiresAt.Local().Format(time.DateTime), share.DownloadCount)
+        }
+        return w.Flush()
+    }
+
+    hours, err := parseExpiry(*expires)
+    if err != nil {
+        return err
+    }
+    var created struct {
+        URL       string       `json:"url"`
+        ShareLink apiShareLink `json:"share_link"`
+    }
+    if err := c.call("POST", links, map[string]int{"expires_in_hours": hours}, &created); err != nil {
+        return err
+    }
+    if *asJSON {
+        return a.printJSON(created)
+    }
+    fmt.Fprintln(a.stdout, created.URL)
+    fmt.Fprintf(a.stderr, "Expires %s\n", created.ShareLink.ExpiresAt.Local().Format(time.DateTime))
+    return nil
+}
+
+// parseExpiry reads a link lifetime in whole hours ("12h") or days ("7d")
+func parseExpiry(value string) (int, error) {
+    invalid := fmt.Errorf("invalid expiry %q: use hours or days, e.g. 12h or 7d", value)
+    if days, ok := strings.CutSuffix(value, "d"); ok {
+        n, err := strconv.Atoi(days)
+        if err != nil || n < 1 {
+            return 0, invalid
+        }
+        return n * 24, nil
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d < time.Hour || d%time.Hour != 0 {
+        return 0, invalid
+    }
+    return int(d / time.Hour), nil
+}
+
+// printFiles prints files as a table
+func (a *app) printFiles(files []apiFile) {
+    w := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tSIZE\tUPLOADED\tPATH")
+    for _, file := range files {
+        fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", file.ID, formatSize(file.Size), file.UploadDate.Local().Format(time.DateTime), path.Join(file.Folder, file.Name))
+    }
+    w.Flush()
+}
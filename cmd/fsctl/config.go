@@ -0,0 +1,107 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const defaultServer = "http://localhost:8080"
+
+// config is what fsctl remembers between runs, kept as JSON in
+// $FSCTL_CONFIG or the user's config directory. It holds an API token, so
+// it is only readable by its owner.
+type config struct {
+    Server string `json:"server"`
+    Email  string `json:"email,omitempty"`
+    Token  string `json:"token,omitempty"`
+    // TokenID is the API token created by login, which logout revokes
+    TokenID int `json:"token_id,omitempty"`
+    // Uploads are the chunked uploads in progress by local path, so that an
+    // interrupted upload resumes where it stopped
+    Uploads map[string]pendingUpload `json:"uploads,omitempty"`
+
+    path string
+}
+
+// pendingUpload is an upload session and the file it was started for. The
+// session is only resumed while the file and destination are unchanged.
+type pendingUpload struct {
+    SessionID string    `json:"session_id"`
+    Size      int64     `json:"size"`
+    ModTime   time.Time `json:"mod_time"`
+    Folder    string    `json:"folder"`
+    OrgID     int       `json:"org_id,omitempty"`
+}
+
+func (p pendingUpload) matches(info os.FileInfo, folder string, orgID int) bool {
+    return p.Size == info.Size() && p.ModTime.Equal(info.ModTime()) && p.Folder == folder && p.OrgID == orgID
+}
+
+func configPath() (string, error) {
+    if path := os.Getenv("FSCTL_CONFIG"); path != "" {
+        return path, nil
+    }
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "fsctl", "config.json"), nil
+}
+
+// loadConfig reads the config file, starting afresh when there is none
+func loadConfig() (*config, error) {
+    path, err := configPath()
+    if err != nil {
+        return nil, err
+    }
+    cfg := &config{path: path}
+    data, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        if err := json.Unmarshal(data, cfg); err != nil {
+            return nil, fmt.Errorf("reading %s: %w", path, err)
+        }
+    }
+    if cfg.Server == "" {
+        cfg.Server = defaultServer
+    }
+    if cfg.Uploads == nil {
+        cfg.Uploads = make(map[string]pendingUpload)
+    }
+    return cfg, nil
+}
+
+// save writes the config file
+func (c *config) save() error {
+    data, err := json.MarshalIndent(c, "", "  ")
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(c.path, append(data, '\n'))
+}
+
+// writeFileAtomic replaces a private file in one step, so that an
+// interrupted run never leaves it half written
+func writeFileAtomic(path string, data []byte) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), ".fsctl-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
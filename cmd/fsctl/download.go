@@ -0,0 +1,68 @@
+package main
+
+import (
+    "io"
+    "mime"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// downloadRequest builds the request for a file ID, or for a share link,
+// which needs no login and is fetched without the token
+func (a *app) downloadRequest(target string) (*client, *http.Request, error) {
+    if u, err := url.Parse(target); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+        req, err := http.NewRequest("GET", target, nil)
+        return &client{http: http.DefaultClient}, req, err
+    }
+    c, err := a.client()
+    if err != nil {
+        return nil, nil, err
+    }
+    req, err := http.NewRequest("GET", c.url("/files/"+url.PathEscape(target)+"/download"), nil)
+    return c, req, err
+}
+
+// downloadName is the file name the server gave a download, falling back
+// to the last segment of its URL. Only the base name is kept, so a server
+// cannot make fsctl write outside the current directory.
+func downloadName(resp *http.Response) string {
+    name := path.Base(resp.Request.URL.Path)
+    if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+        name = params["filename"]
+    }
+    name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+    if name == "." || name == ".." || name == "/" || name == "" {
+        return "download"
+    }
+    return name
+}
+
+// saveDownload writes a response body to dest, through a .part file that
+// is only renamed into place once the download is complete
+func (a *app) saveDownload(resp *http.Response, dest string) (int64, error) {
+    bar := a.newProgress(filepath.Base(dest), resp.ContentLength)
+    defer bar.finish()
+    body := io.TeeReader(resp.Body, bar)
+
+    if dest == "-" {
+        return io.Copy(a.stdout, body)
+    }
+    partial := dest + ".part"
+    f, err := os.Create(partial)
+    if err != nil {
+        return 0, err
+    }
+    n, err := io.Copy(f, body)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(partial)
+        return n, err
+    }
+    return n, os.Rename(partial, dest)
+}
@@ -0,0 +1,209 @@
+// Command fsctl is a command-line client for the file sharing API. It signs
+// in once and keeps an API token in its config file, then uploads, downloads,
+// lists, searches and shares files, and keeps directories in sync with
+// remote folders. Every command takes --json for output that scripts can
+// parse.
+//
+// Usage:
+//
+//	fsctl login [--server URL] [--email EMAIL] [--token TOKEN]
+//	fsctl logout
+//	fsctl upload [--folder PATH] [--org ID] [--chunk-size SIZE] PATH...
+//	fsctl download [-o PATH] FILE_ID|SHARE_URL
+//	fsctl sync [--folder PATH] [--org ID] [--once] [--interval DURATION] DIR
+//	fsctl ls [--org ID] [--name PREFIX] [--type TYPE] [--sort date|name|size] [--all]
+//	fsctl search [--folder PATH] [--type TYPE] [--org ID] QUERY...
+//	fsctl share [--expires 7d] FILE_ID
+//	fsctl share --list FILE_ID
+//	fsctl share --revoke LINK_ID FILE_ID
+//
+// FSCTL_CONFIG overrides where the config file is kept, and FSCTL_SERVER and
+// FSCTL_TOKEN override the server and token it holds, e.g. in CI jobs.
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "golang.org/x/term"
+)
+
+const usage = `Usage: fsctl <command> [flags] [arguments]
+
+Commands:
+  login      sign in and store an API token
+  logout     revoke the stored API token
+  upload     upload files and directories
+  download   download a file by ID or share link
+  sync       keep a local directory and a remote folder in sync
+  ls         list files
+  search     search files
+  share      create, list and revoke share links
+
+Run fsctl <command> -h for the flags of a command.
+`
+
+// errUsage reports that the command line was wrong, after the problem has
+// been printed
+var errUsage = errors.New("usage")
+
+// app is one run of fsctl
+type app struct {
+    cfg    *config
+    stdin  io.Reader
+    stdout io.Writer
+    stderr io.Writer
+    // showProgress draws progress bars on stderr
+    showProgress bool
+
+    input *bufio.Reader
+}
+
+func main() {
+    cfg, err := loadConfig()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "fsctl:", err)
+        os.Exit(1)
+    }
+    a := &app{
+        cfg:          cfg,
+        stdin:        os.Stdin,
+        stdout:       os.Stdout,
+        stderr:       os.Stderr,
+        showProgress: term.IsTerminal(int(os.Stderr.Fd())),
+    }
+
+    switch err := a.run(os.Args[1:]); {
+    case err == nil, errors.Is(err, flag.ErrHelp):
+    case errors.Is(err, errUsage):
+        os.Exit(2)
+    default:
+        fmt.Fprintln(os.Stderr, "fsctl:", err)
+        os.Exit(1)
+    }
+}
+
+func (a *app) run(args []string) error {
+    if len(args) == 0 {
+        fmt.Fprint(a.stderr, usage)
+        return errUsage
+    }
+    commands := map[string]func([]string) error{
+        "login":    a.login,
+        "logout":   a.logout,
+        "upload":   a.upload,
+        "download": a.download,
+        "sync":     a.sync,
+        "ls":       a.list,
+        "search":   a.search,
+        "share":    a.share,
+    }
+    command, ok := commands[args[0]]
+    if !ok {
+        if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+            fmt.Fprint(a.stdout, usage)
+            return nil
+        }
+        fmt.Fprintf(a.stderr, "fsctl: unknown command %q\n\n%s", args[0], usage)
+        return errUsage
+    }
+    return command(args[1:])
+}
+
+// flags starts the flag set of a command. Flags may come after the
+// arguments too, as in fsctl share 42 --expires 1d.
+func (a *app) flags(name, arguments string) *flag.FlagSet {
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+    fs.SetOutput(a.stderr)
+    fs.Usage = func() {
+        fmt.Fprintf(a.stderr, "Usage: fsctl %s %s\n", name, arguments)
+        fs.PrintDefaults()
+    }
+    return fs
+}
+
+// parse parses a command line, allowing flags between the arguments, and
+// checks the number of arguments
+func parse(fs *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+    var positional []string
+    for {
+        if err := fs.Parse(args); err != nil {
+            if errors.Is(err, flag.ErrHelp) {
+                return nil, err
+            }
+            return nil, errUsage
+        }
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) < minArgs || (maxArgs >= 0 && len(positional) > maxArgs) {
+        fs.Usage()
+        return nil, errUsage
+    }
+    return positional, nil
+}
+
+// client returns a client for the signed in user
+func (a *app) client() (*client, error) {
+    c := a.newClient()
+    if c.token == "" {
+        return nil, errNotLoggedIn
+    }
+    return c, nil
+}
+
+// newClient returns a client for the configured server and token
+func (a *app) newClient() *client {
+    c := &client{server: a.cfg.Server, token: a.cfg.Token, http: http.DefaultClient}
+    if server := os.Getenv("FSCTL_SERVER"); server != "" {
+        c.server = server
+    }
+    if token := os.Getenv("FSCTL_TOKEN"); token != "" {
+        c.token = token
+    }
+    return c
+}
+
+func (a *app) newProgress(label string, total int64) *progress {
+    var out io.Writer
+    if a.showProgress {
+        out = a.stderr
+    }
+    return newProgress(out, label, total)
+}
+
+// printJSON writes v as indented JSON to stdout
+func (a *app) printJSON(v interface{}) error {
+    enc := json.NewEncoder(a.stdout)
+    enc.SetIndent("", "  ")
+    return enc.Encode(v)
+}
+
+// prompt asks for a line of input, hiding what is typed when secret is
+// set and stdin is a terminal
+func (a *app) prompt(label string, secret bool) (string, error) {
+    fmt.Fprint(a.stderr, label)
+    if f, ok := a.stdin.(*os.File); ok && secret && term.IsTerminal(int(f.Fd())) {
+        line, err := term.ReadPassword(int(f.Fd()))
+        fmt.Fprintln(a.stderr)
+        return string(line), err
+    }
+    if a.input == nil {
+        a.input = bufio.NewReader(a.stdin)
+    }
+    line, err := a.input.ReadString('\n')
+    if err != nil && (err != io.EOF || line == "") {
+        return "", err
+    }
+    return strings.TrimRight(line, "\r\n"), nil
+}
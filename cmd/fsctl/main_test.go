@@ -0,0 +1,388 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// fakeAPI implements the parts of the API fsctl uses, in memory
+type fakeAPI struct {
+    mu       sync.Mutex
+    sessions map[string]*fakeSession
+    files    []apiFile
+    content  map[int][]byte
+    events   []apiEvent
+    nextID   int
+    puts     int
+    // failPart makes the next PUT of that part fail once
+    failPart int
+}
+
+type fakeSession struct {
+    session apiUploadSession
+    parts   map[int][]byte
+}
+
+func newFakeAPI(t *testing.T) (*httptest.Server, *fakeAPI) {
+    api := &fakeAPI{sessions: make(map[string]*fakeSession), content: make(map[int][]byte)}
+    mux := http.NewServeMux()
+    authed := func(handler http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            if r.Header.Get("Authorization") != "Bearer fst_test" {
+                http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+                return
+            }
+            api.mu.Lock()
+            defer api.mu.Unlock()
+            handler(w, r)
+        }
+    }
+
+    mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+        var body map[string]string
+        json.NewDecoder(r.Body).Decode(&body)
+        if body["email"] != "alice@example.com" || body["password"] != "secret" {
+            http.Error(w, "Invalid password", http.StatusUnauthorized)
+            return
+        }
+        http.SetCookie(w, &http.Cookie{Name: "token", Value: "jwt"})
+    })
+    mux.HandleFunc("POST /tokens", func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "Bearer jwt" {
+            http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"token": "fst_test", "api_token": apiToken{ID: 7}})
+    })
+    mux.HandleFunc("DELETE /tokens/7", authed(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    mux.HandleFunc("POST /upload-sessions", authed(func(w http.ResponseWriter, r *http.Request) {
+        var req sessionRequest
+        json.NewDecoder(r.Body).Decode(&req)
+        session := apiUploadSession{ID: "s" + strconv.Itoa(len(api.sessions)+1), Filename: req.Filename, Size: req.Size, ChunkSize: req.ChunkSize, Folder: req.Folder}
+        session.PartCount = max(1, int((session.Size+session.ChunkSize-1)/session.ChunkSize))
+        api.sessions[session.ID] = &fakeSession{session: session, parts: make(map[int][]byte)}
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(session)
+    }))
+    mux.HandleFunc("GET /upload-sessions/{id}/parts", authed(func(w http.ResponseWriter, r *http.Request) {
+        s, ok := api.sessions[r.PathValue("id")]
+        if !ok {
+            http.Error(w, "Upload session not found", http.StatusNotFound)
+            return
+        }
+        parts := []apiUploadPart{}
+        for n, data := range s.parts {
+            sum := sha256.Sum256(data)
+            parts = append(parts, apiUploadPart{PartNumber: n, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"session": s.session, "parts": parts})
+    }))
+    mux.HandleFunc("PUT /upload-sessions/{id}/parts/{n}", authed(func(w http.ResponseWriter, r *http.Request) {
+        s := api.sessions[r.PathValue("id")]
+        n, _ := strconv.Atoi(r.PathValue("n"))
+        data, _ := io.ReadAll(r.Body)
+        api.puts++
+        if n == api.failPart {
+            api.failPart = 0
+            http.Error(w, "Part is too small", http.StatusBadRequest)
+            return
+        }
+        if sum := sha256.Sum256(data); r.Header.Get("X-Checksum-SHA256") != hex.EncodeToString(sum[:]) {
+            http.Error(w, "Part checksum mismatch", http.StatusUnprocessableEntity)
+            return
+        }
+        s.parts[n] = data
+    }))
+    mux.HandleFunc("POST /upload-sessions/{id}/complete", authed(func(w http.ResponseWriter, r *http.Request) {
+        s := api.sessions[r.PathValue("id")]
+        var m manifest
+        json.NewDecoder(r.Body).Decode(&m)
+        var content []byte
+        for n := 1; n <= s.session.PartCount; n++ {
+            content = append(content, s.parts[n]...)
+        }
+        if sum := sha256.Sum256(content); m.SHA256 != hex.EncodeToString(sum[:]) || len(m.Parts) != s.session.PartCount {
+            http.Error(w, "Invalid manifest", http.StatusBadRequest)
+            return
+        }
+        file := api.addFile(s.session.Folder, s.session.Filename, content)
+        delete(api.sessions, s.session.ID)
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(file)
+    }))
+    mux.HandleFunc("GET /files", authed(func(w http.ResponseWriter, r *http.Request) {
+        page := apiFilePage{Total: len(api.files)}
+        start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+        end := min(start+1, len(api.files))
+        page.Files = api.files[start:end]
+        if end < len(api.files) {
+            page.NextCursor = strconv.Itoa(end)
+        }
+        json.NewEncoder(w).Encode(page)
+    }))
+    mux.HandleFunc("GET /files/{id}/download", authed(func(w http.ResponseWriter, r *http.Request) {
+        id, _ := strconv.Atoi(r.PathValue("id"))
+        content, ok := api.content[id]
+        if !ok {
+            http.Error(w, "File not found", http.StatusNotFound)
+            return
+        }
+        w.Write(content)
+    }))
+    mux.HandleFunc("DELETE /files/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+        id, _ := strconv.Atoi(r.PathValue("id"))
+        if !api.deleteFile(id) {
+            http.Error(w, "File not found", http.StatusNotFound)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    mux.HandleFunc("GET /changes", authed(func(w http.ResponseWriter, r *http.Request) {
+        cursor, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+        page := apiEventsPage{Events: []apiEvent{}, Cursor: strconv.Itoa(cursor)}
+        // Two at a time, to exercise paging
+        for i := min(cursor, len(api.events)); i < len(api.events); i++ {
+            if len(page.Events) == 2 {
+                page.HasMore = true
+                break
+            }
+            page.Events = append(page.Events, api.events[i])
+            page.Cursor = strconv.Itoa(i + 1)
+        }
+        json.NewEncoder(w).Encode(page)
+    }))
+    mux.HandleFunc("POST /files/{id}/links", authed(func(w http.ResponseWriter, r *http.Request) {
+        var body map[string]int
+        json.NewDecoder(r.Body).Decode(&body)
+        if body["expires_in_hours"] != 36 {
+            http.Error(w, "Unexpected expiry", http.StatusUnprocessableEntity)
+            return
+        }
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]interface{}{"url": "http://" + r.Host + "/s/abc", "share_link": apiShareLink{ID: 1}})
+    }))
+    mux.HandleFunc("GET /s/abc", func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "" {
+            http.Error(w, "Share links need no token", http.StatusBadRequest)
+            return
+        }
+        w.Header().Set("Content-Disposition", `attachment; filename="../report.txt"`)
+        io.WriteString(w, "shared content")
+    })
+
+    server := httptest.NewServer(mux)
+    t.Cleanup(server.Close)
+    return server, api
+}
+
+// addFile stores a file and logs its creation, like the files trigger
+func (api *fakeAPI) addFile(folder, name string, content []byte) apiFile {
+    api.nextID++
+    sum := sha256.Sum256(content)
+    file := apiFile{ID: api.nextID, Name: name, Folder: folder, Size: int64(len(content)), Checksum: hex.EncodeToString(sum[:])}
+    api.files = append(api.files, file)
+    api.content[file.ID] = content
+    api.log(file, eventCreated)
+    return file
+}
+
+func (api *fakeAPI) deleteFile(id int) bool {
+    for i, file := range api.files {
+        if file.ID == id {
+            api.files = append(api.files[:i], api.files[i+1:]...)
+            delete(api.content, id)
+            api.log(file, eventDeleted)
+            return true
+        }
+    }
+    return false
+}
+
+func (api *fakeAPI) log(file apiFile, eventType string) {
+    api.events = append(api.events, apiEvent{
+        Type:     eventType,
+        FileID:   &file.ID,
+        Folder:   file.Folder,
+        Name:     file.Name,
+        Size:     &file.Size,
+        Checksum: file.Checksum,
+    })
+    // Sharing is logged too, and sync must skip it
+    api.events = append(api.events, apiEvent{Type: eventLinkCreated, FileID: &file.ID, Folder: file.Folder, Name: file.Name})
+}
+
+func newTestApp(t *testing.T, stdin string) (*app, *bytes.Buffer) {
+    t.Setenv("FSCTL_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+    t.Setenv("FSCTL_SERVER", "")
+    t.Setenv("FSCTL_TOKEN", "")
+    cfg, err := loadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    stdout := &bytes.Buffer{}
+    return &app{cfg: cfg, stdin: strings.NewReader(stdin), stdout: stdout, stderr: io.Discard}, stdout
+}
+
+// TestLoginStoresAPIToken tests that login trades the password for an API
+// token kept in the config file, and that logout forgets it
+func TestLoginStoresAPIToken(t *testing.T) {
+    server, _ := newFakeAPI(t)
+    a, stdout := newTestApp(t, "alice@example.com\nsecret\n")
+
+    if err := a.run([]string{"login", "--server", server.URL}); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(stdout.String(), "alice@example.com") {
+        t.Errorf("Unexpected output %q", stdout.String())
+    }
+    saved, err := loadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if saved.Token != "fst_test" || saved.TokenID != 7 || saved.Server != server.URL {
+        t.Errorf("Unexpected config %+v", saved)
+    }
+    if info, _ := os.Stat(saved.path); info.Mode().Perm() != 0o600 {
+        t.Errorf("Expected config to be private, got %v", info.Mode().Perm())
+    }
+
+    if err := a.run([]string{"logout"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := a.run([]string{"ls"}); err != errNotLoggedIn {
+        t.Errorf("Expected to be logged out, got %v", err)
+    }
+}
+
+// TestLoginWrongPassword tests that a failed sign-in reports the server's error
+func TestLoginWrongPassword(t *testing.T) {
+    server, _ := newFakeAPI(t)
+    a, _ := newTestApp(t, "alice@example.com\nwrong\n")
+
+    err := a.run([]string{"login", "--server", server.URL})
+    if apiErr, ok := err.(*apiError); !ok || apiErr.Status != http.StatusUnauthorized {
+        t.Errorf("Expected 401, got %v", err)
+    }
+}
+
+// TestUploadResumes tests that a directory upload keeps its structure and
+// that an interrupted upload only sends the missing parts when run again
+func TestUploadResumes(t *testing.T) {
+    server, api := newFakeAPI(t)
+    a, stdout := newTestApp(t, "")
+    a.cfg.Server, a.cfg.Token = server.URL, "fst_test"
+
+    dir := filepath.Join(t.TempDir(), "photos")
+    os.MkdirAll(filepath.Join(dir, "2024"), 0o755)
+    content := bytes.Repeat([]byte("0123456789"), 300)
+    os.WriteFile(filepath.Join(dir, "2024", "a.jpg"), content, 0o644)
+
+    api.failPart = 2
+    err := a.run([]string{"upload", "--folder", "backup", "--chunk-size", "1KB", dir})
+    if err == nil || len(a.cfg.Uploads) != 1 {
+        t.Fatalf("Expected the upload to fail and be remembered, got %v", err)
+    }
+    if api.puts != 2 {
+        t.Fatalf("Expected 2 parts sent before the failure, got %d", api.puts)
+    }
+
+    stdout.Reset()
+    if err := a.run([]string{"upload", "--folder", "backup", "--chunk-size", "1KB", "--json", dir}); err != nil {
+        t.Fatal(err)
+    }
+    if api.puts != 4 {
+        t.Errorf("Expected only parts 2 and 3 to be sent again, got %d puts", api.puts)
+    }
+    var files []apiFile
+    if err := json.Unmarshal(stdout.Bytes(), &files); err != nil {
+        t.Fatal(err)
+    }
+    if len(files) != 1 || files[0].Folder != "/backup/photos/2024" || files[0].Size != int64(len(content)) {
+        t.Errorf("Unexpected upload %+v", files)
+    }
+    if len(a.cfg.Uploads) != 0 {
+        t.Error("Expected the completed upload to be forgotten")
+    }
+}
+
+// TestListAll tests following listing cursors
+func TestListAll(t *testing.T) {
+    server, api := newFakeAPI(t)
+    api.addFile("/", "a.txt", nil)
+    api.addFile("/docs", "b.txt", nil)
+    a, stdout := newTestApp(t, "")
+    a.cfg.Server, a.cfg.Token = server.URL, "fst_test"
+
+    if err := a.run([]string{"ls", "--all", "--json"}); err != nil {
+        t.Fatal(err)
+    }
+    var page apiFilePage
+    json.Unmarshal(stdout.Bytes(), &page)
+    if len(page.Files) != 2 || page.NextCursor != "" {
+        t.Errorf("Expected both pages, got %+v", page)
+    }
+
+    stdout.Reset()
+    if err := a.run([]string{"ls"}); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(stdout.String(), "/a.txt") || strings.Contains(stdout.String(), "b.txt") {
+        t.Errorf("Expected only the first page, got %q", stdout.String())
+    }
+}
+
+// TestShareAndDownload tests creating a share link and downloading through
+// it without sending the token
+func TestShareAndDownload(t *testing.T) {
+    server, _ := newFakeAPI(t)
+    a, stdout := newTestApp(t, "")
+    a.cfg.Server, a.cfg.Token = server.URL, "fst_test"
+
+    if err := a.run([]string{"share", "42", "--expires", "36h"}); err != nil {
+        t.Fatal(err)
+    }
+    link := strings.TrimSpace(stdout.String())
+    if link != server.URL+"/s/abc" {
+        t.Fatalf("Unexpected link %q", link)
+    }
+
+    dir := t.TempDir()
+    stdout.Reset()
+    if err := a.run([]string{"download", "-o", dir, "--json", link}); err != nil {
+        t.Fatal(err)
+    }
+    saved, err := os.ReadFile(filepath.Join(dir, "report.txt"))
+    if err != nil || string(saved) != "shared content" {
+        t.Errorf("Expected the shared file in the directory, got %q %v", saved, err)
+    }
+    if _, err := os.Stat(filepath.Join(dir, "report.txt.part")); !os.IsNotExist(err) {
+        t.Error("Expected the partial file to be renamed")
+    }
+}
+
+// TestParseExpiry tests reading share link lifetimes
+func TestParseExpiry(t *testing.T) {
+    for value, hours := range map[string]int{"12h": 12, "7d": 168, "1h0m": 1} {
+        if got, err := parseExpiry(value); err != nil || got != hours {
+            t.Errorf("parseExpiry(%q) = %d, %v; expected %d", value, got, err, hours)
+        }
+    }
+    for _, value := range []string{"", "0d", "30m", "90m", "-2h", "week"} {
+        if _, err := parseExpiry(value); err == nil {
+            t.Errorf("Expected parseExpiry(%q) to fail", value)
+        }
+    }
+}
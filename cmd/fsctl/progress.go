@@ -0,0 +1,90 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strings"
+    "time"
+)
+
+const (
+    progressWidth    = 30
+    progressLabelLen = 24
+    progressInterval = 100 * time.Millisecond
+)
+
+// progress draws a progress bar for one transfer. It is an io.Writer so
+// that it can count the bytes going through an io.TeeReader. Nothing is
+// drawn when out is nil, e.g. when stderr is not a terminal.
+type progress struct {
+    out   io.Writer
+    label string
+    total int64
+    done  int64
+    start time.Time
+    drawn time.Time
+}
+
+func newProgress(out io.Writer, label string, total int64) *progress {
+    return &progress{out: out, label: label, total: total, start: time.Now()}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+    p.set(p.done + int64(len(b)))
+    return len(b), nil
+}
+
+// set moves the bar to n bytes, which may go back when a part is retried
+func (p *progress) set(n int64) {
+    p.done = n
+    if p.out != nil && time.Since(p.drawn) >= progressInterval {
+        p.draw()
+    }
+}
+
+func (p *progress) draw() {
+    p.drawn = time.Now()
+    fmt.Fprintf(p.out, "\r%s", p.line(p.drawn.Sub(p.start)))
+}
+
+// finish draws the final state and moves past the bar
+func (p *progress) finish() {
+    if p.out != nil {
+        p.draw()
+        fmt.Fprintln(p.out)
+    }
+}
+
+func (p *progress) line(elapsed time.Duration) string {
+    label := p.label
+    if len(label) > progressLabelLen {
+        label = label[:progressLabelLen-3] + "..."
+    }
+    rate := ""
+    if seconds := elapsed.Seconds(); seconds > 0 {
+        rate = formatSize(int64(float64(p.done)/seconds)) + "/s"
+    }
+    if p.total <= 0 {
+        return fmt.Sprintf("%-*s %s %s", progressLabelLen, label, formatSize(p.done), rate)
+    }
+
+    done := min(p.done, p.total)
+    filled := int(done * progressWidth / p.total)
+    bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+    return fmt.Sprintf("%-*s [%s] %3d%% %s/%s %s", progressLabelLen, label, bar, done*100/p.total, formatSize(done), formatSize(p.total), rate)
+}
+
+// formatSize prints a byte count with a binary unit, e.g. "1.5 MB"
+func formatSize(n int64) string {
+    if n < 1<<10 {
+        return fmt.Sprintf("%d B", n)
+    }
+    value := float64(n)
+    for _, unit := range []string{"KB", "MB", "GB", "TB"} {
+        value /= 1 << 10
+        if value < 1<<10 || unit == "TB" {
+            return fmt.Sprintf("%.1f %s", value, unit)
+        }
+    }
+    return ""
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestFormatSize tests printing byte counts
+func TestFormatSize(t *testing.T) {
+    for n, expected := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KB", 5 << 20: "5.0 MB", 3 << 40: "3.0 TB"} {
+        if got := formatSize(n); got != expected {
+            t.Errorf("formatSize(%d) = %q, expected %q", n, got, expected)
+        }
+    }
+}
+
+// TestProgressLine tests drawing the bar
+func TestProgressLine(t *testing.T) {
+    p := newProgress(nil, "a-rather-long-file-name-for-the-bar.tar.gz", 4<<20)
+    p.set(1 << 20)
+    line := p.line(time.Second)
+    if !strings.HasPrefix(line, "a-rather-long-file-na... [=======       ") {
+        t.Errorf("Unexpected bar %q", line)
+    }
+    if !strings.Contains(line, " 25% 1.0 MB/4.0 MB 1.0 MB/s") {
+        t.Errorf("Unexpected figures %q", line)
+    }
+
+    unknown := newProgress(nil, "stream", 0)
+    unknown.set(2048)
+    if line := unknown.line(0); strings.Contains(line, "[") || !strings.Contains(line, "2.0 KB") {
+        t.Errorf("Unexpected line without a total %q", line)
+    }
+}
+
+// TestProgressOutput tests that only a visible bar writes anything
+func TestProgressOutput(t *testing.T) {
+    var out bytes.Buffer
+    p := newProgress(&out, "file", 10)
+    p.Write(make([]byte, 10))
+    p.finish()
+    if !strings.Contains(out.String(), "100%") || !strings.HasSuffix(out.String(), "\n") {
+        t.Errorf("Unexpected output %q", out.String())
+    }
+
+    hidden := newProgress(nil, "file", 10)
+    hidden.Write(make([]byte, 10))
+    hidden.finish()
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/fsnotify/fsnotify"
+)
+
+// syncStateFile is kept at the top of a synced directory. It and fsctl's
+// temporary files, which all start with tempPrefix, are never synced.
+const (
+    syncStateFile = ".fsctl-sync.json"
+    tempPrefix    = ".fsctl-"
+)
+
+// How long sync waits for local changes to settle before a pass
+const settleDelay = 2 * time.Second
+
+// syncState is what sync knows about a directory between passes
+type syncState struct {
+    Server string `json:"server"`
+    Folder string `json:"folder"`
+    OrgID  int    `json:"org_id,omitempty"`
+    // Cursor is the position in the server's changes feed
+    Cursor string `json:"cursor"`
+    // Remote is the remote folder's files by path relative to it, built
+    // from the changes feed
+    Remote map[string]remoteEntry `json:"remote"`
+    // Local caches the hashes of local files, so that files whose size and
+    // modification time are unchanged are not hashed again
+    Local map[string]localEntry `json:"local"`
+    // Synced is the checksum each path had when both sides last agreed,
+    // which tells which side changed since
+    Synced map[string]string `json:"synced"`
+}
+
+type remoteEntry struct {
+    FileID   int    `json:"file_id"`
+    Size     int64  `json:"size"`
+    Checksum string `json:"checksum"`
+}
+
+type localEntry struct {
+    Size     int64     `json:"size"`
+    ModTime  time.Time `json:"mod_time"`
+    Checksum string    `json:"checksum"`
+}
+
+// syncEvent is one thing a pass did, printed as a line of text or JSON
+type syncEvent struct {
+    Action string `json:"action"`
+    Path   string `json:"path"`
+    // Copy is the conflict copy kept of a file changed on both sides
+    Copy  string `json:"copy,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+// errNotReady is returned for remote files that cannot be downloaded yet,
+// e.g. while they are scanned for viruses; the next pass tries again
+var errNotReady = errors.New("not available yet")
+
+// syncer keeps a local directory and a remote folder in sync
+type syncer struct {
+    app    *app
+    c      *client
+    dir    string
+    state  *syncState
+    asJSON bool
+    host   string
+}
+
+// loadSyncState reads a directory's sync state, checking that it is synced
+// with the same folder, or starts a new one
+func loadSyncState(dir, server, folder string, orgID int) (*syncState, error) {
+    state := &syncState{Server: server, Folder: folder, OrgID: orgID}
+    data, err := os.ReadFile(filepath.Join(dir, syncStateFile))
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        if err := json.Unmarshal(data, state); err != nil {
+            return nil, fmt.Errorf("reading %s: %w", syncStateFile, err)
+        }
+        if state.Server != server || state.Folder != folder || state.OrgID != orgID {
+            return nil, fmt.Errorf("%s is synced with %s on %s; remove %s to sync it with another folder", dir, state.Folder, state.Server, syncStateFile)
+        }
+    }
+    if state.Remote == nil {
+        state.Remote = make(map[string]remoteEntry)
+    }
+    if state.Local == nil {
+        state.Local = make(map[string]localEntry)
+    }
+    if state.Synced == nil {
+        state.Synced = make(map[string]string)
+    }
+    return state, nil
+}
+
+func (s *syncer) saveState() error {
+    data, err := json.Marshal(s.state)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(filepath.Join(s.dir, syncStateFile), data)
+}
+
+// pass brings both sides up to date once. Problems with single files are
+// reported and retried on the next pass rather than stopping the pass.
+func (s *syncer) pass() (int, error) {
+    if err := s.pullChanges(); err != nil {
+        return 0, err
+    }
+    local, err := s.scanLocal(nil)
+    if err != nil {
+        return 0, err
+    }
+
+    paths := make(map[string]bool)
+    for rel := range local {
+        paths[rel] = true
+    }
+    for rel := range s.state.Remote {
+        paths[rel] = true
+    }
+    for rel := range s.state.Synced {
+        paths[rel] = true
+    }
+    sorted := make([]string, 0, len(paths))
+    for rel := range paths {
+        sorted = append(sorted, rel)
+    }
+    sort.Strings(sorted)
+
+    failed := 0
+    for _, rel := range sorted {
+        if err := s.reconcile(rel, local[rel].Checksum); err != nil {
+            if !errors.Is(err, errNotReady) {
+                failed++
+            }
+            s.report(syncEvent{Action: "skipped", Path: rel, Error: err.Error()})
+        }
+    }
+    return failed, s.saveState()
+}
+
+// pullChanges applies the events logged since the last pass to Remote
+func (s *syncer) pullChanges() error {
+    for {
+        query := url.Values{"cursor": {s.state.Cursor}, "folder": {s.state.Folder}}
+        if s.state.OrgID != 0 {
+            query.Set("org", strconv.Itoa(s.state.OrgID))
+        }
+        var page apiEventsPage
+        if err := s.c.call("GET", "/changes?"+query.Encode(), nil, &page); err != nil {
+            return err
+        }
+        for _, event := range page.Events {
+            s.applyChange(event)
+        }
+        s.state.Cursor = page.Cursor
+        if !page.HasMore {
+            return nil
+        }
+    }
+}
+
+// applyChange updates Remote with an event that changed a file. When
+// several files share a path, the newest one is the remote file.
+func (s *syncer) applyChange(event apiEvent) {
+    if !event.isFileChange() || event.FileID == nil {
+        return
+    }
+    fileID := *event.FileID
+    if event.OldFolder != nil && event.OldName != nil {
+        if rel, ok := s.relPath(*event.OldFolder, *event.OldName); ok && s.state.Remote[rel].FileID == fileID {
+            delete(s.state.Remote, rel)
+        }
+    }
+    rel, ok := s.relPath(event.Folder, event.Name)
+    if !ok {
+        return
+    }
+    if event.Type == eventDeleted {
+        if s.state.Remote[rel].FileID == fileID {
+            delete(s.state.Remote, rel)
+        }
+        return
+    }
+    entry := remoteEntry{FileID: fileID, Checksum: event.Checksum}
+    if event.Size != nil {
+        entry.Size = *event.Size
+    }
+    s.state.Remote[rel] = entry
+}
+
+// relPath returns a remote path relative to the synced folder, and whether
+// it is inside it
+func (s *syncer) relPath(folder, name string) (string, bool) {
+    full := path.Join(folder, name)
+    prefix := strings.TrimSuffix(s.state.Folder, "/") + "/"
+    rel, ok := strings.CutPrefix(full, prefix)
+    if !ok || rel == "" || strings.HasPrefix(path.Base(rel), tempPrefix) {
+        return "", false
+    }
+    return rel, true
+}
+
+// scanLocal hashes the directory's files, reusing cached hashes of files
+// that did not change, and adds its directories to watcher when given
+func (s *syncer) scanLocal(watcher *fsnotify.Watcher) (map[string]localEntry, error) {
+    local := make(map[string]localEntry)
+    err := filepath.WalkDir(s.dir, func(p string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if strings.HasPrefix(entry.Name(), tempPrefix) {
+            return nil
+        }
+        if entry.IsDir() {
+            if watcher != nil {
+                return watcher.Add(p)
+            }
+            return nil
+        }
+        if !entry.Type().IsRegular() {
+            return nil
+        }
+        info, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(s.dir, p)
+        if err != nil {
+            return err
+        }
+        rel = filepath.ToSlash(rel)
+
+        cached, ok := s.state.Local[rel]
+        if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+            local[rel] = cached
+            return nil
+        }
+        sum, err := hashFile(p)
+        if err != nil {
+            return err
+        }
+        local[rel] = localEntry{Size: info.Size(), ModTime: info.ModTime(), Checksum: sum}
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    s.state.Local = local
+    return local, nil
+}
+
+// reconcile compares a path's local and remote checksums with the one
+// both sides last agreed on. A side that still has it is out of date; when
+// both changed, the remote file wins and the local one is kept as a
+// conflict copy. Deleting a file on one side does not win over changing it
+// on the other.
+func (s *syncer) reconcile(rel, localSum string) error {
+    remote, hasRemote := s.state.Remote[rel]
+    remoteSum := remote.Checksum
+    base := s.state.Synced[rel]
+
+    switch {
+    case localSum == remoteSum:
+        s.agree(rel, localSum)
+        return nil
+
+    case localSum == base:
+        if !hasRemote {
+            if err := s.removeLocal(rel); err != nil {
+                return err
+            }
+            s.agree(rel, "")
+            s.report(syncEvent{Action: "deleted locally", Path: rel})
+            return nil
+        }
+        if err := s.download(rel, remote); err != nil {
+            return err
+        }
+        s.report(syncEvent{Action: "downloaded", Path: rel})
+        return nil
+
+    case remoteSum == base:
+        if localSum == "" {
+            if err := s.removeRemote(rel, remote); err != nil {
+                return err
+            }
+            s.agree(rel, "")
+            s.report(syncEvent{Action: "deleted remotely", Path: rel})
+            return nil
+        }
+        if err := s.upload(rel, remote); err != nil {
+            return err
+        }
+        s.report(syncEvent{Action: "uploaded", Path: rel})
+        return nil
+    }
+
+    // Both sides changed since they last agreed
+    switch {
+    case localSum == "":
+        if err := s.download(rel, remote); err != nil {
+            return err
+        }
+        s.report(syncEvent{Action: "downloaded", Path: rel})
+    case !hasRemote:
+        if err := s.upload(rel, remote); err != nil {
+            return err
+        }
+        s.report(syncEvent{Action: "uploaded", Path: rel})
+    default:
+        copyRel := conflictName(rel, s.host, time.Now())
+        if err := os.Rename(s.localPath(rel), s.localPath(copyRel)); err != nil {
+            return err
+        }
+        s.state.Local[copyRel] = s.state.Local[rel]
+        delete(s.state.Local, rel)
+        if err := s.download(rel, remote); err != nil {
+            return err
+        }
+        s.report(syncEvent{Action: "conflict", Path: rel, Copy: copyRel})
+        if err := s.upload(copyRel, remoteEntry{}); err != nil {
+            return fmt.Errorf("uploading conflict copy %s: %w", copyRel, err)
+        }
+        s.report(syncEvent{Action: "uploaded", Path: copyRel})
+    }
+    return nil
+}
+
+// agree records that both sides hold sum, or neither holds the path
+func (s *syncer) agree(rel, sum string) {
+    if sum == "" {
+        delete(s.state.Synced, rel)
+        return
+    }
+    s.state.Synced[rel] = sum
+}
+
+func (s *syncer) localPath(rel string) string {
+    return filepath.Join(s.dir, filepath.FromSlash(rel))
+}
+
+// download replaces the local file with the remote one, checking that the
+// content matches the remote checksum before moving it into place
+func (s *syncer) download(rel string, remote remoteEntry) error {
+    req, err := http.NewRequest("GET", s.c.url("/files/"+strconv.Itoa(remote.FileID)+"/download"), nil)
+    if err != nil {
+        return err
+    }
+    resp, err := s.c.do(req)
+    var apiErr *apiError
+    if errors.As(err, &apiErr) && (apiErr.Status == http.StatusConflict || apiErr.Status == http.StatusNotFound) {
+        // Still being scanned, or deleted since: a later change will tell
+        return fmt.Errorf("%w: %s", errNotReady, apiErr.Message)
+    }
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    dest := s.localPath(rel)
+    if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(dest), tempPrefix+"download-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    bar := s.app.newProgress(path.Base(rel), resp.ContentLength)
+    hash := sha256.New()
+    _, err = io.Copy(io.MultiWriter(tmp, hash, bar), resp.Body)
+    bar.finish()
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    if sum := hex.EncodeToString(hash.Sum(nil)); sum != remote.Checksum {
+        return fmt.Errorf("downloaded content does not match the checksum of file %d", remote.FileID)
+    }
+    if err := os.Rename(tmp.Name(), dest); err != nil {
+        return err
+    }
+
+    info, err := os.Stat(dest)
+    if err != nil {
+        return err
+    }
+    s.state.Local[rel] = localEntry{Size: info.Size(), ModTime: info.ModTime(), Checksum: remote.Checksum}
+    s.agree(rel, remote.Checksum)
+    return nil
+}
+
+// upload sends the local file and then deletes the remote file it replaces
+func (s *syncer) upload(rel string, replaced remoteEntry) error {
+    u := &uploader{app: s.app, c: s.c, orgID: s.state.OrgID, chunkSize: defaultChunkSize}
+    folder := path.Join(s.state.Folder, path.Dir(rel))
+    file, err := u.upload(uploadJob{local: s.localPath(rel), folder: folder})
+    if err != nil {
+        return err
+    }
+    s.state.Remote[rel] = remoteEntry{FileID: file.ID, Size: file.Size, Checksum: file.Checksum}
+    s.agree(rel, file.Checksum)
+
+    if replaced.FileID != 0 && replaced.FileID != file.ID {
+        err := s.c.call("DELETE", "/files/"+strconv.Itoa(replaced.FileID), nil, nil)
+        if err != nil && !isNotFound(err) {
+            return fmt.Errorf("removing the replaced file: %w", err)
+        }
+    }
+    return nil
+}
+
+func (s *syncer) removeRemote(rel string, remote remoteEntry) error {
+    err := s.c.call("DELETE", "/files/"+strconv.Itoa(remote.FileID), nil, nil)
+    if err != nil && !isNotFound(err) {
+        return err
+    }
+    delete(s.state.Remote, rel)
+    return nil
+}
+
+// removeLocal deletes a local file along with the directories it leaves empty
+func (s *syncer) removeLocal(rel string) error {
+    if err := os.Remove(s.localPath(rel)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    delete(s.state.Local, rel)
+    for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+        if os.Remove(s.localPath(dir)) != nil {
+            break
+        }
+    }
+    return nil
+}
+
+func (s *syncer) report(event syncEvent) {
+    if s.asJSON {
+        json.NewEncoder(s.app.stdout).Encode(event)
+        return
+    }
+    switch {
+    case event.Error != "":
+        fmt.Fprintf(s.app.stderr, "%s: %s\n", event.Path, event.Error)
+    case event.Copy != "":
+        fmt.Fprintf(s.app.stdout, "%s: changed on both sides, local copy kept as %s\n", event.Path, event.Copy)
+    default:
+        fmt.Fprintf(s.app.stdout, "%s %s\n", event.Action, event.Path)
+    }
+}
+
+// watch runs a pass whenever local files settle after changing, and every
+// interval to pick up remote changes, until ctx is done
+func (s *syncer) watch(ctx context.Context, interval time.Duration) error {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return err
+    }
+    defer watcher.Close()
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    settle := time.NewTimer(0)
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case err := <-watcher.Errors:
+            fmt.Fprintln(s.app.stderr, "fsctl: watching:", err)
+        case event := <-watcher.Events:
+            if strings.HasPrefix(filepath.Base(event.Name), tempPrefix) {
+                continue
+            }
+            settle.Reset(settleDelay)
+            continue
+        case <-ticker.C:
+        case <-settle.C:
+        }
+
+        // Directories created since the last pass are watched from now on
+        if _, err := s.scanLocal(watcher); err != nil {
+            fmt.Fprintln(s.app.stderr, "fsctl:", err)
+            continue
+        }
+        if _, err := s.pass(); err != nil {
+            fmt.Fprintln(s.app.stderr, "fsctl:", err)
+        }
+    }
+}
+
+// conflictName is where the local side of a conflict is kept, e.g.
+// "notes (conflict laptop 2024-05-01 101502).txt"
+func conflictName(rel, host string, now time.Time) string {
+    dir, name := path.Split(rel)
+    ext := path.Ext(name)
+    if ext == name {
+        ext = ""
+    }
+    label := "conflict " + now.Format("2006-01-02 150405")
+    if host != "" {
+        label = "conflict " + host + " " + now.Format("2006-01-02 150405")
+    }
+    return dir + strings.TrimSuffix(name, ext) + " (" + label + ")" + ext
+}
+
+func hashFile(p string) (string, error) {
+    f, err := os.Open(p)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    hash := sha256.New()
+    if _, err := io.Copy(hash, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func isNotFound(err error) bool {
+    var apiErr *apiError
+    return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// syncOnce runs one sync pass of dir with /remote
+func syncOnce(t *testing.T, a *app, dir string) {
+    t.Helper()
+    if err := a.run([]string{"sync", "--once", "--folder", "/remote", dir}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func readFile(t *testing.T, p string) string {
+    t.Helper()
+    data, err := os.ReadFile(p)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+// remoteFiles returns the fake's files under /remote by path
+func remoteFiles(api *fakeAPI) map[string]string {
+    files := make(map[string]string)
+    for _, file := range api.files {
+        if rel, ok := strings.CutPrefix(file.Folder+"/"+file.Name, "/remote/"); ok {
+            files[rel] = string(api.content[file.ID])
+        }
+    }
+    return files
+}
+
+// TestSync tests bringing both sides together, then sending edits and
+// deletions each way
+func TestSync(t *testing.T) {
+    server, api := newFakeAPI(t)
+    a, _ := newTestApp(t, "")
+    a.cfg.Server, a.cfg.Token = server.URL, "fst_test"
+
+    dir := t.TempDir()
+    api.addFile("/remote/docs", "a.txt", []byte("remote a"))
+    api.addFile("/elsewhere", "x.txt", []byte("not synced"))
+    os.WriteFile(filepath.Join(dir, "b.txt"), []byte("local b"), 0o644)
+
+    syncOnce(t, a, dir)
+    if got := readFile(t, filepath.Join(dir, "docs", "a.txt")); got != "remote a" {
+        t.Errorf("Expected the remote file to be downloaded, got %q", got)
+    }
+    if got := remoteFiles(api); len(got) != 2 || got["b.txt"] != "local b" {
+        t.Errorf("Expected the local file to be uploaded, got %v", got)
+    }
+    if _, err := os.Stat(filepath.Join(dir, "x.txt")); !os.IsNotExist(err) {
+        t.Error("Expected files outside the folder to be left alone")
+    }
+
+    // A local edit replaces the remote file, and a remote deletion removes
+    // the local file along with its emptied directory
+    os.WriteFile(filepath.Join(dir, "b.txt"), []byte("local b, edited"), 0o644)
+    for _, file := range api.files {
+        if file.Name == "a.txt" {
+            api.deleteFile(file.ID)
+            break
+        }
+    }
+    syncOnce(t, a, dir)
+    if got := remoteFiles(api); len(got) != 1 || got["b.txt"] != "local b, edited" {
+        t.Errorf("Expected the edit to replace the remote file, got %v", got)
+    }
+    if _, err := os.Stat(filepath.Join(dir, "docs")); !os.IsNotExist(err) {
+        t.Error("Expected the remote deletion to remove the local file and directory")
+    }
+
+    // A local deletion removes the remote file
+    os.Remove(filepath.Join(dir, "b.txt"))
+    syncOnce(t, a, dir)
+    if got := remoteFiles(api); len(got) != 0 {
+        t.Errorf("Expected the remote file to be deleted, got %v", got)
+    }
+}
+
+// TestSyncConflict tests that a file changed on both sides keeps the remote
+// version and a conflict copy of the local one on both sides
+func TestSyncConflict(t *testing.T) {
+    server, api := newFakeAPI(t)
+    a, stdout := newTestApp(t, "")
+    a.cfg.Server, a.cfg.Token = server.URL, "fst_test"
+
+    dir := t.TempDir()
+    api.addFile("/remote", "notes.txt", []byte("v1"))
+    syncOnce(t, a, dir)
+
+    os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("local v2"), 0o644)
+    old := api.files[0].ID
+    api.addFile("/remote", "notes.txt", []byte("remote v2"))
+    api.deleteFile(old)
+
+    stdout.Reset()
+    syncOnce(t, a, dir)
+    if got := readFile(t, filepath.Join(dir, "notes.txt")); got != "remote v2" {
+        t.Errorf("Expected the remote version to win, got %q", got)
+    }
+    copies, _ := filepath.Glob(filepath.Join(dir, "notes (conflict *).txt"))
+    if len(copies) != 1 || readFile(t, copies[0]) != "local v2" {
+        t.Fatalf("Expected one conflict copy of the local version, got %v", copies)
+    }
+    if got := remoteFiles(api); got[filepath.Base(copies[0])] != "local v2" {
+        t.Errorf("Expected the conflict copy to be uploaded, got %v", got)
+    }
+    if !strings.Contains(stdout.String(), "changed on both sides") {
+        t.Errorf("Expected the conflict to be reported, got %q", stdout.String())
+    }
+
+    // Nothing is left to do afterwards
+    stdout.Reset()
+    syncOnce(t, a, dir)
+    if stdout.Len() != 0 {
+        t.Errorf("Expected a quiet pass, got %q", stdout.String())
+    }
+}
+
+// TestSyncStateFolder tests that a directory stays tied to its folder
+func TestSyncStateFolder(t *testing.T) {
+    server, _ := newFakeAPI(t)
+    a, _ := newTestApp(t, "")
+    a.cfg.Server, a.cfg.Token = server.URL, "fst_test"
+
+    dir := t.TempDir()
+    syncOnce(t, a, dir)
+    err := a.run([]string{"sync", "--once", "--folder", "/other", dir})
+    if err == nil || !strings.Contains(err.Error(), syncStateFile) {
+        t.Errorf("Expected syncing with another folder to be refused, got %v", err)
+    }
+}
+
+// TestApplyChange tests following moves in and out of the synced folder
+func TestApplyChange(t *testing.T) {
+    s := &syncer{state: &syncState{Folder: "/remote", Remote: map[string]remoteEntry{}}}
+    outside, inside := "/elsewhere", "/remote/docs"
+    name := "a.txt"
+    first, second := 1, 2
+
+    s.applyChange(apiEvent{FileID: &first, Type: eventMoved, Folder: inside, Name: name, OldFolder: &outside, OldName: &name, Checksum: "c1"})
+    if s.state.Remote["docs/a.txt"].FileID != 1 {
+        t.Fatalf("Expected a file moved in to appear, got %v", s.state.Remote)
+    }
+    s.applyChange(apiEvent{FileID: &second, Type: eventDeleted, Folder: inside, Name: name})
+    if s.state.Remote["docs/a.txt"].FileID != 1 {
+        t.Error("Expected deleting an older file of the same name to keep the newest")
+    }
+    s.applyChange(apiEvent{FileID: &first, Type: eventPermissionGranted, Folder: inside})
+    if len(s.state.Remote) != 1 {
+        t.Errorf("Expected sharing events to be skipped, got %v", s.state.Remote)
+    }
+    s.applyChange(apiEvent{FileID: &first, Type: eventMoved, Folder: outside, Name: name, OldFolder: &inside, OldName: &name})
+    if len(s.state.Remote) != 0 {
+        t.Errorf("Expected a file moved out to disappear, got %v", s.state.Remote)
+    }
+}
+
+// TestConflictName tests naming conflict copies
+func TestConflictName(t *testing.T) {
+    now := time.Date(2024, 5, 1, 10, 15, 2, 0, time.UTC)
+    for rel, expected := range map[string]string{
+        "notes.txt":        "notes (conflict laptop 2024-05-01 101502).txt",
+        "docs/archive.tar": "docs/archive (conflict laptop 2024-05-01 101502).tar",
+        "docs/.env":        "docs/.env (conflict laptop 2024-05-01 101502)",
+    } {
+        if got := conflictName(rel, "laptop", now); got != expected {
+            t.Errorf("conflictName(%q) = %q, expected %q", rel, got, expected)
+        }
+    }
+    if got := conflictName("README", "", now); got != "README (conflict 2024-05-01 101502)" {
+        t.Errorf("Unexpected name without a host %q", got)
+    }
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "io/fs"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "time"
+)
+
+const (
+    maxPartAttempts = 3
+    // defaultChunkSize is the part size of sync uploads, and the default of
+    // upload --chunk-size
+    defaultChunkSize = 8 << 20
+)
+
+// uploadJob is a local file and the folder it is uploaded into
+type uploadJob struct {
+    local  string
+    folder string
+}
+
+// uploadJobs expands the paths given to upload: files go into folder, and
+// directories are copied below it with their own name, like cp -r
+func uploadJobs(paths []string, folder string) ([]uploadJob, error) {
+    var jobs []uploadJob
+    for _, p := range paths {
+        info, err := os.Stat(p)
+        if err != nil {
+            return nil, err
+        }
+        if !info.IsDir() {
+            jobs = append(jobs, uploadJob{local: p, folder: folder})
+            continue
+        }
+
+        root, err := filepath.Abs(p)
+        if err != nil {
+            return nil, err
+        }
+        base := path.Join(folder, filepath.Base(root))
+        err = filepath.WalkDir(root, func(local string, entry fs.DirEntry, err error) error {
+            if err != nil || !entry.Type().IsRegular() {
+                return err
+            }
+            rel, err := filepath.Rel(root, filepath.Dir(local))
+            if err != nil {
+                return err
+            }
+            jobs = append(jobs, uploadJob{local: local, folder: path.Join(base, filepath.ToSlash(rel))})
+            return nil
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return jobs, nil
+}
+
+// uploader sends files through upload sessions, which take the file in
+// numbered parts. Sessions are remembered in the config until they
+// complete, so running the same upload again resumes it and only sends the
+// parts the server is missing.
+type uploader struct {
+    app       *app
+    c         *client
+    orgID     int
+    chunkSize int64
+}
+
+type sessionRequest struct {
+    Filename  string `json:"filename"`
+    Size      int64  `json:"size"`
+    ChunkSize int64  `json:"chunk_size"`
+    OrgID     int    `json:"org_id,omitempty"`
+    Folder    string `json:"folder"`
+}
+
+type manifestPart struct {
+    PartNumber int    `json:"part_number"`
+    SHA256     string `json:"sha256"`
+}
+
+type manifest struct {
+    Parts  []manifestPart `json:"parts"`
+    SHA256 string         `json:"sha256"`
+}
+
+func (u *uploader) upload(job uploadJob) (apiFile, error) {
+    local, err := filepath.Abs(job.local)
+    if err != nil {
+        return apiFile{}, err
+    }
+    f, err := os.Open(local)
+    if err != nil {
+        return apiFile{}, err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return apiFile{}, err
+    }
+
+    session, received, err := u.session(local, info, job.folder)
+    if err != nil {
+        return apiFile{}, err
+    }
+
+    bar := u.app.newProgress(filepath.Base(local), info.Size())
+    defer bar.finish()
+    whole := sha256.New()
+    var m manifest
+    for n := 1; n <= session.PartCount; n++ {
+        part := io.NewSectionReader(f, int64(n-1)*session.ChunkSize, session.partSize(n))
+        sum, err := hashPart(part, whole)
+        if err != nil {
+            return apiFile{}, err
+        }
+        m.Parts = append(m.Parts, manifestPart{PartNumber: n, SHA256: sum})
+        if received[n] == sum {
+            bar.set(bar.done + part.Size())
+            continue
+        }
+        if err := u.putPart(session.ID, n, part, sum, bar); err != nil {
+            return apiFile{}, fmt.Errorf("part %d: %w", n, err)
+        }
+    }
+    m.SHA256 = hex.EncodeToString(whole.Sum(nil))
+
+    var file apiFile
+    err = u.c.call("POST", "/upload-sessions/"+session.ID+"/complete", m, &file)
+    var apiErr *apiError
+    if err == nil || errors.As(err, &apiErr) {
+        // Once the server has answered, the session is done with either way
+        u.forget(local)
+    }
+    return file, err
+}
+
+// session resumes the upload session for a file when there is one for the
+// same content and destination, or starts a new one. It also returns the
+// checksums of the parts the server already has.
+func (u *uploader) session(local string, info os.FileInfo, folder string) (apiUploadSession, map[int]string, error) {
+    cfg := u.app.cfg
+    if pending, ok := cfg.Uploads[local]; ok {
+        if pending.matches(info, folder, u.orgID) {
+            var listing struct {
+                Session apiUploadSession `json:"session"`
+                Parts   []apiUploadPart  `json:"parts"`
+            }
+            err := u.c.call("GET", "/upload-sessions/"+pending.SessionID+"/parts", nil, &listing)
+            var apiErr *apiError
+            if err != nil && !errors.As(err, &apiErr) {
+                return apiUploadSession{}, nil, err
+            }
+            if err == nil {
+                received := make(map[int]string, len(listing.Parts))
+                for _, part := range listing.Parts {
+                    received[part.PartNumber] = part.SHA256
+                }
+                return listing.Session, received, nil
+            }
+            // The session expired or was discarded, so start over
+        } else {
+            // The file or destination changed since, so the parts are of no use
+            u.c.call("DELETE", "/upload-sessions/"+pending.SessionID, nil, nil)
+        }
+        u.forget(local)
+    }
+
+    var session apiUploadSession
+    err := u.c.call("POST", "/upload-sessions", sessionRequest{
+        Filename:  filepath.Base(local),
+        Size:      info.Size(),
+        ChunkSize: u.chunkSize,
+        OrgID:     u.orgID,
+        Folder:    folder,
+    }, &session)
+    if err != nil {
+        return apiUploadSession{}, nil, err
+    }
+    cfg.Uploads[local] = pendingUpload{SessionID: session.ID, Size: info.Size(), ModTime: info.ModTime(), Folder: folder, OrgID: u.orgID}
+    return session, nil, cfg.save()
+}
+
+func (u *uploader) forget(local string) {
+    delete(u.app.cfg.Uploads, local)
+    u.app.cfg.save()
+}
+
+// putPart sends one part, retrying when the connection fails or the server
+// has a temporary problem
+func (u *uploader) putPart(sessionID string, n int, part *io.SectionReader, sum string, bar *progress) error {
+    start := bar.done
+    for attempt := 1; ; attempt++ {
+        part.Seek(0, io.SeekStart)
+        bar.set(start)
+        req, err := http.NewRequest("PUT", u.c.url("/upload-sessions/"+sessionID+"/parts/"+strconv.Itoa(n)), io.TeeReader(part, bar))
+        if err != nil {
+            return err
+        }
+        req.ContentLength = part.Size()
+        req.Header.Set("Content-Type", "application/octet-stream")
+        req.Header.Set("X-Checksum-SHA256", sum)
+
+        resp, err := u.c.do(req)
+        if err == nil {
+            resp.Body.Close()
+            return nil
+        }
+        var apiErr *apiError
+        if (errors.As(err, &apiErr) && apiErr.Status < 500) || attempt == maxPartAttempts {
+            return err
+        }
+        time.Sleep(time.Duration(attempt) * time.Second)
+    }
+}
+
+// hashPart returns the hex SHA-256 of a part, adding it to the whole file's hash
+func hashPart(part *io.SectionReader, whole hash.Hash) (string, error) {
+    h := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(h, whole), part); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
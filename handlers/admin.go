@@ -0,0 +1,146 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "file-sharing-system/jobs"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+    "github.com/gorilla/mux"
+)
+
+// GetContentPolicies lists the per-group content type policies and the deployment-wide one
+func GetContentPolicies(w http.ResponseWriter, r *http.Request) {
+    policies, err := models.GetContentTypePolicies()
+    if err != nil {
+        http.Error(w, "Unable to retrieve content policies", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "deployment": models.DeploymentContentTypePolicy(),
+        "groups":     policies,
+    })
+}
+
+// PutContentPolicy creates or replaces the content type policy of a user group
+func PutContentPolicy(w http.ResponseWriter, r *http.Request) {
+    var policy models.ContentTypePolicy
+    if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+        http.Error(w, "Invalid content policy", http.StatusBadRequest)
+        return
+    }
+    policy.Group = mux.Vars(r)["group"]
+    for i := range policy.Allowed {
+        policy.Allowed[i] = strings.ToLower(strings.TrimSpace(policy.Allowed[i]))
+    }
+    for i := range policy.Blocked {
+        policy.Blocked[i] = strings.ToLower(strings.TrimSpace(policy.Blocked[i]))
+    }
+
+    if err := models.SaveContentTypePolicy(policy); err != nil {
+        http.Error(w, "Unable to save content policy", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(policy)
+}
+
+func DeleteContentPolicy(w http.ResponseWriter, r *http.Request) {
+    if err := models.DeleteContentTypePolicy(mux.Vars(r)["group"]); err != nil {
+        http.Error(w, "Unable to delete content policy", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// SetUserGroup moves a user into the policy group given in the body
+func SetUserGroup(w http.ResponseWriter, r *http.Request) {
+    userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+    var body struct {
+        Group string `json:"group"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if err := models.SetUserGroup(userID, body.Group); err != nil {
+        http.Error(w, "Unable to update user group", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateEncryptionKeys rewraps every data key with the active master key in the background
+func RotateEncryptionKeys(w http.ResponseWriter, r *http.Request) {
+    if utils.GetKeyProvider() == nil {
+        http.Error(w, "Encryption at rest is not configured", http.StatusConflict)
+        return
+    }
+
+    if err := jobs.EnqueueRewrapKeys(); err != nil {
+        http.Error(w, "Unable to start key rotation", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode("Key rotation started")
+}
+
+// GetJobs lists background jobs in the state given by ?status=, by default
+// the dead jobs that exhausted their retries
+func GetJobs(w http.ResponseWriter, r *http.Request) {
+    status := r.URL.Query().Get("status")
+    if status == "" {
+        status = models.JobDead
+    }
+    switch status {
+    case models.JobQueued, models.JobRunning, models.JobDone, models.JobDead:
+    default:
+        http.Error(w, "Invalid job status", http.StatusBadRequest)
+        return
+    }
+
+    jobList, err := models.GetJobsByStatus(status, 100)
+    if err != nil {
+        http.Error(w, "Unable to retrieve jobs", http.StatusInternalServerError)
+        return
+    }
+    if jobList == nil {
+        jobList = []models.Job{}
+    }
+    json.NewEncoder(w).Encode(jobList)
+}
+
+// RetryJob requeues a dead job with a fresh set of attempts
+func RetryJob(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(mux.Vars(r)["job_id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Job not found", http.StatusNotFound)
+        return
+    }
+
+    requeued, err := models.RequeueDeadJob(id)
+    if err != nil {
+        http.Error(w, "Unable to retry job", http.StatusInternalServerError)
+        return
+    }
+    if !requeued {
+        if _, err := models.GetJob(id); err != nil {
+            http.Error(w, "Job not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Only dead jobs without a queued duplicate can be retried", http.StatusConflict)
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode("Job requeued")
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "mime"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+    "file-sharing-system/models"
+)
+
+// maxArchiveFiles bounds the number of files in one archive
+const maxArchiveFiles = 10000
+
+// maxArchiveSelection bounds the files and folders picked for one archive
+const maxArchiveSelection = 1000
+
+// archiveEntry is a file and its path inside an archive
+type archiveEntry struct {
+    Path string
+    File models.File
+}
+
+// archiveEntries collects the files of an archive, giving files that would
+// land on the same path a numbered suffix
+type archiveEntries struct {
+    entries []archiveEntry
+    names   map[string]map[string]bool
+}
+
+func (a *archiveEntries) add(dir string, file models.File) {
+    if a.names == nil {
+        a.names = map[string]map[string]bool{}
+    }
+    taken := a.names[dir]
+    if taken == nil {
+        taken = map[string]bool{}
+        a.names[dir] = taken
+    }
+
+    name := entryName(file.Name)
+    if taken[name] {
+        name = models.SuffixedName(name, taken)
+    }
+    taken[name] = true
+    a.entries = append(a.entries, archiveEntry{Path: path.Join(dir, name), File: file})
+}
+
+// addFolder adds the files of a folder and the folders below it under the
+// folder's own name, keeping the folders in between. Files that are still
+// being scanned or are infected are left out.
+func (a *archiveEntries) addFolder(root string, files []models.File) {
+    base := ""
+    if root != "/" {
+        base = entryName(path.Base(root))
+    }
+    for _, file := range files {
+        if !file.ScanAllowsAccess() {
+            continue
+        }
+        var dirs []string
+        for _, segment := range strings.Split(strings.TrimPrefix(file.Folder, root), "/") {
+            if segment != "" {
+                dirs = append(dirs, entryName(segment))
+            }
+        }
+        a.add(path.Join(append([]string{base}, dirs...)...), file)
+    }
+}
+
+// entryName makes a name safe as one path segment of an archive entry, so
+// that extracting the archive cannot write outside its folder
+func entryName(name string) string {
+    name = strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+    if name == "" || name == "." || name == ".." {
+        return "_"
+    }
+    return name
+}
+
+// archiveWriter writes the entries of one archive format
+type archiveWriter interface {
+    add(entry archiveEntry, content io.Reader) error
+    Close() error
+}
+
+type zipArchive struct {
+    w *zip.Writer
+}
+
+func (a zipArchive) add(entry archiveEntry, content io.Reader) error {
+    header := &zip.FileHeader{
+        Name:     entry.Path,
+        Method:   zip.Deflate,
+        Modified: entry.File.UploadDate,
+    }
+    if precompressed(entry.File.ContentType) {
+        header.Method = zip.Store
+    }
+    // archive/zip switches to ZIP64 records for entries over 4GB
+    header.SetMode(0o644)
+    w, err := a.w.CreateHeader(header)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(w, content)
+    return err
+}
+
+func (a zipArchive) Close() error {
+    return a.w.Close()
+}
+
+type tarGzipArchive struct {
+    tw *tar.Writer
+    gz *gzip.Writer
+}
+
+func (a tarGzipArchive) add(entry archiveEntry, content io.Reader) error {
+    err := a.tw.WriteHeader(&tar.Header{
+        Typeflag: tar.TypeReg,
+        Name:     entry.Path,
+        Size:     entry.File.Size,
+        Mode:     0o644,
+        ModTime:  entry.File.UploadDate,
+    })
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(a.tw, content)
+    return err
+}
+
+func (a tarGzipArchive) Close() error {
+    if err := a.tw.Close(); err != nil {
+        return err
+    }
+    return a.gz.Close()
+}
+
+// archiveFormats maps the accepted format names to the file extension and
+// content type of the archive
+var archiveFormats = map[string][2]string{
+    "zip":    {".zip", "application/zip"},
+    "tar.gz": {".tar.gz", "application/gzip"},
+    "tgz":    {".tar.gz", "application/gzip"},
+}
+
+// precompressed reports whether content of a type gains nothing from
+// compression, so it is stored as is
+func precompressed(contentType string) bool {
+    for _, prefix := range []string{"image/", "video/", "audio/"} {
+        if strings.HasPrefix(contentType, prefix) && contentType != "image/svg+xml" && contentType != "image/bmp" {
+            return true
+        }
+    }
+    switch contentType {
+    case "application/zip", "application/gzip", "application/x-gzip", "application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2", "application/x-xz", "application/zstd":
+        return true
+    }
+    return false
+}
+
+// streamArchive writes an archive of the entries straight from the storage
+// backend to the response, one file at a time and without temporary files.
+// Once the response has started an error can no longer be reported, so the
+// connection is aborted to leave the client with an incomplete download
+// rather than a truncated archive that looks complete.
+func streamArchive(w http.ResponseWriter, name, format string, entries []archiveEntry) {
+    kind := archiveFormats[format]
+
+    w.Header().Set("Content-Type", kind[1])
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + kind[0]}))
+
+    var archive archiveWriter
+    if kind[0] == ".zip" {
+        archive = zipArchive{w: zip.NewWriter(w)}
+    } else {
+        gz := gzip.NewWriter(w)
+        archive = tarGzipArchive{tw: tar.NewWriter(gz), gz: gz}
+    }
+
+    for _, entry := range entries {
+        content, err := models.OpenContent(entry.File)
+        if err != nil {
+            log.Println("Error opening file for archive:", entry.File.ID, err)
+            panic(http.ErrAbortHandler)
+        }
+        err = archive.add(entry, content)
+        content.Close()
+        if err != nil {
+            log.Println("Error writing archive:", entry.File.ID, err)
+            panic(http.ErrAbortHandler)
+        }
+    }
+    if err := archive.Close(); err != nil {
+        log.Println("Error writing archive:", err)
+        panic(http.ErrAbortHandler)
+    }
+}
+
+// archiveFormat reads and checks the requested archive format, "zip" by default
+func archiveFormat(w http.ResponseWriter, format string) (string, bool) {
+    if format == "" {
+        return "zip", true
+    }
+    if _, ok := archiveFormats[format]; !ok {
+        http.Error(w, "Invalid format: use zip or tar.gz", http.StatusBadRequest)
+        return "", false
+    }
+    return format, true
+}
+
+// folderFiles lists the files of a folder in the user's workspace for an
+// archive, answering with an error when it is empty or too large
+func folderFiles(w http.ResponseWriter, userID, orgID int, folder string) ([]models.File, bool) {
+    files, err := models.GetFolderFiles(userID, orgID, folder, maxArchiveFiles)
+    if errors.Is(err, models.ErrTooManyFiles) {
+        http.Error(w, "Folder has more than "+strconv.Itoa(maxArchiveFiles)+" files", http.StatusUnprocessableEntity)
+        return nil, false
+    }
+    if err != nil {
+        http.Error(w, "Unable to retrieve files", http.StatusInternalServerError)
+        return nil, false
+    }
+    if len(files) == 0 {
+        http.Error(w, "Folder not found", http.StatusNotFound)
+        return nil, false
+    }
+    return files, true
+}
+
+// GetFolderArchive downloads a folder of the user's files (or of an
+// organization's with ?org=) and every folder below it as an archive.
+// ?path= names the folder and ?format= is zip (the default) or tar.gz.
+func GetFolderArchive(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    format, ok := archiveFormat(w, r.URL.Query().Get("format"))
+    if !ok {
+        return
+    }
+    folder, err := normalizeFolder(r.URL.Query().Get("path"))
+    if err != nil {
+        http.Error(w, "Invalid folder: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    orgID, ok := orgParam(w, r)
+    if !ok {
+        return
+    }
+    auditTarget(r, "folder", folder)
+
+    files, ok := folderFiles(w, user.ID, orgID, folder)
+    if !ok {
+        return
+    }
+    var entries archiveEntries
+    entries.addFolder(folder, files)
+    auditDetail(r, "files", strconv.Itoa(len(entries.entries)))
+
+    name := "files"
+    if folder != "/" {
+        name = path.Base(folder)
+    }
+    streamArchive(w, name, format, entries.entries)
+}
+
+// archiveRequest selects files, by ID, and folders of the user's workspace,
+// by path, for CreateArchive
+type archiveRequest struct {
+    FileIDs []int    `json:"file_ids"`
+    Folders []string `json:"folders"`
+    Format  string   `json:"format"`
+}
+
+// CreateArchive downloads a selection of files and folders as one archive.
+// Selected files are placed at the top of the archive and folders keep
+// their structure below their own name. Any file the user can view can be
+// selected; folders are looked up in the user's files, or in an
+// organization's with ?org=.
+func CreateArchive(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    var req archiveRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid archive request", http.StatusBadRequest)
+        return
+    }
+    ids := make([]string, len(req.FileIDs))
+    for i, id := range req.FileIDs {
+        ids[i] = strconv.Itoa(id)
+    }
+    auditDetail(r, "file_ids", strings.Join(ids, ","))
+    auditDetail(r, "folders", strings.Join(req.Folders, ","))
+    if len(req.FileIDs)+len(req.Folders) == 0 || len(req.FileIDs)+len(req.Folders) > maxArchiveSelection {
+        http.Error(w, "Invalid archive request: select 1 to "+strconv.Itoa(maxArchiveSelection)+" files and folders", http.StatusUnprocessableEntity)
+        return
+    }
+    format, ok := archiveFormat(w, req.Format)
+    if !ok {
+        return
+    }
+    orgID, ok := orgParam(w, r)
+    if !ok {
+        return
+    }
+
+    var entries archiveEntries
+    for _, id := range req.FileIDs {
+        file, err := models.GetFileByID(strconv.Itoa(id))
+        if err != nil {
+            http.Error(w, "File not found", http.StatusNotFound)
+            return
+        }
+        role, err := models.FileRole(file, user.ID)
+        if err != nil {
+            http.Error(w, "Unable to check permissions", http.StatusInternalServerError)
+            return
+        }
+        if role == "" {
+            http.Error(w, "File not found", http.StatusNotFound)
+            return
+        }
+        if !checkScanStatus(w, file) {
+            return
+        }
+        entries.add("", file)
+    }
+    for _, value := range req.Folders {
+        folder, err := normalizeFolder(value)
+        if err != nil {
+            http.Error(w, "Invalid folder: "+err.Error(), http.StatusUnprocessableEntity)
+            return
+        }
+        files, ok := folderFiles(w, user.ID, orgID, folder)
+        if !ok {
+            return
+        }
+        entries.addFolder(folder, files)
+        if len(entries.entries) > maxArchiveFiles {
+            http.Error(w, "Archive would hold more than "+strconv.Itoa(maxArchiveFiles)+" files", http.StatusUnprocessableEntity)
+            return
+        }
+    }
+
+    auditDetail(r, "files", strconv.Itoa(len(entries.entries)))
+    streamArchive(w, "files", format, entries.entries)
+}
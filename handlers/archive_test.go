@@ -0,0 +1,101 @@
+package handlers
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "bytes"
+    "compress/gzip"
+    "io"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+    "file-sharing-system/models"
+)
+
+// TestArchiveEntries tests the paths files get inside an archive
+func TestArchiveEntries(t *testing.T) {
+    var entries archiveEntries
+    entries.add("", models.File{Name: "notes.txt"})
+    entries.add("", models.File{Name: "notes.txt"})
+    entries.add("", models.File{Name: "../../etc/passwd"})
+    entries.addFolder("/projects/apollo", []models.File{
+        {Name: "plan.pdf", Folder: "/projects/apollo", ScanStatus: models.ScanClean},
+        {Name: "logo.png", Folder: "/projects/apollo/assets", ScanStatus: models.ScanClean},
+        {Name: "virus.exe", Folder: "/projects/apollo", ScanStatus: models.ScanInfected},
+    })
+    entries.addFolder("/", []models.File{
+        {Name: "top.txt", Folder: "/", ScanStatus: models.ScanSkipped},
+        {Name: "deep.txt", Folder: "/a/b", ScanStatus: models.ScanSkipped},
+    })
+
+    var paths []string
+    for _, entry := range entries.entries {
+        paths = append(paths, entry.Path)
+    }
+    expected := []string{"notes.txt", "notes (1).txt", ".._.._etc_passwd", "apollo/plan.pdf", "apollo/assets/logo.png", "top.txt", "a/b/deep.txt"}
+    if !reflect.DeepEqual(paths, expected) {
+        t.Errorf("Expected %v, got %v", expected, paths)
+    }
+}
+
+// TestArchiveWriters tests that both archive formats hold the content,
+// paths and modification times of their entries
+func TestArchiveWriters(t *testing.T) {
+    modified := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+    entry := archiveEntry{Path: "apollo/plan.txt", File: models.File{Size: 5, ContentType: "text/plain", UploadDate: modified}}
+
+    var buf bytes.Buffer
+    archive := zipArchive{w: zip.NewWriter(&buf)}
+    if err := archive.add(entry, strings.NewReader("hello")); err != nil {
+        t.Fatal(err)
+    }
+    archive.Close()
+    zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    f, _ := zr.File[0].Open()
+    content, _ := io.ReadAll(f)
+    if zr.File[0].Name != entry.Path || string(content) != "hello" || !zr.File[0].Modified.Equal(modified) {
+        t.Errorf("Unexpected zip entry %s %q %s", zr.File[0].Name, content, zr.File[0].Modified)
+    }
+
+    buf.Reset()
+    gz := gzip.NewWriter(&buf)
+    tgz := tarGzipArchive{tw: tar.NewWriter(gz), gz: gz}
+    if err := tgz.add(entry, strings.NewReader("hello")); err != nil {
+        t.Fatal(err)
+    }
+    tgz.Close()
+    gr, err := gzip.NewReader(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tr := tar.NewReader(gr)
+    header, err := tr.Next()
+    if err != nil {
+        t.Fatal(err)
+    }
+    content, _ = io.ReadAll(tr)
+    if header.Name != entry.Path || string(content) != "hello" || !header.ModTime.Equal(modified) {
+        t.Errorf("Unexpected tar entry %s %q %s", header.Name, content, header.ModTime)
+    }
+}
+
+// TestPrecompressed tests which content types are stored without compression
+func TestPrecompressed(t *testing.T) {
+    cases := map[string]bool{
+        "image/jpeg":      true,
+        "video/mp4":       true,
+        "application/zip": true,
+        "image/svg+xml":   false,
+        "text/plain":      false,
+        "application/pdf": false,
+    }
+    for contentType, expected := range cases {
+        if precompressed(contentType) != expected {
+            t.Errorf("%s: expected %v", contentType, expected)
+        }
+    }
+}
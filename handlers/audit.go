@@ -0,0 +1,386 @@
+package handlers
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "log"
+    "net"
+    "net/http"
+    "net/netip"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "file-sharing-system/models"
+)
+
+const (
+    auditContextKey contextKey = "audit"
+
+    defaultAuditLimit = 100
+    maxAuditLimit     = 1000
+)
+
+// statusRecorder remembers the status a handler answers with
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// Audit writes an audit log entry for every request next handles, with
+// the authenticated user or the actor the handler names, the client's
+// address and user agent, the target the handler names and the outcome
+// of the status it answers with
+func Audit(action string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        audited(w, r, action, next)
+    }
+}
+
+func audited(w http.ResponseWriter, r *http.Request, action string, next http.HandlerFunc) {
+    entry := &models.AuditEntry{Action: action, Details: map[string]string{}}
+    recorder := &statusRecorder{ResponseWriter: w}
+    next(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey, entry)))
+    if entry.Action == "" {
+        return
+    }
+
+    status := recorder.status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    entry.Outcome = auditOutcome(status)
+    if entry.Outcome != models.AuditSuccess {
+        entry.Details["status"] = strconv.Itoa(status)
+    }
+    recordAudit(r, *entry)
+}
+
+// auditOutcome is the outcome of a request answered with status
+func auditOutcome(status int) string {
+    switch {
+    case status < 400:
+        return models.AuditSuccess
+    case status == http.StatusUnauthorized || status == http.StatusForbidden:
+        return models.AuditDenied
+    }
+    return models.AuditFailure
+}
+
+// recordAudit writes an audit entry for a request, taking the actor from
+// the authenticated user unless the entry names one
+func recordAudit(r *http.Request, entry models.AuditEntry) {
+    if entry.ActorID == nil {
+        if user, ok := currentUser(r); ok {
+            entry.ActorID, entry.ActorEmail = &user.ID, user.Email
+        }
+    }
+    entry.IP = clientIP(r)
+    entry.UserAgent = r.UserAgent()
+    appendAudit(entry)
+}
+
+// appendAudit writes an audit entry. The action already happened, so a
+// failure is logged rather than reported to the client.
+func appendAudit(entry models.AuditEntry) {
+    if _, err := models.AppendAuditEntry(entry); err != nil {
+        log.Printf("Error writing audit log entry for %s: %v", entry.Action, err)
+    }
+}
+
+// signInEntry is an auth.login entry for a sign-in over protocol, naming
+// the user when they are known or else the email they gave
+func signInEntry(protocol string, user models.User, email, outcome string) models.AuditEntry {
+    entry := models.AuditEntry{Action: models.AuditLogin, ActorEmail: email, Outcome: outcome, Details: map[string]string{"protocol": protocol}}
+    if user.ID != 0 {
+        entry.ActorID, entry.ActorEmail = &user.ID, user.Email
+    }
+    return entry
+}
+
+// auditEntry returns the entry being built for an audited request, or nil
+func auditEntry(r *http.Request) *models.AuditEntry {
+    entry, _ := r.Context().Value(auditContextKey).(*models.AuditEntry)
+    return entry
+}
+
+// auditTarget names what an audited request acts on
+func auditTarget(r *http.Request, targetType, targetID string) {
+    if entry := auditEntry(r); entry != nil {
+        entry.TargetType, entry.TargetID = targetType, targetID
+    }
+}
+
+// auditFile names a file as the target of an audited request
+func auditFile(r *http.Request, file models.File) {
+    auditTarget(r, "file", strconv.Itoa(file.ID))
+    auditDetail(r, "folder", file.Folder)
+    auditDetail(r, "name", file.Name)
+}
+
+// auditDetail adds a detail to an audited request's entry
+func auditDetail(r *http.Request, key, value string) {
+    if entry := auditEntry(r); entry != nil {
+        entry.Details[key] = value
+    }
+}
+
+// auditActor names who made an audited request that is not authenticated,
+// such as a sign-in; userID is 0 when they are not known
+func auditActor(r *http.Request, userID int, email string) {
+    if entry := auditEntry(r); entry != nil {
+        entry.ActorID, entry.ActorEmail = nil, email
+        if userID != 0 {
+            entry.ActorID = &userID
+        }
+    }
+}
+
+// skipAudit leaves an audited request out of the audit log, e.g. a chunk
+// of an upload that is not the last one
+func skipAudit(r *http.Request) {
+    if entry := auditEntry(r); entry != nil {
+        entry.Action = ""
+    }
+}
+
+// clientIP is the address a request came from. Behind the reverse proxies
+// in TRUSTED_PROXIES it is the right-most address of X-Forwarded-For that
+// is not one of them, since a client can put anything in front of the
+// address the first proxy appends; otherwise it is the connection's.
+func clientIP(r *http.Request) string {
+    ip := remoteHost(r.RemoteAddr)
+    proxies := trustedProxies()
+    if !isTrustedProxy(proxies, ip) {
+        return ip
+    }
+    var hops []string
+    for _, header := range r.Header.Values("X-Forwarded-For") {
+        hops = append(hops, strings.Split(header, ",")...)
+    }
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := strings.TrimSpace(hops[i])
+        if hop == "" {
+            continue
+        }
+        ip = hop
+        if !isTrustedProxy(proxies, ip) {
+            break
+        }
+    }
+    return ip
+}
+
+// trustedProxies reads TRUSTED_PROXIES, a comma separated list of the IP
+// addresses and CIDR ranges of reverse proxies
+func trustedProxies() []netip.Prefix {
+    var proxies []netip.Prefix
+    for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+        value = strings.TrimSpace(value)
+        if prefix, err := netip.ParsePrefix(value); err == nil {
+            proxies = append(proxies, prefix.Masked())
+        } else if addr, err := netip.ParseAddr(value); err == nil {
+            proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+        }
+    }
+    return proxies
+}
+
+// isTrustedProxy reports whether host is one of proxies
+func isTrustedProxy(proxies []netip.Prefix, host string) bool {
+    addr, err := netip.ParseAddr(host)
+    if err != nil {
+        return false
+    }
+    for _, prefix := range proxies {
+        if prefix.Contains(addr.Unmap()) {
+            return true
+        }
+    }
+    return false
+}
+
+// remoteHost strips the port from a remote address
+func remoteHost(addr string) string {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return addr
+    }
+    return host
+}
+
+// parseAuditFilter reads the audit log filters: actor (a user ID or
+// email), action (e.g. "auth.login" or "file.*"), outcome, target_type,
+// target_id, ip, and from and to (dates or RFC 3339 times; a date in to
+// includes that day)
+func parseAuditFilter(query url.Values) (models.AuditFilter, error) {
+    filter := models.AuditFilter{
+        Action:     query.Get("action"),
+        Outcome:    query.Get("outcome"),
+        TargetType: query.Get("target_type"),
+        TargetID:   query.Get("target_id"),
+        IP:         query.Get("ip"),
+    }
+    if actor := query.Get("actor"); actor != "" {
+        if id, err := strconv.Atoi(actor); err == nil {
+            filter.ActorID = id
+        } else {
+            filter.ActorEmail = actor
+        }
+    }
+    switch filter.Outcome {
+    case "", models.AuditSuccess, models.AuditFailure, models.AuditDenied:
+    default:
+        return filter, errors.New("outcome must be success, failure or denied")
+    }
+    if value := query.Get("from"); value != "" {
+        from, _, err := parseSearchTime(value)
+        if err != nil {
+            return filter, errors.New("invalid from date")
+        }
+        filter.From = &from
+    }
+    if value := query.Get("to"); value != "" {
+        to, dateOnly, err := parseSearchTime(value)
+        if err != nil {
+            return filter, errors.New("invalid to date")
+        }
+        if dateOnly {
+            to = to.AddDate(0, 0, 1)
+        }
+        filter.To = &to
+    }
+    return filter, nil
+}
+
+// GetAuditLog lists audit log entries matching the filters of
+// parseAuditFilter, newest first, limit at a time; cursor continues from
+// the next_cursor of an earlier page
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    filter, err := parseAuditFilter(query)
+    if err != nil {
+        http.Error(w, "Invalid audit log filters: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    filter.Limit = defaultAuditLimit
+    if value := query.Get("limit"); value != "" {
+        limit, err := strconv.Atoi(value)
+        if err != nil || limit < 1 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        filter.Limit = min(limit, maxAuditLimit)
+    }
+    if value := query.Get("cursor"); value != "" {
+        filter.Before, err = strconv.ParseInt(value, 10, 64)
+        if err != nil || filter.Before < 1 {
+            http.Error(w, "Invalid cursor", http.StatusBadRequest)
+            return
+        }
+    }
+
+    page, err := models.ListAuditEntries(filter)
+    if err != nil {
+        http.Error(w, "Unable to retrieve audit log", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(page)
+}
+
+// auditCSVHeader names the columns of CSV exports
+var auditCSVHeader = []string{"id", "created_at", "actor_id", "actor_email", "ip", "user_agent", "action", "target_type", "target_id", "outcome", "details", "prev_hash", "hash"}
+
+// auditCSVRecord is an entry as a row of a CSV export, its details as JSON
+func auditCSVRecord(e models.AuditEntry) []string {
+    actorID := ""
+    if e.ActorID != nil {
+        actorID = strconv.Itoa(*e.ActorID)
+    }
+    details, _ := json.Marshal(e.Details)
+    return []string{strconv.FormatInt(e.ID, 10), e.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), actorID, e.ActorEmail,
+        e.IP, e.UserAgent, e.Action, e.TargetType, e.TargetID, e.Outcome, string(details), e.PrevHash, e.Hash}
+}
+
+// ExportAuditLog streams every audit log entry matching the filters of
+// parseAuditFilter, oldest first, as CSV or, with format=jsonl, as JSON
+// Lines. Entries keep their hashes, so an unfiltered export can be checked
+// on its own.
+func ExportAuditLog(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    filter, err := parseAuditFilter(query)
+    if err != nil {
+        http.Error(w, "Invalid audit log filters: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    filter.Ascending = true
+
+    var write func(models.AuditEntry) error
+    var flush func() error
+    switch format := query.Get("format"); format {
+    case "", "csv":
+        w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+        w.Header().Set("Content-Disposition", `attachment; filename="audit-log.csv"`)
+        writer := csv.NewWriter(w)
+        writer.Write(auditCSVHeader)
+        write = func(e models.AuditEntry) error {
+            return writer.Write(auditCSVRecord(e))
+        }
+        flush = func() error {
+            writer.Flush()
+            return writer.Error()
+        }
+    case "jsonl":
+        w.Header().Set("Content-Type", "application/jsonl")
+        w.Header().Set("Content-Disposition", `attachment; filename="audit-log.jsonl"`)
+        encoder := json.NewEncoder(w)
+        write = func(e models.AuditEntry) error {
+            return encoder.Encode(e)
+        }
+        flush = func() error { return nil }
+    default:
+        http.Error(w, "Invalid format: use csv or jsonl", http.StatusBadRequest)
+        return
+    }
+
+    // Headers are already sent by the time a failure could happen, so it
+    // can only cut the export short
+    if err := models.EachAuditEntry(filter, write); err != nil {
+        log.Println("Error exporting audit log:", err)
+    }
+    if err := flush(); err != nil {
+        log.Println("Error exporting audit log:", err)
+    }
+}
+
+// VerifyAuditLog checks the audit log's hash chain and reports the first
+// entry that does not follow from the one before it
+func VerifyAuditLog(w http.ResponseWriter, r *http.Request) {
+    result, err := models.VerifyAuditChain()
+    if err != nil {
+        http.Error(w, "Unable to verify audit log", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+    "encoding/csv"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "file-sharing-system/models"
+)
+
+// TestAuditOutcome tests how answers map to outcomes
+func TestAuditOutcome(t *testing.T) {
+    for status, outcome := range map[int]string{
+        http.StatusOK:                  models.AuditSuccess,
+        http.StatusNoContent:           models.AuditSuccess,
+        http.StatusPartialContent:      models.AuditSuccess,
+        http.StatusUnauthorized:        models.AuditDenied,
+        http.StatusForbidden:           models.AuditDenied,
+        http.StatusNotFound:            models.AuditFailure,
+        http.StatusInternalServerError: models.AuditFailure,
+    } {
+        if got := auditOutcome(status); got != outcome {
+            t.Errorf("%d: expected %s, got %s", status, outcome, got)
+        }
+    }
+}
+
+// TestStatusRecorder tests that the first status written is kept, and
+// that a body without one counts as 200
+func TestStatusRecorder(t *testing.T) {
+    rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+    rec.Write([]byte("ok"))
+    rec.WriteHeader(http.StatusTeapot)
+    if rec.status != http.StatusOK {
+        t.Errorf("Expected 200, got %d", rec.status)
+    }
+
+    rec = &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+    http.Error(rec, "Forbidden", http.StatusForbidden)
+    if rec.status != http.StatusForbidden {
+        t.Errorf("Expected 403, got %d", rec.status)
+    }
+}
+
+// TestAuditAnnotations tests that handlers can describe the audited
+// request, and that annotating an unaudited request does nothing
+func TestAuditAnnotations(t *testing.T) {
+    req := httptest.NewRequest("POST", "/login", nil)
+    auditTarget(req, "file", "1")
+    auditDetail(req, "name", "a.txt")
+    auditActor(req, 1, "a@example.com")
+    skipAudit(req)
+
+    var entry *models.AuditEntry
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        auditActor(r, 0, "a@example.com")
+        auditFile(r, models.File{ID: 9, Folder: "/docs", Name: "a.txt"})
+        entry = auditEntry(r)
+        // Skipping keeps the test away from the database
+        skipAudit(r)
+    }
+    audited(httptest.NewRecorder(), req, models.AuditLogin, handler)
+    if entry == nil || entry.ActorID != nil || entry.ActorEmail != "a@example.com" {
+        t.Fatalf("Unexpected entry %+v", entry)
+    }
+    if entry.TargetType != "file" || entry.TargetID != "9" || entry.Details["name"] != "a.txt" || entry.Details["folder"] != "/docs" {
+        t.Errorf("Unexpected target %+v", entry)
+    }
+}
+
+// TestSignInEntry tests that sign-ins name the user once they are known
+func TestSignInEntry(t *testing.T) {
+    entry := signInEntry("webdav", models.User{}, "a@example.com", models.AuditDenied)
+    if entry.Action != models.AuditLogin || entry.ActorID != nil || entry.ActorEmail != "a@example.com" || entry.Details["protocol"] != "webdav" {
+        t.Errorf("Unexpected entry %+v", entry)
+    }
+    entry = signInEntry("sftp", models.User{ID: 4, Email: "b@example.com"}, "B@example.com", models.AuditSuccess)
+    if entry.ActorID == nil || *entry.ActorID != 4 || entry.ActorEmail != "b@example.com" || entry.Outcome != models.AuditSuccess {
+        t.Errorf("Unexpected entry %+v", entry)
+    }
+}
+
+// TestClientIP tests that X-Forwarded-For is only read from trusted
+// proxies, and only as far back as the first address that is not one
+func TestClientIP(t *testing.T) {
+    req := httptest.NewRequest("GET", "/", nil)
+    req.RemoteAddr = "192.0.2.1:54321"
+    req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9, 10.0.0.1")
+
+    t.Setenv("TRUSTED_PROXIES", "")
+    if ip := clientIP(req); ip != "192.0.2.1" {
+        t.Errorf("Expected the connection's address, got %s", ip)
+    }
+    t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+    if ip := clientIP(req); ip != "203.0.113.9" {
+        t.Errorf("Expected the right-most untrusted address, got %s", ip)
+    }
+    req.Header.Add("X-Forwarded-For", "10.0.0.2")
+    if ip := clientIP(req); ip != "203.0.113.9" {
+        t.Errorf("Expected every X-Forwarded-For header to be read, got %s", ip)
+    }
+    req.Header.Set("X-Forwarded-For", "10.0.0.3, 10.0.0.1")
+    if ip := clientIP(req); ip != "10.0.0.3" {
+        t.Errorf("Expected the left-most address when every hop is trusted, got %s", ip)
+    }
+
+    // Connections from elsewhere cannot claim an address
+    req.RemoteAddr = "198.51.100.1:54321"
+    if ip := clientIP(req); ip != "198.51.100.1" {
+        t.Errorf("Expected the untrusted connection's address, got %s", ip)
+    }
+
+    req.RemoteAddr = "[2001:db8::1]:443"
+    req.Header.Del("X-Forwarded-For")
+    if ip := clientIP(req); ip != "2001:db8::1" {
+        t.Errorf("Expected the IPv6 address, got %s", ip)
+    }
+}
+
+// TestParseAuditFilter tests reading filters from the query
+func TestParseAuditFilter(t *testing.T) {
+    req := httptest.NewRequest("GET", "/admin/audit?actor=12&action=file.*&outcome=denied&from=2026-03-01&to=2026-03-31", nil)
+    filter, err := parseAuditFilter(req.URL.Query())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if filter.ActorID != 12 || filter.Action != "file.*" || filter.Outcome != models.AuditDenied {
+        t.Errorf("Unexpected filter %+v", filter)
+    }
+    if !filter.From.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) || !filter.To.Equal(time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("Expected the whole of March, got %v to %v", filter.From, filter.To)
+    }
+
+    req = httptest.NewRequest("GET", "/admin/audit?actor=alice@example.com", nil)
+    if filter, _ := parseAuditFilter(req.URL.Query()); filter.ActorEmail != "alice@example.com" || filter.ActorID != 0 {
+        t.Errorf("Expected an actor email, got %+v", filter)
+    }
+}
+
+// TestAuditLogInvalidParameters tests that malformed requests are
+// rejected before the log is read
+func TestAuditLogInvalidParameters(t *testing.T) {
+    for _, query := range []string{"outcome=maybe", "from=yesterday", "to=2026-13-01", "limit=0", "limit=many", "cursor=abc", "cursor=-1"} {
+        rec := httptest.NewRecorder()
+        GetAuditLog(rec, httptest.NewRequest("GET", "/admin/audit?"+query, nil))
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("%s: expected 400, got %d", query, rec.Code)
+        }
+    }
+    for _, query := range []string{"format=xml", "outcome=maybe"} {
+        rec := httptest.NewRecorder()
+        ExportAuditLog(rec, httptest.NewRequest("GET", "/admin/audit/export?"+query, nil))
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("%s: expected 400, got %d", query, rec.Code)
+        }
+    }
+}
+
+// TestAuditCSVRecord tests the columns of CSV exports
+func TestAuditCSVRecord(t *testing.T) {
+    actorID := 3
+    e := models.AuditEntry{
+        ID:         5,
+        CreatedAt:  time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+        ActorID:    &actorID,
+        ActorEmail: "alice@example.com",
+        Action:     models.AuditShareGrant,
+        Outcome:    models.AuditSuccess,
+        Details:    map[string]string{"grantee": "bob@example.com", "role": "viewer"},
+        Hash:       "h",
+    }
+    record := auditCSVRecord(e)
+    if len(record) != len(auditCSVHeader) {
+        t.Fatalf("Expected %d columns, got %d", len(auditCSVHeader), len(record))
+    }
+    var b strings.Builder
+    w := csv.NewWriter(&b)
+    w.Write(record)
+    w.Flush()
+    expected := `5,2026-03-01T12:00:00.000000Z,3,alice@example.com,,,share.grant,,,success,"{""grantee"":""bob@example.com"",""role"":""viewer""}",,h` + "\n"
+    if b.String() != expected {
+        t.Errorf("Unexpected record %q", b.String())
+    }
+
+    e.ActorID = nil
+    if record := auditCSVRecord(e); record[2] != "" {
+        t.Errorf("Expected an empty actor ID, got %q", record[2])
+    }
+}
+
+// TestS3AuditAction tests which S3 requests are audited
+func TestS3AuditAction(t *testing.T) {
+    for target, action := range map[string]string{
+        "GET /bucket/a.txt":               models.AuditFileDownload,
+        "HEAD /bucket/a.txt":              "",
+        "PUT /bucket/a.txt":               models.AuditFileUpload,
+        "PUT /bucket/a.txt?uploadId=1":    "",
+        "POST /bucket/a.txt?uploads":      "",
+        "POST /bucket/a.txt?uploadId=1":   models.AuditFileUpload,
+        "DELETE /bucket/a.txt":            models.AuditFileDelete,
+        "DELETE /bucket/a.txt?uploadId=1": "",
+        "GET /bucket/":                    "",
+    } {
+        method, url, _ := strings.Cut(target, " ")
+        req := httptest.NewRequest(method, url, nil)
+        _, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+        if got := s3AuditAction(req, key); got != action {
+            t.Errorf("%s: expected %q, got %q", target, action, got)
+        }
+    }
+}
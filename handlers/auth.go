@@ -34,6 +34,7 @@ func CheckPasswordHash(password, hashedPassword string) bool {
 func Register(w http.ResponseWriter, r *http.Request) {
     var user models.User
     json.NewDecoder(r.Body).Decode(&user)
+    auditActor(r, 0, user.Email)
     
     // Hash password and store user in DB
     hashedPassword, err := HashPassword(user.Password)
@@ -56,6 +57,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 func Login(w http.ResponseWriter, r *http.Request) {
     var user models.User
     json.NewDecoder(r.Body).Decode(&user)
+    auditActor(r, 0, user.Email)
     
     storedUser, err := models.GetUserByEmail(user.Email)
     if err != nil {
@@ -68,6 +70,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Invalid password", http.StatusUnauthorized)
         return
     }
+    auditActor(r, storedUser.ID, storedUser.Email)
 
     // Generate JWT Token
     expirationTime := time.Now().Add(1 * time.Hour)
@@ -0,0 +1,363 @@
+package handlers
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+const (
+    defaultChangesLimit = 500
+    maxChangesLimit     = 5000
+    maxChangesWait      = time.Minute
+    // Waiting requests look for events this often even without an
+    // announcement, in case one was missed
+    eventsPollInterval = 10 * time.Second
+    // Idle event streams send a comment this often so proxies keep them open
+    streamKeepAlive = 15 * time.Second
+)
+
+// eventScope is the workspace an event belongs to: an organization's, or
+// a user's personal files when orgID is 0
+type eventScope struct {
+    userID int
+    orgID  int
+}
+
+// scopeOf is the workspace opts reads events from
+func scopeOf(opts models.EventsOptions) eventScope {
+    if opts.OrgID != 0 {
+        return eventScope{orgID: opts.OrgID}
+    }
+    return eventScope{userID: opts.UserID}
+}
+
+// eventNotice reads the workspace from the payload the database announces
+// an event with
+func eventNotice(payload string) (eventScope, error) {
+    var notice struct {
+        UserID *int `json:"user_id"`
+        OrgID  *int `json:"org_id"`
+    }
+    if err := json.Unmarshal([]byte(payload), &notice); err != nil {
+        return eventScope{}, err
+    }
+    if notice.OrgID != nil {
+        return eventScope{orgID: *notice.OrgID}, nil
+    }
+    if notice.UserID != nil {
+        return eventScope{userID: *notice.UserID}, nil
+    }
+    return eventScope{}, errors.New("event has no workspace")
+}
+
+// eventSignal wakes the requests waiting on a workspace's events whenever
+// an event in it is announced, so that an event only sends the requests
+// that can see it back to the database
+type eventSignal struct {
+    mu    sync.Mutex
+    ready map[eventScope]chan struct{}
+}
+
+var newEvents = &eventSignal{ready: make(map[eventScope]chan struct{})}
+
+// wait returns a channel that is closed at the next announcement in scope
+func (s *eventSignal) wait(scope eventScope) <-chan struct{} {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ready, ok := s.ready[scope]
+    if !ok {
+        ready = make(chan struct{})
+        s.ready[scope] = ready
+    }
+    return ready
+}
+
+// announce wakes everyone waiting on scope
+func (s *eventSignal) announce(scope eventScope) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if ready, ok := s.ready[scope]; ok {
+        close(ready)
+        delete(s.ready, scope)
+    }
+}
+
+// announceAll wakes everyone, as after announcements may have been missed
+func (s *eventSignal) announceAll() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for scope, ready := range s.ready {
+        close(ready)
+        delete(s.ready, scope)
+    }
+}
+
+// ListenForEvents listens for the events the database announces and wakes
+// the requests waiting on the feed, reconnecting after errors, until ctx
+// is done
+func ListenForEvents(ctx context.Context) {
+    for {
+        err := listenForEvents(ctx)
+        if ctx.Err() != nil {
+            return
+        }
+        log.Println("Error listening for events:", err)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(eventsPollInterval):
+        }
+    }
+}
+
+func listenForEvents(ctx context.Context) error {
+    db, err := utils.OpenDB()
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+
+    conn, err := db.Acquire(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Release()
+    if _, err := conn.Exec(ctx, "LISTEN "+models.EventsChannel); err != nil {
+        return err
+    }
+    // Events logged while not listening were never announced
+    newEvents.announceAll()
+    for {
+        notification, err := conn.Conn().WaitForNotification(ctx)
+        if err != nil {
+            return err
+        }
+        scope, err := eventNotice(notification.Payload)
+        if err != nil {
+            log.Printf("Error reading event announcement %q: %v", notification.Payload, err)
+            continue
+        }
+        newEvents.announce(scope)
+    }
+}
+
+// GetChanges returns the events in the user's files since ?cursor=, a
+// cursor from an earlier response, or from the start of the log when it is
+// absent: files created, renamed, moved and deleted, share links created
+// and revoked, and permissions granted, changed and revoked. Clients that
+// pass ?since= instead, as before the event log, get the file changes in
+// the shape of legacyChanges.
+// folder limits it to events in that folder or below, including files
+// moved in or out, org reads an organization's events and limit bounds
+// the page size.
+// When there are no events yet, wait=<seconds> holds the request open
+// until there are. Clients accepting text/event-stream instead get every
+// event as a Server-Sent Event as it happens, resuming after Last-Event-ID
+// when they reconnect.
+func GetChanges(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+    query := r.URL.Query()
+    stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+    folder, err := normalizeFolder(query.Get("folder"))
+    if err != nil {
+        http.Error(w, "Invalid folder: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    limit := defaultChangesLimit
+    if value := query.Get("limit"); value != "" {
+        limit, err = strconv.Atoi(value)
+        if err != nil || limit < 1 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        limit = min(limit, maxChangesLimit)
+    }
+    var wait time.Duration
+    if value := query.Get("wait"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds < 0 {
+            http.Error(w, "Invalid wait", http.StatusBadRequest)
+            return
+        }
+        wait = min(time.Duration(seconds)*time.Second, maxChangesWait)
+    }
+    cursor := query.Get("cursor")
+    legacy := cursor == "" && query.Has("since")
+    if legacy {
+        cursor = query.Get("since")
+    }
+    if id := r.Header.Get("Last-Event-ID"); stream && id != "" {
+        cursor = id
+    }
+    if _, err := models.ParseEventCursor(cursor); err != nil {
+        http.Error(w, "Invalid cursor", http.StatusBadRequest)
+        return
+    }
+    orgID, ok := orgParam(w, r)
+    if !ok {
+        return
+    }
+
+    opts := models.EventsOptions{
+        UserID: user.ID,
+        OrgID:  orgID,
+        Folder: folder,
+        Cursor: cursor,
+        Limit:  limit,
+    }
+    if stream {
+        streamEvents(w, r, opts)
+        return
+    }
+    page, err := waitForEvents(r.Context(), opts, wait)
+    if err != nil {
+        http.Error(w, "Unable to retrieve changes", http.StatusInternalServerError)
+        return
+    }
+    if legacy {
+        json.NewEncoder(w).Encode(legacyChanges(page))
+        return
+    }
+    json.NewEncoder(w).Encode(page)
+}
+
+// fileChange and changesPage are the feed's shape before it became the
+// event log, which clients passing since still get
+type fileChange struct {
+    FileID    int       `json:"file_id"`
+    Action    string    `json:"action"`
+    Folder    string    `json:"folder"`
+    Name      string    `json:"name"`
+    OldFolder *string   `json:"old_folder,omitempty"`
+    OldName   *string   `json:"old_name,omitempty"`
+    Size      int64     `json:"size"`
+    Checksum  string    `json:"checksum"`
+    ChangedAt time.Time `json:"changed_at"`
+}
+
+type changesPage struct {
+    Changes []fileChange `json:"changes"`
+    Cursor  string       `json:"cursor"`
+    HasMore bool         `json:"has_more"`
+}
+
+// legacyChanges is a page of events as a page of that feed: only changes
+// to files, with renames reported as moves as they were then
+func legacyChanges(page models.EventsPage) changesPage {
+    changes := changesPage{Changes: []fileChange{}, Cursor: page.Cursor, HasMore: page.HasMore}
+    for _, event := range page.Events {
+        if !event.IsFileChange() || event.FileID == nil {
+            continue
+        }
+        change := fileChange{
+            FileID:    *event.FileID,
+            Action:    event.Type,
+            Folder:    event.Folder,
+            Name:      event.Name,
+            OldFolder: event.OldFolder,
+            OldName:   event.OldName,
+            Checksum:  event.Checksum,
+            ChangedAt: event.CreatedAt,
+        }
+        if change.Action == models.EventRenamed {
+            change.Action = models.EventMoved
+        }
+        if event.Size != nil {
+            change.Size = *event.Size
+        }
+        changes.Changes = append(changes.Changes, change)
+    }
+    return changes
+}
+
+// waitForEvents returns the next page of events, waiting up to wait for
+// one to happen when there are none yet
+func waitForEvents(ctx context.Context, opts models.EventsOptions, wait time.Duration) (models.EventsPage, error) {
+    deadline := time.NewTimer(wait)
+    defer deadline.Stop()
+    for {
+        // Taken before the query so that no announcement falls in between
+        announced := newEvents.wait(scopeOf(opts))
+        page, err := models.GetEvents(opts)
+        if err != nil || len(page.Events) > 0 || wait == 0 {
+            return page, err
+        }
+        select {
+        case <-deadline.C:
+            return page, nil
+        case <-ctx.Done():
+            return page, nil
+        case <-announced:
+        case <-time.After(eventsPollInterval):
+        }
+    }
+}
+
+// streamEvents sends events as Server-Sent Events as they happen, until
+// the client goes away
+func streamEvents(w http.ResponseWriter, r *http.Request, opts models.EventsOptions) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    keepAlive := time.NewTicker(streamKeepAlive)
+    defer keepAlive.Stop()
+    for {
+        announced := newEvents.wait(scopeOf(opts))
+        page, err := models.GetEvents(opts)
+        if err != nil {
+            log.Println("Error streaming events:", err)
+            return
+        }
+        for _, event := range page.Events {
+            if err := writeEvent(w, event); err != nil {
+                return
+            }
+        }
+        flusher.Flush()
+        opts.Cursor = page.Cursor
+        if page.HasMore {
+            continue
+        }
+
+        select {
+        case <-r.Context().Done():
+            return
+        case <-announced:
+        case <-time.After(eventsPollInterval):
+        case <-keepAlive.C:
+            if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// writeEvent sends an event as a Server-Sent Event whose ID is its cursor,
+// which a reconnecting client resumes after
+func writeEvent(w io.Writer, event models.Event) error {
+    data, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.Cursor(), data)
+    return err
+}
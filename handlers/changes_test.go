@@ -0,0 +1,121 @@
+package handlers
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "file-sharing-system/models"
+)
+
+// TestGetChangesInvalidParameters tests that malformed requests are
+// rejected before the feed is read
+func TestGetChangesInvalidParameters(t *testing.T) {
+    for _, query := range []string{"folder=/a/../b", "limit=0", "limit=many", "cursor=abc", "cursor=-1", "since=abc", "since=-1", "wait=soon", "wait=-5"} {
+        req := withUser(httptest.NewRequest("GET", "/changes?"+query, nil), models.User{ID: 1})
+        rec := httptest.NewRecorder()
+        GetChanges(rec, req)
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("%s: expected 400, got %d", query, rec.Code)
+        }
+    }
+
+    // A stream resumes from Last-Event-ID, which is checked the same way
+    req := withUser(httptest.NewRequest("GET", "/changes", nil), models.User{ID: 1})
+    req.Header.Set("Accept", "text/event-stream")
+    req.Header.Set("Last-Event-ID", "abc")
+    rec := httptest.NewRecorder()
+    GetChanges(rec, req)
+    if rec.Code != http.StatusBadRequest {
+        t.Errorf("Last-Event-ID: expected 400, got %d", rec.Code)
+    }
+}
+
+// TestWriteEvent tests the Server-Sent Event format of events
+func TestWriteEvent(t *testing.T) {
+    fileID := 7
+    event := models.Event{ID: 42, Type: models.EventRenamed, FileID: &fileID, Folder: "/docs", Name: "b.txt"}
+
+    var buf bytes.Buffer
+    if err := writeEvent(&buf, event); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(buf.String(), "\n")
+    if len(lines) != 4 || lines[0] != "id: 42" || !strings.HasPrefix(lines[1], "data: ") || lines[2] != "" {
+        t.Fatalf("Unexpected event %q", buf.String())
+    }
+    var decoded models.Event
+    if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &decoded); err != nil {
+        t.Fatal(err)
+    }
+    if decoded.Type != models.EventRenamed || decoded.Name != "b.txt" || *decoded.FileID != 7 || decoded.Details != nil {
+        t.Errorf("Unexpected event data %+v", decoded)
+    }
+}
+
+// TestEventSignal tests that an announcement wakes everyone waiting on
+// its workspace, and only them
+func TestEventSignal(t *testing.T) {
+    signal := &eventSignal{ready: make(map[eventScope]chan struct{})}
+    alice, org := eventScope{userID: 1}, eventScope{orgID: 1}
+    first, second, other := signal.wait(alice), signal.wait(alice), signal.wait(org)
+    signal.announce(alice)
+    for _, ch := range []<-chan struct{}{first, second} {
+        select {
+        case <-ch:
+        case <-time.After(time.Second):
+            t.Fatal("Expected the announcement to wake waiters")
+        }
+    }
+    select {
+    case <-other:
+        t.Error("Expected waiters on other workspaces to keep waiting")
+    case <-signal.wait(alice):
+        t.Error("Expected later waiters to wait for the next announcement")
+    default:
+    }
+
+    signal.announceAll()
+    select {
+    case <-other:
+    default:
+        t.Error("Expected announceAll to wake every workspace")
+    }
+}
+
+// TestEventNotice tests reading the workspace of an announced event
+func TestEventNotice(t *testing.T) {
+    for payload, expected := range map[string]eventScope{
+        `{"id": 5, "user_id": 3, "org_id": null}`: {userID: 3},
+        `{"id": 6, "user_id": 3, "org_id": 2}`:    {orgID: 2},
+    } {
+        if scope, err := eventNotice(payload); err != nil || scope != expected {
+            t.Errorf("%s: expected %+v, got %+v (%v)", payload, expected, scope, err)
+        }
+    }
+    for _, payload := range []string{"42", `{"id": 7, "user_id": null, "org_id": null}`} {
+        if _, err := eventNotice(payload); err == nil {
+            t.Errorf("%s: expected an error", payload)
+        }
+    }
+}
+
+// TestLegacyChanges tests that clients of the feed before the event log
+// get file changes in its shape
+func TestLegacyChanges(t *testing.T) {
+    fileID, size, oldFolder, oldName := 7, int64(10), "/docs", "a.txt"
+    page := models.EventsPage{Cursor: "9", HasMore: true, Events: []models.Event{
+        {ID: 8, Type: models.EventRenamed, FileID: &fileID, Folder: "/docs", Name: "b.txt", OldFolder: &oldFolder, OldName: &oldName, Size: &size},
+        {ID: 9, Type: models.EventLinkCreated, FileID: &fileID, Folder: "/docs", Name: "b.txt"},
+    }}
+    changes := legacyChanges(page)
+    if changes.Cursor != "9" || !changes.HasMore || len(changes.Changes) != 1 {
+        t.Fatalf("Unexpected page %+v", changes)
+    }
+    if change := changes.Changes[0]; change.Action != models.EventMoved || change.FileID != 7 || change.Size != 10 || *change.OldName != "a.txt" {
+        t.Errorf("Unexpected change %+v", change)
+    }
+}
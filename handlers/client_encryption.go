@@ -0,0 +1,60 @@
+package handlers
+
+import (
+    "encoding/base64"
+    "errors"
+    "net/http"
+)
+
+// Limits on the opaque material a client stores with a file it encrypted itself
+const (
+    maxEncryptionHeaderSize  = 4 << 10
+    maxEncryptedMetadataSize = 64 << 10
+)
+
+var errInvalidClientEncryption = errors.New("invalid client encryption header")
+
+// clientEncryption is the header and encrypted metadata a client sends with
+// a file it encrypted before uploading. The server never sees the key: it is
+// kept by the client and passed to recipients in the share link's fragment.
+type clientEncryption struct {
+    Header   []byte
+    Metadata []byte
+}
+
+func (c clientEncryption) enabled() bool {
+    return len(c.Header) > 0
+}
+
+func (c clientEncryption) validate() error {
+    if len(c.Header) > maxEncryptionHeaderSize || len(c.Metadata) > maxEncryptedMetadataSize {
+        return errInvalidClientEncryption
+    }
+    if len(c.Metadata) > 0 && len(c.Header) == 0 {
+        return errInvalidClientEncryption
+    }
+    return nil
+}
+
+// parseClientEncryption decodes the base64 encryption_header and
+// encrypted_metadata form fields of an upload
+func parseClientEncryption(header, metadata string) (clientEncryption, error) {
+    var encryption clientEncryption
+    var err error
+    if encryption.Header, err = base64.StdEncoding.DecodeString(header); err != nil {
+        return clientEncryption{}, errInvalidClientEncryption
+    }
+    if encryption.Metadata, err = base64.StdEncoding.DecodeString(metadata); err != nil {
+        return clientEncryption{}, errInvalidClientEncryption
+    }
+    return encryption, encryption.validate()
+}
+
+// setClientEncryptionHeaders lets a download of a client-encrypted file be
+// decrypted without a separate metadata request
+func setClientEncryptionHeaders(w http.ResponseWriter, header, metadata []byte) {
+    w.Header().Set("X-Encryption-Header", base64.StdEncoding.EncodeToString(header))
+    if len(metadata) > 0 {
+        w.Header().Set("X-Encrypted-Metadata", base64.StdEncoding.EncodeToString(metadata))
+    }
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+    "bytes"
+    "encoding/base64"
+    "io"
+    "mime/multipart"
+    "net/http/httptest"
+    "testing"
+)
+
+// TestParseClientEncryption tests decoding and limits of the encryption form fields
+func TestParseClientEncryption(t *testing.T) {
+    encryption, err := parseClientEncryption("", "")
+    if err != nil || encryption.enabled() {
+        t.Errorf("Expected plain upload without encryption fields, got %+v (%v)", encryption, err)
+    }
+
+    header := base64.StdEncoding.EncodeToString([]byte("age-encryption.org/v1"))
+    metadata := base64.StdEncoding.EncodeToString([]byte{0x01, 0x02, 0x03})
+    encryption, err = parseClientEncryption(header, metadata)
+    if err != nil || !encryption.enabled() || string(encryption.Header) != "age-encryption.org/v1" || len(encryption.Metadata) != 3 {
+        t.Errorf("Expected decoded encryption header, got %+v (%v)", encryption, err)
+    }
+
+    invalid := [][2]string{
+        {"not base64!", ""},
+        {"", metadata},
+        {base64.StdEncoding.EncodeToString(make([]byte, maxEncryptionHeaderSize+1)), ""},
+        {header, base64.StdEncoding.EncodeToString(make([]byte, maxEncryptedMetadataSize+1))},
+    }
+    for _, fields := range invalid {
+        if _, err := parseClientEncryption(fields[0], fields[1]); err == nil {
+            t.Errorf("Expected error for fields %.20q", fields)
+        }
+    }
+}
+
+// TestFilePartFields tests that form fields sent before the file are returned
+func TestFilePartFields(t *testing.T) {
+    var body bytes.Buffer
+    form := multipart.NewWriter(&body)
+    form.WriteField("encryption_header", "aGVhZGVy")
+    part, _ := form.CreateFormFile("file", "../secret.bin")
+    part.Write([]byte("ciphertext"))
+    form.Close()
+
+    r := httptest.NewRequest("POST", "/upload", &body)
+    r.Header.Set("Content-Type", form.FormDataContentType())
+    file, filename, fields, err := filePart(r)
+    if err != nil {
+        t.Fatalf("Error reading file part: %s", err)
+    }
+    content, _ := io.ReadAll(file)
+    if filename != "secret.bin" || string(content) != "ciphertext" || fields["encryption_header"] != "aGVhZGVy" {
+        t.Errorf("Unexpected file part %q %q %v", filename, content, fields)
+    }
+}
+
+// TestUploadEncryption tests reading the encryption header from tus Upload-Metadata
+func TestUploadEncryption(t *testing.T) {
+    header := "filename " + base64.StdEncoding.EncodeToString([]byte("report.pdf.enc")) +
+        ",encryption_header " + base64.StdEncoding.EncodeToString([]byte("header"))
+    metadata, err := parseUploadMetadata(header)
+    if err != nil {
+        t.Fatal(err)
+    }
+    encryption := uploadEncryption(metadata)
+    if !encryption.enabled() || string(encryption.Header) != "header" || len(encryption.Metadata) != 0 {
+        t.Errorf("Expected encryption header from metadata, got %+v", encryption)
+    }
+    if uploadEncryption(map[string]string{"filename": "a"}).enabled() {
+        t.Errorf("Expected plain upload without encryption_header")
+    }
+}
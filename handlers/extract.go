@@ -0,0 +1,356 @@
+package handlers
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "github.com/gorilla/mux"
+    "github.com/jackc/pgx/v4"
+    "file-sharing-system/jobs"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+// TypeExtractArchive unpacks an uploaded archive into individual files
+const TypeExtractArchive = "extract_archive"
+
+var (
+    errUnsafePath      = errors.New("entry path leaves the target folder")
+    errTooManyEntries  = errors.New("archive has too many entries")
+    errArchiveTooLarge = errors.New("archive expands beyond the size limit")
+)
+
+// extractMaxEntries is the most files one archive may hold, from
+// EXTRACT_MAX_ENTRIES (default 10000)
+func extractMaxEntries() int {
+    if n, err := strconv.Atoi(os.Getenv("EXTRACT_MAX_ENTRIES")); err == nil && n > 0 {
+        return n
+    }
+    return 10000
+}
+
+// extractMaxBytes is the most one archive may expand to, from
+// EXTRACT_MAX_BYTES (default 10GB). Archives are checked against it before
+// extraction and, since sizes in archive headers can lie, while extracting.
+func extractMaxBytes() int64 {
+    if n, err := models.ParseSize(os.Getenv("EXTRACT_MAX_BYTES")); err == nil && n > 0 {
+        return n
+    }
+    return 10 << 30
+}
+
+// archiveKind returns the archive format of a file name, "zip" or
+// "tar.gz", or "" when it cannot be extracted
+func archiveKind(name string) string {
+    name = strings.ToLower(name)
+    switch {
+    case strings.HasSuffix(name, ".zip"):
+        return "zip"
+    case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+        return "tar.gz"
+    }
+    return ""
+}
+
+// extractTarget places an archive entry below root, returning its folder
+// and file name. Absolute paths and ".." segments, which would escape root
+// ("zip slip"), are rejected.
+func extractTarget(root, name string) (string, string, error) {
+    name = strings.ReplaceAll(name, `\`, "/")
+    if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+        return "", "", errUnsafePath
+    }
+    var segments []string
+    for _, segment := range strings.Split(name, "/") {
+        switch segment {
+        case "", ".":
+            continue
+        case "..":
+            return "", "", errUnsafePath
+        }
+        segments = append(segments, segment)
+    }
+    if len(segments) == 0 {
+        return "", "", fmt.Errorf("invalid entry name %q", name)
+    }
+
+    base := segments[len(segments)-1]
+    if err := validName(base); err != nil {
+        return "", "", fmt.Errorf("invalid entry name %q: %w", name, err)
+    }
+    folder, err := normalizeFolder(path.Join(append([]string{root}, segments[:len(segments)-1]...)...))
+    if err != nil {
+        return "", "", fmt.Errorf("invalid entry name %q: %w", name, err)
+    }
+    return folder, base, nil
+}
+
+// skipEntry reports whether an entry is operating system clutter rather
+// than a file, such as the resource forks macOS adds to ZIP files
+func skipEntry(name string) bool {
+    return strings.HasPrefix(name, "__MACOSX/") || path.Base(name) == ".DS_Store"
+}
+
+// budgetReader fails once more than its shared budget has been read, so a
+// lying archive cannot expand beyond the size limit
+type budgetReader struct {
+    r      io.Reader
+    budget *int64
+}
+
+func (b budgetReader) Read(p []byte) (int, error) {
+    n, err := b.r.Read(p)
+    *b.budget -= int64(n)
+    if *b.budget < 0 {
+        return n, errArchiveTooLarge
+    }
+    return n, err
+}
+
+// startExtraction queues the extraction of a freshly uploaded archive and
+// answers 202 with the extraction, whose progress is at status_url
+func startExtraction(w http.ResponseWriter, archive models.File) {
+    extraction, err := models.CreateExtraction(models.Extraction{
+        UserID:      archive.UserID,
+        OrgID:       archive.OrgID,
+        ArchiveID:   &archive.ID,
+        ArchiveName: archive.Name,
+        Folder:      archive.Folder,
+    })
+    if err == nil {
+        err = jobs.Enqueue(TypeExtractArchive, map[string]int64{"extraction_id": extraction.ID})
+    }
+    if err != nil {
+        log.Println("Error queueing extraction:", err)
+        http.Error(w, "Archive uploaded but its extraction could not be started", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "extraction": extraction,
+        "status_url": fmt.Sprintf("/extractions/%d", extraction.ID),
+    })
+}
+
+// GetExtraction reports the status and progress of one of the user's extractions
+func GetExtraction(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    id, err := strconv.ParseInt(mux.Vars(r)["extraction_id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Extraction not found", http.StatusNotFound)
+        return
+    }
+    extraction, err := models.GetExtraction(id)
+    if err != nil || extraction.UserID != user.ID {
+        http.Error(w, "Extraction not found", http.StatusNotFound)
+        return
+    }
+    json.NewEncoder(w).Encode(extraction)
+}
+
+// ExtractArchive is the job handler that unpacks an archive. Each entry
+// becomes a file in the folder the archive was uploaded to, below the
+// entry's own folders, and goes through the same type policy, virus scan
+// and quota as any upload; entries refused by the type policy or the scan
+// are counted as skipped. The archive is deleted once it is unpacked.
+// Failures are final, since retrying would duplicate the files already
+// extracted.
+func ExtractArchive(payload json.RawMessage) error {
+    var p struct {
+        ExtractionID int64 `json:"extraction_id"`
+    }
+    if err := json.Unmarshal(payload, &p); err != nil {
+        return jobs.Permanent(err)
+    }
+    extraction, err := models.GetExtraction(p.ExtractionID)
+    if err == pgx.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    switch extraction.Status {
+    case models.ExtractionDone, models.ExtractionFailed:
+        return nil
+    case models.ExtractionRunning:
+        // A worker stopped partway through; starting over would duplicate files
+        err = errors.New("extraction was interrupted")
+    default:
+        extraction.Status = models.ExtractionRunning
+        if err := models.UpdateExtraction(extraction); err != nil {
+            return err
+        }
+        err = extract(&extraction)
+    }
+
+    if err != nil {
+        extraction.Status, extraction.Error = models.ExtractionFailed, err.Error()
+        if err := models.UpdateExtraction(extraction); err != nil {
+            log.Println("Error saving extraction status:", err)
+        }
+        return jobs.Permanent(err)
+    }
+    extraction.Status = models.ExtractionDone
+    return models.UpdateExtraction(extraction)
+}
+
+// extract unpacks the archive of an extraction, updating its progress
+func extract(extraction *models.Extraction) error {
+    if extraction.ArchiveID == nil {
+        return errors.New("archive was deleted")
+    }
+    archive, err := models.GetFileByID(strconv.Itoa(*extraction.ArchiveID))
+    if err != nil {
+        return errors.New("archive was deleted")
+    }
+    if archive.ScanStatus == models.ScanInfected {
+        return errInfected
+    }
+
+    content, err := models.OpenContent(archive)
+    if err != nil {
+        return err
+    }
+    defer content.Close()
+
+    budget := extractMaxBytes()
+    add := func(name string, r io.Reader) error {
+        err := extractEntry(extraction, name, budgetReader{r: r, budget: &budget})
+        // Storage backends may not wrap the reader's error
+        if budget < 0 {
+            return errArchiveTooLarge
+        }
+        return err
+    }
+    if archiveKind(archive.Name) == "zip" {
+        err = extractZip(content, archive.Size, add)
+    } else {
+        err = extractTarGzip(content, add)
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := removeFile(archive); err != nil {
+        log.Println("Error deleting extracted archive:", err)
+    }
+    return nil
+}
+
+// extractZip passes each regular file of a ZIP archive to add. ZIP files
+// keep their directory at the end, so the archive is first copied to the
+// staging directory for random access.
+func extractZip(content io.Reader, size int64, add func(string, io.Reader) error) error {
+    if err := os.MkdirAll(utils.StagingDir(), 0o755); err != nil {
+        return err
+    }
+    staged, err := os.CreateTemp(utils.StagingDir(), "extract-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(staged.Name())
+    defer staged.Close()
+    if _, err := io.Copy(staged, content); err != nil {
+        return err
+    }
+
+    zr, err := zip.NewReader(staged, size)
+    if err != nil {
+        return fmt.Errorf("invalid zip archive: %w", err)
+    }
+    if len(zr.File) > extractMaxEntries() {
+        return errTooManyEntries
+    }
+    var declared uint64
+    for _, f := range zr.File {
+        declared += f.UncompressedSize64
+    }
+    if declared > uint64(extractMaxBytes()) {
+        return errArchiveTooLarge
+    }
+
+    for _, f := range zr.File {
+        if !f.Mode().IsRegular() || skipEntry(f.Name) {
+            continue
+        }
+        r, err := f.Open()
+        if err != nil {
+            return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+        }
+        err = add(f.Name, r)
+        r.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// extractTarGzip passes each regular file of a tar.gz archive to add,
+// streaming it straight from storage
+func extractTarGzip(content io.Reader, add func(string, io.Reader) error) error {
+    gz, err := gzip.NewReader(content)
+    if err != nil {
+        return fmt.Errorf("invalid tar.gz archive: %w", err)
+    }
+    defer gz.Close()
+
+    tr := tar.NewReader(gz)
+    entries := 0
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("invalid tar.gz archive: %w", err)
+        }
+        if entries++; entries > extractMaxEntries() {
+            return errTooManyEntries
+        }
+        if header.Typeflag != tar.TypeReg || skipEntry(header.Name) {
+            continue
+        }
+        if err := add(header.Name, tr); err != nil {
+            return err
+        }
+    }
+}
+
+// extractEntry stores one archive entry as a file and records the progress
+func extractEntry(extraction *models.Extraction, name string, r io.Reader) error {
+    folder, base, err := extractTarget(extraction.Folder, name)
+    if err != nil {
+        return err
+    }
+
+    file, err := storeFile(extraction.UserID, base, r, storeOptions{
+        OrgID:  orgIDValue(extraction.OrgID),
+        Folder: folder,
+    })
+    switch {
+    case errors.Is(err, errContentTypeBlocked), errors.Is(err, errInfected):
+        extraction.FilesSkipped++
+    case errors.Is(err, errArchiveTooLarge), errors.Is(err, models.ErrQuotaExceeded):
+        return err
+    case err != nil:
+        return fmt.Errorf("storing %q: %w", name, err)
+    default:
+        extraction.FilesExtracted++
+        extraction.BytesExtracted += file.Size
+    }
+    return models.UpdateExtraction(*extraction)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "bytes"
+    "compress/gzip"
+    "io"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// TestExtractTarget tests where archive entries land and that entries
+// escaping the target folder are rejected
+func TestExtractTarget(t *testing.T) {
+    cases := map[string][2]string{
+        "report.pdf":           {"/projects", "report.pdf"},
+        "apollo/docs/plan.txt": {"/projects/apollo/docs", "plan.txt"},
+        "./apollo//notes.txt":  {"/projects/apollo", "notes.txt"},
+        `apollo\windows\a.txt`: {"/projects/apollo/windows", "a.txt"},
+    }
+    for name, expected := range cases {
+        folder, base, err := extractTarget("/projects", name)
+        if err != nil || folder != expected[0] || base != expected[1] {
+            t.Errorf("%q: expected %v, got %s %s %v", name, expected, folder, base, err)
+        }
+    }
+
+    for _, name := range []string{"../evil.sh", "apollo/../../evil.sh", "/etc/passwd", `..\evil.exe`, "C:/evil.exe", "a/\x01.txt"} {
+        if _, _, err := extractTarget("/projects", name); err == nil {
+            t.Errorf("%q: expected error", name)
+        }
+    }
+}
+
+// TestArchiveKind tests recognizing archives by name
+func TestArchiveKind(t *testing.T) {
+    cases := map[string]string{"site.ZIP": "zip", "backup.tar.gz": "tar.gz", "backup.tgz": "tar.gz", "notes.txt": "", "archive.tar": ""}
+    for name, expected := range cases {
+        if kind := archiveKind(name); kind != expected {
+            t.Errorf("%q: expected %q, got %q", name, expected, kind)
+        }
+    }
+}
+
+// collect returns an add function recording the entries it is given
+func collect(entries map[string]string) func(string, io.Reader) error {
+    return func(name string, r io.Reader) error {
+        content, err := io.ReadAll(r)
+        entries[name] = string(content)
+        return err
+    }
+}
+
+// TestExtractZip tests reading the files of a ZIP archive and its limits
+func TestExtractZip(t *testing.T) {
+    t.Setenv("UPLOAD_STAGING_DIR", t.TempDir())
+
+    var buf bytes.Buffer
+    zw := zip.NewWriter(&buf)
+    for _, name := range []string{"apollo/", "apollo/plan.txt", "__MACOSX/apollo/._plan.txt", "readme.md"} {
+        w, _ := zw.Create(name)
+        if !strings.HasSuffix(name, "/") {
+            w.Write([]byte("content of " + name))
+        }
+    }
+    zw.Close()
+
+    entries := map[string]string{}
+    if err := extractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), collect(entries)); err != nil {
+        t.Fatal(err)
+    }
+    expected := map[string]string{"apollo/plan.txt": "content of apollo/plan.txt", "readme.md": "content of readme.md"}
+    if !reflect.DeepEqual(entries, expected) {
+        t.Errorf("Expected %v, got %v", expected, entries)
+    }
+
+    t.Setenv("EXTRACT_MAX_ENTRIES", "2")
+    if err := extractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), collect(map[string]string{})); err != errTooManyEntries {
+        t.Errorf("Expected errTooManyEntries, got %v", err)
+    }
+    t.Setenv("EXTRACT_MAX_ENTRIES", "")
+    t.Setenv("EXTRACT_MAX_BYTES", "10")
+    if err := extractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), collect(map[string]string{})); err != errArchiveTooLarge {
+        t.Errorf("Expected errArchiveTooLarge, got %v", err)
+    }
+}
+
+// TestExtractTarGzip tests reading the regular files of a tar.gz archive
+func TestExtractTarGzip(t *testing.T) {
+    var buf bytes.Buffer
+    gz := gzip.NewWriter(&buf)
+    tw := tar.NewWriter(gz)
+    tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "apollo/", Mode: 0o755})
+    tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "apollo/plan.txt", Mode: 0o644, Size: 5})
+    tw.Write([]byte("hello"))
+    tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "apollo/passwd", Linkname: "/etc/passwd"})
+    tw.Close()
+    gz.Close()
+
+    entries := map[string]string{}
+    if err := extractTarGzip(bytes.NewReader(buf.Bytes()), collect(entries)); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(entries, map[string]string{"apollo/plan.txt": "hello"}) {
+        t.Errorf("Unexpected entries %v", entries)
+    }
+
+    if err := extractTarGzip(strings.NewReader("not gzip"), collect(entries)); err == nil {
+        t.Errorf("Expected an error for an invalid archive")
+    }
+}
+
+// TestBudgetReader tests that reading past the shared budget fails
+func TestBudgetReader(t *testing.T) {
+    budget := int64(8)
+    if _, err := io.ReadAll(budgetReader{r: strings.NewReader("12345"), budget: &budget}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := io.ReadAll(budgetReader{r: strings.NewReader("12345"), budget: &budget}); err != errArchiveTooLarge {
+        t.Errorf("Expected errArchiveTooLarge, got %v", err)
+    }
+}
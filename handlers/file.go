@@ -1,40 +1,86 @@
 package handlers
 
 import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "fmt"
+    "io"
+    "log"
+    "mime"
     "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
     "time"
-    "github.com/gorilla/mux"
+    "file-sharing-system/jobs"
     "file-sharing-system/models" // This should correctly import your models package
     "file-sharing-system/utils"
 )
 
 
+// UploadFile stores a multipart upload in the folder given by ?folder= (the
+// top by default). With ?extract=true a ZIP or tar.gz archive is unpacked
+// into that folder in the background instead, and the response describes
+// the extraction.
 func UploadFile(w http.ResponseWriter, r *http.Request) {
-    file, handler, err := r.FormFile("file")
+    user, _ := currentUser(r)
+    orgID, ok := orgParam(w, r)
+    if !ok {
+        return
+    }
+    folder, err := normalizeFolder(r.URL.Query().Get("folder"))
+    if err != nil {
+        http.Error(w, "Invalid folder: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    extract := r.URL.Query().Get("extract") == "true"
+
+    usage, err := workspaceUsage(user.ID, orgID)
+    if err != nil {
+        http.Error(w, "Unable to check storage quota", http.StatusInternalServerError)
+        return
+    }
+    if !checkQuota(w, r, usage) {
+        return
+    }
+
+    // Stream the file part instead of buffering the whole form
+    file, filename, fields, err := filePart(r)
     if err != nil {
         http.Error(w, "Invalid file", http.StatusBadRequest)
         return
     }
     defer file.Close()
+    auditDetail(r, "name", filename)
 
-    // Upload to S3 or Local Storage
-    fileURL, err := utils.UploadToS3(file, handler.Filename)
+    encryption, err := parseClientEncryption(fields["encryption_header"], fields["encrypted_metadata"])
     if err != nil {
-        http.Error(w, "Unable to upload file", http.StatusInternalServerError)
+        http.Error(w, "Invalid encryption header", http.StatusBadRequest)
+        return
+    }
+    if extract && (archiveKind(filename) == "" || encryption.enabled()) {
+        http.Error(w, "Only unencrypted .zip, .tar.gz and .tgz archives can be extracted", http.StatusUnsupportedMediaType)
         return
     }
 
-    // Save file metadata in the database
-    fileMetadata := models.File{
-        Name:      handler.Filename,
-        Size:      handler.Size,
-        URL:       fileURL,
-        UploadDate: time.Now(),
+    // Upload to S3 or Local Storage, counting bytes against the remaining quota
+    counter := &quotaReader{r: file, limit: usage.BytesRemaining}
+    stored, err := storeFile(user.ID, filename, counter, storeOptions{Encryption: encryption, OrgID: orgID, Folder: folder})
+    if counter.n > counter.limit {
+        err = models.ErrQuotaExceeded
+    }
+    if err != nil {
+        writeStoreError(w, err)
+        return
     }
-    if err := models.SaveFileMetadata(fileMetadata); err != nil {
-        http.Error(w, "Error saving file metadata", http.StatusInternalServerError)
+    auditFile(r, stored)
+    if extract {
+        startExtraction(w, stored)
         return
     }
 
@@ -42,27 +88,430 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
     fmt.Fprintf(w, "File uploaded successfully")
 }
 
+var (
+    errChecksumMismatch   = errors.New("checksum mismatch")
+    errContentTypeBlocked = errors.New("content type not allowed")
+    errInfected           = errors.New("file is infected")
+)
+
+// storeOptions are the optional parts of a storeFile call
+type storeOptions struct {
+    // Checksum is the expected hex SHA-256 of the content
+    Checksum string
+    // Encryption is set when the content was encrypted by the client
+    Encryption clientEncryption
+    // OrgID stores the file in an organization's workspace when set
+    OrgID int
+    // Folder places the file in a folder instead of at the top
+    Folder string
+}
+
+// storeFile streams content into the storage backend, encrypted when
+// encryption at rest is enabled, and records its metadata against the
+// user's quota. The content type is sniffed from the first bytes and
+// checked against the user's content type policy. When a checksum is
+// given, the SHA-256 of the stored content must match it or the object is
+// discarded. With virus scanning configured the file is either scanned
+// before it is recorded or queued for a background scan. Client-encrypted
+// content is opaque, so it is neither sniffed, scanned nor thumbnailed.
+func storeFile(userID int, filename string, content io.Reader, opts storeOptions) (models.File, error) {
+    buffered := bufio.NewReaderSize(content, utils.SniffLen)
+    contentType := "application/octet-stream"
+    if !opts.Encryption.enabled() {
+        head, err := buffered.Peek(utils.SniffLen)
+        if err != nil && err != io.EOF {
+            return models.File{}, err
+        }
+        contentType = utils.DetectContentType(head, filename)
+    }
+
+    policy, err := models.ContentTypePolicyForUser(userID)
+    if err != nil {
+        return models.File{}, err
+    }
+    if !policy.Allows(contentType) {
+        return models.File{}, fmt.Errorf("%w: %s", errContentTypeBlocked, contentType)
+    }
+
+    hash := sha256.New()
+    counter := &countingReader{r: io.TeeReader(buffered, hash)}
+
+    // Encrypted at rest with a fresh data key when a master key is configured
+    storageKey := utils.NewStorageKey(userID, filename)
+    fileURL, keyID, wrappedKey, err := models.PutContent(storageKey, counter)
+    if err != nil {
+        return models.File{}, err
+    }
+
+    file := models.File{
+        UserID:      userID,
+        Name:        filename,
+        Size:        counter.n,
+        ContentType: contentType,
+        URL:         fileURL,
+        StorageKey:  storageKey,
+        Checksum:    hex.EncodeToString(hash.Sum(nil)),
+        KeyID:       keyID,
+        WrappedKey:  wrappedKey,
+        UploadDate:  time.Now(),
+        Folder:      opts.Folder,
+    }
+    if opts.OrgID != 0 {
+        file.OrgID = &opts.OrgID
+    }
+    if opts.Encryption.enabled() {
+        file.ClientEncrypted = true
+        file.EncryptionHeader = opts.Encryption.Header
+        file.EncryptedMetadata = opts.Encryption.Metadata
+    }
+    if opts.Checksum != "" && !strings.EqualFold(opts.Checksum, file.Checksum) {
+        utils.GetStorage().Delete(storageKey)
+        return models.File{}, errChecksumMismatch
+    }
+
+    file.ScanStatus = models.ScanSkipped
+    if jobs.ScanningEnabled() && !file.ClientEncrypted {
+        file.ScanStatus = models.ScanPending
+        if !jobs.AsyncScanning() {
+            result, err := jobs.ScanObject(file)
+            if err != nil {
+                utils.GetStorage().Delete(storageKey)
+                return models.File{}, err
+            }
+            if result.Infected {
+                utils.GetStorage().Delete(storageKey)
+                return models.File{}, fmt.Errorf("%w: %s", errInfected, result.Signature)
+            }
+            file.ScanStatus = models.ScanClean
+        }
+    }
+
+    // Thumbnails are generated in the background once the file is accepted;
+    // opaque ciphertext has none
+    file.PreviewStatus = models.PreviewNone
+    if !file.ClientEncrypted && utils.CanThumbnail(file.ContentType) {
+        file.PreviewStatus = models.PreviewPending
+    }
+
+    file.ID, err = models.SaveFileMetadata(file)
+    if err != nil {
+        utils.GetStorage().Delete(storageKey)
+        return models.File{}, err
+    }
+    if file.ScanStatus == models.ScanPending {
+        if err := jobs.EnqueueScan(file); err != nil {
+            log.Println("Error queueing virus scan:", err)
+        }
+    }
+    // Files awaiting a background scan are accepted, and get thumbnails,
+    // once they are found clean
+    if file.ScanStatus != models.ScanPending {
+        jobs.FileAccepted(file)
+    }
+    return file, nil
+}
+
+// writeStoreError answers with the status matching a storeFile error
+func writeStoreError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, models.ErrQuotaExceeded):
+        http.Error(w, "Not enough storage quota remaining for this file", http.StatusInsufficientStorage)
+    case errors.Is(err, errContentTypeBlocked):
+        http.Error(w, "File type is not allowed", http.StatusUnsupportedMediaType)
+    case errors.Is(err, errInfected):
+        http.Error(w, "File rejected by virus scan: "+strings.TrimPrefix(err.Error(), errInfected.Error()+": "), http.StatusUnprocessableEntity)
+    case errors.Is(err, errChecksumMismatch):
+        http.Error(w, "Stored file does not match the expected sha256", http.StatusUnprocessableEntity)
+    default:
+        http.Error(w, "Unable to store file", http.StatusInternalServerError)
+    }
+}
+
+// checkScanStatus answers 409 for files still being scanned and 403 for
+// infected files, returning false when access must be refused.
+func checkScanStatus(w http.ResponseWriter, file models.File) bool {
+    if file.ScanAllowsAccess() {
+        return true
+    }
+    if file.ScanStatus == models.ScanInfected {
+        http.Error(w, "File is infected and cannot be accessed", http.StatusForbidden)
+        return false
+    }
+    http.Error(w, "File is still being scanned for viruses", http.StatusConflict)
+    return false
+}
+
+// saveStagedFile moves a fully received file from local staging into storage
+func saveStagedFile(userID int, filename, path string, opts storeOptions) (models.File, error) {
+    staged, err := os.Open(path)
+    if err != nil {
+        return models.File{}, err
+    }
+    defer staged.Close()
+
+    return storeFile(userID, filename, staged, opts)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+    r io.Reader
+    n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.n += int64(n)
+    return n, err
+}
+
+// maxFormFieldSize limits the form fields read before the file part
+const maxFormFieldSize = 128 << 10
+
+// filePart returns the "file" part of a multipart upload without reading the
+// rest of the body, along with the form fields sent before it.
+func filePart(r *http.Request) (io.ReadCloser, string, map[string]string, error) {
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return nil, "", nil, err
+    }
+    fields := make(map[string]string)
+    for {
+        part, err := reader.NextPart()
+        if err != nil {
+            return nil, "", nil, err
+        }
+        if part.FormName() == "file" && part.FileName() != "" {
+            return part, filepath.Base(part.FileName()), fields, nil
+        }
+        if part.FileName() == "" {
+            value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+            if err != nil || len(value) > maxFormFieldSize {
+                part.Close()
+                return nil, "", nil, errors.New("form field too large")
+            }
+            fields[part.FormName()] = string(value)
+        }
+        part.Close()
+    }
+}
+
+const (
+    defaultPageSize = 50
+    maxPageSize     = 1000
+)
+
+// GetFiles lists the authenticated user's files a page at a time. sort is
+// "date" (the default, newest first), "name" or "size", and order ("asc" or
+// "desc") overrides its direction. name filters by name prefix, type by
+// content type ("image/*" for a family), tag by tags and meta.<key> by
+// metadata values. Pass next_cursor from a response as cursor, with the
+// same sort, to fetch the following page. org lists an organization's
+// files instead.
 func GetFiles(w http.ResponseWriter, r *http.Request) {
-    // Retrieve all files for the authenticated user
-    files, err := models.GetAllFiles()
+    user, _ := currentUser(r)
+
+    opts, err := parseListOptions(r.URL.Query())
+    if err != nil {
+        http.Error(w, "Invalid listing parameters: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    orgID, ok := orgParam(w, r)
+    if !ok {
+        return
+    }
+    opts.UserID, opts.OrgID = user.ID, orgID
+
+    page, err := models.ListFiles(opts)
+    if errors.Is(err, models.ErrInvalidCursor) {
+        http.Error(w, "Invalid cursor", http.StatusBadRequest)
+        return
+    }
     if err != nil {
         http.Error(w, "Unable to retrieve files", http.StatusInternalServerError)
         return
     }
-    
-    json.NewEncoder(w).Encode(files)
+    for i := range page.Files {
+        page.Files[i].ThumbnailURL = thumbnailURL(page.Files[i])
+    }
+
+    json.NewEncoder(w).Encode(page)
 }
 
-func ShareFile(w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    fileID := vars["file_id"]
+// parseListOptions reads the listing parameters, leaving UserID unset
+func parseListOptions(query url.Values) (models.ListOptions, error) {
+    opts := models.ListOptions{
+        Sort:        query.Get("sort"),
+        NamePrefix:  query.Get("name"),
+        ContentType: strings.ToLower(strings.TrimSpace(query.Get("type"))),
+        Cursor:      query.Get("cursor"),
+        Limit:       defaultPageSize,
+    }
+    if opts.Sort == "" {
+        opts.Sort = "date"
+    }
+    var err error
+    if opts.Tags, opts.Metadata, err = parseDetailFilters(query); err != nil {
+        return opts, err
+    }
+    switch opts.Sort {
+    case "date", "size":
+        opts.Descending = true
+    case "name":
+    default:
+        return opts, errors.New("sort must be date, name or size")
+    }
+
+    switch query.Get("order") {
+    case "":
+    case "asc":
+        opts.Descending = false
+    case "desc":
+        opts.Descending = true
+    default:
+        return opts, errors.New("order must be asc or desc")
+    }
+
+    if value := query.Get("limit"); value != "" {
+        limit, err := strconv.Atoi(value)
+        if err != nil || limit < 1 {
+            return opts, errors.New("invalid limit")
+        }
+        opts.Limit = min(limit, maxPageSize)
+    }
+    return opts, nil
+}
+
+// DownloadFile streams a file's content with the content type detected at
+// upload. A single byte range may be requested with the Range header.
+func DownloadFile(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleViewer)
+    if !ok || !checkScanStatus(w, file) {
+        return
+    }
+    serveContent(w, r, file)
+}
+
+// serveContent writes a file's content as a download, honouring a Range
+// header for a single byte range
+func serveContent(w http.ResponseWriter, r *http.Request, file models.File) {
+    offset, length, partial, err := parseRange(r.Header.Get("Range"), file.Size)
+    if err != nil {
+        w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+        http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+        return
+    }
 
-    file, err := models.GetFileByID(fileID)
+    content, err := models.OpenContentRange(file, offset, length)
     if err != nil {
-        http.Error(w, "File not found", http.StatusNotFound)
+        http.Error(w, "Unable to read file", http.StatusInternalServerError)
+        return
+    }
+    defer content.Close()
+
+    contentType := file.ContentType
+    if contentType == "" {
+        contentType = "application/octet-stream"
+    }
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+    w.Header().Set("Accept-Ranges", "bytes")
+    w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+    if file.ClientEncrypted {
+        setClientEncryptionHeaders(w, file.EncryptionHeader, file.EncryptedMetadata)
+    }
+    if partial {
+        w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, file.Size))
+        w.WriteHeader(http.StatusPartialContent)
+    }
+    io.Copy(w, content)
+}
+
+var errInvalidRange = errors.New("invalid range")
+
+// parseRange interprets a Range header for a single range of a size byte
+// file, returning the whole file when the header is absent.
+func parseRange(header string, size int64) (offset, length int64, partial bool, err error) {
+    if header == "" {
+        return 0, size, false, nil
+    }
+    spec, ok := strings.CutPrefix(header, "bytes=")
+    if !ok || strings.Contains(spec, ",") {
+        return 0, 0, false, errInvalidRange
+    }
+    startText, endText, ok := strings.Cut(strings.TrimSpace(spec), "-")
+    if !ok {
+        return 0, 0, false, errInvalidRange
+    }
+
+    if startText == "" {
+        // Suffix range: the last n bytes
+        n, err := strconv.ParseInt(endText, 10, 64)
+        if err != nil || n <= 0 || size == 0 {
+            return 0, 0, false, errInvalidRange
+        }
+        if n > size {
+            n = size
+        }
+        return size - n, n, true, nil
+    }
+
+    start, err := strconv.ParseInt(startText, 10, 64)
+    if err != nil || start < 0 || start >= size {
+        return 0, 0, false, errInvalidRange
+    }
+    end := size - 1
+    if endText != "" {
+        end, err = strconv.ParseInt(endText, 10, 64)
+        if err != nil || end < start {
+            return 0, 0, false, errInvalidRange
+        }
+        if end >= size {
+            end = size - 1
+        }
+    }
+    return start, end - start + 1, true, nil
+}
+
+// ShareFile returns a public link to a file, which takes the owner role
+func ShareFile(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleOwner)
+    if !ok || !checkScanStatus(w, file) {
         return
     }
 
     sharedURL := fmt.Sprintf("https://my-file-sharing-app.com/files/%d", file.ID) // Use %d for integers
     json.NewEncoder(w).Encode(sharedURL)
 }
+
+// DeleteFile removes a file and frees its quota, which takes the owner role
+func DeleteFile(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleOwner)
+    if !ok {
+        return
+    }
+
+    if err := removeFile(file); err != nil {
+        http.Error(w, "Unable to delete file", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// removeFile deletes a file's row along with its stored content and thumbnails
+func removeFile(file models.File) error {
+    // Thumbnail rows go with the file, so look up their objects first
+    thumbs, err := models.GetThumbnails(file.ID)
+    if err != nil {
+        return err
+    }
+    if err := models.DeleteFile(file); err != nil {
+        return err
+    }
+    if file.StorageKey != "" {
+        utils.GetStorage().Delete(file.StorageKey)
+    }
+    deleteThumbnails(thumbs)
+    notifyWebhooks(models.WebhookFileDeleted, file, map[string]interface{}{"file": file})
+    return nil
+}
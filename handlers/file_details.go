@@ -0,0 +1,280 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+// Limits on the details users attach to a file
+const (
+    maxTags              = 50
+    maxTagLength         = 64
+    maxDescriptionLength = 10000
+    maxMetadataKeys      = 50
+    maxMetadataKeyLength = 64
+    maxMetadataValueSize = 1024
+    maxNameLength        = 255
+    maxFolderLength      = 1024
+)
+
+// patchFileRequest is the body of PATCH /files/{id}. Absent fields are left
+// unchanged; tags replace the current tags, and metadata is merged into the
+// current metadata with null values removing keys. OnConflict is the policy
+// for a new name or folder clashing with another file (default "fail").
+type patchFileRequest struct {
+    Name        *string            `json:"name"`
+    Folder      *string            `json:"folder"`
+    OnConflict  string             `json:"on_conflict"`
+    Tags        *[]string          `json:"tags"`
+    Description *string            `json:"description"`
+    Metadata    map[string]*string `json:"metadata"`
+}
+
+// validName checks a file name, or one segment of a folder path
+func validName(name string) error {
+    if name == "" || name == "." || name == ".." || len(name) > maxNameLength {
+        return fmt.Errorf("names must be 1 to %d bytes and not . or ..", maxNameLength)
+    }
+    if strings.ContainsAny(name, `/\`) || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+        return errors.New("names must not contain slashes or control characters")
+    }
+    return nil
+}
+
+// normalizeFolder turns a folder path into the stored form: "/" followed by
+// segments separated by single slashes, without a trailing slash
+func normalizeFolder(folder string) (string, error) {
+    var segments []string
+    for _, segment := range strings.Split(folder, "/") {
+        if segment == "" {
+            continue
+        }
+        if err := validName(segment); err != nil {
+            return "", err
+        }
+        segments = append(segments, segment)
+    }
+    normalized := "/" + strings.Join(segments, "/")
+    if len(normalized) > maxFolderLength {
+        return "", fmt.Errorf("folders must be at most %d bytes", maxFolderLength)
+    }
+    return normalized, nil
+}
+
+// normalizeTags trims and lowercases tags and drops duplicates, so "Apollo"
+// and "apollo " are the same tag
+func normalizeTags(tags []string) ([]string, error) {
+    seen := make(map[string]bool)
+    normalized := []string{}
+    for _, tag := range tags {
+        tag = strings.ToLower(strings.TrimSpace(tag))
+        if tag == "" || seen[tag] {
+            continue
+        }
+        if utf8.RuneCountInString(tag) > maxTagLength || strings.Contains(tag, ",") {
+            return nil, fmt.Errorf("tags must be at most %d characters without commas", maxTagLength)
+        }
+        seen[tag] = true
+        normalized = append(normalized, tag)
+    }
+    if len(normalized) > maxTags {
+        return nil, fmt.Errorf("a file can have at most %d tags", maxTags)
+    }
+    sort.Strings(normalized)
+    return normalized, nil
+}
+
+// applyPatch updates file with the changes in req, validating the result
+func applyPatch(file *models.File, req patchFileRequest) error {
+    if req.Name != nil {
+        name := strings.TrimSpace(*req.Name)
+        if err := validName(name); err != nil {
+            return err
+        }
+        file.Name = name
+    }
+
+    if req.Folder != nil {
+        folder, err := normalizeFolder(*req.Folder)
+        if err != nil {
+            return err
+        }
+        file.Folder = folder
+    }
+
+    if req.Tags != nil {
+        tags, err := normalizeTags(*req.Tags)
+        if err != nil {
+            return err
+        }
+        file.Tags = tags
+    }
+
+    if req.Description != nil {
+        description := strings.TrimSpace(*req.Description)
+        if utf8.RuneCountInString(description) > maxDescriptionLength {
+            return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+        }
+        file.Description = description
+    }
+
+    if len(req.Metadata) > 0 {
+        metadata := make(map[string]string, len(file.Metadata)+len(req.Metadata))
+        for key, value := range file.Metadata {
+            metadata[key] = value
+        }
+        for key, value := range req.Metadata {
+            if key == "" || utf8.RuneCountInString(key) > maxMetadataKeyLength {
+                return fmt.Errorf("metadata keys must be 1 to %d characters", maxMetadataKeyLength)
+            }
+            if value == nil {
+                delete(metadata, key)
+                continue
+            }
+            if len(*value) > maxMetadataValueSize {
+                return fmt.Errorf("metadata values must be at most %d bytes", maxMetadataValueSize)
+            }
+            metadata[key] = *value
+        }
+        if len(metadata) > maxMetadataKeys {
+            return fmt.Errorf("a file can have at most %d metadata keys", maxMetadataKeys)
+        }
+        file.Metadata = metadata
+    }
+    return nil
+}
+
+// parseDetailFilters reads tag filters, given as repeated or comma separated
+// tag parameters, and metadata filters, given as meta.<key>=<value>
+func parseDetailFilters(query url.Values) ([]string, map[string]string, error) {
+    var tags []string
+    for _, value := range query["tag"] {
+        tags = append(tags, strings.Split(value, ",")...)
+    }
+    tags, err := normalizeTags(tags)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var metadata map[string]string
+    for param, values := range query {
+        if key, ok := strings.CutPrefix(param, "meta."); ok && key != "" {
+            if metadata == nil {
+                metadata = make(map[string]string)
+            }
+            metadata[key] = values[0]
+        }
+    }
+    return tags, metadata, nil
+}
+
+// fileETag identifies the version of a file's details, for If-Match
+func fileETag(file models.File) string {
+    return fmt.Sprintf(`"%d-%d"`, file.ID, file.Version)
+}
+
+// ifMatch reports whether an If-Match header allows changing a resource
+// with the given ETag. A missing header matches anything.
+func ifMatch(header, etag string) bool {
+    header = strings.TrimSpace(header)
+    if header == "" || header == "*" {
+        return true
+    }
+    for _, candidate := range strings.Split(header, ",") {
+        // If-Match uses strong comparison, so weak tags never match
+        if strings.TrimSpace(candidate) == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// GetFile returns the details of a file the user can view
+func GetFile(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleViewer)
+    if !ok {
+        return
+    }
+
+    w.Header().Set("ETag", fileETag(file))
+    json.NewEncoder(w).Encode(file)
+}
+
+// PatchFile renames or moves a file and edits its tags, description and
+// metadata, which takes the editor role. When an If-Match header is sent,
+// the change only applies if the file is still at that version.
+func PatchFile(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleEditor)
+    if !ok {
+        return
+    }
+    if !ifMatch(r.Header.Get("If-Match"), fileETag(file)) {
+        w.Header().Set("ETag", fileETag(file))
+        http.Error(w, "File has been modified", http.StatusPreconditionFailed)
+        return
+    }
+
+    var req patchFileRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid file update", http.StatusBadRequest)
+        return
+    }
+    policy := req.OnConflict
+    switch policy {
+    case "":
+        policy = models.ConflictFail
+    case models.ConflictFail, models.ConflictSuffix, models.ConflictOverwrite:
+    default:
+        http.Error(w, "Invalid file update: on_conflict must be fail, suffix or overwrite", http.StatusUnprocessableEntity)
+        return
+    }
+    // Overwriting deletes another file, which only the workspace's owner may do
+    if policy == models.ConflictOverwrite {
+        user, _ := currentUser(r)
+        owns, err := ownsWorkspace(file, user.ID)
+        if err != nil {
+            http.Error(w, "Unable to check permissions", http.StatusInternalServerError)
+            return
+        }
+        if !owns {
+            http.Error(w, "Only the file's owner can overwrite other files", http.StatusForbidden)
+            return
+        }
+    }
+    if err := applyPatch(&file, req); err != nil {
+        http.Error(w, "Invalid file update: "+err.Error(), http.StatusUnprocessableEntity)
+        return
+    }
+
+    update, err := models.UpdateFile(file, policy)
+    switch err {
+    case nil:
+    case models.ErrVersionConflict:
+        http.Error(w, "File has been modified", http.StatusPreconditionFailed)
+        return
+    case models.ErrNameTaken:
+        http.Error(w, "A file with that name already exists in the folder", http.StatusConflict)
+        return
+    default:
+        http.Error(w, "Unable to update file", http.StatusInternalServerError)
+        return
+    }
+    if replaced := update.Replaced; replaced != nil {
+        if replaced.StorageKey != "" {
+            utils.GetStorage().Delete(replaced.StorageKey)
+        }
+        deleteThumbnails(update.ReplacedThumbnails)
+    }
+
+    w.Header().Set("ETag", fileETag(update.File))
+    json.NewEncoder(w).Encode(update.File)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/url"
+    "reflect"
+    "strings"
+    "testing"
+    "file-sharing-system/models"
+)
+
+// TestNormalizeTags tests trimming, lowercasing and deduplicating tags
+func TestNormalizeTags(t *testing.T) {
+    tags, err := normalizeTags([]string{" Apollo", "customer-acme", "apollo", ""})
+    if err != nil || !reflect.DeepEqual(tags, []string{"apollo", "customer-acme"}) {
+        t.Errorf("Unexpected tags %v (%v)", tags, err)
+    }
+    if _, err := normalizeTags([]string{"a,b"}); err == nil {
+        t.Errorf("Expected error for a tag with a comma")
+    }
+    if _, err := normalizeTags([]string{strings.Repeat("x", maxTagLength+1)}); err == nil {
+        t.Errorf("Expected error for a long tag")
+    }
+}
+
+// TestApplyPatch tests replacing tags and merging metadata
+func TestApplyPatch(t *testing.T) {
+    file := models.File{
+        Tags:        []string{"draft"},
+        Description: "Old",
+        Metadata:    map[string]string{"project": "apollo", "customer": "acme"},
+    }
+    var req patchFileRequest
+    json.Unmarshal([]byte(`{"tags":["Final","Q3"],"metadata":{"customer":null,"owner":"finance"}}`), &req)
+
+    if err := applyPatch(&file, req); err != nil {
+        t.Fatalf("Error applying patch: %s", err)
+    }
+    if !reflect.DeepEqual(file.Tags, []string{"final", "q3"}) {
+        t.Errorf("Expected tags to be replaced, got %v", file.Tags)
+    }
+    if file.Description != "Old" {
+        t.Errorf("Expected description to be unchanged, got %q", file.Description)
+    }
+    if !reflect.DeepEqual(file.Metadata, map[string]string{"project": "apollo", "owner": "finance"}) {
+        t.Errorf("Expected metadata to be merged, got %v", file.Metadata)
+    }
+
+    invalid := []string{
+        `{"description":"` + strings.Repeat("x", maxDescriptionLength+1) + `"}`,
+        `{"metadata":{"":"empty key"}}`,
+        `{"metadata":{"notes":"` + strings.Repeat("x", maxMetadataValueSize+1) + `"}}`,
+    }
+    for _, body := range invalid {
+        var req patchFileRequest
+        json.Unmarshal([]byte(body), &req)
+        if err := applyPatch(&models.File{}, req); err == nil {
+            t.Errorf("Expected error for %.40s", body)
+        }
+    }
+}
+
+// TestParseDetailFilters tests tag and metadata filters in the query string
+func TestParseDetailFilters(t *testing.T) {
+    query, _ := url.ParseQuery("tag=Apollo,q3&tag=final&meta.customer=acme&meta.=ignored&name=x")
+    tags, metadata, err := parseDetailFilters(query)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(tags, []string{"apollo", "final", "q3"}) {
+        t.Errorf("Unexpected tag filter %v", tags)
+    }
+    if !reflect.DeepEqual(metadata, map[string]string{"customer": "acme"}) {
+        t.Errorf("Unexpected metadata filter %v", metadata)
+    }
+}
+
+// TestApplyPatchRenameMove tests validating and normalizing a new name and folder
+func TestApplyPatchRenameMove(t *testing.T) {
+    file := models.File{Name: "draft.txt", Folder: "/"}
+    var req patchFileRequest
+    json.Unmarshal([]byte(`{"name":" report.txt ","folder":"projects//apollo/"}`), &req)
+
+    if err := applyPatch(&file, req); err != nil {
+        t.Fatalf("Error applying patch: %s", err)
+    }
+    if file.Name != "report.txt" || file.Folder != "/projects/apollo" {
+        t.Errorf("Expected report.txt in /projects/apollo, got %q in %q", file.Name, file.Folder)
+    }
+
+    invalid := []string{
+        `{"name":""}`,
+        `{"name":".."}`,
+        `{"name":"a/b.txt"}`,
+        `{"name":"a\\b.txt"}`,
+        `{"name":"line\nbreak"}`,
+        `{"name":"` + strings.Repeat("x", maxNameLength+1) + `"}`,
+        `{"folder":"/projects/../etc"}`,
+    }
+    for _, body := range invalid {
+        var req patchFileRequest
+        json.Unmarshal([]byte(body), &req)
+        if err := applyPatch(&models.File{}, req); err == nil {
+            t.Errorf("Expected error for %.40s", body)
+        }
+    }
+}
+
+// TestNormalizeFolder tests the stored form of folder paths
+func TestNormalizeFolder(t *testing.T) {
+    cases := map[string]string{
+        "":            "/",
+        "/":           "/",
+        "docs":        "/docs",
+        "/docs/2026/": "/docs/2026",
+        "//a///b":     "/a/b",
+    }
+    for input, expected := range cases {
+        if folder, err := normalizeFolder(input); err != nil || folder != expected {
+            t.Errorf("%q: expected %q, got %q (%v)", input, expected, folder, err)
+        }
+    }
+}
+
+// TestIfMatch tests If-Match comparison against a file's ETag
+func TestIfMatch(t *testing.T) {
+    etag := fileETag(models.File{ID: 7, Version: 3})
+    if etag != `"7-3"` {
+        t.Fatalf("Unexpected ETag %s", etag)
+    }
+    cases := map[string]bool{
+        ``:             true,
+        `*`:            true,
+        `"7-3"`:        true,
+        `"7-2", "7-3"`: true,
+        `"7-2"`:        false,
+        `W/"7-3"`:      false,
+    }
+    for header, expected := range cases {
+        if ifMatch(header, etag) != expected {
+            t.Errorf("%q: expected %v", header, expected)
+        }
+    }
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+    "file-sharing-system/models"
+)
+
+// TestCheckScanStatus tests that only scanned or unscannable files are served
+func TestCheckScanStatus(t *testing.T) {
+    cases := map[string]int{
+        models.ScanClean:    http.StatusOK,
+        models.ScanSkipped:  http.StatusOK,
+        models.ScanPending:  http.StatusConflict,
+        models.ScanInfected: http.StatusForbidden,
+    }
+    for status, expected := range cases {
+        rr := httptest.NewRecorder()
+        ok := checkScanStatus(rr, models.File{ScanStatus: status})
+        if ok != (expected == http.StatusOK) || rr.Code != expected {
+            t.Errorf("Scan status %s: expected %d, got %d", status, expected, rr.Code)
+        }
+    }
+}
+
+// TestWriteStoreError tests the status codes for upload pipeline failures
+func TestWriteStoreError(t *testing.T) {
+    cases := []struct {
+        err      error
+        expected int
+    }{
+        {models.ErrQuotaExceeded, http.StatusInsufficientStorage},
+        {fmt.Errorf("%w: application/x-msdownload", errContentTypeBlocked), http.StatusUnsupportedMediaType},
+        {fmt.Errorf("%w: Win.Test.EICAR_HDB-1", errInfected), http.StatusUnprocessableEntity},
+        {errChecksumMismatch, http.StatusUnprocessableEntity},
+        {errors.New("connection reset"), http.StatusInternalServerError},
+    }
+    for _, c := range cases {
+        rr := httptest.NewRecorder()
+        writeStoreError(rr, c.err)
+        if rr.Code != c.expected {
+            t.Errorf("%v: expected %d, got %d", c.err, c.expected, rr.Code)
+        }
+    }
+}
+
+// TestParseRange tests single byte ranges in the Range header
+func TestParseRange(t *testing.T) {
+    cases := []struct {
+        header         string
+        offset, length int64
+        partial        bool
+        invalid        bool
+    }{
+        {"", 0, 1000, false, false},
+        {"bytes=0-99", 0, 100, true, false},
+        {"bytes=900-", 900, 100, true, false},
+        {"bytes=-100", 900, 100, true, false},
+        {"bytes=-5000", 0, 1000, true, false},
+        {"bytes=990-2000", 990, 10, true, false},
+        {"bytes=1000-", 0, 0, false, true},
+        {"bytes=5-1", 0, 0, false, true},
+        {"bytes=0-1,5-6", 0, 0, false, true},
+        {"items=0-1", 0, 0, false, true},
+    }
+    for _, c := range cases {
+        offset, length, partial, err := parseRange(c.header, 1000)
+        if c.invalid {
+            if err == nil {
+                t.Errorf("%q: expected invalid range", c.header)
+            }
+            continue
+        }
+        if err != nil || offset != c.offset || length != c.length || partial != c.partial {
+            t.Errorf("%q: expected %d+%d partial=%v, got %d+%d partial=%v (%v)", c.header, c.offset, c.length, c.partial, offset, length, partial, err)
+        }
+    }
+}
+
+// TestParseListOptions tests the sorting, filtering and paging parameters of GetFiles
+func TestParseListOptions(t *testing.T) {
+    opts, err := parseListOptions(url.Values{})
+    if err != nil || opts.Sort != "date" || !opts.Descending || opts.Limit != defaultPageSize {
+        t.Errorf("Expected newest first by default, got %+v (%v)", opts, err)
+    }
+
+    opts, err = parseListOptions(url.Values{"sort": {"name"}, "name": {"Rep"}, "type": {"Image/*"}, "limit": {"5000"}, "cursor": {"abc"}})
+    if err != nil || opts.Descending || opts.NamePrefix != "Rep" || opts.ContentType != "image/*" || opts.Limit != maxPageSize || opts.Cursor != "abc" {
+        t.Errorf("Unexpected options %+v (%v)", opts, err)
+    }
+
+    opts, err = parseListOptions(url.Values{"sort": {"size"}, "order": {"asc"}})
+    if err != nil || opts.Descending {
+        t.Errorf("Expected ascending size order, got %+v (%v)", opts, err)
+    }
+
+    for _, invalid := range []url.Values{{"sort": {"owner"}}, {"order": {"up"}}, {"limit": {"0"}}, {"limit": {"ten"}}} {
+        if _, err := parseListOptions(invalid); err == nil {
+            t.Errorf("%v: expected error", invalid)
+        }
+    }
+}
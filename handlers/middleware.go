@@ -0,0 +1,89 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strings"
+    "file-sharing-system/models"
+    "github.com/dgrijalva/jwt-go"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// Authenticate rejects requests without a valid JWT or API token, taken
+// from the Authorization bearer header or the token cookie set by Login,
+// and stores the authenticated user in the request context.
+func Authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        tokenString := bearerToken(r)
+        if tokenString == "" {
+            http.Error(w, "Missing authentication token", http.StatusUnauthorized)
+            return
+        }
+
+        user, err := userFromToken(tokenString)
+        if err != nil {
+            http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+            return
+        }
+        next.ServeHTTP(w, withUser(r, user))
+    })
+}
+
+var errInvalidToken = errors.New("invalid authentication token")
+
+// userFromToken returns the user a JWT or API token authenticates
+func userFromToken(tokenString string) (models.User, error) {
+    if strings.HasPrefix(tokenString, models.APITokenPrefix) {
+        return models.GetUserByAPIToken(tokenString)
+    }
+
+    claims := &Claims{}
+    token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+            return nil, jwt.ErrSignatureInvalid
+        }
+        return jwtKey, nil
+    })
+    if err != nil || !token.Valid {
+        return models.User{}, errInvalidToken
+    }
+    return models.GetUserByEmail(claims.Email)
+}
+
+// withUser stores the authenticated user in the request context
+func withUser(r *http.Request, user models.User) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+func bearerToken(r *http.Request) string {
+    if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+        return strings.TrimPrefix(header, "Bearer ")
+    }
+    if cookie, err := r.Cookie("token"); err == nil {
+        return cookie.Value
+    }
+    return ""
+}
+
+// currentUser returns the user stored by Authenticate
+func currentUser(r *http.Request) (models.User, bool) {
+    user, ok := r.Context().Value(userContextKey).(models.User)
+    return user, ok
+}
+
+// RequireAdmin only lets administrators through; it must run after Authenticate
+func RequireAdmin(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        user, _ := currentUser(r)
+        admin, err := models.IsAdmin(user.ID)
+        if err != nil || !admin {
+            http.Error(w, "Administrator access required", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
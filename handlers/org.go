@@ -0,0 +1,465 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+    "github.com/jackc/pgx/v4"
+    "file-sharing-system/jobs"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+// invitationExpiry is how long an invitation can be accepted
+const invitationExpiry = 7 * 24 * time.Hour
+
+// maxOrgNameLength bounds organization names
+const maxOrgNameLength = 100
+
+// appURL is the public base URL used in links sent by email, from APP_URL
+func appURL() string {
+    if url := os.Getenv("APP_URL"); url != "" {
+        return strings.TrimSuffix(url, "/")
+    }
+    return "http://localhost:8080"
+}
+
+// requireOrgMember checks that the user belongs to an organization,
+// answering 404 otherwise so organization IDs do not reveal which exist.
+func requireOrgMember(w http.ResponseWriter, userID, orgID int) (string, bool) {
+    role, err := models.OrgRole(orgID, userID)
+    if err != nil {
+        http.Error(w, "Unable to check organization membership", http.StatusInternalServerError)
+        return "", false
+    }
+    if role == "" {
+        http.Error(w, "Organization not found", http.StatusNotFound)
+        return "", false
+    }
+    return role, true
+}
+
+// parseOrgID reads an organization ID given as text, returning 0 for ""
+func parseOrgID(w http.ResponseWriter, value string) (int, bool) {
+    if value == "" {
+        return 0, true
+    }
+    orgID, err := strconv.Atoi(value)
+    if err != nil || orgID < 1 {
+        http.Error(w, "Invalid organization", http.StatusBadRequest)
+        return 0, false
+    }
+    return orgID, true
+}
+
+// orgParam reads the workspace selected by ?org=: 0 for the user's personal
+// files, or an organization the user belongs to
+func orgParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+    user, _ := currentUser(r)
+    orgID, ok := parseOrgID(w, r.URL.Query().Get("org"))
+    if !ok || orgID == 0 {
+        return orgID, ok
+    }
+    _, ok = requireOrgMember(w, user.ID, orgID)
+    return orgID, ok
+}
+
+// authorizeOrg checks that the user holds at least role in the organization
+// named in the URL
+func authorizeOrg(w http.ResponseWriter, r *http.Request, role string) (int, string, bool) {
+    user, _ := currentUser(r)
+
+    orgID, err := strconv.Atoi(mux.Vars(r)["org_id"])
+    if err != nil {
+        http.Error(w, "Organization not found", http.StatusNotFound)
+        return 0, "", false
+    }
+    held, ok := requireOrgMember(w, user.ID, orgID)
+    if !ok {
+        return 0, "", false
+    }
+    if models.OrgRoleRank(held) < models.OrgRoleRank(role) {
+        http.Error(w, "Insufficient permissions: this requires the "+role+" role in the organization", http.StatusForbidden)
+        return 0, "", false
+    }
+    return orgID, held, true
+}
+
+// ownsWorkspace reports whether a user controls every file in the
+// workspace holding file: their own personal files, or an organization
+// they administer
+func ownsWorkspace(file models.File, userID int) (bool, error) {
+    if file.OrgID == nil {
+        return file.UserID == userID, nil
+    }
+    role, err := models.OrgRole(*file.OrgID, userID)
+    return models.OrgRoleRank(role) >= models.OrgRoleRank(models.OrgAdmin), err
+}
+
+// orgIDValue is the organization ID stored with an upload, or 0 for none
+func orgIDValue(orgID *int) int {
+    if orgID == nil {
+        return 0
+    }
+    return *orgID
+}
+
+// validOrgRole reports whether role is a member role
+func validOrgRole(role string) bool {
+    return models.OrgRoleRank(role) > 0
+}
+
+// CreateOrg creates an organization owned by the authenticated user
+func CreateOrg(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    var body struct {
+        Name string `json:"name"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid organization", http.StatusBadRequest)
+        return
+    }
+    name := strings.TrimSpace(body.Name)
+    if name == "" || len(name) > maxOrgNameLength {
+        http.Error(w, fmt.Sprintf("Invalid organization: names must be 1 to %d bytes", maxOrgNameLength), http.StatusUnprocessableEntity)
+        return
+    }
+
+    org, err := models.CreateOrg(name, user.ID)
+    if err != nil {
+        http.Error(w, "Unable to create organization", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(org)
+}
+
+// GetOrgs lists the organizations the authenticated user belongs to
+func GetOrgs(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    orgs, err := models.GetUserOrgs(user.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve organizations", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(orgs)
+}
+
+// GetOrg returns an organization the user belongs to with its storage usage
+func GetOrg(w http.ResponseWriter, r *http.Request) {
+    orgID, role, ok := authorizeOrg(w, r, models.OrgMember)
+    if !ok {
+        return
+    }
+
+    org, err := models.GetOrg(orgID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve organization", http.StatusInternalServerError)
+        return
+    }
+    usage, err := models.GetOrgUsage(orgID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve organization", http.StatusInternalServerError)
+        return
+    }
+    org.Role = role
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "organization": org,
+        "usage":        usage,
+    })
+}
+
+// GetOrgMembers lists the members of an organization
+func GetOrgMembers(w http.ResponseWriter, r *http.Request) {
+    orgID, _, ok := authorizeOrg(w, r, models.OrgMember)
+    if !ok {
+        return
+    }
+
+    members, err := models.GetOrgMembers(orgID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve members", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(members)
+}
+
+// memberParam reads the member named in the URL and their current role
+func memberParam(w http.ResponseWriter, r *http.Request, orgID int) (int, string, bool) {
+    userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Member not found", http.StatusNotFound)
+        return 0, "", false
+    }
+    role, err := models.OrgRole(orgID, userID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve member", http.StatusInternalServerError)
+        return 0, "", false
+    }
+    if role == "" {
+        http.Error(w, "Member not found", http.StatusNotFound)
+        return 0, "", false
+    }
+    return userID, role, true
+}
+
+// writeMembershipError answers with the status matching a membership change error
+func writeMembershipError(w http.ResponseWriter, err error) {
+    switch err {
+    case models.ErrLastOwner:
+        http.Error(w, "An organization must keep at least one owner", http.StatusConflict)
+    case pgx.ErrNoRows:
+        http.Error(w, "Member not found", http.StatusNotFound)
+    default:
+        http.Error(w, "Unable to update membership", http.StatusInternalServerError)
+    }
+}
+
+// PutOrgMember changes a member's role. Admins manage members and admins;
+// only owners can make or change owners.
+func PutOrgMember(w http.ResponseWriter, r *http.Request) {
+    orgID, held, ok := authorizeOrg(w, r, models.OrgAdmin)
+    if !ok {
+        return
+    }
+    userID, current, ok := memberParam(w, r, orgID)
+    if !ok {
+        return
+    }
+
+    var body struct {
+        Role string `json:"role"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid member", http.StatusBadRequest)
+        return
+    }
+    if !validOrgRole(body.Role) {
+        http.Error(w, "Invalid member: role must be one of "+strings.Join(models.OrgRoles, ", "), http.StatusUnprocessableEntity)
+        return
+    }
+    if (body.Role == models.OrgOwner || current == models.OrgOwner) && held != models.OrgOwner {
+        http.Error(w, "Only owners can manage owners", http.StatusForbidden)
+        return
+    }
+
+    if err := models.SetOrgMemberRole(orgID, userID, body.Role); err != nil {
+        writeMembershipError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteOrgMember removes a member. Members can leave on their own; removing
+// others takes the admin role, and removing owners the owner role. The
+// files of removed members stay with the organization.
+func DeleteOrgMember(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    orgID, held, ok := authorizeOrg(w, r, models.OrgMember)
+    if !ok {
+        return
+    }
+    userID, current, ok := memberParam(w, r, orgID)
+    if !ok {
+        return
+    }
+    if userID != user.ID {
+        if models.OrgRoleRank(held) < models.OrgRoleRank(models.OrgAdmin) || (current == models.OrgOwner && held != models.OrgOwner) {
+            http.Error(w, "Insufficient permissions to remove this member", http.StatusForbidden)
+            return
+        }
+    }
+
+    if err := models.RemoveOrgMember(orgID, userID); err != nil {
+        writeMembershipError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateInvitation invites an email address to the organization and emails
+// them a link to accept. The link is also returned, for sharing it another way.
+func CreateInvitation(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    orgID, held, ok := authorizeOrg(w, r, models.OrgAdmin)
+    if !ok {
+        return
+    }
+
+    var body struct {
+        Email string `json:"email"`
+        Role  string `json:"role"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid invitation", http.StatusBadRequest)
+        return
+    }
+    body.Email = strings.TrimSpace(body.Email)
+    if body.Role == "" {
+        body.Role = models.OrgMember
+    }
+    if !strings.Contains(body.Email, "@") || strings.ContainsAny(body.Email, " \r\n") {
+        http.Error(w, "Invalid invitation: a valid email is required", http.StatusUnprocessableEntity)
+        return
+    }
+    if !validOrgRole(body.Role) {
+        http.Error(w, "Invalid invitation: role must be one of "+strings.Join(models.OrgRoles, ", "), http.StatusUnprocessableEntity)
+        return
+    }
+    if body.Role == models.OrgOwner && held != models.OrgOwner {
+        http.Error(w, "Only owners can invite owners", http.StatusForbidden)
+        return
+    }
+
+    token := utils.RandomID(32)
+    inv, err := models.CreateInvitation(models.OrgInvitation{
+        OrgID:     orgID,
+        Email:     body.Email,
+        Role:      body.Role,
+        InvitedBy: &user.ID,
+        ExpiresAt: time.Now().Add(invitationExpiry),
+    }, token)
+    if err != nil {
+        http.Error(w, "Unable to create invitation", http.StatusInternalServerError)
+        return
+    }
+
+    acceptURL := appURL() + "/invitations/" + token
+    message := fmt.Sprintf("%s has invited you to join %s as %s.\n\nTo accept, sign in with this email address and open:\n%s\n\nThe invitation expires on %s.",
+        user.Email, inv.OrgName, inv.Role, acceptURL, inv.ExpiresAt.UTC().Format("2 January 2006 15:04 MST"))
+    if err := jobs.EnqueueEmail(inv.Email, "Invitation to join "+inv.OrgName, message); err != nil {
+        log.Println("Error queueing invitation email:", err)
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "invitation": inv,
+        "accept_url": acceptURL,
+    })
+}
+
+// GetInvitations lists an organization's pending invitations
+func GetInvitations(w http.ResponseWriter, r *http.Request) {
+    orgID, _, ok := authorizeOrg(w, r, models.OrgAdmin)
+    if !ok {
+        return
+    }
+
+    invitations, err := models.GetOrgInvitations(orgID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve invitations", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(invitations)
+}
+
+// DeleteInvitation withdraws a pending invitation
+func DeleteInvitation(w http.ResponseWriter, r *http.Request) {
+    orgID, _, ok := authorizeOrg(w, r, models.OrgAdmin)
+    if !ok {
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["invitation_id"])
+    if err != nil {
+        http.Error(w, "Invitation not found", http.StatusNotFound)
+        return
+    }
+
+    if err := models.DeleteInvitation(orgID, id); err != nil {
+        if err == pgx.ErrNoRows {
+            http.Error(w, "Invitation not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Unable to delete invitation", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// GetInvitation shows the invitation behind an accept link
+func GetInvitation(w http.ResponseWriter, r *http.Request) {
+    inv, err := models.GetInvitationByToken(mux.Vars(r)["token"])
+    if err != nil {
+        writeInvitationError(w, err)
+        return
+    }
+    json.NewEncoder(w).Encode(inv)
+}
+
+// AcceptInvitation adds the authenticated user to the organization they
+// were invited to. The invitation must have been sent to their email.
+func AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+    token := mux.Vars(r)["token"]
+
+    inv, err := models.GetInvitationByToken(token)
+    if err != nil {
+        writeInvitationError(w, err)
+        return
+    }
+    if !strings.EqualFold(inv.Email, user.Email) {
+        http.Error(w, "This invitation was sent to another email address", http.StatusForbidden)
+        return
+    }
+
+    inv, err = models.AcceptInvitation(token, user.ID)
+    if err != nil {
+        writeInvitationError(w, err)
+        return
+    }
+    json.NewEncoder(w).Encode(inv)
+}
+
+func writeInvitationError(w http.ResponseWriter, err error) {
+    if errors.Is(err, models.ErrInvitationInvalid) {
+        http.Error(w, "Invitation is invalid or has expired", http.StatusNotFound)
+        return
+    }
+    http.Error(w, "Unable to retrieve invitation", http.StatusInternalServerError)
+}
+
+// SetOrgQuota changes an organization's plan and quota override; a null
+// quota_bytes falls back to the plan's quota
+func SetOrgQuota(w http.ResponseWriter, r *http.Request) {
+    orgID, err := strconv.Atoi(mux.Vars(r)["org_id"])
+    if err != nil {
+        http.Error(w, "Organization not found", http.StatusNotFound)
+        return
+    }
+    var body struct {
+        Plan       string `json:"plan"`
+        QuotaBytes *int64 `json:"quota_bytes"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Plan == "" || (body.QuotaBytes != nil && *body.QuotaBytes < 0) {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    if err := models.SetOrgPlan(orgID, body.Plan, body.QuotaBytes); err != nil {
+        if err == pgx.ErrNoRows {
+            http.Error(w, "Organization not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Unable to update organization quota", http.StatusInternalServerError)
+        return
+    }
+
+    usage, err := models.GetOrgUsage(orgID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve usage", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// TestParseOrgID tests reading the organization that selects a workspace
+func TestParseOrgID(t *testing.T) {
+    cases := map[string]int{"": 0, "7": 7}
+    for value, expected := range cases {
+        if orgID, ok := parseOrgID(httptest.NewRecorder(), value); !ok || orgID != expected {
+            t.Errorf("%q: expected %d, got %d", value, expected, orgID)
+        }
+    }
+
+    for _, value := range []string{"abc", "0", "-3"} {
+        rr := httptest.NewRecorder()
+        if _, ok := parseOrgID(rr, value); ok || rr.Code != http.StatusBadRequest {
+            t.Errorf("%q: expected 400, got %d", value, rr.Code)
+        }
+    }
+}
+
+// TestAppURL tests the base URL of accept links
+func TestAppURL(t *testing.T) {
+    t.Setenv("APP_URL", "")
+    if url := appURL(); url != "http://localhost:8080" {
+        t.Errorf("Unexpected default %q", url)
+    }
+    t.Setenv("APP_URL", "https://files.example.com/")
+    if url := appURL(); url != "https://files.example.com" {
+        t.Errorf("Unexpected URL %q", url)
+    }
+}
@@ -0,0 +1,989 @@
+package handlers
+
+import (
+    "crypto/md5"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/jackc/pgx/v4"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+// The S3 gateway serves a subset of the S3 REST API over the authenticated
+// user's personal files, for tools that only speak S3. The top folders are
+// the buckets and the path below a bucket is the object key, addressed in
+// path style: /<bucket>/<key>. Of several files sharing a key the newest is
+// the object. Writes go through storeFile like any upload.
+
+const (
+    s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+    // s3TimeFormat is how S3 writes times in XML
+    s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+    maxS3ObjectSize = 5 << 30
+    minS3PartSize   = 5 << 20
+    maxS3Parts      = 10000
+    maxS3Keys       = 1000
+    // maxS3ListFiles bounds the files of a bucket that are listed
+    maxS3ListFiles = 100000
+)
+
+// s3Error is an error answered in S3's XML error format
+type s3Error struct {
+    Status  int
+    Code    string
+    Message string
+}
+
+func (e *s3Error) Error() string {
+    return e.Code + ": " + e.Message
+}
+
+var (
+    errS3AnonymousAccess       = &s3Error{http.StatusForbidden, "AccessDenied", "Anonymous access is not allowed"}
+    errS3InvalidAccessKey      = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID does not exist or has expired"}
+    errS3SignatureMismatch     = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match"}
+    errS3TimeSkewed            = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The request time is too far from the server time"}
+    errS3ExpiredRequest        = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+    errS3MalformedAuth         = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed"}
+    errS3MissingContentSHA256  = &s3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header x-amz-content-sha256"}
+    errS3ContentSHA256Mismatch = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The content SHA-256 does not match x-amz-content-sha256"}
+    errS3InvalidDigest         = &s3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 is not valid"}
+    errS3BadDigest             = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match the content"}
+    errS3IncompleteBody        = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is malformed or incomplete"}
+    errS3NotImplemented        = &s3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported"}
+    errS3MethodNotAllowed      = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed against this resource"}
+    errS3InvalidBucketName     = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The bucket name is not valid"}
+    errS3InvalidKey            = &s3Error{http.StatusBadRequest, "InvalidArgument", "The object key is not valid"}
+    errS3InvalidArgument       = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+    errS3NoSuchBucket          = &s3Error{http.StatusNotFound, "NoSuchBucket", "The bucket does not exist"}
+    errS3NoSuchKey             = &s3Error{http.StatusNotFound, "NoSuchKey", "The key does not exist"}
+    errS3NoSuchUpload          = &s3Error{http.StatusNotFound, "NoSuchUpload", "The multipart upload does not exist"}
+    errS3BucketExists          = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists"}
+    errS3InvalidRange          = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable"}
+    errS3MalformedXML          = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML is not well-formed"}
+    errS3InvalidPart           = &s3Error{http.StatusBadRequest, "InvalidPart", "A part was not uploaded or its ETag does not match"}
+    errS3InvalidPartOrder      = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "Parts must be listed in ascending order"}
+    errS3EntityTooSmall        = &s3Error{http.StatusBadRequest, "EntityTooSmall", "Every part but the last must be at least 5MB"}
+    errS3EntityTooLarge        = &s3Error{http.StatusBadRequest, "EntityTooLarge", "The object exceeds the maximum size"}
+    errS3QuotaExceeded         = &s3Error{http.StatusForbidden, "QuotaExceeded", "Not enough storage quota remaining for this object"}
+    errS3TypeBlocked           = &s3Error{http.StatusForbidden, "AccessDenied", "File type is not allowed"}
+    errS3ScanPending           = &s3Error{http.StatusConflict, "OperationAborted", "Object is still being scanned for viruses"}
+    errS3Infected              = &s3Error{http.StatusForbidden, "AccessDenied", "Object is infected and cannot be accessed"}
+    errS3InternalError         = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error, please try again"}
+)
+
+// writeS3Error answers with an S3 error document
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+    var e *s3Error
+    if !errors.As(err, &e) {
+        log.Printf("S3 %s %s: %v", r.Method, r.URL.Path, err)
+        e = errS3InternalError
+    }
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(e.Status)
+    xml.NewEncoder(w).Encode(struct {
+        XMLName   xml.Name `xml:"Error"`
+        Code      string
+        Message   string
+        Resource  string
+        RequestID string `xml:"RequestId"`
+    }{Code: e.Code, Message: e.Message, Resource: r.URL.Path, RequestID: w.Header().Get("X-Amz-Request-Id")})
+}
+
+// writeS3Result answers with an S3 XML document
+func writeS3Result(w http.ResponseWriter, result interface{}) {
+    w.Header().Set("Content-Type", "application/xml")
+    io.WriteString(w, xml.Header)
+    xml.NewEncoder(w).Encode(result)
+}
+
+// s3StoreError maps a storeFile error to an S3 error. The body's own
+// verification errors take precedence, since storage backends may not
+// pass them through.
+func s3StoreError(err error, body *trackingReader) error {
+    var e *s3Error
+    switch {
+    case errors.As(body.err, &e):
+        return e
+    case errors.Is(err, models.ErrQuotaExceeded):
+        return errS3QuotaExceeded
+    case errors.Is(err, errContentTypeBlocked):
+        return errS3TypeBlocked
+    case errors.Is(err, errInfected):
+        return &s3Error{http.StatusForbidden, "AccessDenied", "Object rejected by virus scan: " + strings.TrimPrefix(err.Error(), errInfected.Error()+": ")}
+    }
+    return err
+}
+
+// trackingReader remembers the first error other than io.EOF read from r
+type trackingReader struct {
+    r   io.Reader
+    err error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+    n, err := t.r.Read(p)
+    if err != nil && err != io.EOF && t.err == nil {
+        t.err = err
+    }
+    return n, err
+}
+
+// sizeLimitReader fails with errS3EntityTooLarge once more than limit
+// bytes have been read from r
+type sizeLimitReader struct {
+    r     io.Reader
+    limit int64
+    n     int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+    n, err := l.r.Read(p)
+    l.n += int64(n)
+    if l.n > l.limit {
+        return n, errS3EntityTooLarge
+    }
+    return n, err
+}
+
+// s3Request is an authenticated S3 request
+type s3Request struct {
+    w      http.ResponseWriter
+    r      *http.Request
+    user   models.User
+    body   io.Reader
+    bucket string
+    key    string
+}
+
+// ServeS3 is the S3 gateway. It is served on its own address, as S3
+// clients expect buckets at the root of the endpoint.
+func ServeS3(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("X-Amz-Request-Id", strings.ToUpper(utils.RandomID(8)))
+
+    user, body, err := authenticateS3(r)
+    if err != nil {
+        writeS3Error(w, r, err)
+        return
+    }
+    bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+    serve := func(w http.ResponseWriter, r *http.Request) {
+        req := &s3Request{w: w, r: r, user: user, body: body, bucket: bucket, key: key}
+        if err := req.serve(); err != nil {
+            writeS3Error(w, r, err)
+        }
+    }
+
+    action := s3AuditAction(r, key)
+    if action == "" {
+        serve(w, r)
+        return
+    }
+    audited(w, withUser(r, user), action, func(w http.ResponseWriter, r *http.Request) {
+        auditTarget(r, "path", "/"+bucket+"/"+key)
+        serve(w, r)
+    })
+}
+
+// s3AuditAction is the audited action an S3 request performs on an object,
+// or "" for requests that are not audited: a multipart upload counts once,
+// when it is completed
+func s3AuditAction(r *http.Request, key string) string {
+    if key == "" {
+        return ""
+    }
+    multipart := r.URL.Query().Has("uploadId")
+    switch {
+    case r.Method == http.MethodGet && !multipart:
+        return models.AuditFileDownload
+    case r.Method == http.MethodPut && !multipart, r.Method == http.MethodPost && multipart:
+        return models.AuditFileUpload
+    case r.Method == http.MethodDelete && !multipart:
+        return models.AuditFileDelete
+    }
+    return ""
+}
+
+func (s *s3Request) serve() error {
+    query := s.r.URL.Query()
+    if s.r.Header.Get("X-Amz-Copy-Source") != "" {
+        return errS3NotImplemented
+    }
+
+    switch {
+    case s.bucket == "":
+        if s.r.Method != http.MethodGet {
+            return errS3MethodNotAllowed
+        }
+        return s.listBuckets()
+
+    case s.key == "":
+        switch s.r.Method {
+        case http.MethodGet:
+            if query.Get("list-type") != "2" || query.Has("uploads") || query.Has("versions") {
+                return errS3NotImplemented
+            }
+            return s.listObjects()
+        case http.MethodHead:
+            return s.headBucket()
+        case http.MethodPut:
+            return s.createBucket()
+        }
+        return errS3MethodNotAllowed
+
+    default:
+        switch {
+        case s.r.Method == http.MethodPost && query.Has("uploads"):
+            return s.createMultipartUpload()
+        case query.Has("uploadId"):
+            switch s.r.Method {
+            case http.MethodPut:
+                return s.uploadPart()
+            case http.MethodGet:
+                return s.listParts()
+            case http.MethodPost:
+                return s.completeMultipartUpload()
+            case http.MethodDelete:
+                return s.abortMultipartUpload()
+            }
+        case s.r.Method == http.MethodGet, s.r.Method == http.MethodHead:
+            return s.getObject()
+        case s.r.Method == http.MethodPut:
+            return s.putObject()
+        case s.r.Method == http.MethodDelete:
+            return s.deleteObject()
+        }
+        return errS3MethodNotAllowed
+    }
+}
+
+// bucketFolder returns the folder of the request's bucket, checking that
+// it exists
+func (s *s3Request) bucketFolder() (string, error) {
+    if validName(s.bucket) != nil {
+        return "", errS3InvalidBucketName
+    }
+    folder := "/" + s.bucket
+    exists, err := models.FolderExists(s.user.ID, 0, folder)
+    if err != nil {
+        return "", err
+    }
+    if !exists {
+        return "", errS3NoSuchBucket
+    }
+    return folder, nil
+}
+
+// objectPath returns the folder and file name of the request's object key.
+// Keys ending in "/" name folders and have no file name.
+func (s *s3Request) objectPath() (string, string, error) {
+    root, err := s.bucketFolder()
+    if err != nil {
+        return "", "", err
+    }
+    return keyPath(root, s.key)
+}
+
+// keyPath places an object key below a bucket's folder
+func keyPath(root, key string) (string, string, error) {
+    dir, name := path.Split(key)
+    folder, err := normalizeFolder(root + "/" + dir)
+    if err != nil || strings.Contains(dir, "//") || name != "" && validName(name) != nil {
+        return "", "", errS3InvalidKey
+    }
+    return folder, name, nil
+}
+
+// objectFiles returns the files stored under an object key, newest first
+func (s *s3Request) objectFiles(folder, name string) ([]models.File, error) {
+    files, err := models.GetFilesInFolder(s.user.ID, 0, folder)
+    if err != nil {
+        return nil, err
+    }
+    var matches []models.File
+    for _, file := range files {
+        if file.Name == name {
+            matches = append(matches, file)
+        }
+    }
+    sort.Slice(matches, func(i, j int) bool { return matches[i].ID > matches[j].ID })
+    return matches, nil
+}
+
+type s3Owner struct {
+    ID          string
+    DisplayName string
+}
+
+func (s *s3Request) owner() s3Owner {
+    return s3Owner{ID: strconv.Itoa(s.user.ID), DisplayName: s.user.Email}
+}
+
+// listBuckets lists the user's top folders
+func (s *s3Request) listBuckets() error {
+    folders, err := models.GetSubfolders(s.user.ID, 0, "/")
+    if err != nil {
+        return err
+    }
+    type bucket struct {
+        Name         string
+        CreationDate string
+    }
+    result := struct {
+        XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+        Xmlns   string   `xml:"xmlns,attr"`
+        Owner   s3Owner
+        Buckets []bucket `xml:"Buckets>Bucket"`
+    }{Xmlns: s3Namespace, Owner: s.owner()}
+    for _, folder := range folders {
+        result.Buckets = append(result.Buckets, bucket{Name: folder.Name, CreationDate: folder.Modified.UTC().Format(s3TimeFormat)})
+    }
+    writeS3Result(s.w, result)
+    return nil
+}
+
+func (s *s3Request) headBucket() error {
+    _, err := s.bucketFolder()
+    return err
+}
+
+// createBucket creates a top folder
+func (s *s3Request) createBucket() error {
+    if validName(s.bucket) != nil {
+        return errS3InvalidBucketName
+    }
+    exists, err := models.FolderExists(s.user.ID, 0, "/"+s.bucket)
+    if err != nil {
+        return err
+    }
+    if exists {
+        return errS3BucketExists
+    }
+    if err := models.CreateFolder(s.user.ID, 0, "/"+s.bucket); err != nil {
+        return err
+    }
+    s.w.Header().Set("Location", "/"+s.bucket)
+    return nil
+}
+
+// s3Object is a file and its key in a bucket
+type s3Object struct {
+    Key  string
+    File models.File
+}
+
+// bucketObjects turns the files below a bucket's folder into objects
+// sorted by key, keeping the newest file of each key
+func bucketObjects(root string, files []models.File) []s3Object {
+    newest := map[string]models.File{}
+    for _, file := range files {
+        key := strings.TrimPrefix(strings.TrimPrefix(file.Folder, root)+"/", "/") + file.Name
+        if current, ok := newest[key]; !ok || file.ID > current.ID {
+            newest[key] = file
+        }
+    }
+    objects := make([]s3Object, 0, len(newest))
+    for key, file := range newest {
+        objects = append(objects, s3Object{Key: key, File: file})
+    }
+    sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+    return objects
+}
+
+// objectListing is one page of a ListObjectsV2 response
+type objectListing struct {
+    Contents       []s3Object
+    CommonPrefixes []string
+    Truncated      bool
+    // Next is the key or common prefix the next page starts after
+    Next string
+}
+
+// listObjectPage picks a page of objects after a key, grouping keys that
+// contain the delimiter after the prefix into common prefixes
+func listObjectPage(objects []s3Object, prefix, delimiter, after string, maxKeys int) objectListing {
+    var page objectListing
+    count := 0
+    for _, object := range objects {
+        key := object.Key
+        if !strings.HasPrefix(key, prefix) || key <= after {
+            continue
+        }
+        // Resuming after a common prefix skips every key inside it
+        if delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(key, after) {
+            continue
+        }
+
+        commonPrefix := ""
+        if delimiter != "" {
+            if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+                commonPrefix = key[:len(prefix)+i+len(delimiter)]
+                if n := len(page.CommonPrefixes); n > 0 && page.CommonPrefixes[n-1] == commonPrefix {
+                    continue
+                }
+            }
+        }
+
+        if count == maxKeys {
+            page.Truncated = true
+            break
+        }
+        count++
+        if commonPrefix != "" {
+            page.CommonPrefixes = append(page.CommonPrefixes, commonPrefix)
+            page.Next = commonPrefix
+        } else {
+            page.Contents = append(page.Contents, object)
+            page.Next = key
+        }
+    }
+    if !page.Truncated {
+        page.Next = ""
+    }
+    return page
+}
+
+// listObjects implements ListObjectsV2
+func (s *s3Request) listObjects() error {
+    root, err := s.bucketFolder()
+    if err != nil {
+        return err
+    }
+    query := s.r.URL.Query()
+    prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+    maxKeys := maxS3Keys
+    if value := query.Get("max-keys"); value != "" {
+        maxKeys, err = strconv.Atoi(value)
+        if err != nil || maxKeys < 0 {
+            return errS3InvalidArgument
+        }
+        maxKeys = min(maxKeys, maxS3Keys)
+    }
+    after := query.Get("start-after")
+    if token := query.Get("continuation-token"); token != "" {
+        decoded, err := base64.RawURLEncoding.DecodeString(token)
+        if err != nil {
+            return errS3InvalidArgument
+        }
+        after = string(decoded)
+    }
+
+    files, err := models.GetFolderFiles(s.user.ID, 0, root, maxS3ListFiles)
+    if errors.Is(err, models.ErrTooManyFiles) {
+        return &s3Error{http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("Buckets with more than %d files cannot be listed", maxS3ListFiles)}
+    }
+    if err != nil {
+        return err
+    }
+    page := listObjectPage(bucketObjects(root, files), prefix, delimiter, after, maxKeys)
+
+    type object struct {
+        Key          string
+        LastModified string
+        ETag         string
+        Size         int64
+        StorageClass string
+    }
+    type commonPrefix struct {
+        Prefix string
+    }
+    result := struct {
+        XMLName               xml.Name `xml:"ListBucketResult"`
+        Xmlns                 string   `xml:"xmlns,attr"`
+        Name                  string
+        Prefix                string
+        Delimiter             string `xml:",omitempty"`
+        StartAfter            string `xml:",omitempty"`
+        ContinuationToken     string `xml:",omitempty"`
+        NextContinuationToken string `xml:",omitempty"`
+        KeyCount              int
+        MaxKeys               int
+        IsTruncated           bool
+        Contents              []object
+        CommonPrefixes        []commonPrefix
+    }{
+        Xmlns:             s3Namespace,
+        Name:              s.bucket,
+        Prefix:            prefix,
+        Delimiter:         delimiter,
+        StartAfter:        query.Get("start-after"),
+        ContinuationToken: query.Get("continuation-token"),
+        KeyCount:          len(page.Contents) + len(page.CommonPrefixes),
+        MaxKeys:           maxKeys,
+        IsTruncated:       page.Truncated,
+    }
+    if page.Truncated {
+        result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(page.Next))
+    }
+    for _, o := range page.Contents {
+        result.Contents = append(result.Contents, object{
+            Key:          o.Key,
+            LastModified: o.File.UploadDate.UTC().Format(s3TimeFormat),
+            ETag:         fileETag(o.File),
+            Size:         o.File.Size,
+            StorageClass: "STANDARD",
+        })
+    }
+    for _, p := range page.CommonPrefixes {
+        result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{p})
+    }
+    writeS3Result(s.w, result)
+    return nil
+}
+
+// getObject implements GetObject and HeadObject, with a single byte range
+func (s *s3Request) getObject() error {
+    folder, name, err := s.objectPath()
+    if err != nil {
+        return err
+    }
+    if name == "" {
+        return errS3NoSuchKey
+    }
+    file, err := models.GetFileByPath(s.user.ID, 0, folder, name)
+    if err == pgx.ErrNoRows {
+        return errS3NoSuchKey
+    }
+    if err != nil {
+        return err
+    }
+    if !file.ScanAllowsAccess() {
+        if file.ScanStatus == models.ScanInfected {
+            return errS3Infected
+        }
+        return errS3ScanPending
+    }
+
+    offset, length, partial, err := parseRange(s.r.Header.Get("Range"), file.Size)
+    if err != nil {
+        s.w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+        return errS3InvalidRange
+    }
+
+    contentType := file.ContentType
+    if contentType == "" {
+        contentType = "application/octet-stream"
+    }
+    header := s.w.Header()
+    header.Set("Content-Type", contentType)
+    header.Set("Content-Length", strconv.FormatInt(length, 10))
+    header.Set("ETag", fileETag(file))
+    header.Set("Last-Modified", file.UploadDate.UTC().Format(http.TimeFormat))
+    header.Set("Accept-Ranges", "bytes")
+    if file.ClientEncrypted {
+        setClientEncryptionHeaders(s.w, file.EncryptionHeader, file.EncryptedMetadata)
+    }
+    if s.r.Method == http.MethodHead {
+        return nil
+    }
+
+    content, err := models.OpenContentRange(file, offset, length)
+    if err != nil {
+        return err
+    }
+    defer content.Close()
+    if partial {
+        header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, file.Size))
+        s.w.WriteHeader(http.StatusPartialContent)
+    }
+    io.Copy(s.w, content)
+    return nil
+}
+
+// checkS3Quota refuses uploads whose announced size cannot fit
+func (s *s3Request) checkS3Quota(size int64) error {
+    if size > maxS3ObjectSize {
+        return errS3EntityTooLarge
+    }
+    usage, err := workspaceUsage(s.user.ID, 0)
+    if err != nil {
+        return err
+    }
+    if size > usage.BytesRemaining {
+        return errS3QuotaExceeded
+    }
+    return nil
+}
+
+// storeObject stores content under an object key, replacing the files
+// previously stored under it
+func (s *s3Request) storeObject(folder, name string, content io.Reader) (models.File, error) {
+    previous, err := s.objectFiles(folder, name)
+    if err != nil {
+        return models.File{}, err
+    }
+
+    body := &trackingReader{r: content}
+    file, err := storeFile(s.user.ID, name, body, storeOptions{Folder: folder})
+    if err != nil {
+        return models.File{}, s3StoreError(err, body)
+    }
+    for _, old := range previous {
+        if err := removeFile(old); err != nil {
+            log.Println("Error removing replaced file:", err)
+        }
+    }
+    return file, nil
+}
+
+// putObject implements PutObject. Empty keys ending in "/", which S3
+// tools use as folder markers, create folders.
+func (s *s3Request) putObject() error {
+    folder, name, err := s.objectPath()
+    if err != nil {
+        return err
+    }
+    if name == "" {
+        if _, err := io.Copy(io.Discard, s.body); err != nil {
+            return err
+        }
+        if err := models.CreateFolder(s.user.ID, 0, folder); err != nil {
+            return err
+        }
+        s.w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+        return nil
+    }
+    if err := s.checkS3Quota(payloadLength(s.r)); err != nil {
+        return err
+    }
+
+    // Bodies whose size was not announced fail while they are stored, before
+    // the object they would replace is removed
+    file, err := s.storeObject(folder, name, &sizeLimitReader{r: s.body, limit: maxS3ObjectSize})
+    if err != nil {
+        return err
+    }
+    s.w.Header().Set("ETag", fileETag(file))
+    return nil
+}
+
+// deleteObject implements DeleteObject, which succeeds for missing keys
+func (s *s3Request) deleteObject() error {
+    folder, name, err := s.objectPath()
+    if err != nil {
+        return err
+    }
+    if name == "" {
+        s.w.WriteHeader(http.StatusNoContent)
+        return nil
+    }
+    files, err := s.objectFiles(folder, name)
+    if err != nil {
+        return err
+    }
+    if len(files) > 0 {
+        // Keep the bucket once its last object is gone
+        if err := models.CreateFolder(s.user.ID, 0, "/"+s.bucket); err != nil {
+            return err
+        }
+    }
+    for _, file := range files {
+        if err := removeFile(file); err != nil {
+            return err
+        }
+    }
+    s.w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+func s3UploadDir(id string) string {
+    return filepath.Join(utils.StagingDir(), "s3-uploads", id)
+}
+
+func s3PartPath(id string, partNumber int) string {
+    return filepath.Join(s3UploadDir(id), strconv.Itoa(partNumber))
+}
+
+// createMultipartUpload implements CreateMultipartUpload
+func (s *s3Request) createMultipartUpload() error {
+    folder, name, err := s.objectPath()
+    if err != nil {
+        return err
+    }
+    if name == "" {
+        return errS3InvalidKey
+    }
+
+    now := time.Now()
+    upload := models.S3Upload{
+        ID:        utils.RandomID(16),
+        UserID:    s.user.ID,
+        Folder:    folder,
+        Name:      name,
+        CreatedAt: now,
+        ExpiresAt: now.Add(uploadExpiry()),
+    }
+    if err := os.MkdirAll(s3UploadDir(upload.ID), 0o755); err != nil {
+        return err
+    }
+    if err := models.CreateS3Upload(upload); err != nil {
+        os.RemoveAll(s3UploadDir(upload.ID))
+        return err
+    }
+
+    writeS3Result(s.w, struct {
+        XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+        Xmlns    string   `xml:"xmlns,attr"`
+        Bucket   string
+        Key      string
+        UploadID string `xml:"UploadId"`
+    }{Xmlns: s3Namespace, Bucket: s.bucket, Key: s.key, UploadID: upload.ID})
+    return nil
+}
+
+// multipartUpload returns the upload named in the query, which must be the
+// user's, unexpired, and for the request's object
+func (s *s3Request) multipartUpload() (models.S3Upload, error) {
+    folder, name, err := s.objectPath()
+    if err != nil {
+        return models.S3Upload{}, err
+    }
+    upload, err := models.GetS3Upload(s.r.URL.Query().Get("uploadId"))
+    if err == pgx.ErrNoRows {
+        return models.S3Upload{}, errS3NoSuchUpload
+    }
+    if err != nil {
+        return models.S3Upload{}, err
+    }
+    if upload.UserID != s.user.ID || upload.Folder != folder || upload.Name != name || time.Now().After(upload.ExpiresAt) {
+        return models.S3Upload{}, errS3NoSuchUpload
+    }
+    return upload, nil
+}
+
+// uploadPart implements UploadPart, staging the part locally. Parts may be
+// retried; the last copy received wins.
+func (s *s3Request) uploadPart() error {
+    upload, err := s.multipartUpload()
+    if err != nil {
+        return err
+    }
+    partNumber, err := strconv.Atoi(s.r.URL.Query().Get("partNumber"))
+    if err != nil || partNumber < 1 || partNumber > maxS3Parts {
+        return &s3Error{http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Part number must be between 1 and %d", maxS3Parts)}
+    }
+
+    parts, err := models.GetS3UploadParts(upload.ID)
+    if err != nil {
+        return err
+    }
+    var staged int64
+    for _, part := range parts {
+        if part.PartNumber != partNumber {
+            staged += part.Size
+        }
+    }
+    if err := s.checkS3Quota(staged + payloadLength(s.r)); err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(s3UploadDir(upload.ID), fmt.Sprintf(".%d-*", partNumber))
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    hash := md5.New()
+    n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(s.body, maxS3ObjectSize+1))
+    tmp.Close()
+    if err != nil {
+        return err
+    }
+    if n > maxS3ObjectSize {
+        return errS3EntityTooLarge
+    }
+
+    part := models.S3UploadPart{
+        PartNumber: partNumber,
+        Size:       n,
+        ETag:       `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+        ReceivedAt: time.Now(),
+    }
+    if err := os.Rename(tmp.Name(), s3PartPath(upload.ID, partNumber)); err != nil {
+        return err
+    }
+    if err := models.SaveS3UploadPart(upload.ID, part); err != nil {
+        return err
+    }
+    s.w.Header().Set("ETag", part.ETag)
+    return nil
+}
+
+// listParts implements ListParts, returning every part at once
+func (s *s3Request) listParts() error {
+    upload, err := s.multipartUpload()
+    if err != nil {
+        return err
+    }
+    parts, err := models.GetS3UploadParts(upload.ID)
+    if err != nil {
+        return err
+    }
+
+    type part struct {
+        PartNumber   int
+        LastModified string
+        ETag         string
+        Size         int64
+    }
+    result := struct {
+        XMLName     xml.Name `xml:"ListPartsResult"`
+        Xmlns       string   `xml:"xmlns,attr"`
+        Bucket      string
+        Key         string
+        UploadID    string `xml:"UploadId"`
+        IsTruncated bool
+        Parts       []part `xml:"Part"`
+    }{Xmlns: s3Namespace, Bucket: s.bucket, Key: s.key, UploadID: upload.ID}
+    for _, p := range parts {
+        result.Parts = append(result.Parts, part{p.PartNumber, p.ReceivedAt.UTC().Format(s3TimeFormat), p.ETag, p.Size})
+    }
+    writeS3Result(s.w, result)
+    return nil
+}
+
+// completedPart is a part listed in a CompleteMultipartUpload request
+type completedPart struct {
+    PartNumber int
+    ETag       string
+}
+
+// selectParts checks the parts a client lists to complete an upload
+// against the parts received, returning them in order
+func selectParts(received []models.S3UploadPart, listed []completedPart) ([]models.S3UploadPart, error) {
+    if len(listed) == 0 {
+        return nil, errS3MalformedXML
+    }
+    byNumber := make(map[int]models.S3UploadPart, len(received))
+    for _, part := range received {
+        byNumber[part.PartNumber] = part
+    }
+
+    selected := make([]models.S3UploadPart, 0, len(listed))
+    for i, entry := range listed {
+        if i > 0 && entry.PartNumber <= listed[i-1].PartNumber {
+            return nil, errS3InvalidPartOrder
+        }
+        part, ok := byNumber[entry.PartNumber]
+        if !ok || strings.Trim(entry.ETag, `"`) != strings.Trim(part.ETag, `"`) {
+            return nil, errS3InvalidPart
+        }
+        if i > 0 && selected[i-1].Size < minS3PartSize {
+            return nil, errS3EntityTooSmall
+        }
+        selected = append(selected, part)
+    }
+    return selected, nil
+}
+
+// completeMultipartUpload implements CompleteMultipartUpload, streaming
+// the listed parts in order into storage
+func (s *s3Request) completeMultipartUpload() error {
+    unlock, ok := lockUpload("s3-" + s.r.URL.Query().Get("uploadId"))
+    if !ok {
+        return &s3Error{http.StatusConflict, "OperationAborted", "The upload is already being completed"}
+    }
+    defer unlock()
+
+    upload, err := s.multipartUpload()
+    if err != nil {
+        return err
+    }
+    var req struct {
+        Parts []completedPart `xml:"Part"`
+    }
+    if err := xml.NewDecoder(io.LimitReader(s.body, 1<<20)).Decode(&req); err != nil {
+        return errS3MalformedXML
+    }
+    received, err := models.GetS3UploadParts(upload.ID)
+    if err != nil {
+        return err
+    }
+    parts, err := selectParts(received, req.Parts)
+    if err != nil {
+        return err
+    }
+
+    pr, pw := io.Pipe()
+    go func() {
+        for _, part := range parts {
+            f, err := os.Open(s3PartPath(upload.ID, part.PartNumber))
+            if err != nil {
+                pw.CloseWithError(err)
+                return
+            }
+            _, err = io.Copy(pw, f)
+            f.Close()
+            if err != nil {
+                pw.CloseWithError(err)
+                return
+            }
+        }
+        pw.Close()
+    }()
+    file, err := s.storeObject(upload.Folder, upload.Name, pr)
+    pr.Close()
+    if err != nil {
+        return err
+    }
+    discardS3Upload(upload.ID)
+
+    writeS3Result(s.w, struct {
+        XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+        Xmlns    string   `xml:"xmlns,attr"`
+        Location string
+        Bucket   string
+        Key      string
+        ETag     string
+    }{Xmlns: s3Namespace, Location: "/" + s.bucket + "/" + s.key, Bucket: s.bucket, Key: s.key, ETag: fileETag(file)})
+    return nil
+}
+
+// abortMultipartUpload implements AbortMultipartUpload
+func (s *s3Request) abortMultipartUpload() error {
+    upload, err := s.multipartUpload()
+    if err != nil {
+        return err
+    }
+    discardS3Upload(upload.ID)
+    s.w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+// discardS3Upload removes a multipart upload's staged parts and records
+func discardS3Upload(id string) {
+    if err := os.RemoveAll(s3UploadDir(id)); err != nil {
+        log.Println("Error removing staged parts:", err)
+    }
+    if err := models.DeleteS3Upload(id); err != nil {
+        log.Println("Error deleting multipart upload:", err)
+    }
+    uploadLocks.Delete("s3-" + id)
+}
+
+// PurgeExpiredS3Uploads discards multipart uploads that passed their
+// expiry without completing
+func PurgeExpiredS3Uploads() error {
+    uploads, err := models.GetExpiredS3Uploads(time.Now())
+    if err != nil {
+        return err
+    }
+    for _, upload := range uploads {
+        discardS3Upload(upload.ID)
+    }
+    return nil
+}
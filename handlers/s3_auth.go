@@ -0,0 +1,432 @@
+package handlers
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/hmac"
+    "crypto/md5"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/jackc/pgx/v4"
+    "file-sharing-system/models"
+)
+
+// S3 requests are authenticated with AWS Signature Version 4, using the
+// access key and secret of one of the user's API tokens. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+    sigV4Algorithm  = "AWS4-HMAC-SHA256"
+    sigV4TimeFormat = "20060102T150405Z"
+
+    unsignedPayload          = "UNSIGNED-PAYLOAD"
+    streamingSignedPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+    streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+    emptySHA256              = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+    maxClockSkew     = 15 * time.Minute
+    maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// sigV4Auth is the signature of a request and what it covers
+type sigV4Auth struct {
+    AccessKeyID   string
+    Scope         string
+    SignedHeaders []string
+    Signature     string
+    Date          time.Time
+    PayloadHash   string
+    Presigned     bool
+    Expires       time.Duration
+}
+
+// parseSigV4 reads the signature from the Authorization header, or from
+// the query string of a presigned URL
+func parseSigV4(r *http.Request) (sigV4Auth, error) {
+    var auth sigV4Auth
+    var credential, signedHeaders, date string
+
+    query := r.URL.Query()
+    if header := r.Header.Get("Authorization"); header != "" {
+        params, ok := strings.CutPrefix(header, sigV4Algorithm+" ")
+        if !ok {
+            return auth, errS3MalformedAuth
+        }
+        for _, param := range strings.Split(params, ",") {
+            key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+            switch key {
+            case "Credential":
+                credential = value
+            case "SignedHeaders":
+                signedHeaders = value
+            case "Signature":
+                auth.Signature = value
+            }
+        }
+        date = r.Header.Get("X-Amz-Date")
+        auth.PayloadHash = r.Header.Get("X-Amz-Content-Sha256")
+        if auth.PayloadHash == "" {
+            return auth, errS3MissingContentSHA256
+        }
+    } else if query.Get("X-Amz-Algorithm") != "" {
+        if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+            return auth, errS3MalformedAuth
+        }
+        credential = query.Get("X-Amz-Credential")
+        signedHeaders = query.Get("X-Amz-SignedHeaders")
+        auth.Signature = query.Get("X-Amz-Signature")
+        date = query.Get("X-Amz-Date")
+        auth.PayloadHash = unsignedPayload
+        auth.Presigned = true
+        seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+        if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPresignExpiry {
+            return auth, errS3MalformedAuth
+        }
+        auth.Expires = time.Duration(seconds) * time.Second
+    } else {
+        return auth, errS3AnonymousAccess
+    }
+
+    // Credential is <access key>/<yyyymmdd>/<region>/s3/aws4_request
+    scope := strings.Split(credential, "/")
+    if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" || auth.Signature == "" || signedHeaders == "" {
+        return auth, errS3MalformedAuth
+    }
+    auth.AccessKeyID = scope[0]
+    auth.Scope = strings.Join(scope[1:], "/")
+    auth.SignedHeaders = strings.Split(signedHeaders, ";")
+
+    var err error
+    auth.Date, err = time.Parse(sigV4TimeFormat, date)
+    if err != nil || auth.Date.Format("20060102") != scope[1] {
+        return auth, errS3MalformedAuth
+    }
+    return auth, nil
+}
+
+// s3URIEncode encodes a string the way SigV4 expects: every byte but the
+// unreserved characters, and '/' when encoding a path, is percent-encoded
+func s3URIEncode(s string, path bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || path && c == '/' {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+// canonicalRequest builds the SigV4 canonical form of a request
+func canonicalRequest(r *http.Request, auth sigV4Auth) string {
+    uri := s3URIEncode(r.URL.Path, true)
+    if uri == "" {
+        uri = "/"
+    }
+
+    var params []string
+    for key, values := range r.URL.Query() {
+        if auth.Presigned && key == "X-Amz-Signature" {
+            continue
+        }
+        for _, value := range values {
+            params = append(params, s3URIEncode(key, false)+"="+s3URIEncode(value, false))
+        }
+    }
+    sort.Strings(params)
+
+    var headers strings.Builder
+    for _, name := range auth.SignedHeaders {
+        var value string
+        switch name {
+        case "host":
+            value = r.Host
+        case "content-length":
+            value = strconv.FormatInt(r.ContentLength, 10)
+        default:
+            values := r.Header.Values(name)
+            for i, v := range values {
+                values[i] = strings.Join(strings.Fields(v), " ")
+            }
+            value = strings.Join(values, ",")
+        }
+        headers.WriteString(name + ":" + value + "\n")
+    }
+
+    return strings.Join([]string{
+        r.Method,
+        uri,
+        strings.Join(params, "&"),
+        headers.String(),
+        strings.Join(auth.SignedHeaders, ";"),
+        auth.PayloadHash,
+    }, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// signingKey derives the key that signs requests of one day, region and service
+func signingKey(secret, scope string) []byte {
+    key := []byte("AWS4" + secret)
+    for _, part := range strings.Split(scope, "/") {
+        key = hmacSHA256(key, part)
+    }
+    return key
+}
+
+// sigV4Signature signs a request's canonical form
+func sigV4Signature(key []byte, auth sigV4Auth, canonical string) string {
+    stringToSign := strings.Join([]string{
+        sigV4Algorithm,
+        auth.Date.Format(sigV4TimeFormat),
+        auth.Scope,
+        sha256Hex([]byte(canonical)),
+    }, "\n")
+    return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// authenticateS3 verifies a request's signature and returns the user it
+// was signed for, with the request body wrapped to verify its payload
+func authenticateS3(r *http.Request) (models.User, io.Reader, error) {
+    auth, err := parseSigV4(r)
+    if err != nil {
+        return models.User{}, nil, err
+    }
+
+    now := time.Now()
+    if auth.Presigned {
+        if now.After(auth.Date.Add(auth.Expires)) || auth.Date.After(now.Add(maxClockSkew)) {
+            return models.User{}, nil, errS3ExpiredRequest
+        }
+    } else if now.Sub(auth.Date) > maxClockSkew || auth.Date.Sub(now) > maxClockSkew {
+        return models.User{}, nil, errS3TimeSkewed
+    }
+
+    // Clients sign every request, so only failed sign-ins are audited
+    user, secret, err := models.GetS3Credentials(auth.AccessKeyID)
+    if err == pgx.ErrNoRows {
+        auditS3SignIn(r, auth, models.User{}, errS3InvalidAccessKey)
+        return models.User{}, nil, errS3InvalidAccessKey
+    }
+    if err != nil {
+        return models.User{}, nil, err
+    }
+
+    key := signingKey(secret, auth.Scope)
+    signature := sigV4Signature(key, auth, canonicalRequest(r, auth))
+    if !hmac.Equal([]byte(signature), []byte(auth.Signature)) {
+        auditS3SignIn(r, auth, user, errS3SignatureMismatch)
+        return models.User{}, nil, errS3SignatureMismatch
+    }
+
+    body, err := payloadReader(r, auth, key)
+    return user, body, err
+}
+
+// auditS3SignIn records a request whose credentials were refused
+func auditS3SignIn(r *http.Request, auth sigV4Auth, user models.User, err *s3Error) {
+    entry := signInEntry("s3", user, "", models.AuditDenied)
+    entry.Details["access_key_id"] = auth.AccessKeyID
+    entry.Details["reason"] = err.Code
+    recordAudit(r, entry)
+}
+
+// payloadReader wraps the body so that reading it verifies the payload
+// the signature covers, and decodes aws-chunked bodies
+func payloadReader(r *http.Request, auth sigV4Auth, key []byte) (io.Reader, error) {
+    var body io.Reader = r.Body
+    switch auth.PayloadHash {
+    case unsignedPayload:
+    case streamingSignedPayload:
+        body = &awsChunkedReader{r: bufio.NewReader(r.Body), key: key, auth: auth, previous: auth.Signature, hash: sha256.New()}
+    case streamingUnsignedTrailer:
+        body = &awsChunkedReader{r: bufio.NewReader(r.Body)}
+    default:
+        want, err := hex.DecodeString(auth.PayloadHash)
+        if err != nil || len(want) != sha256.Size {
+            return nil, errS3NotImplemented
+        }
+        body = &digestReader{r: body, hash: sha256.New(), want: want, mismatch: errS3ContentSHA256Mismatch}
+    }
+
+    if value := r.Header.Get("Content-Md5"); value != "" {
+        want, err := base64.StdEncoding.DecodeString(value)
+        if err != nil || len(want) != md5.Size {
+            return nil, errS3InvalidDigest
+        }
+        body = &digestReader{r: body, hash: md5.New(), want: want, mismatch: errS3BadDigest}
+    }
+    return body, nil
+}
+
+// payloadLength returns the size of the decoded payload, or -1 when unknown
+func payloadLength(r *http.Request) int64 {
+    if value := r.Header.Get("X-Amz-Decoded-Content-Length"); value != "" {
+        if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+            return n
+        }
+        return -1
+    }
+    return r.ContentLength
+}
+
+// digestReader fails at the end of its content unless the content hashes
+// to want
+type digestReader struct {
+    r        io.Reader
+    hash     hash.Hash
+    want     []byte
+    mismatch error
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+    n, err := d.r.Read(p)
+    d.hash.Write(p[:n])
+    if err == io.EOF && !bytes.Equal(d.hash.Sum(nil), d.want) {
+        return n, d.mismatch
+    }
+    return n, err
+}
+
+// awsChunkedReader decodes an aws-chunked body, in which the payload is
+// sent as "<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n" chunks
+// ending with an empty chunk and optional trailers. When a key is set each
+// chunk's signature is verified, chaining from the request's signature.
+type awsChunkedReader struct {
+    r         *bufio.Reader
+    remaining int64
+    err       error
+
+    key       []byte
+    auth      sigV4Auth
+    previous  string
+    signature string
+    hash      hash.Hash
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+    if c.err != nil {
+        return 0, c.err
+    }
+    if c.remaining == 0 {
+        if c.err = c.nextChunk(); c.err != nil {
+            return 0, c.err
+        }
+    }
+
+    if int64(len(p)) > c.remaining {
+        p = p[:c.remaining]
+    }
+    n, err := c.r.Read(p)
+    c.remaining -= int64(n)
+    if c.hash != nil {
+        c.hash.Write(p[:n])
+    }
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    if err == nil && c.remaining == 0 {
+        err = c.endChunk()
+    }
+    c.err = err
+    return n, err
+}
+
+// nextChunk reads a chunk header. The final, empty chunk is verified
+// straight away and its trailers skipped.
+func (c *awsChunkedReader) nextChunk() error {
+    line, err := c.readLine()
+    if err != nil {
+        return err
+    }
+    sizeText, params, _ := strings.Cut(line, ";")
+    size, err := strconv.ParseInt(sizeText, 16, 64)
+    if err != nil || size < 0 {
+        return errS3IncompleteBody
+    }
+    if c.key != nil {
+        signature, ok := strings.CutPrefix(params, "chunk-signature=")
+        if !ok {
+            return errS3SignatureMismatch
+        }
+        c.signature = signature
+        c.hash.Reset()
+    }
+
+    if size > 0 {
+        c.remaining = size
+        return nil
+    }
+    if err := c.verifyChunk(); err != nil {
+        return err
+    }
+    // Trailers, such as checksums, end with an empty line
+    for {
+        line, err := c.readLine()
+        if err == io.EOF || err == nil && line == "" {
+            return io.EOF
+        }
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// endChunk reads the line break after a chunk's data and verifies the chunk
+func (c *awsChunkedReader) endChunk() error {
+    if line, err := c.readLine(); err != nil || line != "" {
+        return errS3IncompleteBody
+    }
+    return c.verifyChunk()
+}
+
+func (c *awsChunkedReader) verifyChunk() error {
+    if c.key == nil {
+        return nil
+    }
+    stringToSign := strings.Join([]string{
+        sigV4Algorithm + "-PAYLOAD",
+        c.auth.Date.Format(sigV4TimeFormat),
+        c.auth.Scope,
+        c.previous,
+        emptySHA256,
+        hex.EncodeToString(c.hash.Sum(nil)),
+    }, "\n")
+    expected := hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+    if !hmac.Equal([]byte(expected), []byte(c.signature)) {
+        return errS3SignatureMismatch
+    }
+    c.previous = c.signature
+    return nil
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+    line, err := c.r.ReadString('\n')
+    if err == io.EOF && line != "" {
+        err = io.ErrUnexpectedEOF
+    }
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+    "file-sharing-system/models"
+)
+
+// TestKeyPath tests where object keys land below a bucket's folder
+func TestKeyPath(t *testing.T) {
+    cases := map[string][2]string{
+        "report.pdf":          {"/photos", "report.pdf"},
+        "2024/trip/beach.jpg": {"/photos/2024/trip", "beach.jpg"},
+        "2024/trip/":          {"/photos/2024/trip", ""},
+    }
+    for key, expected := range cases {
+        folder, name, err := keyPath("/photos", key)
+        if err != nil || folder != expected[0] || name != expected[1] {
+            t.Errorf("%q: expected %v, got %s %s %v", key, expected, folder, name, err)
+        }
+    }
+
+    for _, key := range []string{"a//b.txt", "../b.txt", "a/\x01.txt"} {
+        if _, _, err := keyPath("/photos", key); err != errS3InvalidKey {
+            t.Errorf("%q: expected invalid key, got %v", key, err)
+        }
+    }
+}
+
+func objectKeys(objects []s3Object) []string {
+    var keys []string
+    for _, o := range objects {
+        keys = append(keys, o.Key)
+    }
+    return keys
+}
+
+// TestBucketObjects tests that files become objects keyed by their path
+// below the bucket, the newest file winning
+func TestBucketObjects(t *testing.T) {
+    files := []models.File{
+        {ID: 1, Folder: "/photos", Name: "b.jpg"},
+        {ID: 2, Folder: "/photos/2024", Name: "a.jpg"},
+        {ID: 3, Folder: "/photos", Name: "b.jpg", Size: 7},
+    }
+    objects := bucketObjects("/photos", files)
+
+    if keys := objectKeys(objects); !reflect.DeepEqual(keys, []string{"2024/a.jpg", "b.jpg"}) {
+        t.Errorf("Unexpected keys %v", keys)
+    }
+    if objects[1].File.ID != 3 {
+        t.Errorf("Expected the newest file for b.jpg, got %d", objects[1].File.ID)
+    }
+}
+
+// TestListObjectPage tests prefixes, delimiters and pagination
+func TestListObjectPage(t *testing.T) {
+    var objects []s3Object
+    for _, key := range []string{"a.txt", "docs/1.txt", "docs/2.txt", "docs/old/3.txt", "music/x.mp3", "z.txt"} {
+        objects = append(objects, s3Object{Key: key})
+    }
+
+    page := listObjectPage(objects, "", "/", "", 1000)
+    if keys := objectKeys(page.Contents); !reflect.DeepEqual(keys, []string{"a.txt", "z.txt"}) {
+        t.Errorf("Unexpected top level keys %v", keys)
+    }
+    if !reflect.DeepEqual(page.CommonPrefixes, []string{"docs/", "music/"}) || page.Truncated {
+        t.Errorf("Unexpected common prefixes %v", page.CommonPrefixes)
+    }
+
+    page = listObjectPage(objects, "docs/", "/", "", 1000)
+    if keys := objectKeys(page.Contents); !reflect.DeepEqual(keys, []string{"docs/1.txt", "docs/2.txt"}) || !reflect.DeepEqual(page.CommonPrefixes, []string{"docs/old/"}) {
+        t.Errorf("Unexpected listing of docs/: %v %v", keys, page.CommonPrefixes)
+    }
+
+    // Pages of two resume after the last key or common prefix
+    var seen []string
+    after := ""
+    for i := 0; i < 10; i++ {
+        page = listObjectPage(objects, "", "/", after, 2)
+        seen = append(seen, objectKeys(page.Contents)...)
+        seen = append(seen, page.CommonPrefixes...)
+        if !page.Truncated {
+            break
+        }
+        after = page.Next
+    }
+    sort.Strings(seen)
+    if !reflect.DeepEqual(seen, []string{"a.txt", "docs/", "music/", "z.txt"}) {
+        t.Errorf("Unexpected paginated listing %v", seen)
+    }
+
+    if page := listObjectPage(objects, "", "", "docs/2.txt", 2); !reflect.DeepEqual(objectKeys(page.Contents), []string{"docs/old/3.txt", "music/x.mp3"}) || !page.Truncated {
+        t.Errorf("Unexpected page after docs/2.txt: %v", objectKeys(page.Contents))
+    }
+}
+
+// TestSelectParts tests the checks made when completing a multipart upload
+func TestSelectParts(t *testing.T) {
+    received := []models.S3UploadPart{
+        {PartNumber: 1, Size: minS3PartSize, ETag: `"aaa"`},
+        {PartNumber: 2, Size: 10, ETag: `"bbb"`},
+        {PartNumber: 3, Size: 10, ETag: `"ccc"`},
+    }
+
+    parts, err := selectParts(received, []completedPart{{1, "aaa"}, {2, `"bbb"`}})
+    if err != nil || len(parts) != 2 || parts[1].PartNumber != 2 {
+        t.Errorf("Expected parts 1 and 2, got %v %v", parts, err)
+    }
+
+    cases := map[error][]completedPart{
+        errS3InvalidPartOrder: {{2, "bbb"}, {1, "aaa"}},
+        errS3InvalidPart:      {{1, "aaa"}, {4, "ddd"}},
+        errS3EntityTooSmall:   {{2, "bbb"}, {3, "ccc"}},
+        errS3MalformedXML:     {},
+    }
+    for expected, listed := range cases {
+        if _, err := selectParts(received, listed); err != expected {
+            t.Errorf("%v: expected %v, got %v", listed, expected, err)
+        }
+    }
+    if _, err := selectParts(received, []completedPart{{1, "zzz"}}); err != errS3InvalidPart {
+        t.Errorf("Expected ETag mismatch to be rejected, got %v", err)
+    }
+}
+
+// TestServeS3Unauthenticated tests that unsigned and stale requests are
+// refused with S3 error documents
+func TestServeS3Unauthenticated(t *testing.T) {
+    rr := httptest.NewRecorder()
+    ServeS3(rr, httptest.NewRequest("GET", "/photos/a.jpg", nil))
+    if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "<Code>AccessDenied</Code>") {
+        t.Errorf("Expected AccessDenied, got %d %s", rr.Code, rr.Body.String())
+    }
+
+    req := httptest.NewRequest("GET", "/photos/a.jpg", nil)
+    req.Header.Set("X-Amz-Date", "20130524T000000Z")
+    req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+    req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKID/20130524/us-east-1/s3/aws4_request,SignedHeaders=host,Signature=abc")
+    rr = httptest.NewRecorder()
+    ServeS3(rr, req)
+    if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "RequestTimeTooSkewed") {
+        t.Errorf("Expected RequestTimeTooSkewed, got %d %s", rr.Code, rr.Body.String())
+    }
+}
+
+// TestSizeLimitReader tests that oversized bodies fail while they are read,
+// and that the failure reaches the client as EntityTooLarge
+func TestSizeLimitReader(t *testing.T) {
+    body := &trackingReader{r: &sizeLimitReader{r: strings.NewReader("hello world"), limit: 5}}
+    if _, err := io.ReadAll(body); err != errS3EntityTooLarge {
+        t.Errorf("Expected EntityTooLarge, got %v", err)
+    }
+    if err := s3StoreError(errors.New("upload failed"), body); err != errS3EntityTooLarge {
+        t.Errorf("Expected EntityTooLarge, got %v", err)
+    }
+
+    data, err := io.ReadAll(&sizeLimitReader{r: strings.NewReader("hello"), limit: 5})
+    if err != nil || string(data) != "hello" {
+        t.Errorf("Expected a body at the limit to be read, got %q, %v", data, err)
+    }
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+    "file-sharing-system/models"
+)
+
+const maxSearchResults = 100
+
+// SearchFiles finds the user's files whose name, tags or description match
+// every word of ?q= as a prefix. Results can be narrowed with type (e.g.
+// "application/pdf" or "image/*"), min_size and max_size (e.g. "10MB"),
+// from and to (dates or RFC 3339 times; a date in to includes that day),
+// folder, tag, meta.<key> and limit; org searches an organization's files.
+func SearchFiles(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    filter, err := parseSearchFilter(r.URL.Query())
+    if err != nil {
+        http.Error(w, "Invalid search parameters: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    orgID, ok := orgParam(w, r)
+    if !ok {
+        return
+    }
+    filter.UserID, filter.OrgID = user.ID, orgID
+
+    results, err := models.SearchFiles(filter)
+    if err != nil {
+        http.Error(w, "Unable to search files", http.StatusInternalServerError)
+        return
+    }
+    for i := range results {
+        results[i].ThumbnailURL = thumbnailURL(results[i].File)
+    }
+
+    json.NewEncoder(w).Encode(results)
+}
+
+// parseSearchFilter reads the search parameters, leaving UserID unset
+func parseSearchFilter(query url.Values) (models.SearchFilter, error) {
+    filter := models.SearchFilter{
+        Query:       query.Get("q"),
+        ContentType: strings.ToLower(strings.TrimSpace(query.Get("type"))),
+        Folder:      query.Get("folder"),
+    }
+    var err error
+    if filter.Tags, filter.Metadata, err = parseDetailFilters(query); err != nil {
+        return filter, err
+    }
+
+    for _, bound := range []struct {
+        param string
+        dest  **int64
+    }{{"min_size", &filter.MinSize}, {"max_size", &filter.MaxSize}} {
+        if value := query.Get(bound.param); value != "" {
+            size, err := models.ParseSize(value)
+            if err != nil || size < 0 {
+                return filter, errors.New("invalid " + bound.param)
+            }
+            *bound.dest = &size
+        }
+    }
+
+    if value := query.Get("from"); value != "" {
+        from, _, err := parseSearchTime(value)
+        if err != nil {
+            return filter, errors.New("invalid from date")
+        }
+        filter.From = &from
+    }
+    if value := query.Get("to"); value != "" {
+        to, dateOnly, err := parseSearchTime(value)
+        if err != nil {
+            return filter, errors.New("invalid to date")
+        }
+        if dateOnly {
+            to = to.AddDate(0, 0, 1)
+        }
+        filter.To = &to
+    }
+
+    filter.Limit = 20
+    if value := query.Get("limit"); value != "" {
+        limit, err := strconv.Atoi(value)
+        if err != nil || limit < 1 {
+            return filter, errors.New("invalid limit")
+        }
+        filter.Limit = min(limit, maxSearchResults)
+    }
+    return filter, nil
+}
+
+// parseSearchTime accepts a date (2006-01-02) or an RFC 3339 time and
+// reports which one it was given
+func parseSearchTime(value string) (time.Time, bool, error) {
+    if t, err := time.Parse("2006-01-02", value); err == nil {
+        return t, true, nil
+    }
+    t, err := time.Parse(time.RFC3339, value)
+    return t, false, err
+}
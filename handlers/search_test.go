@@ -0,0 +1,40 @@
+package handlers
+
+import (
+    "net/url"
+    "testing"
+    "time"
+)
+
+// TestParseSearchFilter tests reading the search filters from the query string
+func TestParseSearchFilter(t *testing.T) {
+    query, _ := url.ParseQuery("q=report&type=Image/*&min_size=1MB&max_size=2048&from=2026-01-01&to=2026-01-31&folder=/work&limit=500")
+    filter, err := parseSearchFilter(query)
+    if err != nil {
+        t.Fatalf("Error parsing filter: %s", err)
+    }
+    if filter.Query != "report" || filter.ContentType != "image/*" || filter.Folder != "/work" {
+        t.Errorf("Unexpected filter %+v", filter)
+    }
+    if filter.MinSize == nil || *filter.MinSize != 1<<20 || filter.MaxSize == nil || *filter.MaxSize != 2048 {
+        t.Errorf("Unexpected size range %v-%v", filter.MinSize, filter.MaxSize)
+    }
+    if !filter.From.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) || !filter.To.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("Expected the to date to include the whole day, got %s - %s", filter.From, filter.To)
+    }
+    if filter.Limit != maxSearchResults {
+        t.Errorf("Expected limit to be capped at %d, got %d", maxSearchResults, filter.Limit)
+    }
+
+    filter, err = parseSearchFilter(url.Values{"to": {"2026-01-31T12:00:00Z"}})
+    if err != nil || !filter.To.Equal(time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)) || filter.Limit != 20 {
+        t.Errorf("Expected an exact to time and the default limit, got %+v (%v)", filter, err)
+    }
+
+    for _, invalid := range []string{"min_size=lots", "max_size=-1", "from=yesterday", "to=2026-13-01", "limit=0"} {
+        query, _ := url.ParseQuery(invalid)
+        if _, err := parseSearchFilter(query); err == nil {
+            t.Errorf("%s: expected error", invalid)
+        }
+    }
+}
@@ -0,0 +1,531 @@
+package handlers
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/pem"
+    "errors"
+    "io"
+    "log"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/jackc/pgx/v4"
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/bcrypt"
+    "golang.org/x/crypto/ssh"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+const (
+    // sftpHandshakeTimeout bounds the key exchange and sign-in
+    sftpHandshakeTimeout = 30 * time.Second
+    // sftpMaxAuthTries is how many sign-in attempts a connection gets
+    sftpMaxAuthTries = 3
+    // sftpMaxFailures is how many wrong passwords an address, or an
+    // account, may send within sftpFailureWindow across all connections
+    sftpMaxFailures   = 10
+    sftpFailureWindow = 15 * time.Minute
+)
+
+// sftpFailures counts wrong SFTP passwords by address and by account
+var sftpFailures = newSignInLimiter(sftpMaxFailures, sftpFailureWindow)
+
+// sftpDummyHash is compared against when the account does not exist, so
+// that unknown emails take as long to refuse as wrong passwords
+var sftpDummyHash = sync.OnceValue(func() string {
+    hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+    return string(hash)
+})
+
+// signInLimiter refuses sign-ins for keys, such as an address or an
+// account, that have failed max times within window
+type signInLimiter struct {
+    mu       sync.Mutex
+    max      int
+    window   time.Duration
+    failures map[string]signInFailures
+}
+
+// signInFailures counts the failures of a key since the first of them
+type signInFailures struct {
+    count int
+    since time.Time
+}
+
+func newSignInLimiter(max int, window time.Duration) *signInLimiter {
+    return &signInLimiter{max: max, window: window, failures: map[string]signInFailures{}}
+}
+
+// blocked reports whether any of keys has used up its failures
+func (l *signInLimiter) blocked(now time.Time, keys ...string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, key := range keys {
+        if f, ok := l.failures[key]; ok && now.Sub(f.since) < l.window && f.count >= l.max {
+            return true
+        }
+    }
+    return false
+}
+
+// fail counts a failure against each of keys
+func (l *signInLimiter) fail(now time.Time, keys ...string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, key := range keys {
+        f := l.failures[key]
+        if now.Sub(f.since) >= l.window {
+            f = signInFailures{since: now}
+        }
+        f.count++
+        l.failures[key] = f
+    }
+    // Forget failures that have run their time once there are many
+    if len(l.failures) > 10000 {
+        for key, f := range l.failures {
+            if now.Sub(f.since) >= l.window {
+                delete(l.failures, key)
+            }
+        }
+    }
+}
+
+// reset forgets the failures of key
+func (l *signInLimiter) reset(key string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    delete(l.failures, key)
+}
+
+var (
+    errSFTPCredentials = errors.New("invalid credentials")
+    errNotFile         = errors.New("is a directory")
+    errDirNotEmpty     = errors.New("directory not empty")
+)
+
+// sftpHostKeyPath is where the SFTP server's host key is kept, from
+// SFTP_HOST_KEY (default sftp_host_ed25519_key)
+func sftpHostKeyPath() string {
+    if path := os.Getenv("SFTP_HOST_KEY"); path != "" {
+        return path
+    }
+    return "sftp_host_ed25519_key"
+}
+
+// sftpHostKey loads the server's host key, generating an ed25519 key on
+// first start so that clients see the same host key across restarts
+func sftpHostKey() (ssh.Signer, error) {
+    path := sftpHostKeyPath()
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        _, private, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        block, err := ssh.MarshalPrivateKey(private, "")
+        if err != nil {
+            return nil, err
+        }
+        data = pem.EncodeToMemory(block)
+        if err := os.WriteFile(path, data, 0o600); err != nil {
+            return nil, err
+        }
+        log.Println("Generated SFTP host key", path)
+    } else if err != nil {
+        return nil, err
+    }
+    return ssh.ParsePrivateKey(data)
+}
+
+// sftpServerConfig signs users in with their email as the user name and
+// either their password or one of their registered public keys. Refused
+// credentials are audited here; sign-ins once the handshake completes.
+// Addresses and accounts that send too many wrong passwords are refused
+// for a while, however many connections they spread them over.
+func sftpServerConfig(hostKey ssh.Signer) *ssh.ServerConfig {
+    config := &ssh.ServerConfig{
+        MaxAuthTries: sftpMaxAuthTries,
+        PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+            ipKey, accountKey := "ip:"+remoteHost(conn.RemoteAddr().String()), "account:"+strings.ToLower(conn.User())
+            if sftpFailures.blocked(time.Now(), ipKey, accountKey) {
+                auditSFTPSignIn(conn, models.User{}, models.AuditDenied, "password")
+                return nil, errSFTPCredentials
+            }
+            user, err := models.GetUserByEmail(conn.User())
+            hash := user.Password
+            if err != nil {
+                hash = sftpDummyHash()
+            }
+            if !CheckPasswordHash(string(password), hash) || err != nil {
+                sftpFailures.fail(time.Now(), ipKey, accountKey)
+                auditSFTPSignIn(conn, models.User{}, models.AuditDenied, "password")
+                return nil, errSFTPCredentials
+            }
+            sftpFailures.reset(accountKey)
+            return sftpPermissions(user, "password"), nil
+        },
+        PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+            user, err := models.GetUserBySSHKey(ssh.FingerprintSHA256(key))
+            if err != nil || !strings.EqualFold(user.Email, conn.User()) {
+                auditSFTPSignIn(conn, models.User{}, models.AuditDenied, "publickey")
+                return nil, errSFTPCredentials
+            }
+            return sftpPermissions(user, "publickey"), nil
+        },
+    }
+    config.AddHostKey(hostKey)
+    return config
+}
+
+func sftpPermissions(user models.User, method string) *ssh.Permissions {
+    return &ssh.Permissions{Extensions: map[string]string{"user_id": strconv.Itoa(user.ID), "method": method}}
+}
+
+// auditSFTPSignIn records a sign-in attempt with method, which names the
+// user once they are signed in and the user name they gave otherwise
+func auditSFTPSignIn(conn ssh.ConnMetadata, user models.User, outcome, method string) {
+    entry := signInEntry("sftp", user, conn.User(), outcome)
+    entry.Details["method"] = method
+    entry.IP = remoteHost(conn.RemoteAddr().String())
+    entry.UserAgent = string(conn.ClientVersion())
+    appendAudit(entry)
+}
+
+// ServeSFTP runs the SFTP server on addr, exposing each user's personal
+// files. It only returns when the server cannot start or stops accepting
+// connections.
+func ServeSFTP(addr string) error {
+    hostKey, err := sftpHostKey()
+    if err != nil {
+        return err
+    }
+    config := sftpServerConfig(hostKey)
+
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            return err
+        }
+        go serveSFTPConn(conn, config)
+    }
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+    defer conn.Close()
+
+    // Failed handshakes are too common to be worth logging. Clients get a
+    // bounded time to sign in, so idle connections are not kept open
+    // forever.
+    conn.SetDeadline(time.Now().Add(sftpHandshakeTimeout))
+    server, channels, requests, err := ssh.NewServerConn(conn, config)
+    if err != nil {
+        return
+    }
+    conn.SetDeadline(time.Time{})
+    defer server.Close()
+    go ssh.DiscardRequests(requests)
+
+    userID, _ := strconv.Atoi(server.Permissions.Extensions["user_id"])
+    auditSFTPSignIn(server, models.User{ID: userID, Email: server.User()}, models.AuditSuccess, server.Permissions.Extensions["method"])
+    source := models.AuditEntry{
+        ActorID:    &userID,
+        ActorEmail: server.User(),
+        IP:         remoteHost(server.RemoteAddr().String()),
+        UserAgent:  string(server.ClientVersion()),
+    }
+    for newChannel := range channels {
+        if newChannel.ChannelType() != "session" {
+            newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+            continue
+        }
+        channel, requests, err := newChannel.Accept()
+        if err != nil {
+            log.Println("Error accepting SFTP session:", err)
+            continue
+        }
+        go serveSFTPSession(channel, requests, userID, source)
+    }
+}
+
+// serveSFTPSession runs the sftp subsystem on a session. Shells and
+// commands are refused. Audit entries name source's actor and client.
+func serveSFTPSession(channel ssh.Channel, requests <-chan *ssh.Request, userID int, source models.AuditEntry) {
+    defer channel.Close()
+
+    for req := range requests {
+        // The payload is the subsystem name as an SSH string
+        ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+        req.Reply(ok, nil)
+        if !ok {
+            continue
+        }
+
+        go ssh.DiscardRequests(requests)
+        fs := &sftpFS{fs: &davFS{userID: userID}, source: source}
+        server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+        if err := server.Serve(); err != nil && err != io.EOF {
+            log.Println("SFTP session ended:", err)
+        }
+        server.Close()
+        return
+    }
+}
+
+// sftpFS serves a user's files over SFTP through the file system behind
+// WebDAV
+type sftpFS struct {
+    fs     *davFS
+    source models.AuditEntry
+}
+
+// audit records a download, upload or deletion of a path in the audit log
+func (h *sftpFS) audit(action, path string, err error) {
+    entry := h.source
+    entry.Action, entry.TargetType, entry.TargetID = action, "path", path
+    entry.Outcome, entry.Details = models.AuditSuccess, map[string]string{"protocol": "sftp"}
+    if err != nil {
+        entry.Outcome = models.AuditFailure
+        if errors.Is(err, os.ErrPermission) {
+            entry.Outcome = models.AuditDenied
+        }
+        entry.Details["error"] = err.Error()
+    }
+    appendAudit(entry)
+}
+
+func (h *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+    reader, err := h.open(r)
+    h.audit(models.AuditFileDownload, r.Filepath, err)
+    return reader, err
+}
+
+func (h *sftpFS) open(r *sftp.Request) (io.ReaderAt, error) {
+    f, err := h.fs.OpenFile(r.Context(), r.Filepath, os.O_RDONLY, 0)
+    if err != nil {
+        return nil, err
+    }
+    reader, ok := f.(*davReader)
+    if !ok {
+        f.Close()
+        return nil, errNotFile
+    }
+    return &sftpReader{r: reader}, nil
+}
+
+func (h *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+    flags := r.Pflags()
+    if flags.Append {
+        return nil, sftp.ErrSSHFxOpUnsupported
+    }
+    folder, name, err := davPath(r.Filepath)
+    if err != nil {
+        return nil, err
+    }
+    if name == "" {
+        return nil, os.ErrInvalid
+    }
+    if err := h.fs.parentExists(folder); err != nil {
+        return nil, err
+    }
+    if flags.Excl {
+        _, err := models.GetFileByPath(h.fs.userID, 0, folder, name)
+        if err == nil {
+            return nil, os.ErrExist
+        }
+        if err != pgx.ErrNoRows {
+            return nil, err
+        }
+    }
+
+    usage, err := workspaceUsage(h.fs.userID, 0)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.MkdirAll(utils.StagingDir(), 0o755); err != nil {
+        return nil, err
+    }
+    tmp, err := os.CreateTemp(utils.StagingDir(), "sftp-*")
+    if err != nil {
+        return nil, err
+    }
+    record := func(err error) {
+        h.audit(models.AuditFileUpload, r.Filepath, err)
+    }
+    return &sftpWriter{fs: h.fs, folder: folder, name: name, tmp: tmp, limit: usage.BytesRemaining, record: record}, nil
+}
+
+func (h *sftpFS) Filecmd(r *sftp.Request) error {
+    ctx := r.Context()
+    switch r.Method {
+    case "Setstat":
+        // Modes, owners and times are not kept
+        return nil
+    case "Rename":
+        return h.fs.Rename(ctx, r.Filepath, r.Target)
+    case "Mkdir":
+        return h.fs.Mkdir(ctx, r.Filepath, 0)
+    case "Rmdir":
+        f, err := h.fs.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        dir, ok := f.(*davDir)
+        if !ok {
+            return errNotDir
+        }
+        entries, err := dir.Readdir(0)
+        if err != nil {
+            return err
+        }
+        if len(entries) > 0 {
+            return errDirNotEmpty
+        }
+        return h.fs.RemoveAll(ctx, r.Filepath)
+    case "Remove":
+        file, _, err := h.fs.lookup(r.Filepath)
+        if err != nil {
+            return err
+        }
+        if file == nil {
+            return errNotFile
+        }
+        err = h.fs.RemoveAll(ctx, r.Filepath)
+        h.audit(models.AuditFileDelete, r.Filepath, err)
+        return err
+    }
+    return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+    switch r.Method {
+    case "List":
+        f, err := h.fs.OpenFile(r.Context(), r.Filepath, os.O_RDONLY, 0)
+        if err != nil {
+            return nil, err
+        }
+        defer f.Close()
+        dir, ok := f.(*davDir)
+        if !ok {
+            return nil, errNotDir
+        }
+        entries, err := dir.Readdir(0)
+        return sftpListing(entries), err
+    case "Stat":
+        info, err := h.fs.Stat(r.Context(), r.Filepath)
+        if err != nil {
+            return nil, err
+        }
+        return sftpListing{info}, nil
+    }
+    return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpListing is a directory listing or a single file's details
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+    if offset >= int64(len(l)) {
+        return 0, io.EOF
+    }
+    n := copy(entries, l[offset:])
+    if n < len(entries) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+// sftpReader reads a file at the offsets clients ask for. Requests usually
+// come in order, so the content stream is only reopened after a jump.
+type sftpReader struct {
+    mu sync.Mutex
+    r  *davReader
+}
+
+func (s *sftpReader) ReadAt(p []byte, offset int64) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := s.r.Seek(offset, io.SeekStart); err != nil {
+        return 0, err
+    }
+    n, err := io.ReadFull(s.r, p)
+    if err == io.ErrUnexpectedEOF {
+        err = io.EOF
+    }
+    return n, err
+}
+
+func (s *sftpReader) Close() error {
+    return s.r.Close()
+}
+
+// sftpWriter stages an upload, whose writes may arrive out of order, in a
+// temporary file and stores it once the client closes it, replacing the
+// file of the same name. Uploads cut off by a dropped connection are
+// discarded. record, when set, is told how the upload ended.
+type sftpWriter struct {
+    fs     *davFS
+    folder string
+    name   string
+    tmp    *os.File
+    limit  int64
+    failed error
+    record func(error)
+}
+
+func (s *sftpWriter) WriteAt(p []byte, offset int64) (int, error) {
+    if offset+int64(len(p)) > s.limit {
+        return 0, errQuotaExceeded
+    }
+    return s.tmp.WriteAt(p, offset)
+}
+
+func (s *sftpWriter) TransferError(err error) {
+    s.failed = err
+}
+
+func (s *sftpWriter) Close() error {
+    defer os.Remove(s.tmp.Name())
+    defer s.tmp.Close()
+    if s.failed != nil {
+        if s.record != nil {
+            s.record(s.failed)
+        }
+        return nil
+    }
+    err := s.store()
+    if s.record != nil {
+        s.record(err)
+    }
+    return err
+}
+
+// store saves the staged upload, replacing the file of the same name
+func (s *sftpWriter) store() error {
+    if _, err := s.tmp.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    previous, err := models.GetFileByPath(s.fs.userID, 0, s.folder, s.name)
+    if err != nil && err != pgx.ErrNoRows {
+        return err
+    }
+    if _, err := storeFile(s.fs.userID, s.name, s.tmp, storeOptions{Folder: s.folder}); err != nil {
+        return err
+    }
+    if previous.ID != 0 {
+        if err := removeFile(previous); err != nil {
+            log.Println("Error removing replaced file:", err)
+        }
+    }
+    return nil
+}
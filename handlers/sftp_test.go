@@ -0,0 +1,122 @@
+package handlers
+
+import (
+    "bytes"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestParsePublicKey tests reading authorized_keys lines
+func TestParsePublicKey(t *testing.T) {
+    line := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl partner@sftp\n"
+    key, fingerprint, comment, err := parsePublicKey(line)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(key, "ssh-ed25519 AAAA") || strings.HasSuffix(key, "\n") || strings.Contains(key, "partner") {
+        t.Errorf("Unexpected normalized key %q", key)
+    }
+    if !strings.HasPrefix(fingerprint, "SHA256:") || comment != "partner@sftp" {
+        t.Errorf("Unexpected fingerprint %q or comment %q", fingerprint, comment)
+    }
+
+    if _, _, _, err := parsePublicKey("not a key"); err == nil {
+        t.Error("Expected invalid key to be rejected")
+    }
+}
+
+// TestSFTPHostKey tests that the host key is generated once and reused
+func TestSFTPHostKey(t *testing.T) {
+    t.Setenv("SFTP_HOST_KEY", filepath.Join(t.TempDir(), "host_key"))
+
+    first, err := sftpHostKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := sftpHostKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(first.PublicKey().Marshal(), second.PublicKey().Marshal()) {
+        t.Error("Expected the same host key after a restart")
+    }
+}
+
+// TestSFTPListing tests listing entries in batches
+func TestSFTPListing(t *testing.T) {
+    listing := sftpListing{davDirInfo{name: "a"}, davDirInfo{name: "b"}, davDirInfo{name: "c"}}
+    batch := make([]os.FileInfo, 2)
+
+    if n, err := listing.ListAt(batch, 0); n != 2 || err != nil {
+        t.Errorf("Expected a full first batch, got %d %v", n, err)
+    }
+    if n, err := listing.ListAt(batch, 2); n != 1 || err != io.EOF || batch[0].Name() != "c" {
+        t.Errorf("Expected the last entry and io.EOF, got %d %v", n, err)
+    }
+    if n, err := listing.ListAt(batch, 3); n != 0 || err != io.EOF {
+        t.Errorf("Expected io.EOF past the end, got %d %v", n, err)
+    }
+}
+
+// TestSFTPWriter tests that uploads stage writes in any order, stop at the
+// quota, and are discarded when the transfer fails
+func TestSFTPWriter(t *testing.T) {
+    tmp, err := os.CreateTemp(t.TempDir(), "sftp-*")
+    if err != nil {
+        t.Fatal(err)
+    }
+    w := &sftpWriter{fs: &davFS{userID: 1}, folder: "/", name: "a.txt", tmp: tmp, limit: 10}
+
+    w.WriteAt([]byte("world"), 5)
+    w.WriteAt([]byte("hello"), 0)
+    staged, _ := os.ReadFile(tmp.Name())
+    if string(staged) != "helloworld" {
+        t.Errorf("Expected helloworld, got %q", staged)
+    }
+    if _, err := w.WriteAt([]byte("!"), 10); err != errQuotaExceeded {
+        t.Errorf("Expected quota error, got %v", err)
+    }
+
+    w.TransferError(io.ErrUnexpectedEOF)
+    if err := w.Close(); err != nil {
+        t.Errorf("Expected failed transfer to be discarded, got %v", err)
+    }
+    if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+        t.Error("Expected staged file to be removed")
+    }
+}
+
+// TestSignInLimiter tests that failures count across connections per key
+// and are forgotten once the window has passed
+func TestSignInLimiter(t *testing.T) {
+    l := newSignInLimiter(3, time.Minute)
+    now := time.Now()
+
+    for i := 0; i < 3; i++ {
+        if l.blocked(now, "ip:a", "account:x") {
+            t.Fatalf("Expected attempt %d to be allowed", i+1)
+        }
+        l.fail(now, "ip:a", "account:x")
+    }
+    if !l.blocked(now, "ip:a", "account:y") {
+        t.Error("Expected the address to be blocked for any account")
+    }
+    if !l.blocked(now, "ip:b", "account:x") {
+        t.Error("Expected the account to be blocked from any address")
+    }
+    if l.blocked(now, "ip:b", "account:y") {
+        t.Error("Expected other addresses and accounts to be allowed")
+    }
+    if l.blocked(now.Add(time.Minute), "ip:a", "account:x") {
+        t.Error("Expected failures to be forgotten after the window")
+    }
+
+    l.reset("account:x")
+    if l.blocked(now, "ip:b", "account:x") {
+        t.Error("Expected a reset account to be allowed")
+    }
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/gorilla/mux"
+    "github.com/jackc/pgx/v4"
+    "file-sharing-system/models"
+)
+
+const (
+    defaultShareLinkHours = 7 * 24
+    maxShareLinkHours     = 365 * 24
+)
+
+// shareLinkURL is the public address of a share link
+func shareLinkURL(token string) string {
+    return appURL() + "/s/" + token
+}
+
+// CreateShareLink creates a public link to a file, which takes the owner
+// role. The link expires after expires_in_hours (7 days by default, at most
+// a year) and its URL is only returned in this response.
+func CreateShareLink(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+    file, ok := authorizeFile(w, r, models.RoleOwner)
+    if !ok || !checkScanStatus(w, file) {
+        return
+    }
+
+    var body struct {
+        ExpiresInHours int `json:"expires_in_hours"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+            http.Error(w, "Invalid share link request", http.StatusBadRequest)
+            return
+        }
+    }
+    if body.ExpiresInHours == 0 {
+        body.ExpiresInHours = defaultShareLinkHours
+    }
+    if body.ExpiresInHours < 0 || body.ExpiresInHours > maxShareLinkHours {
+        http.Error(w, "Invalid share link request: expires_in_hours must be between 1 and 8760", http.StatusUnprocessableEntity)
+        return
+    }
+
+    token := models.NewShareLinkToken()
+    link, err := models.CreateShareLink(models.ShareLink{
+        FileID:    file.ID,
+        CreatedBy: user.ID,
+        ExpiresAt: time.Now().Add(time.Duration(body.ExpiresInHours) * time.Hour),
+    }, token)
+    if err != nil {
+        http.Error(w, "Unable to create share link", http.StatusInternalServerError)
+        return
+    }
+    auditDetail(r, "link_id", strconv.Itoa(link.ID))
+    auditDetail(r, "expires_at", link.ExpiresAt.UTC().Format(time.RFC3339))
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "url":        shareLinkURL(token),
+        "share_link": link,
+    })
+}
+
+// GetShareLinks lists a file's unexpired share links, without their URLs
+func GetShareLinks(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleOwner)
+    if !ok {
+        return
+    }
+
+    links, err := models.GetShareLinks(file.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve share links", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(links)
+}
+
+// DeleteShareLink revokes one of a file's share links
+func DeleteShareLink(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleOwner)
+    if !ok {
+        return
+    }
+
+    id, err := strconv.Atoi(mux.Vars(r)["link_id"])
+    if err != nil {
+        http.Error(w, "Share link not found", http.StatusNotFound)
+        return
+    }
+    auditDetail(r, "link_id", strconv.Itoa(id))
+    if err := models.DeleteShareLink(file.ID, id); err != nil {
+        if err == pgx.ErrNoRows {
+            http.Error(w, "Share link not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Unable to revoke share link", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// DownloadSharedFile serves the file behind a share link to anyone holding
+// the link. Unknown and expired links get 404.
+func DownloadSharedFile(w http.ResponseWriter, r *http.Request) {
+    file, link, err := models.GetFileByShareLink(mux.Vars(r)["token"])
+    if err != nil {
+        http.Error(w, "Share link not found or expired", http.StatusNotFound)
+        return
+    }
+    auditTarget(r, "share_link", strconv.Itoa(link.ID))
+    auditDetail(r, "file_id", strconv.Itoa(file.ID))
+    auditDetail(r, "name", file.Name)
+    if !checkScanStatus(w, file) {
+        return
+    }
+    // Resumed and segmented downloads request many ranges; only the one
+    // from the start of the file counts as an access
+    if offset, _, _, err := parseRange(r.Header.Get("Range"), file.Size); err == nil && offset == 0 {
+        notifyWebhooks(models.WebhookShareAccessed, file, map[string]interface{}{"file": file, "share_link": link})
+    }
+    serveContent(w, r, file)
+}
+
+// PurgeExpiredShareLinks deletes share links that have expired
+func PurgeExpiredShareLinks() error {
+    _, err := models.DeleteExpiredShareLinks(time.Now())
+    return err
+}
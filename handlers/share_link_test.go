@@ -0,0 +1,19 @@
+package handlers
+
+import (
+    "strings"
+    "testing"
+    "file-sharing-system/models"
+)
+
+// TestShareLinkURL tests that share links point at the public download route
+func TestShareLinkURL(t *testing.T) {
+    t.Setenv("APP_URL", "https://files.example.com/")
+    token := models.NewShareLinkToken()
+    if len(token) != 48 || strings.Trim(token, "0123456789abcdef") != "" {
+        t.Errorf("Unexpected token %q", token)
+    }
+    if url := shareLinkURL(token); url != "https://files.example.com/s/"+token {
+        t.Errorf("Unexpected URL %q", url)
+    }
+}
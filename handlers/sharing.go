@@ -0,0 +1,259 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "github.com/gorilla/mux"
+    "file-sharing-system/models"
+)
+
+// authorizeFile fetches the file named in the URL and checks that the
+// authenticated user holds at least role on it, as owner or through an ACL
+// entry. Every file handler calls it before acting. Users without any
+// access get 404, so file IDs do not reveal which files exist.
+func authorizeFile(w http.ResponseWriter, r *http.Request, role string) (models.File, bool) {
+    user, _ := currentUser(r)
+
+    auditTarget(r, "file", mux.Vars(r)["file_id"])
+    file, err := models.GetFileByID(mux.Vars(r)["file_id"])
+    if err != nil {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return models.File{}, false
+    }
+    auditFile(r, file)
+    held, err := models.FileRole(file, user.ID)
+    if err != nil {
+        http.Error(w, "Unable to check permissions", http.StatusInternalServerError)
+        return models.File{}, false
+    }
+    if held == "" {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return models.File{}, false
+    }
+    if models.RoleRank(held) < models.RoleRank(role) {
+        http.Error(w, "Insufficient permissions: this requires the "+role+" role", http.StatusForbidden)
+        return models.File{}, false
+    }
+    file.ThumbnailURL = thumbnailURL(file)
+    return file, true
+}
+
+// grantRequest is the body of the permission endpoints: a registered
+// user's email or a user group, and the role to grant them
+type grantRequest struct {
+    Email string `json:"email"`
+    Group string `json:"group"`
+    Role  string `json:"role"`
+}
+
+// validate checks that the request names exactly one grantee and a known role
+func (g *grantRequest) validate() error {
+    g.Email = strings.TrimSpace(g.Email)
+    g.Group = strings.TrimSpace(g.Group)
+    if (g.Email == "") == (g.Group == "") {
+        return errors.New("give either an email or a group")
+    }
+    if models.RoleRank(g.Role) == 0 {
+        return errors.New("role must be one of " + strings.Join(models.Roles, ", "))
+    }
+    return nil
+}
+
+// grant decodes a grant request and saves it as an ACL entry built by entry
+func grant(w http.ResponseWriter, r *http.Request, entry models.ACLEntry) {
+    user, _ := currentUser(r)
+
+    var req grantRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid permission", http.StatusBadRequest)
+        return
+    }
+    if err := req.validate(); err != nil {
+        http.Error(w, "Invalid permission: "+err.Error(), http.StatusUnprocessableEntity)
+        return
+    }
+
+    entry.Email, entry.Group, entry.Role, entry.CreatedBy = req.Email, req.Group, req.Role, user.ID
+    auditDetail(r, "grantee", granteeName(entry))
+    auditDetail(r, "role", req.Role)
+    saved, err := models.GrantAccess(entry)
+    if err == models.ErrGranteeNotFound || err == models.ErrGranteeIsOwner {
+        http.Error(w, "Invalid permission: "+err.Error(), http.StatusUnprocessableEntity)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Unable to save permission", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(saved)
+}
+
+// granteeName is who an ACL entry grants access to, for the audit log
+func granteeName(entry models.ACLEntry) string {
+    if entry.Group != "" {
+        return "group:" + entry.Group
+    }
+    return entry.Email
+}
+
+// GetFilePermissions lists who can access a file, including access
+// inherited from its folders
+func GetFilePermissions(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleOwner)
+    if !ok {
+        return
+    }
+
+    entries, err := models.GetFileACL(file)
+    if err != nil {
+        http.Error(w, "Unable to retrieve permissions", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(entries)
+}
+
+// PutFilePermission grants a user or group a role on a file, replacing the
+// role they had on it
+func PutFilePermission(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleOwner)
+    if !ok {
+        return
+    }
+
+    grant(w, r, models.ACLEntry{OwnerID: file.UserID, OrgID: file.OrgID, FileID: &file.ID})
+}
+
+// folderParam reads the folder given by ?path= from the authenticated
+// user's files, or from an organization's files given by ?org=, which
+// takes the admin role in the organization
+func folderParam(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+    user, _ := currentUser(r)
+
+    folder, err := normalizeFolder(r.URL.Query().Get("path"))
+    if err != nil {
+        http.Error(w, "Invalid folder: "+err.Error(), http.StatusBadRequest)
+        return 0, "", false
+    }
+    orgID, ok := orgParam(w, r)
+    if !ok || orgID == 0 {
+        return orgID, folder, ok
+    }
+    if role, err := models.OrgRole(orgID, user.ID); err != nil || models.OrgRoleRank(role) < models.OrgRoleRank(models.OrgAdmin) {
+        http.Error(w, "Insufficient permissions: this requires the admin role in the organization", http.StatusForbidden)
+        return 0, "", false
+    }
+    return orgID, folder, true
+}
+
+// folderEntry is the ACL entry for a folder of the user's files, or of an
+// organization's files when orgID is set
+func folderEntry(userID, orgID int, folder string) models.ACLEntry {
+    if orgID != 0 {
+        return models.ACLEntry{OrgID: &orgID, Folder: &folder}
+    }
+    return models.ACLEntry{OwnerID: userID, Folder: &folder}
+}
+
+// GetFolderPermissions lists who can access one of the user's folders
+func GetFolderPermissions(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+    orgID, folder, ok := folderParam(w, r)
+    if !ok {
+        return
+    }
+
+    entries, err := models.GetFolderACL(user.ID, orgID, folder)
+    if err != nil {
+        http.Error(w, "Unable to retrieve permissions", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(entries)
+}
+
+// PutFolderPermission grants a user or group a role on one of the user's
+// folders, which applies to every file in it and in the folders below it
+func PutFolderPermission(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+    orgID, folder, ok := folderParam(w, r)
+    if !ok {
+        return
+    }
+    auditTarget(r, "folder", folder)
+
+    grant(w, r, folderEntry(user.ID, orgID, folder))
+}
+
+// DeletePermission revokes an ACL entry. Folder entries can be revoked by
+// the folder's owner, or for organization folders by the organization's
+// admins; file entries by anyone holding the owner role on the file.
+func DeletePermission(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    auditTarget(r, "permission", mux.Vars(r)["permission_id"])
+    id, err := strconv.Atoi(mux.Vars(r)["permission_id"])
+    if err != nil {
+        http.Error(w, "Permission not found", http.StatusNotFound)
+        return
+    }
+    entry, err := models.GetACLEntry(id)
+    if err != nil {
+        http.Error(w, "Permission not found", http.StatusNotFound)
+        return
+    }
+    auditDetail(r, "grantee", granteeName(entry))
+    auditDetail(r, "role", entry.Role)
+
+    allowed := false
+    switch {
+    case entry.FileID != nil:
+        file, err := models.GetFileByID(strconv.Itoa(*entry.FileID))
+        if err == nil {
+            role, err := models.FileRole(file, user.ID)
+            allowed = err == nil && role == models.RoleOwner
+        }
+    case entry.OrgID != nil:
+        role, err := models.OrgRole(*entry.OrgID, user.ID)
+        allowed = err == nil && models.OrgRoleRank(role) >= models.OrgRoleRank(models.OrgAdmin)
+    default:
+        allowed = entry.OwnerID == user.ID
+    }
+    if !allowed {
+        http.Error(w, "Permission not found", http.StatusNotFound)
+        return
+    }
+
+    if err := models.RevokeAccess(entry.ID); err != nil {
+        http.Error(w, "Unable to revoke permission", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// SharedWithMe lists the files other users have shared with the
+// authenticated user, directly, through a folder or through their group
+func SharedWithMe(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    limit := defaultPageSize
+    if value := r.URL.Query().Get("limit"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        limit = min(n, maxPageSize)
+    }
+
+    files, err := models.GetSharedWithUser(user.ID, limit)
+    if err != nil {
+        http.Error(w, "Unable to retrieve shared files", http.StatusInternalServerError)
+        return
+    }
+    for i := range files {
+        files[i].ThumbnailURL = thumbnailURL(files[i].File)
+    }
+    json.NewEncoder(w).Encode(files)
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+    "testing"
+)
+
+// TestGrantRequestValidate tests that a grant names one grantee and a known role
+func TestGrantRequestValidate(t *testing.T) {
+    valid := []grantRequest{
+        {Email: " bob@example.com ", Role: "viewer"},
+        {Group: "finance", Role: "editor"},
+    }
+    for _, req := range valid {
+        if err := req.validate(); err != nil {
+            t.Errorf("%+v: unexpected error %s", req, err)
+        }
+    }
+
+    invalid := []grantRequest{
+        {Role: "viewer"},
+        {Email: "bob@example.com", Group: "finance", Role: "viewer"},
+        {Email: "bob@example.com", Role: "admin"},
+        {Group: "finance"},
+    }
+    for _, req := range invalid {
+        if err := req.validate(); err == nil {
+            t.Errorf("%+v: expected error", req)
+        }
+    }
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "github.com/gorilla/mux"
+    "github.com/jackc/pgx/v4"
+    "golang.org/x/crypto/ssh"
+    "file-sharing-system/models"
+)
+
+// parsePublicKey reads a public key in authorized_keys format, returning
+// it normalized along with its fingerprint. The key's comment becomes the
+// default name.
+func parsePublicKey(text string) (string, string, string, error) {
+    key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+    if err != nil {
+        return "", "", "", err
+    }
+    normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+    return normalized, ssh.FingerprintSHA256(key), comment, nil
+}
+
+// CreateSSHKey registers a public key the authenticated user can sign in
+// to the SFTP server with
+func CreateSSHKey(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    var body struct {
+        Name      string `json:"name"`
+        PublicKey string `json:"public_key"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid key request", http.StatusBadRequest)
+        return
+    }
+    publicKey, fingerprint, comment, err := parsePublicKey(body.PublicKey)
+    if err != nil {
+        http.Error(w, "Invalid public key: use the authorized_keys format, e.g. the content of id_ed25519.pub", http.StatusUnprocessableEntity)
+        return
+    }
+    name := strings.TrimSpace(body.Name)
+    if name == "" {
+        name = comment
+    }
+    if len(name) > maxTokenNameLength {
+        http.Error(w, "Invalid key request: the name is at most 100 bytes", http.StatusUnprocessableEntity)
+        return
+    }
+
+    key, err := models.CreateSSHKey(models.SSHKey{UserID: user.ID, Name: name, PublicKey: publicKey, Fingerprint: fingerprint})
+    if err == models.ErrSSHKeyTaken {
+        http.Error(w, "This public key is already registered", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Unable to register key", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(key)
+}
+
+// GetSSHKeys lists the authenticated user's public keys
+func GetSSHKeys(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    keys, err := models.GetSSHKeys(user.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve keys", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(keys)
+}
+
+// DeleteSSHKey removes one of the authenticated user's public keys
+func DeleteSSHKey(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    id, err := strconv.Atoi(mux.Vars(r)["key_id"])
+    if err != nil {
+        http.Error(w, "Key not found", http.StatusNotFound)
+        return
+    }
+    if err := models.DeleteSSHKey(user.ID, id); err != nil {
+        if err == pgx.ErrNoRows {
+            http.Error(w, "Key not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Unable to remove key", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
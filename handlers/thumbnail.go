@@ -0,0 +1,84 @@
+package handlers
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+// thumbnailURL is where a file's thumbnail is served once it is ready
+func thumbnailURL(file models.File) string {
+    if file.PreviewStatus != models.PreviewReady {
+        return ""
+    }
+    return fmt.Sprintf("/files/%d/thumbnail", file.ID)
+}
+
+// GetThumbnail serves a JPEG thumbnail of an image file. The size query
+// parameter picks one of utils.ThumbnailSizes and defaults to
+// utils.DefaultThumbnailSize. Thumbnails never change once generated, so
+// they are cached by the browser and revalidated with their ETag.
+func GetThumbnail(w http.ResponseWriter, r *http.Request) {
+    file, ok := authorizeFile(w, r, models.RoleViewer)
+    if !ok || !checkScanStatus(w, file) {
+        return
+    }
+
+    size := utils.DefaultThumbnailSize
+    if param := r.URL.Query().Get("size"); param != "" {
+        var err error
+        size, err = strconv.Atoi(param)
+        if err != nil || !utils.ValidThumbnailSize(size) {
+            http.Error(w, fmt.Sprintf("Thumbnail size must be one of %v", utils.ThumbnailSizes), http.StatusBadRequest)
+            return
+        }
+    }
+
+    switch file.PreviewStatus {
+    case models.PreviewReady:
+    case models.PreviewPending:
+        w.Header().Set("Retry-After", "5")
+        http.Error(w, "Thumbnail is still being generated", http.StatusAccepted)
+        return
+    default:
+        http.Error(w, "No thumbnail available for this file", http.StatusNotFound)
+        return
+    }
+
+    thumb, err := models.GetThumbnail(file.ID, size)
+    if err != nil {
+        http.Error(w, "No thumbnail available for this file", http.StatusNotFound)
+        return
+    }
+
+    etag := fmt.Sprintf(`"%s-%d"`, file.Checksum, size)
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", "private, max-age=86400")
+    if r.Header.Get("If-None-Match") == etag {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+
+    content, err := models.OpenThumbnail(thumb)
+    if err != nil {
+        http.Error(w, "Unable to read thumbnail", http.StatusInternalServerError)
+        return
+    }
+    defer content.Close()
+
+    w.Header().Set("Content-Type", "image/jpeg")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.Header().Set("Content-Length", strconv.FormatInt(thumb.Bytes, 10))
+    w.Header().Set("Last-Modified", thumb.CreatedAt.UTC().Format(http.TimeFormat))
+    io.Copy(w, content)
+}
+
+// deleteThumbnails removes the derived thumbnail objects of a file
+func deleteThumbnails(thumbs []models.Thumbnail) {
+    for _, thumb := range thumbs {
+        utils.GetStorage().Delete(thumb.StorageKey)
+    }
+}
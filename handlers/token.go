@@ -0,0 +1,90 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+    "github.com/jackc/pgx/v4"
+    "file-sharing-system/models"
+)
+
+// maxTokenNameLength bounds API token names
+const maxTokenNameLength = 100
+
+// CreateAPIToken creates an API token for the authenticated user, along
+// with an S3 access key for the S3 gateway. The token and the secret access
+// key are only returned in this response. expires_in_days, when given,
+// limits how long they can be used.
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    var body struct {
+        Name          string `json:"name"`
+        ExpiresInDays int    `json:"expires_in_days"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid token request", http.StatusBadRequest)
+        return
+    }
+    body.Name = strings.TrimSpace(body.Name)
+    if body.Name == "" || len(body.Name) > maxTokenNameLength || body.ExpiresInDays < 0 {
+        http.Error(w, "Invalid token request: a name of at most 100 bytes is required", http.StatusUnprocessableEntity)
+        return
+    }
+
+    t := models.APIToken{UserID: user.ID, Name: body.Name}
+    if body.ExpiresInDays > 0 {
+        expires := time.Now().AddDate(0, 0, body.ExpiresInDays)
+        t.ExpiresAt = &expires
+    }
+    token := models.NewAPIToken()
+    var secret string
+    t.AccessKeyID, secret = models.NewS3Credentials()
+    t, err := models.CreateAPIToken(t, token, secret)
+    if err != nil {
+        http.Error(w, "Unable to create token", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "token":             token,
+        "secret_access_key": secret,
+        "api_token":         t,
+    })
+}
+
+// GetAPITokens lists the authenticated user's API tokens, without the tokens themselves
+func GetAPITokens(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    tokens, err := models.GetAPITokens(user.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve tokens", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(tokens)
+}
+
+// DeleteAPIToken revokes one of the authenticated user's API tokens
+func DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    id, err := strconv.Atoi(mux.Vars(r)["token_id"])
+    if err != nil {
+        http.Error(w, "Token not found", http.StatusNotFound)
+        return
+    }
+    if err := models.DeleteAPIToken(user.ID, id); err != nil {
+        if err == pgx.ErrNoRows {
+            http.Error(w, "Token not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Unable to revoke token", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
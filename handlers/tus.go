@@ -0,0 +1,384 @@
+package handlers
+
+import (
+    "encoding/base64"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+    "github.com/gorilla/mux"
+)
+
+// Resumable uploads implementing the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination and expiration extensions. Received bytes
+// are appended to a staging file and moved to the storage backend once the
+// upload is complete.
+
+const (
+    tusVersion    = "1.0.0"
+    tusExtensions = "creation,termination,expiration"
+)
+
+// uploadLocks serialises PATCH and DELETE requests for the same upload
+var uploadLocks sync.Map
+
+func lockUpload(id string) (func(), bool) {
+    v, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+    mu := v.(*sync.Mutex)
+    if !mu.TryLock() {
+        return nil, false
+    }
+    return mu.Unlock, true
+}
+
+func uploadExpiry() time.Duration {
+    if expiry, err := time.ParseDuration(os.Getenv("UPLOAD_EXPIRY")); err == nil && expiry > 0 {
+        return expiry
+    }
+    return 24 * time.Hour
+}
+
+func stagingPath(id string) string {
+    return filepath.Join(utils.StagingDir(), id)
+}
+
+// checkTusVersion answers 412 when the client speaks an unsupported tus version
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+    w.Header().Set("Tus-Resumable", tusVersion)
+    if r.Header.Get("Tus-Resumable") != tusVersion {
+        w.Header().Set("Tus-Version", tusVersion)
+        http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+        return false
+    }
+    return true
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header of comma separated
+// "key base64value" pairs; keys may appear without a value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+    metadata := make(map[string]string)
+    for _, pair := range strings.Split(header, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        key, encoded, _ := strings.Cut(pair, " ")
+        value, err := base64.StdEncoding.DecodeString(encoded)
+        if err != nil {
+            return nil, err
+        }
+        metadata[key] = string(value)
+    }
+    return metadata, nil
+}
+
+// TusOptions advertises the supported tus version and extensions
+func TusOptions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Tus-Resumable", tusVersion)
+    w.Header().Set("Tus-Version", tusVersion)
+    w.Header().Set("Tus-Extension", tusExtensions)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a new resumable upload (creation extension)
+func CreateUpload(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+    user, _ := currentUser(r)
+    if r.Header.Get("Upload-Length") != "0" {
+        // Uploads are audited when their last chunk arrives; only empty
+        // ones complete when they are created
+        skipAudit(r)
+    }
+
+    length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+    if err != nil || length < 0 {
+        http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+        return
+    }
+    metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+    if err != nil {
+        http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+        return
+    }
+    if err := uploadEncryption(metadata).validate(); err != nil {
+        http.Error(w, "Invalid encryption header", http.StatusBadRequest)
+        return
+    }
+    orgID, ok := parseOrgID(w, metadata["org_id"])
+    if !ok {
+        return
+    }
+    if orgID != 0 {
+        if _, ok := requireOrgMember(w, user.ID, orgID); !ok {
+            return
+        }
+    }
+
+    usage, err := workspaceUsage(user.ID, orgID)
+    if err != nil {
+        http.Error(w, "Unable to check storage quota", http.StatusInternalServerError)
+        return
+    }
+    if length > usage.QuotaBytes {
+        http.Error(w, "File is larger than your storage quota", http.StatusRequestEntityTooLarge)
+        return
+    }
+    if length > usage.BytesRemaining {
+        http.Error(w, "Not enough storage quota remaining for this file", http.StatusInsufficientStorage)
+        return
+    }
+
+    now := time.Now()
+    upload := models.Upload{
+        ID:        utils.RandomID(16),
+        UserID:    user.ID,
+        Filename:  metadata["filename"],
+        Length:    length,
+        Metadata:  r.Header.Get("Upload-Metadata"),
+        CreatedAt: now,
+        ExpiresAt: now.Add(uploadExpiry()),
+    }
+    if orgID != 0 {
+        upload.OrgID = &orgID
+    }
+    if upload.Filename == "" {
+        upload.Filename = "upload-" + upload.ID
+    }
+    upload.Filename = filepath.Base(upload.Filename)
+
+    if err := os.MkdirAll(utils.StagingDir(), 0o755); err != nil {
+        http.Error(w, "Unable to create upload", http.StatusInternalServerError)
+        return
+    }
+    staged, err := os.Create(stagingPath(upload.ID))
+    if err != nil {
+        http.Error(w, "Unable to create upload", http.StatusInternalServerError)
+        return
+    }
+    staged.Close()
+
+    if err := models.CreateUpload(upload); err != nil {
+        os.Remove(stagingPath(upload.ID))
+        http.Error(w, "Unable to create upload", http.StatusInternalServerError)
+        return
+    }
+
+    // An empty upload has no chunk to complete it, so it is complete now
+    if upload.Length == 0 && !finishUpload(w, r, upload) {
+        return
+    }
+
+    w.Header().Set("Location", "/uploads/"+upload.ID)
+    w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.WriteHeader(http.StatusCreated)
+}
+
+// loadUpload fetches the upload named in the URL, answering 404 or 410 when
+// it does not belong to the user or has expired.
+func loadUpload(w http.ResponseWriter, r *http.Request) (models.Upload, bool) {
+    user, _ := currentUser(r)
+
+    upload, err := models.GetUpload(mux.Vars(r)["upload_id"])
+    if err != nil || upload.UserID != user.ID {
+        http.Error(w, "Upload not found", http.StatusNotFound)
+        return models.Upload{}, false
+    }
+    if time.Now().After(upload.ExpiresAt) {
+        http.Error(w, "Upload expired", http.StatusGone)
+        return models.Upload{}, false
+    }
+    return upload, true
+}
+
+// GetUploadOffset reports how many bytes of an upload have been received
+func GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+    upload, ok := loadUpload(w, r)
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+    w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+    w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+    if upload.Metadata != "" {
+        w.Header().Set("Upload-Metadata", upload.Metadata)
+    }
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload appends a chunk at the current offset and completes the
+// upload once all bytes have arrived.
+func PatchUpload(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+    if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+        http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+        return
+    }
+    offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+        return
+    }
+
+    id := mux.Vars(r)["upload_id"]
+    unlock, ok := lockUpload(id)
+    if !ok {
+        http.Error(w, "Upload is locked by another request", http.StatusLocked)
+        return
+    }
+    defer unlock()
+
+    upload, ok := loadUpload(w, r)
+    if !ok {
+        // Keep no lock for uploads that are unknown or can no longer be resumed
+        uploadLocks.Delete(id)
+        return
+    }
+    if offset != upload.Offset {
+        http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+        return
+    }
+
+    staged, err := os.OpenFile(stagingPath(upload.ID), os.O_WRONLY, 0)
+    if err != nil {
+        http.Error(w, "Unable to write upload", http.StatusInternalServerError)
+        return
+    }
+    // Drop any bytes written after the last recorded offset, e.g. by a crash
+    if err := staged.Truncate(upload.Offset); err != nil {
+        staged.Close()
+        http.Error(w, "Unable to write upload", http.StatusInternalServerError)
+        return
+    }
+    staged.Seek(upload.Offset, io.SeekStart)
+    n, copyErr := io.Copy(staged, io.LimitReader(r.Body, upload.Length-upload.Offset))
+    staged.Close()
+
+    // Keep whatever arrived, even from an interrupted request, so the client can resume
+    upload.Offset += n
+    upload.ExpiresAt = time.Now().Add(uploadExpiry())
+    if err := models.UpdateUploadOffset(upload.ID, upload.Offset, upload.ExpiresAt); err != nil {
+        http.Error(w, "Unable to record upload offset", http.StatusInternalServerError)
+        return
+    }
+    if copyErr != nil {
+        http.Error(w, "Error receiving upload data", http.StatusInternalServerError)
+        return
+    }
+
+    if upload.Offset == upload.Length {
+        if !finishUpload(w, r, upload) {
+            return
+        }
+    } else {
+        // Only the chunk completing the upload is audited
+        skipAudit(r)
+    }
+
+    w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+    w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadEncryption reads the client encryption header and metadata from the
+// encryption_header and encrypted_metadata keys of Upload-Metadata
+func uploadEncryption(metadata map[string]string) clientEncryption {
+    return clientEncryption{
+        Header:   []byte(metadata["encryption_header"]),
+        Metadata: []byte(metadata["encrypted_metadata"]),
+    }
+}
+
+// finishUpload completes a fully received upload, answering with the error
+// when it cannot be stored
+func finishUpload(w http.ResponseWriter, r *http.Request, upload models.Upload) bool {
+    file, err := completeUpload(upload)
+    if err != nil {
+        if errors.Is(err, errContentTypeBlocked) || errors.Is(err, errInfected) {
+            // The content will never be accepted, so don't keep it around
+            discardUpload(upload.ID)
+        }
+        writeStoreError(w, err)
+        return false
+    }
+    auditFile(r, file)
+    return true
+}
+
+// completeUpload moves a fully received upload into storage and records the file
+func completeUpload(upload models.Upload) (models.File, error) {
+    metadata, err := parseUploadMetadata(upload.Metadata)
+    if err != nil {
+        return models.File{}, err
+    }
+    file, err := saveStagedFile(upload.UserID, upload.Filename, stagingPath(upload.ID), storeOptions{Encryption: uploadEncryption(metadata), OrgID: orgIDValue(upload.OrgID)})
+    if err != nil {
+        return models.File{}, err
+    }
+    discardUpload(upload.ID)
+    return file, nil
+}
+
+// discardUpload removes an upload's staging file and tracking row
+func discardUpload(id string) {
+    if err := os.Remove(stagingPath(id)); err != nil && !os.IsNotExist(err) {
+        log.Println("Error removing staged upload:", err)
+    }
+    if err := models.DeleteUpload(id); err != nil {
+        log.Println("Error deleting upload:", err)
+    }
+    uploadLocks.Delete(id)
+}
+
+// TerminateUpload cancels an upload and discards its data (termination
+// extension). An upload a PATCH is still writing or storing is left alone.
+func TerminateUpload(w http.ResponseWriter, r *http.Request) {
+    if !checkTusVersion(w, r) {
+        return
+    }
+
+    id := mux.Vars(r)["upload_id"]
+    unlock, ok := lockUpload(id)
+    if !ok {
+        http.Error(w, "Upload is locked by another request", http.StatusLocked)
+        return
+    }
+    defer unlock()
+
+    upload, ok := loadUpload(w, r)
+    if !ok {
+        uploadLocks.Delete(id)
+        return
+    }
+
+    discardUpload(upload.ID)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeExpiredUploads discards uploads that passed their expiry without completing
+func PurgeExpiredUploads() error {
+    uploads, err := models.GetExpiredUploads(time.Now())
+    if err != nil {
+        return err
+    }
+    for _, upload := range uploads {
+        discardUpload(upload.ID)
+    }
+    return nil
+}
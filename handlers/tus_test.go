@@ -0,0 +1,95 @@
+package handlers
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gorilla/mux"
+)
+
+// TestParseUploadMetadata tests decoding of the Upload-Metadata header
+func TestParseUploadMetadata(t *testing.T) {
+    metadata, err := parseUploadMetadata("filename cmVwb3J0LnBkZg==, is_confidential,filetype YXBwbGljYXRpb24vcGRm")
+    if err != nil {
+        t.Fatalf("Unexpected error: %s", err)
+    }
+    if metadata["filename"] != "report.pdf" {
+        t.Errorf("Expected filename report.pdf, got %q", metadata["filename"])
+    }
+    if metadata["filetype"] != "application/pdf" {
+        t.Errorf("Expected filetype application/pdf, got %q", metadata["filetype"])
+    }
+    if _, ok := metadata["is_confidential"]; !ok {
+        t.Errorf("Expected key without value to be present")
+    }
+
+    if _, err := parseUploadMetadata("filename not-base64!"); err == nil {
+        t.Errorf("Expected error for invalid base64 value")
+    }
+}
+
+// TestTusOptions tests the protocol discovery response
+func TestTusOptions(t *testing.T) {
+    rr := httptest.NewRecorder()
+    TusOptions(rr, httptest.NewRequest("OPTIONS", "/uploads", nil))
+
+    if rr.Code != http.StatusNoContent {
+        t.Errorf("Expected status 204, got %v", rr.Code)
+    }
+    if rr.Header().Get("Tus-Version") != tusVersion {
+        t.Errorf("Expected Tus-Version %s, got %q", tusVersion, rr.Header().Get("Tus-Version"))
+    }
+    if !strings.Contains(rr.Header().Get("Tus-Extension"), "termination") {
+        t.Errorf("Expected termination extension, got %q", rr.Header().Get("Tus-Extension"))
+    }
+}
+
+// TestTusVersionMismatch tests that requests without a supported Tus-Resumable header are rejected
+func TestTusVersionMismatch(t *testing.T) {
+    req := httptest.NewRequest("PATCH", "/uploads/abc", strings.NewReader("data"))
+    req.Header.Set("Tus-Resumable", "0.2.2")
+    rr := httptest.NewRecorder()
+    PatchUpload(rr, req)
+
+    if rr.Code != http.StatusPreconditionFailed {
+        t.Errorf("Expected status 412, got %v", rr.Code)
+    }
+    if rr.Header().Get("Tus-Version") != tusVersion {
+        t.Errorf("Expected Tus-Version header on rejection")
+    }
+}
+
+// TestPatchUploadContentType tests that chunks must use the offset+octet-stream content type
+func TestPatchUploadContentType(t *testing.T) {
+    req := httptest.NewRequest("PATCH", "/uploads/abc", strings.NewReader("data"))
+    req.Header.Set("Tus-Resumable", tusVersion)
+    req.Header.Set("Content-Type", "application/octet-stream")
+    req.Header.Set("Upload-Offset", "0")
+    rr := httptest.NewRecorder()
+    PatchUpload(rr, req)
+
+    if rr.Code != http.StatusUnsupportedMediaType {
+        t.Errorf("Expected status 415, got %v", rr.Code)
+    }
+}
+
+// TestTerminateLockedUpload tests that an upload a PATCH holds is not
+// discarded from under it
+func TestTerminateLockedUpload(t *testing.T) {
+    unlock, ok := lockUpload("abc")
+    if !ok {
+        t.Fatal("Expected to take the upload's lock")
+    }
+    defer unlock()
+
+    req := httptest.NewRequest("DELETE", "/uploads/abc", nil)
+    req.Header.Set("Tus-Resumable", tusVersion)
+    req = mux.SetURLVars(req, map[string]string{"upload_id": "abc"})
+    rr := httptest.NewRecorder()
+    TerminateUpload(rr, req)
+
+    if rr.Code != http.StatusLocked {
+        t.Errorf("Expected status 423, got %v", rr.Code)
+    }
+}
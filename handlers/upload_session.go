@@ -0,0 +1,389 @@
+package handlers
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+    "github.com/gorilla/mux"
+)
+
+// Upload sessions let clients send a large file as fixed-size numbered parts,
+// concurrently and in any order. Parts are staged locally and streamed into
+// the storage backend in order on completion, which uses an S3 multipart
+// upload or a plain file concatenation depending on the backend.
+
+const (
+    minChunkSize = 1 << 20
+    maxChunkSize = 1 << 30
+    maxPartCount = 10000
+)
+
+func defaultChunkSize() int64 {
+    if size, err := models.ParseSize(os.Getenv("UPLOAD_CHUNK_SIZE")); err == nil && size > 0 {
+        return size
+    }
+    return 64 << 20
+}
+
+// chooseChunkSize clamps the requested chunk size and grows it until the
+// file fits in maxPartCount parts.
+func chooseChunkSize(size, requested int64) int64 {
+    chunkSize := requested
+    if chunkSize <= 0 {
+        chunkSize = defaultChunkSize()
+    }
+    if chunkSize < minChunkSize {
+        chunkSize = minChunkSize
+    }
+    if chunkSize > maxChunkSize {
+        chunkSize = maxChunkSize
+    }
+    if smallest := (size + maxPartCount - 1) / maxPartCount; chunkSize < smallest {
+        chunkSize = smallest
+    }
+    return chunkSize
+}
+
+func sessionDir(id string) string {
+    return filepath.Join(utils.StagingDir(), "sessions", id)
+}
+
+func partPath(id string, partNumber int) string {
+    return filepath.Join(sessionDir(id), strconv.Itoa(partNumber))
+}
+
+type initiateSessionRequest struct {
+    Filename  string `json:"filename"`
+    Size      int64  `json:"size"`
+    ChunkSize int64  `json:"chunk_size"`
+    // OrgID uploads into an organization's workspace
+    OrgID int `json:"org_id"`
+    // Folder places the file in a folder instead of at the top
+    Folder string `json:"folder"`
+
+    // Base64 encoded, set when the parts are encrypted by the client
+    EncryptionHeader  []byte `json:"encryption_header"`
+    EncryptedMetadata []byte `json:"encrypted_metadata"`
+}
+
+// CreateUploadSession starts a chunked upload and tells the client the chunk size to use
+func CreateUploadSession(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    var req initiateSessionRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Filename == "" || req.Size < 0 {
+        http.Error(w, "Invalid upload session request", http.StatusBadRequest)
+        return
+    }
+    encryption := clientEncryption{Header: req.EncryptionHeader, Metadata: req.EncryptedMetadata}
+    if err := encryption.validate(); err != nil {
+        http.Error(w, "Invalid encryption header", http.StatusBadRequest)
+        return
+    }
+    folder, err := normalizeFolder(req.Folder)
+    if err != nil {
+        http.Error(w, "Invalid folder: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.OrgID != 0 {
+        if _, ok := requireOrgMember(w, user.ID, req.OrgID); !ok {
+            return
+        }
+    }
+
+    usage, err := workspaceUsage(user.ID, req.OrgID)
+    if err != nil {
+        http.Error(w, "Unable to check storage quota", http.StatusInternalServerError)
+        return
+    }
+    if req.Size > usage.QuotaBytes {
+        http.Error(w, "File is larger than your storage quota", http.StatusRequestEntityTooLarge)
+        return
+    }
+    if req.Size > usage.BytesRemaining {
+        http.Error(w, "Not enough storage quota remaining for this file", http.StatusInsufficientStorage)
+        return
+    }
+
+    now := time.Now()
+    session := models.UploadSession{
+        ID:        utils.RandomID(16),
+        UserID:    user.ID,
+        Filename:  filepath.Base(req.Filename),
+        Size:      req.Size,
+        ChunkSize: chooseChunkSize(req.Size, req.ChunkSize),
+        CreatedAt: now,
+        ExpiresAt: now.Add(uploadExpiry()),
+        Folder:    folder,
+
+        EncryptionHeader:  encryption.Header,
+        EncryptedMetadata: encryption.Metadata,
+    }
+    if req.OrgID != 0 {
+        session.OrgID = &req.OrgID
+    }
+    session.PartCount = models.PartCount(session.Size, session.ChunkSize)
+
+    if err := os.MkdirAll(sessionDir(session.ID), 0o755); err != nil {
+        http.Error(w, "Unable to create upload session", http.StatusInternalServerError)
+        return
+    }
+    if err := models.CreateUploadSession(session); err != nil {
+        os.RemoveAll(sessionDir(session.ID))
+        http.Error(w, "Unable to create upload session", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(session)
+}
+
+// loadUploadSession fetches the session named in the URL, answering 404 or
+// 410 when it does not belong to the user or has expired.
+func loadUploadSession(w http.ResponseWriter, r *http.Request) (models.UploadSession, bool) {
+    user, _ := currentUser(r)
+
+    session, err := models.GetUploadSession(mux.Vars(r)["session_id"])
+    if err != nil || session.UserID != user.ID {
+        http.Error(w, "Upload session not found", http.StatusNotFound)
+        return models.UploadSession{}, false
+    }
+    if time.Now().After(session.ExpiresAt) {
+        http.Error(w, "Upload session expired", http.StatusGone)
+        return models.UploadSession{}, false
+    }
+    return session, true
+}
+
+// UploadPart stores one numbered part; parts may arrive concurrently and be retried
+func UploadPart(w http.ResponseWriter, r *http.Request) {
+    session, ok := loadUploadSession(w, r)
+    if !ok {
+        return
+    }
+
+    partNumber, err := strconv.Atoi(mux.Vars(r)["part_number"])
+    if err != nil || partNumber < 1 || partNumber > session.PartCount {
+        http.Error(w, fmt.Sprintf("Part number must be between 1 and %d", session.PartCount), http.StatusBadRequest)
+        return
+    }
+    expected := session.PartSize(partNumber)
+
+    // Write to a temporary name so a retried part never mixes with an earlier attempt
+    tmp, err := os.CreateTemp(sessionDir(session.ID), fmt.Sprintf(".%d-*", partNumber))
+    if err != nil {
+        http.Error(w, "Unable to store part", http.StatusInternalServerError)
+        return
+    }
+    defer os.Remove(tmp.Name())
+
+    hash := sha256.New()
+    n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r.Body, expected+1))
+    tmp.Close()
+    if err != nil {
+        http.Error(w, "Error receiving part data", http.StatusInternalServerError)
+        return
+    }
+    if n != expected {
+        http.Error(w, fmt.Sprintf("Part %d must be exactly %d bytes", partNumber, expected), http.StatusBadRequest)
+        return
+    }
+
+    part := models.UploadPart{
+        PartNumber: partNumber,
+        Size:       n,
+        SHA256:     hex.EncodeToString(hash.Sum(nil)),
+        ReceivedAt: time.Now(),
+    }
+    if checksum := r.Header.Get("X-Checksum-SHA256"); checksum != "" && !strings.EqualFold(checksum, part.SHA256) {
+        http.Error(w, "Part checksum mismatch", http.StatusUnprocessableEntity)
+        return
+    }
+
+    if err := os.Rename(tmp.Name(), partPath(session.ID, partNumber)); err != nil {
+        http.Error(w, "Unable to store part", http.StatusInternalServerError)
+        return
+    }
+    if err := models.SaveUploadPart(session.ID, part); err != nil {
+        http.Error(w, "Unable to record part", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(part)
+}
+
+// ListUploadParts reports which parts of a session have been received
+func ListUploadParts(w http.ResponseWriter, r *http.Request) {
+    session, ok := loadUploadSession(w, r)
+    if !ok {
+        return
+    }
+
+    parts, err := models.GetUploadParts(session.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve parts", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "session": session,
+        "parts":   parts,
+    })
+}
+
+type manifestPart struct {
+    PartNumber int    `json:"part_number"`
+    SHA256     string `json:"sha256"`
+}
+
+type completeSessionRequest struct {
+    Parts  []manifestPart `json:"parts"`
+    SHA256 string         `json:"sha256"`
+}
+
+// verifyManifest checks that every part was received and matches the
+// client's checksum manifest.
+func verifyManifest(session models.UploadSession, received []models.UploadPart, manifest completeSessionRequest) error {
+    if manifest.SHA256 == "" {
+        return errors.New("manifest must include the sha256 of the whole file")
+    }
+    if len(manifest.Parts) != session.PartCount {
+        return fmt.Errorf("manifest lists %d parts, expected %d", len(manifest.Parts), session.PartCount)
+    }
+
+    byNumber := make(map[int]models.UploadPart, len(received))
+    for _, part := range received {
+        byNumber[part.PartNumber] = part
+    }
+    for _, entry := range manifest.Parts {
+        part, ok := byNumber[entry.PartNumber]
+        if !ok {
+            return fmt.Errorf("part %d has not been uploaded", entry.PartNumber)
+        }
+        if !strings.EqualFold(part.SHA256, entry.SHA256) {
+            return fmt.Errorf("part %d checksum mismatch", entry.PartNumber)
+        }
+        delete(byNumber, entry.PartNumber)
+    }
+    if len(byNumber) > 0 || len(received) != session.PartCount {
+        return errors.New("manifest does not cover every part")
+    }
+    return nil
+}
+
+// CompleteUploadSession assembles the parts in order, verifies the whole-file
+// hash and records the file.
+func CompleteUploadSession(w http.ResponseWriter, r *http.Request) {
+    unlock, ok := lockUpload(mux.Vars(r)["session_id"])
+    if !ok {
+        http.Error(w, "Upload session is already being completed", http.StatusLocked)
+        return
+    }
+    defer unlock()
+
+    session, ok := loadUploadSession(w, r)
+    if !ok {
+        return
+    }
+    auditDetail(r, "name", session.Filename)
+
+    var manifest completeSessionRequest
+    if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+        http.Error(w, "Invalid manifest", http.StatusBadRequest)
+        return
+    }
+    received, err := models.GetUploadParts(session.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve parts", http.StatusInternalServerError)
+        return
+    }
+    if err := verifyManifest(session, received, manifest); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // Stream the parts one after another without building a concatenated copy
+    pr, pw := io.Pipe()
+    go func() {
+        for number := 1; number <= session.PartCount; number++ {
+            part, err := os.Open(partPath(session.ID, number))
+            if err != nil {
+                pw.CloseWithError(err)
+                return
+            }
+            _, err = io.Copy(pw, part)
+            part.Close()
+            if err != nil {
+                pw.CloseWithError(err)
+                return
+            }
+        }
+        pw.Close()
+    }()
+
+    file, err := storeFile(session.UserID, session.Filename, pr, storeOptions{
+        Checksum:   manifest.SHA256,
+        Encryption: clientEncryption{Header: session.EncryptionHeader, Metadata: session.EncryptedMetadata},
+        OrgID:      orgIDValue(session.OrgID),
+        Folder:     session.Folder,
+    })
+    pr.Close()
+    if err != nil {
+        if errors.Is(err, errContentTypeBlocked) || errors.Is(err, errInfected) {
+            discardUploadSession(session.ID)
+        }
+        writeStoreError(w, err)
+        return
+    }
+
+    discardUploadSession(session.ID)
+    auditFile(r, file)
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(file)
+}
+
+// discardUploadSession removes a session's staged parts and tracking rows
+func discardUploadSession(id string) {
+    if err := os.RemoveAll(sessionDir(id)); err != nil {
+        log.Println("Error removing staged parts:", err)
+    }
+    if err := models.DeleteUploadSession(id); err != nil {
+        log.Println("Error deleting upload session:", err)
+    }
+    uploadLocks.Delete(id)
+}
+
+// AbortUploadSession cancels a session and discards its parts
+func AbortUploadSession(w http.ResponseWriter, r *http.Request) {
+    session, ok := loadUploadSession(w, r)
+    if !ok {
+        return
+    }
+
+    discardUploadSession(session.ID)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeExpiredUploadSessions discards sessions that passed their expiry without completing
+func PurgeExpiredUploadSessions() error {
+    sessions, err := models.GetExpiredUploadSessions(time.Now())
+    if err != nil {
+        return err
+    }
+    for _, session := range sessions {
+        discardUploadSession(session.ID)
+    }
+    return nil
+}
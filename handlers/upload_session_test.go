@@ -0,0 +1,71 @@
+package handlers
+
+import (
+    "testing"
+    "file-sharing-system/models"
+)
+
+// TestChooseChunkSize tests clamping of the requested chunk size
+func TestChooseChunkSize(t *testing.T) {
+    if size := chooseChunkSize(100<<20, 1024); size != minChunkSize {
+        t.Errorf("Expected chunk size to be raised to the minimum, got %d", size)
+    }
+    if size := chooseChunkSize(100<<20, 8<<30); size != maxChunkSize {
+        t.Errorf("Expected chunk size to be capped at the maximum, got %d", size)
+    }
+
+    // A 50 GB file with 1 MB chunks would need far more than maxPartCount parts
+    size := chooseChunkSize(50<<30, 1<<20)
+    if parts := models.PartCount(50<<30, size); parts > maxPartCount {
+        t.Errorf("Expected at most %d parts, got %d", maxPartCount, parts)
+    }
+}
+
+// TestPartSize tests that only the last part may be shorter than the chunk size
+func TestPartSize(t *testing.T) {
+    session := models.UploadSession{Size: 25, ChunkSize: 10}
+    session.PartCount = models.PartCount(session.Size, session.ChunkSize)
+
+    if session.PartCount != 3 {
+        t.Fatalf("Expected 3 parts, got %d", session.PartCount)
+    }
+    if size := session.PartSize(1); size != 10 {
+        t.Errorf("Expected first part of 10 bytes, got %d", size)
+    }
+    if size := session.PartSize(3); size != 5 {
+        t.Errorf("Expected last part of 5 bytes, got %d", size)
+    }
+}
+
+// TestVerifyManifest tests matching the completion manifest against received parts
+func TestVerifyManifest(t *testing.T) {
+    session := models.UploadSession{Size: 20, ChunkSize: 10, PartCount: 2}
+    received := []models.UploadPart{
+        {PartNumber: 1, SHA256: "aaa"},
+        {PartNumber: 2, SHA256: "bbb"},
+    }
+
+    valid := completeSessionRequest{
+        Parts:  []manifestPart{{PartNumber: 2, SHA256: "BBB"}, {PartNumber: 1, SHA256: "aaa"}},
+        SHA256: "ccc",
+    }
+    if err := verifyManifest(session, received, valid); err != nil {
+        t.Errorf("Expected valid manifest, got %s", err)
+    }
+
+    cases := map[string]completeSessionRequest{
+        "missing file hash": {Parts: valid.Parts},
+        "wrong part hash":   {Parts: []manifestPart{{1, "aaa"}, {2, "zzz"}}, SHA256: "ccc"},
+        "duplicate part":    {Parts: []manifestPart{{1, "aaa"}, {1, "aaa"}}, SHA256: "ccc"},
+        "too few parts":     {Parts: []manifestPart{{1, "aaa"}}, SHA256: "ccc"},
+    }
+    for name, manifest := range cases {
+        if err := verifyManifest(session, received, manifest); err == nil {
+            t.Errorf("Expected error for %s", name)
+        }
+    }
+
+    if err := verifyManifest(session, received[:1], valid); err == nil {
+        t.Errorf("Expected error when a part has not been uploaded")
+    }
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "file-sharing-system/models"
+)
+
+// multipartOverhead is the slack allowed between Content-Length and the file
+// size for multipart boundaries and part headers.
+const multipartOverhead = 4 << 10
+
+var errQuotaExceeded = errors.New("upload exceeds remaining storage quota")
+
+// quotaReader counts the bytes read through it and fails once more than
+// limit bytes have been read, so oversized uploads are cut off mid-stream.
+type quotaReader struct {
+    r     io.Reader
+    limit int64
+    n     int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+    n, err := q.r.Read(p)
+    q.n += int64(n)
+    if q.n > q.limit {
+        return n, errQuotaExceeded
+    }
+    return n, err
+}
+
+// checkQuota rejects a request whose Content-Length cannot fit in the
+// user's quota before any of the body is read. It writes the error response
+// and returns false when the upload must not proceed.
+func checkQuota(w http.ResponseWriter, r *http.Request, usage models.Usage) bool {
+    if r.ContentLength > usage.QuotaBytes+multipartOverhead {
+        http.Error(w, "File is larger than your storage quota", http.StatusRequestEntityTooLarge)
+        return false
+    }
+    if r.ContentLength > usage.BytesRemaining+multipartOverhead {
+        http.Error(w, "Not enough storage quota remaining for this file", http.StatusInsufficientStorage)
+        return false
+    }
+    return true
+}
+
+// workspaceUsage returns the usage and quota an upload counts against: the
+// organization's when orgID is set, or else the user's
+func workspaceUsage(userID, orgID int) (models.Usage, error) {
+    if orgID != 0 {
+        return models.GetOrgUsage(orgID)
+    }
+    return models.GetUsage(userID)
+}
+
+// GetUsage reports the authenticated user's storage usage and quota
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    usage, err := models.GetUsage(user.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve usage", http.StatusInternalServerError)
+        return
+    }
+
+    json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "file-sharing-system/models"
+)
+
+// TestQuotaReader tests that reads fail once the limit is passed
+func TestQuotaReader(t *testing.T) {
+    within := &quotaReader{r: strings.NewReader("hello"), limit: 5}
+    if _, err := io.ReadAll(within); err != nil {
+        t.Errorf("Expected no error within quota, got %s", err)
+    }
+    if within.n != 5 {
+        t.Errorf("Expected 5 bytes counted, got %d", within.n)
+    }
+
+    over := &quotaReader{r: strings.NewReader("hello world"), limit: 5}
+    if _, err := io.ReadAll(over); !errors.Is(err, errQuotaExceeded) {
+        t.Errorf("Expected errQuotaExceeded, got %v", err)
+    }
+}
+
+// TestCheckQuota tests the Content-Length checks made before reading the body
+func TestCheckQuota(t *testing.T) {
+    usage := models.Usage{QuotaBytes: 1 << 20, BytesUsed: 1<<20 - 1000, BytesRemaining: 1000}
+
+    cases := []struct {
+        contentLength int64
+        expected      int
+    }{
+        {500, http.StatusOK},
+        {-1, http.StatusOK},
+        {100 << 10, http.StatusInsufficientStorage},
+        {2 << 20, http.StatusRequestEntityTooLarge},
+    }
+    for _, c := range cases {
+        req := httptest.NewRequest("POST", "/upload", nil)
+        req.ContentLength = c.contentLength
+        rr := httptest.NewRecorder()
+
+        ok := checkQuota(rr, req, usage)
+        if ok != (c.expected == http.StatusOK) || rr.Code != c.expected {
+            t.Errorf("Content-Length %d: expected status %d, got %d", c.contentLength, c.expected, rr.Code)
+        }
+    }
+}
@@ -0,0 +1,620 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+    "github.com/jackc/pgx/v4"
+    "golang.org/x/net/webdav"
+    "file-sharing-system/models"
+)
+
+// davMaxTreeFiles bounds the files a WebDAV DELETE of a folder may remove
+const davMaxTreeFiles = 100000
+
+var errNotDir = errors.New("not a directory")
+
+// davAuditActions are the audited WebDAV methods
+var davAuditActions = map[string]string{
+    http.MethodGet:    models.AuditFileDownload,
+    http.MethodPut:    models.AuditFileUpload,
+    http.MethodDelete: models.AuditFileDelete,
+}
+
+// davLocks holds the WebDAV locks of each workspace. Locks live in memory,
+// so they only coordinate clients of the same API process.
+var davLocks = struct {
+    sync.Mutex
+    systems map[string]webdav.LockSystem
+}{systems: map[string]webdav.LockSystem{}}
+
+func davLockSystem(key string) webdav.LockSystem {
+    davLocks.Lock()
+    defer davLocks.Unlock()
+    ls, ok := davLocks.systems[key]
+    if !ok {
+        ls = webdav.NewMemLS()
+        davLocks.systems[key] = ls
+    }
+    return ls
+}
+
+// AuthenticateDAV authenticates WebDAV clients, which mostly only speak
+// basic auth: the user's email with either their password or an API token.
+// Bearer JWTs and API tokens are accepted as well. Failures ask the client
+// for credentials.
+func AuthenticateDAV(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var user models.User
+        var err error
+        if email, password, ok := r.BasicAuth(); ok {
+            // Clients sign in on every request, so only failures are audited
+            if user, err = basicAuthUser(email, password); err != nil {
+                recordAudit(r, signInEntry("webdav", models.User{}, email, models.AuditDenied))
+            }
+        } else if token := bearerToken(r); token != "" {
+            user, err = userFromToken(token)
+        } else {
+            err = errInvalidToken
+        }
+        if err != nil {
+            w.Header().Set("WWW-Authenticate", `Basic realm="File Sharing", charset="UTF-8"`)
+            http.Error(w, "Authentication required", http.StatusUnauthorized)
+            return
+        }
+        next.ServeHTTP(w, withUser(r, user))
+    })
+}
+
+// basicAuthUser checks an email with a password or one of the user's API tokens
+func basicAuthUser(email, password string) (models.User, error) {
+    if strings.HasPrefix(password, models.APITokenPrefix) {
+        user, err := models.GetUserByAPIToken(password)
+        if err != nil || !strings.EqualFold(user.Email, email) {
+            return models.User{}, errInvalidToken
+        }
+        return user, nil
+    }
+    user, err := models.GetUserByEmail(email)
+    if err != nil || !CheckPasswordHash(password, user.Password) {
+        return models.User{}, errInvalidToken
+    }
+    return user, nil
+}
+
+// ServeWebDAV serves the authenticated user's files over WebDAV at /dav/,
+// and the files of an organization they belong to at /dav-org/{org_id}/.
+// Downloads, uploads and deletions are audited.
+func ServeWebDAV(w http.ResponseWriter, r *http.Request) {
+    action, ok := davAuditActions[r.Method]
+    if !ok {
+        serveWebDAV(w, r)
+        return
+    }
+    audited(w, r, action, func(w http.ResponseWriter, r *http.Request) {
+        auditTarget(r, "path", r.URL.Path)
+        serveWebDAV(w, r)
+    })
+}
+
+func serveWebDAV(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    prefix, orgID := "/dav", 0
+    if value, ok := mux.Vars(r)["org_id"]; ok {
+        if orgID, ok = parseOrgID(w, value); !ok {
+            return
+        }
+        if _, ok := requireOrgMember(w, user.ID, orgID); !ok {
+            return
+        }
+        prefix = "/dav-org/" + value
+    }
+
+    // Refuse uploads that cannot fit before reading them, and cut off those
+    // of unknown length once they outgrow the quota
+    fs := &davFS{userID: user.ID, orgID: orgID}
+    if r.Method == http.MethodPut {
+        usage, err := workspaceUsage(user.ID, orgID)
+        if err != nil {
+            http.Error(w, "Unable to check storage quota", http.StatusInternalServerError)
+            return
+        }
+        if !checkQuota(w, r, usage) {
+            return
+        }
+        fs.usage = &usage
+    }
+
+    handler := &webdav.Handler{
+        Prefix:     prefix,
+        FileSystem: fs,
+        LockSystem: davLockSystem(prefix + "@" + user.Email),
+        Logger: func(r *http.Request, err error) {
+            if err != nil && !os.IsNotExist(err) {
+                log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+            }
+        },
+    }
+    if orgID != 0 {
+        // Members of an organization share its locks
+        handler.LockSystem = davLockSystem(prefix)
+    }
+    handler.ServeHTTP(&davStatusWriter{ResponseWriter: w, fs: fs}, r)
+}
+
+// davStatusWriter answers a PUT that ran out of quota with 507, where
+// webdav.Handler gives 405 for any failed write
+type davStatusWriter struct {
+    http.ResponseWriter
+    fs       *davFS
+    replaced bool
+}
+
+func (w *davStatusWriter) WriteHeader(status int) {
+    if status == http.StatusMethodNotAllowed && errors.Is(w.fs.storeErr, models.ErrQuotaExceeded) {
+        w.replaced = true
+        http.Error(w.ResponseWriter, "Not enough storage quota remaining for this file", http.StatusInsufficientStorage)
+        return
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *davStatusWriter) Write(p []byte) (int, error) {
+    if w.replaced {
+        return len(p), nil
+    }
+    return w.ResponseWriter.Write(p)
+}
+
+// davFS is a webdav.FileSystem over the files and folders of a user's
+// personal workspace, or of an organization's when orgID is set
+type davFS struct {
+    userID int
+    orgID  int
+    // usage limits what a PUT may store; storeErr is why storing it failed
+    usage    *models.Usage
+    storeErr error
+}
+
+// davPath splits a WebDAV path into its folder and name; the top folder
+// has no name
+func davPath(name string) (string, string, error) {
+    clean := path.Clean("/" + name)
+    if clean == "/" {
+        return "/", "", nil
+    }
+    folder, err := normalizeFolder(path.Dir(clean))
+    if err != nil {
+        return "", "", os.ErrInvalid
+    }
+    base := path.Base(clean)
+    if validName(base) != nil {
+        return "", "", os.ErrInvalid
+    }
+    return folder, base, nil
+}
+
+// joinFolder returns the path of a folder's subfolder
+func joinFolder(folder, name string) string {
+    return path.Join(folder, name)
+}
+
+// lookup finds the file or folder at a path. A file wins over a folder of
+// the same name.
+func (fs *davFS) lookup(name string) (*models.File, os.FileInfo, error) {
+    folder, base, err := davPath(name)
+    if err != nil {
+        return nil, nil, err
+    }
+    if base == "" {
+        return nil, davDirInfo{name: "/"}, nil
+    }
+
+    file, err := models.GetFileByPath(fs.userID, fs.orgID, folder, base)
+    if err == nil {
+        return &file, davFileInfo{file}, nil
+    }
+    if err != pgx.ErrNoRows {
+        return nil, nil, err
+    }
+    exists, err := models.FolderExists(fs.userID, fs.orgID, joinFolder(folder, base))
+    if err != nil {
+        return nil, nil, err
+    }
+    if !exists {
+        return nil, nil, os.ErrNotExist
+    }
+    return nil, davDirInfo{name: base}, nil
+}
+
+// canRemove reports whether the user may delete or overwrite a file: any
+// of their personal files, and organization files they hold the owner role on
+func (fs *davFS) canRemove(file models.File) (bool, error) {
+    if fs.orgID == 0 {
+        return true, nil
+    }
+    role, err := models.FileRole(file, fs.userID)
+    return role == models.RoleOwner, err
+}
+
+// parentExists checks that the folder holding a new file or folder exists
+func (fs *davFS) parentExists(folder string) error {
+    exists, err := models.FolderExists(fs.userID, fs.orgID, folder)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        return os.ErrNotExist
+    }
+    return nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+    folder, base, err := davPath(name)
+    if err != nil {
+        return err
+    }
+    if _, _, err := fs.lookup(name); err == nil {
+        return os.ErrExist
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+    if err := fs.parentExists(folder); err != nil {
+        return err
+    }
+    return models.CreateFolder(fs.userID, fs.orgID, joinFolder(folder, base))
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+    if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+        file, info, err := fs.lookup(name)
+        if err != nil {
+            return nil, err
+        }
+        if file == nil {
+            return &davDir{fs: fs, path: path.Clean("/" + name), info: info}, nil
+        }
+        if !file.ScanAllowsAccess() {
+            return nil, os.ErrPermission
+        }
+        return &davReader{file: *file}, nil
+    }
+
+    // Writes always replace the whole file
+    folder, base, err := davPath(name)
+    if err != nil {
+        return nil, err
+    }
+    if base == "" || flag&os.O_TRUNC == 0 && flag&os.O_CREATE == 0 {
+        return nil, os.ErrPermission
+    }
+    if err := fs.parentExists(folder); err != nil {
+        return nil, err
+    }
+    writer := &davWriter{fs: fs, folder: folder, name: base}
+    existing, err := models.GetFileByPath(fs.userID, fs.orgID, folder, base)
+    switch {
+    case err == nil && flag&os.O_EXCL != 0:
+        return nil, os.ErrExist
+    case err == nil:
+        if ok, err := fs.canRemove(existing); err != nil || !ok {
+            return nil, os.ErrPermission
+        }
+        writer.replaces = &existing
+    case err != pgx.ErrNoRows:
+        return nil, err
+    }
+    return writer, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+    file, info, err := fs.lookup(name)
+    if err != nil {
+        return err
+    }
+    if file != nil {
+        if ok, err := fs.canRemove(*file); err != nil || !ok {
+            return os.ErrPermission
+        }
+        return removeFile(*file)
+    }
+    if info.Name() == "/" {
+        return os.ErrPermission
+    }
+
+    folder := path.Clean("/" + name)
+    files, err := models.GetFolderFiles(fs.userID, fs.orgID, folder, davMaxTreeFiles)
+    if err != nil {
+        return err
+    }
+    // Check every file first so a folder is not left half deleted
+    for _, f := range files {
+        if ok, err := fs.canRemove(f); err != nil || !ok {
+            return os.ErrPermission
+        }
+    }
+    for _, f := range files {
+        if err := removeFile(f); err != nil {
+            return err
+        }
+    }
+    return models.DeleteFolders(fs.userID, fs.orgID, folder)
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+    file, _, err := fs.lookup(oldName)
+    if err != nil {
+        return err
+    }
+    folder, base, err := davPath(newName)
+    if err != nil || base == "" {
+        return os.ErrInvalid
+    }
+    if err := fs.parentExists(folder); err != nil {
+        return err
+    }
+
+    if file != nil {
+        file.Name, file.Folder = base, folder
+        _, err := models.UpdateFile(*file, models.ConflictFail)
+        if err == models.ErrNameTaken {
+            return os.ErrExist
+        }
+        return err
+    }
+
+    from, to := path.Clean("/"+oldName), joinFolder(folder, base)
+    if from == "/" || to == from || strings.HasPrefix(to, from+"/") {
+        return os.ErrInvalid
+    }
+    return models.RenameFolder(fs.userID, fs.orgID, from, to)
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+    _, info, err := fs.lookup(name)
+    return info, err
+}
+
+// davFileInfo describes a stored file. It supplies the content type and
+// ETag so that listings do not read the content.
+type davFileInfo struct {
+    file models.File
+}
+
+func (i davFileInfo) Name() string       { return i.file.Name }
+func (i davFileInfo) Size() int64        { return i.file.Size }
+func (i davFileInfo) Mode() os.FileMode  { return 0o644 }
+func (i davFileInfo) ModTime() time.Time { return i.file.UploadDate }
+func (i davFileInfo) IsDir() bool        { return false }
+func (i davFileInfo) Sys() interface{}   { return nil }
+
+func (i davFileInfo) ContentType(ctx context.Context) (string, error) {
+    if i.file.ContentType == "" {
+        return "application/octet-stream", nil
+    }
+    return i.file.ContentType, nil
+}
+
+func (i davFileInfo) ETag(ctx context.Context) (string, error) {
+    return fileETag(i.file), nil
+}
+
+// davDirInfo describes a folder
+type davDirInfo struct {
+    name     string
+    modified time.Time
+}
+
+func (i davDirInfo) Name() string       { return i.name }
+func (i davDirInfo) Size() int64        { return 0 }
+func (i davDirInfo) Mode() os.FileMode  { return os.ModeDir | 0o755 }
+func (i davDirInfo) ModTime() time.Time { return i.modified }
+func (i davDirInfo) IsDir() bool        { return true }
+func (i davDirInfo) Sys() interface{}   { return nil }
+
+// davPendingInfo describes a file while it is being written
+type davPendingInfo struct {
+    name string
+    size int64
+}
+
+func (i davPendingInfo) Name() string       { return i.name }
+func (i davPendingInfo) Size() int64        { return i.size }
+func (i davPendingInfo) Mode() os.FileMode  { return 0o644 }
+func (i davPendingInfo) ModTime() time.Time { return time.Now() }
+func (i davPendingInfo) IsDir() bool        { return false }
+func (i davPendingInfo) Sys() interface{}   { return nil }
+
+// davReader reads a stored file, opening the storage backend at the
+// current offset on the first read after each seek
+type davReader struct {
+    file    models.File
+    offset  int64
+    content io.ReadCloser
+}
+
+func (f *davReader) Read(p []byte) (int, error) {
+    if f.offset >= f.file.Size {
+        return 0, io.EOF
+    }
+    if f.content == nil {
+        content, err := models.OpenContentRange(f.file, f.offset, f.file.Size-f.offset)
+        if err != nil {
+            return 0, err
+        }
+        f.content = content
+    }
+    n, err := f.content.Read(p)
+    f.offset += int64(n)
+    return n, err
+}
+
+func (f *davReader) Seek(offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekCurrent:
+        offset += f.offset
+    case io.SeekEnd:
+        offset += f.file.Size
+    }
+    if offset < 0 {
+        return 0, os.ErrInvalid
+    }
+    if offset != f.offset && f.content != nil {
+        f.content.Close()
+        f.content = nil
+    }
+    f.offset = offset
+    return offset, nil
+}
+
+func (f *davReader) Close() error {
+    if f.content != nil {
+        return f.content.Close()
+    }
+    return nil
+}
+
+func (f *davReader) Readdir(count int) ([]os.FileInfo, error) { return nil, errNotDir }
+func (f *davReader) Stat() (os.FileInfo, error)               { return davFileInfo{f.file}, nil }
+func (f *davReader) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+
+// davWriter streams a new file's content into storeFile as it is written.
+// Once stored, it replaces the file of the same name, if any.
+type davWriter struct {
+    fs       *davFS
+    folder   string
+    name     string
+    replaces *models.File
+
+    pw    *io.PipeWriter
+    quota *quotaReader
+    done  chan struct{}
+    n     int64
+    err   error
+}
+
+func (f *davWriter) start() {
+    pr, pw := io.Pipe()
+    f.pw, f.done = pw, make(chan struct{})
+    var content io.Reader = pr
+    if f.fs.usage != nil {
+        f.quota = &quotaReader{r: pr, limit: f.fs.usage.BytesRemaining}
+        content = f.quota
+    }
+    go func() {
+        defer close(f.done)
+        _, f.err = storeFile(f.fs.userID, f.name, content, storeOptions{OrgID: f.fs.orgID, Folder: f.folder})
+        if f.quota != nil && f.quota.n > f.quota.limit {
+            f.err = models.ErrQuotaExceeded
+        }
+        pr.CloseWithError(f.err)
+    }()
+}
+
+func (f *davWriter) Write(p []byte) (int, error) {
+    if f.pw == nil {
+        f.start()
+    }
+    n, err := f.pw.Write(p)
+    f.n += int64(n)
+    return n, err
+}
+
+func (f *davWriter) Close() error {
+    if f.pw == nil {
+        f.start()
+    }
+    f.pw.Close()
+    <-f.done
+    if f.err != nil {
+        f.fs.storeErr = f.err
+        return f.err
+    }
+    if f.replaces != nil {
+        if err := removeFile(*f.replaces); err != nil {
+            log.Println("Error removing replaced file:", err)
+        }
+    }
+    return nil
+}
+
+func (f *davWriter) Read(p []byte) (int, error)                   { return 0, os.ErrPermission }
+func (f *davWriter) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrPermission }
+func (f *davWriter) Readdir(count int) ([]os.FileInfo, error)     { return nil, errNotDir }
+func (f *davWriter) Stat() (os.FileInfo, error)                   { return davPendingInfo{f.name, f.n}, nil }
+
+// davDir lists a folder: its subfolders, then its files. Of several files
+// sharing a name only the newest is listed.
+type davDir struct {
+    fs      *davFS
+    path    string
+    info    os.FileInfo
+    entries []os.FileInfo
+    listed  bool
+}
+
+func (d *davDir) list() error {
+    folders, err := models.GetSubfolders(d.fs.userID, d.fs.orgID, d.path)
+    if err != nil {
+        return err
+    }
+    files, err := models.GetFilesInFolder(d.fs.userID, d.fs.orgID, d.path)
+    if err != nil {
+        return err
+    }
+
+    // Entries are indexed by name so a file replaces a folder or an older
+    // file of the same name, as in lookup
+    index := map[string]int{}
+    for _, folder := range folders {
+        index[folder.Name] = len(d.entries)
+        d.entries = append(d.entries, davDirInfo{name: folder.Name, modified: folder.Modified})
+    }
+    for _, file := range files {
+        if i, ok := index[file.Name]; ok {
+            if older, ok := d.entries[i].(davFileInfo); !ok || file.ID > older.file.ID {
+                d.entries[i] = davFileInfo{file}
+            }
+            continue
+        }
+        index[file.Name] = len(d.entries)
+        d.entries = append(d.entries, davFileInfo{file})
+    }
+    d.listed = true
+    return nil
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+    if !d.listed {
+        if err := d.list(); err != nil {
+            return nil, err
+        }
+    }
+    if count <= 0 {
+        entries := d.entries
+        d.entries = nil
+        return entries, nil
+    }
+    if len(d.entries) == 0 {
+        return nil, io.EOF
+    }
+    n := min(count, len(d.entries))
+    entries := d.entries[:n]
+    d.entries = d.entries[n:]
+    return entries, nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
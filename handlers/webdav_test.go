@@ -0,0 +1,140 @@
+package handlers
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "testing"
+    "time"
+    "file-sharing-system/models"
+)
+
+// TestDavPath tests how WebDAV paths are split into folder and name
+func TestDavPath(t *testing.T) {
+    cases := map[string][2]string{
+        "/":                     {"/", ""},
+        "":                      {"/", ""},
+        "/report.pdf":           {"/", "report.pdf"},
+        "/projects/apollo/":     {"/projects", "apollo"},
+        "/projects//./plan.txt": {"/projects", "plan.txt"},
+        "/a/../b.txt":           {"/", "b.txt"},
+    }
+    for name, expected := range cases {
+        folder, base, err := davPath(name)
+        if err != nil || folder != expected[0] || base != expected[1] {
+            t.Errorf("%q: expected %v, got %s %s %v", name, expected, folder, base, err)
+        }
+    }
+
+    if _, _, err := davPath("/projects/bad\x01name"); err != os.ErrInvalid {
+        t.Errorf("Expected invalid name to be rejected, got %v", err)
+    }
+}
+
+// TestDavFileInfo tests that file details come from the file record
+func TestDavFileInfo(t *testing.T) {
+    uploaded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    info := davFileInfo{models.File{ID: 7, Name: "plan.txt", Size: 42, UploadDate: uploaded}}
+
+    if info.Name() != "plan.txt" || info.Size() != 42 || !info.ModTime().Equal(uploaded) || info.IsDir() {
+        t.Errorf("Unexpected file info: %s %d %v %v", info.Name(), info.Size(), info.ModTime(), info.IsDir())
+    }
+    contentType, _ := info.ContentType(context.Background())
+    if contentType != "application/octet-stream" {
+        t.Errorf("Expected default content type, got %q", contentType)
+    }
+    etag, _ := info.ETag(context.Background())
+    if etag != fileETag(info.file) {
+        t.Errorf("Expected ETag %s, got %s", fileETag(info.file), etag)
+    }
+
+    dir := davDirInfo{name: "projects"}
+    if !dir.IsDir() || !dir.Mode().IsDir() {
+        t.Error("Expected folder info to be a directory")
+    }
+}
+
+// TestDavDirReaddir tests that listings can be read in pages
+func TestDavDirReaddir(t *testing.T) {
+    d := &davDir{listed: true, entries: []os.FileInfo{
+        davDirInfo{name: "a"}, davDirInfo{name: "b"}, davFileInfo{models.File{Name: "c.txt"}},
+    }}
+
+    page, err := d.Readdir(2)
+    if err != nil || len(page) != 2 || page[0].Name() != "a" {
+        t.Fatalf("Unexpected first page: %v %v", page, err)
+    }
+    page, err = d.Readdir(2)
+    if err != nil || len(page) != 1 || page[0].Name() != "c.txt" {
+        t.Fatalf("Unexpected second page: %v %v", page, err)
+    }
+    if _, err := d.Readdir(2); err != io.EOF {
+        t.Errorf("Expected io.EOF after the last page, got %v", err)
+    }
+}
+
+// TestDavReaderSeek tests seeking within a file without opening its content
+func TestDavReaderSeek(t *testing.T) {
+    f := &davReader{file: models.File{Size: 100}}
+
+    if offset, err := f.Seek(-10, io.SeekEnd); err != nil || offset != 90 {
+        t.Errorf("Expected offset 90, got %d %v", offset, err)
+    }
+    if offset, err := f.Seek(5, io.SeekCurrent); err != nil || offset != 95 {
+        t.Errorf("Expected offset 95, got %d %v", offset, err)
+    }
+    if _, err := f.Seek(-1, io.SeekStart); err == nil {
+        t.Error("Expected negative offset to be rejected")
+    }
+    if _, err := f.Seek(0, io.SeekEnd); err != nil {
+        t.Fatal(err)
+    }
+    if n, err := f.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+        t.Errorf("Expected io.EOF at the end, got %d %v", n, err)
+    }
+}
+
+// TestAuthenticateDAVChallenge tests that clients without credentials are
+// asked for basic auth
+func TestAuthenticateDAVChallenge(t *testing.T) {
+    handler := AuthenticateDAV(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        t.Error("Expected request to be rejected")
+    }))
+
+    req := httptest.NewRequest("PROPFIND", "/dav/", nil)
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusUnauthorized {
+        t.Errorf("Expected status 401, got %d", rr.Code)
+    }
+    if rr.Header().Get("WWW-Authenticate") == "" {
+        t.Error("Expected a basic auth challenge")
+    }
+}
+
+// TestDavStatusWriter tests that a PUT cut off by the quota is answered
+// with 507 rather than webdav's 405
+func TestDavStatusWriter(t *testing.T) {
+    fs := &davFS{storeErr: models.ErrQuotaExceeded}
+    rr := httptest.NewRecorder()
+    w := &davStatusWriter{ResponseWriter: rr, fs: fs}
+    w.WriteHeader(http.StatusMethodNotAllowed)
+    w.Write([]byte("Method Not Allowed"))
+
+    if rr.Code != http.StatusInsufficientStorage {
+        t.Errorf("Expected status 507, got %d", rr.Code)
+    }
+    if body := rr.Body.String(); body != "Not enough storage quota remaining for this file\n" {
+        t.Errorf("Unexpected body %q", body)
+    }
+
+    rr = httptest.NewRecorder()
+    w = &davStatusWriter{ResponseWriter: rr, fs: &davFS{}}
+    w.WriteHeader(http.StatusMethodNotAllowed)
+    if rr.Code != http.StatusMethodNotAllowed {
+        t.Errorf("Expected other failures to keep status 405, got %d", rr.Code)
+    }
+}
@@ -0,0 +1,419 @@
+package handlers
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/netip"
+    "net/url"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+    "file-sharing-system/jobs"
+    "file-sharing-system/models"
+    "github.com/gorilla/mux"
+    "github.com/jackc/pgx/v4"
+)
+
+// TypeDeliverWebhook sends one delivery to its webhook. Failed sends are
+// retried with the job queue's backoff.
+const TypeDeliverWebhook = "deliver_webhook"
+
+const (
+    maxWebhookURLLength      = 2048
+    defaultDeliveriesLimit   = 50
+    maxDeliveriesLimit       = 500
+    webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// errWebhookAddress is returned for webhooks whose host is, or resolves
+// to, an address that is not public
+var errWebhookAddress = errors.New("webhook address is not public")
+
+// webhookClient sends deliveries. Redirects are not followed: a webhook
+// must answer 2xx itself. Connections are only made to public addresses,
+// checked after DNS resolution so that a name cannot be pointed at an
+// internal address between validation and delivery, and never through a
+// proxy.
+var webhookClient = &http.Client{
+    Timeout: 10 * time.Second,
+    CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+    },
+    Transport: &http.Transport{
+        Proxy: nil,
+        DialContext: (&net.Dialer{
+            Timeout: 5 * time.Second,
+            Control: webhookDialControl,
+        }).DialContext,
+        TLSHandshakeTimeout: 5 * time.Second,
+        MaxIdleConns:        100,
+        IdleConnTimeout:     90 * time.Second,
+    },
+}
+
+// webhookPrivateAllowed reports whether webhooks may call private
+// addresses, which WEBHOOK_ALLOW_PRIVATE=true allows, e.g. for tests or
+// receivers on the same network
+func webhookPrivateAllowed() bool {
+    return os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+}
+
+// webhookDialControl refuses connections to addresses that are not public,
+// such as loopback, private networks and cloud metadata endpoints
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+    if webhookPrivateAllowed() {
+        return nil
+    }
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    ip, err := netip.ParseAddr(host)
+    if err != nil || !publicAddr(ip) {
+        return errWebhookAddress
+    }
+    return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, 100.64.0.0/10
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether an address is reachable on the internet:
+// not loopback, private, link-local, multicast or unspecified
+func publicAddr(ip netip.Addr) bool {
+    ip = ip.Unmap()
+    return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// webhookPayload is the JSON body of every delivery
+type webhookPayload struct {
+    Event     string                 `json:"event"`
+    CreatedAt time.Time              `json:"created_at"`
+    Data      map[string]interface{} `json:"data"`
+}
+
+type webhookJob struct {
+    DeliveryID int64 `json:"delivery_id"`
+}
+
+// webhookRequest is the body of POST /webhooks
+type webhookRequest struct {
+    URL    string   `json:"url"`
+    Events []string `json:"events"`
+}
+
+// validate checks that the request names an http(s) URL and only known
+// events, and drops repeated events
+func (req *webhookRequest) validate() error {
+    req.URL = strings.TrimSpace(req.URL)
+    u, err := url.Parse(req.URL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(req.URL) > maxWebhookURLLength {
+        return errors.New("url must be an http or https URL")
+    }
+    // Names are checked when deliveries connect, once they are resolved
+    if ip, err := netip.ParseAddr(strings.Trim(u.Hostname(), "[]")); err == nil && !publicAddr(ip) && !webhookPrivateAllowed() {
+        return errors.New("url must point to a public address")
+    }
+    if strings.EqualFold(u.Hostname(), "localhost") && !webhookPrivateAllowed() {
+        return errors.New("url must point to a public address")
+    }
+    if len(req.Events) == 0 {
+        return errors.New("subscribe to at least one event")
+    }
+    var events []string
+    for _, event := range req.Events {
+        if !slices.Contains(models.WebhookEvents, event) {
+            return errors.New("events must be among " + strings.Join(models.WebhookEvents, ", "))
+        }
+        if !slices.Contains(events, event) {
+            events = append(events, event)
+        }
+    }
+    req.Events = events
+    return nil
+}
+
+// CreateWebhook registers a URL to be called on the events it subscribes
+// to in the user's files, or in an organization's files given by ?org=,
+// which takes the admin role in the organization. The secret deliveries
+// are signed with is only returned in this response.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    var req webhookRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid webhook", http.StatusBadRequest)
+        return
+    }
+    if err := req.validate(); err != nil {
+        http.Error(w, "Invalid webhook: "+err.Error(), http.StatusUnprocessableEntity)
+        return
+    }
+    orgID, ok := parseOrgID(w, r.URL.Query().Get("org"))
+    if !ok {
+        return
+    }
+    hook := models.Webhook{UserID: user.ID, URL: req.URL, Secret: models.NewWebhookSecret(), Events: req.Events}
+    if orgID != 0 {
+        role, ok := requireOrgMember(w, user.ID, orgID)
+        if !ok {
+            return
+        }
+        if models.OrgRoleRank(role) < models.OrgRoleRank(models.OrgAdmin) {
+            http.Error(w, "Insufficient permissions: this requires the admin role in the organization", http.StatusForbidden)
+            return
+        }
+        hook.OrgID = &orgID
+    }
+
+    hook, err := models.CreateWebhook(hook)
+    if err != nil {
+        http.Error(w, "Unable to create webhook", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "secret":  hook.Secret,
+        "webhook": hook,
+    })
+}
+
+// GetWebhooks lists the webhooks the user registered, without their secrets
+func GetWebhooks(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    hooks, err := models.GetWebhooks(user.ID)
+    if err != nil {
+        http.Error(w, "Unable to retrieve webhooks", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(hooks)
+}
+
+// webhookParam reads the user's webhook named in the URL
+func webhookParam(w http.ResponseWriter, r *http.Request) (models.Webhook, bool) {
+    user, _ := currentUser(r)
+
+    id, err := strconv.Atoi(mux.Vars(r)["webhook_id"])
+    if err != nil {
+        http.Error(w, "Webhook not found", http.StatusNotFound)
+        return models.Webhook{}, false
+    }
+    hook, err := models.GetWebhook(user.ID, id)
+    if err == pgx.ErrNoRows {
+        http.Error(w, "Webhook not found", http.StatusNotFound)
+        return models.Webhook{}, false
+    }
+    if err != nil {
+        http.Error(w, "Unable to retrieve webhook", http.StatusInternalServerError)
+        return models.Webhook{}, false
+    }
+    return hook, true
+}
+
+// DeleteWebhook removes one of the user's webhooks and its deliveries
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+
+    id, err := strconv.Atoi(mux.Vars(r)["webhook_id"])
+    if err != nil {
+        http.Error(w, "Webhook not found", http.StatusNotFound)
+        return
+    }
+    if err := models.DeleteWebhook(user.ID, id); err != nil {
+        if err == pgx.ErrNoRows {
+            http.Error(w, "Webhook not found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Unable to delete webhook", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries lists a webhook's latest deliveries, newest first,
+// with every attempt at each; limit bounds how many
+func GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+    hook, ok := webhookParam(w, r)
+    if !ok {
+        return
+    }
+    limit := defaultDeliveriesLimit
+    if value := r.URL.Query().Get("limit"); value != "" {
+        var err error
+        limit, err = strconv.Atoi(value)
+        if err != nil || limit < 1 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        limit = min(limit, maxDeliveriesLimit)
+    }
+
+    deliveries, err := models.GetWebhookDeliveries(hook.ID, limit)
+    if err != nil {
+        http.Error(w, "Unable to retrieve deliveries", http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(deliveries)
+}
+
+// RedeliverWebhook queues one of a webhook's deliveries to be sent again,
+// with the same payload, whatever became of the earlier attempts
+func RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+    hook, ok := webhookParam(w, r)
+    if !ok {
+        return
+    }
+    id, err := strconv.ParseInt(mux.Vars(r)["delivery_id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Delivery not found", http.StatusNotFound)
+        return
+    }
+    delivery, _, err := models.GetWebhookDelivery(id)
+    if err == pgx.ErrNoRows || (err == nil && delivery.WebhookID != hook.ID) {
+        http.Error(w, "Delivery not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Unable to retrieve delivery", http.StatusInternalServerError)
+        return
+    }
+
+    if err := jobs.Enqueue(TypeDeliverWebhook, webhookJob{DeliveryID: delivery.ID}); err != nil {
+        http.Error(w, "Unable to queue delivery", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(delivery)
+}
+
+// notifyWebhooks queues a delivery of an event to every webhook subscribed
+// to it in the workspace holding file. Failures are logged rather than
+// failing what caused the event.
+func notifyWebhooks(event string, file models.File, data map[string]interface{}) {
+    orgID := 0
+    if file.OrgID != nil {
+        orgID = *file.OrgID
+    }
+    hooks, err := models.GetSubscribedWebhooks(file.UserID, orgID, event)
+    if err != nil {
+        log.Println("Error finding webhooks:", err)
+        return
+    }
+    if len(hooks) == 0 {
+        return
+    }
+
+    payload, err := json.Marshal(webhookPayload{Event: event, CreatedAt: time.Now().UTC(), Data: data})
+    if err != nil {
+        log.Println("Error encoding webhook payload:", err)
+        return
+    }
+    for _, hook := range hooks {
+        delivery, err := models.CreateWebhookDelivery(hook.ID, event, payload)
+        if err != nil {
+            log.Println("Error recording webhook delivery:", err)
+            continue
+        }
+        if err := jobs.Enqueue(TypeDeliverWebhook, webhookJob{DeliveryID: delivery.ID}); err != nil {
+            log.Println("Error queueing webhook delivery:", err)
+        }
+    }
+}
+
+// NotifyFileUploaded tells webhooks about a file once it is accepted,
+// i.e. after its virus scan, so receivers never hear of files that are
+// then quarantined
+func NotifyFileUploaded(file models.File) {
+    notifyWebhooks(models.WebhookFileUploaded, file, map[string]interface{}{"file": file})
+}
+
+// DeliverWebhook sends a delivery and records the attempt. A failed
+// attempt returns an error so that the job is retried.
+func DeliverWebhook(payload json.RawMessage) error {
+    var job webhookJob
+    if err := json.Unmarshal(payload, &job); err != nil {
+        return jobs.Permanent(err)
+    }
+    delivery, hook, err := models.GetWebhookDelivery(job.DeliveryID)
+    if err == pgx.ErrNoRows {
+        // The webhook was deleted since
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    attempt, sendErr := sendWebhook(hook, delivery)
+    if err := models.RecordWebhookAttempt(delivery.ID, attempt, sendErr == nil); err != nil {
+        log.Println("Error recording webhook attempt:", err)
+    }
+    return sendErr
+}
+
+// sendWebhook POSTs a delivery's payload to its webhook, signed with the
+// webhook's secret, and reports how the attempt went
+func sendWebhook(hook models.Webhook, delivery models.WebhookDelivery) (models.WebhookAttempt, error) {
+    attempt := models.WebhookAttempt{AttemptedAt: time.Now()}
+    req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(delivery.Payload))
+    if err != nil {
+        attempt.Error = err.Error()
+        return attempt, jobs.Permanent(err)
+    }
+    timestamp := strconv.FormatInt(attempt.AttemptedAt.Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "file-sharing-system-webhooks")
+    req.Header.Set("X-Webhook-Event", delivery.Event)
+    req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.ID, 10))
+    req.Header.Set("X-Webhook-Timestamp", timestamp)
+    req.Header.Set("X-Webhook-Signature", signWebhook(hook.Secret, timestamp, delivery.Payload))
+
+    resp, err := webhookClient.Do(req)
+    attempt.DurationMS = int(time.Since(attempt.AttemptedAt).Milliseconds())
+    if err != nil {
+        attempt.Error = err.Error()
+        if errors.Is(err, errWebhookAddress) {
+            return attempt, jobs.Permanent(err)
+        }
+        return attempt, err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+    attempt.StatusCode = &resp.StatusCode
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        err = fmt.Errorf("webhook answered %s", resp.Status)
+        attempt.Error = err.Error()
+    }
+    return attempt, err
+}
+
+// signWebhook returns the X-Webhook-Signature of a payload sent at
+// timestamp: "sha256=" and the hex HMAC-SHA256 of "<timestamp>.<payload>"
+// keyed with the webhook's secret. Covering the timestamp lets receivers
+// reject replays of old deliveries.
+func signWebhook(secret, timestamp string, payload []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(payload)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// PurgeWebhookDeliveries deletes deliveries older than 30 days
+func PurgeWebhookDeliveries() error {
+    _, err := models.DeleteWebhookDeliveries(time.Now().Add(-webhookDeliveryRetention))
+    return err
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "net/netip"
+    "strings"
+    "testing"
+    "file-sharing-system/models"
+)
+
+// TestWebhookRequestValidate tests checking webhook URLs and events
+func TestWebhookRequestValidate(t *testing.T) {
+    for _, req := range []webhookRequest{
+        {URL: "ftp://example.com/hook", Events: []string{models.WebhookFileUploaded}},
+        {URL: "/hook", Events: []string{models.WebhookFileUploaded}},
+        {URL: "https://example.com/hook"},
+        {URL: "https://example.com/hook", Events: []string{"file.renamed"}},
+        {URL: "http://169.254.169.254/latest/meta-data", Events: []string{models.WebhookFileUploaded}},
+        {URL: "http://[::1]:8080/hook", Events: []string{models.WebhookFileUploaded}},
+        {URL: "http://localhost/hook", Events: []string{models.WebhookFileUploaded}},
+    } {
+        if err := req.validate(); err == nil {
+            t.Errorf("Expected %+v to be rejected", req)
+        }
+    }
+
+    req := webhookRequest{URL: " https://example.com/hook ", Events: []string{models.WebhookFileDeleted, models.WebhookShareAccessed, models.WebhookFileDeleted}}
+    if err := req.validate(); err != nil {
+        t.Fatal(err)
+    }
+    if req.URL != "https://example.com/hook" || len(req.Events) != 2 {
+        t.Errorf("Unexpected request %+v", req)
+    }
+}
+
+// TestCreateWebhookInvalid tests that invalid webhooks are rejected before
+// anything is stored
+func TestCreateWebhookInvalid(t *testing.T) {
+    for body, code := range map[string]int{
+        `not json`: http.StatusBadRequest,
+        `{"url": "http://example.com", "events": []}`:         http.StatusUnprocessableEntity,
+        `{"url": "example.com", "events": ["file.uploaded"]}`: http.StatusUnprocessableEntity,
+    } {
+        req := withUser(httptest.NewRequest("POST", "/webhooks", strings.NewReader(body)), models.User{ID: 1})
+        rec := httptest.NewRecorder()
+        CreateWebhook(rec, req)
+        if rec.Code != code {
+            t.Errorf("%s: expected %d, got %d", body, code, rec.Code)
+        }
+    }
+}
+
+// TestSendWebhook tests that deliveries carry their payload, event and an
+// HMAC-SHA256 signature a receiver can verify with the secret
+func TestSendWebhook(t *testing.T) {
+    t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+    hook := models.Webhook{Secret: models.NewWebhookSecret()}
+    delivery := models.WebhookDelivery{ID: 12, Event: models.WebhookFileUploaded, Payload: []byte(`{"event":"file.uploaded","data":{}}`)}
+
+    var received http.Header
+    var body []byte
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        received = r.Header
+        body, _ = io.ReadAll(r.Body)
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    defer receiver.Close()
+    hook.URL = receiver.URL
+
+    attempt, err := sendWebhook(hook, delivery)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if attempt.StatusCode == nil || *attempt.StatusCode != http.StatusNoContent || attempt.Error != "" {
+        t.Errorf("Unexpected attempt %+v", attempt)
+    }
+    if string(body) != string(delivery.Payload) {
+        t.Errorf("Unexpected body %s", body)
+    }
+    if received.Get("X-Webhook-Event") != models.WebhookFileUploaded || received.Get("X-Webhook-Delivery") != "12" {
+        t.Errorf("Unexpected headers %v", received)
+    }
+
+    mac := hmac.New(sha256.New, []byte(hook.Secret))
+    mac.Write([]byte(received.Get("X-Webhook-Timestamp") + "." + string(body)))
+    expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+    if received.Get("X-Webhook-Signature") != expected {
+        t.Errorf("Expected signature %s, got %s", expected, received.Get("X-Webhook-Signature"))
+    }
+}
+
+// TestSendWebhookFailures tests that error answers, redirects and
+// unreachable receivers count as failed attempts
+func TestSendWebhookFailures(t *testing.T) {
+    t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/moved" {
+            http.Redirect(w, r, "/hook", http.StatusFound)
+            return
+        }
+        http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+    }))
+    delivery := models.WebhookDelivery{ID: 1, Event: models.WebhookFileDeleted, Payload: []byte(`{}`)}
+
+    for path, code := range map[string]int{"/hook": http.StatusServiceUnavailable, "/moved": http.StatusFound} {
+        attempt, err := sendWebhook(models.Webhook{URL: receiver.URL + path, Secret: "s"}, delivery)
+        if err == nil || attempt.StatusCode == nil || *attempt.StatusCode != code || attempt.Error == "" {
+            t.Errorf("%s: unexpected attempt %+v, %v", path, attempt, err)
+        }
+    }
+
+    receiver.Close()
+    attempt, err := sendWebhook(models.Webhook{URL: receiver.URL + "/hook", Secret: "s"}, delivery)
+    if err == nil || attempt.StatusCode != nil || attempt.Error == "" {
+        t.Errorf("Expected an unreachable receiver to fail without a status, got %+v", attempt)
+    }
+}
+
+// TestSendWebhookPrivateAddress tests that deliveries never connect to
+// internal addresses unless that is allowed
+func TestSendWebhookPrivateAddress(t *testing.T) {
+    called := false
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        called = true
+    }))
+    defer receiver.Close()
+
+    t.Setenv("WEBHOOK_ALLOW_PRIVATE", "")
+    delivery := models.WebhookDelivery{ID: 1, Event: models.WebhookFileUploaded, Payload: []byte(`{}`)}
+    attempt, err := sendWebhook(models.Webhook{URL: receiver.URL, Secret: "s"}, delivery)
+    if !errors.Is(err, errWebhookAddress) || attempt.StatusCode != nil || called {
+        t.Errorf("Expected a loopback receiver to be refused, got %+v, %v", attempt, err)
+    }
+}
+
+// TestPublicAddr tests which addresses webhooks may connect to
+func TestPublicAddr(t *testing.T) {
+    for addr, public := range map[string]bool{
+        "93.184.216.34":          true,
+        "2606:2800:220:1::":      true,
+        "127.0.0.1":              false,
+        "10.1.2.3":               false,
+        "172.16.0.1":             false,
+        "192.168.1.1":            false,
+        "169.254.169.254":        false,
+        "100.64.0.1":             false,
+        "0.0.0.0":                false,
+        "224.0.0.1":              false,
+        "::1":                    false,
+        "fe80::1":                false,
+        "fd00::1":                false,
+        "::":                     false,
+        "::ffff:127.0.0.1":       false,
+        "::ffff:169.254.169.254": false,
+    } {
+        if got := publicAddr(netip.MustParseAddr(addr)); got != public {
+            t.Errorf("%s: expected %v, got %v", addr, public, got)
+        }
+    }
+}
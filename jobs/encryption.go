@@ -0,0 +1,107 @@
+package jobs
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+// TypeRewrapKeys rewraps data keys after a master key rotation
+const TypeRewrapKeys = "rewrap_keys"
+
+func init() {
+    Register(TypeRewrapKeys, func(json.RawMessage) error {
+        count, err := RewrapKeys()
+        log.Printf("Rewrapped %d data keys", count)
+        return err
+    })
+}
+
+// RewrapKeys rewraps the data keys of files and thumbnails encrypted under a
+// retired master key with the active one, along with the S3 secrets of API
+// tokens, which it also wraps when they were stored before encryption at
+// rest was enabled. Contents are not touched, so rotating the master key is
+// cheap; the retired key can be removed from the keyfile once this reports
+// no failures.
+func RewrapKeys() (int, error) {
+    provider := utils.GetKeyProvider()
+    if provider == nil {
+        return 0, fmt.Errorf("encryption at rest is not configured")
+    }
+    active := provider.ActiveKeyID()
+
+    files, err := models.GetFilesToRewrap(active)
+    if err != nil {
+        return 0, err
+    }
+    thumbs, err := models.GetThumbnailsToRewrap(active)
+    if err != nil {
+        return 0, err
+    }
+    secrets, err := models.GetS3SecretsToRewrap(active)
+    if err != nil {
+        return 0, err
+    }
+
+    rewrapped := 0
+    for _, file := range files {
+        wrapped, err := rewrapKey(provider, file.KeyID, file.WrappedKey)
+        if err != nil {
+            log.Printf("Unable to rewrap data key of file %d: %s", file.ID, err)
+            continue
+        }
+        if err := models.UpdateFileKey(file.ID, active, wrapped); err != nil {
+            return rewrapped, err
+        }
+        rewrapped++
+    }
+    for _, thumb := range thumbs {
+        wrapped, err := rewrapKey(provider, thumb.KeyID, thumb.WrappedKey)
+        if err != nil {
+            log.Printf("Unable to rewrap data key of thumbnail %d/%d: %s", thumb.FileID, thumb.Size, err)
+            continue
+        }
+        if err := models.UpdateThumbnailKey(thumb, active, wrapped); err != nil {
+            return rewrapped, err
+        }
+        rewrapped++
+    }
+
+    for _, secret := range secrets {
+        var wrapped []byte
+        if secret.KeyID == "" {
+            wrapped, err = provider.WrapKey(active, []byte(*secret.Plain))
+        } else {
+            wrapped, err = rewrapKey(provider, secret.KeyID, secret.Wrapped)
+        }
+        if err != nil {
+            log.Printf("Unable to rewrap S3 secret of API token %d: %s", secret.TokenID, err)
+            continue
+        }
+        if err := models.UpdateS3Secret(secret.TokenID, active, wrapped); err != nil {
+            return rewrapped, err
+        }
+        rewrapped++
+    }
+
+    if total := len(files) + len(thumbs) + len(secrets); rewrapped < total {
+        return rewrapped, fmt.Errorf("%d of %d data keys could not be rewrapped", total-rewrapped, total)
+    }
+    return rewrapped, nil
+}
+
+// rewrapKey wraps a data key wrapped under keyID with the active master key
+func rewrapKey(provider utils.KeyProvider, keyID string, wrapped []byte) ([]byte, error) {
+    dataKey, err := provider.UnwrapKey(keyID, wrapped)
+    if err != nil {
+        return nil, err
+    }
+    return provider.WrapKey(provider.ActiveKeyID(), dataKey)
+}
+
+// EnqueueRewrapKeys schedules a background rewrap of data keys
+func EnqueueRewrapKeys() error {
+    return EnqueueUnique(TypeRewrapKeys, TypeRewrapKeys, struct{}{})
+}
@@ -0,0 +1,31 @@
+package jobs
+
+import (
+    "encoding/json"
+    "file-sharing-system/utils"
+)
+
+// TypeSendEmail sends an email, so a slow or unavailable mail server does
+// not hold up requests and failed sends are retried
+const TypeSendEmail = "send_email"
+
+type emailPayload struct {
+    To      string `json:"to"`
+    Subject string `json:"subject"`
+    Body    string `json:"body"`
+}
+
+func init() {
+    Register(TypeSendEmail, func(payload json.RawMessage) error {
+        var p emailPayload
+        if err := json.Unmarshal(payload, &p); err != nil {
+            return Permanent(err)
+        }
+        return utils.SendMail(p.To, p.Subject, p.Body)
+    })
+}
+
+// EnqueueEmail queues a plain text email for sending
+func EnqueueEmail(to, subject, body string) error {
+    return Enqueue(TypeSendEmail, emailPayload{To: to, Subject: subject, Body: body})
+}
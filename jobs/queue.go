@@ -0,0 +1,241 @@
+package jobs
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/rand"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+    "file-sharing-system/models"
+    "github.com/jackc/pgx/v4"
+)
+
+// Jobs are stored in Postgres and claimed with SELECT ... FOR UPDATE SKIP
+// LOCKED, so any number of worker processes can share the queue. A failed
+// job is retried with exponential backoff until it has been attempted
+// JOB_MAX_ATTEMPTS times, after which it is kept as dead for an
+// administrator to inspect and retry.
+
+// Handler runs one job given its JSON payload
+type Handler func(payload json.RawMessage) error
+
+var (
+    handlersMu sync.RWMutex
+    handlers   = make(map[string]Handler)
+)
+
+// Register sets the handler for a job type. Job types used by the jobs
+// package register themselves; others are registered by main.
+func Register(jobType string, handler Handler) {
+    handlersMu.Lock()
+    defer handlersMu.Unlock()
+    handlers[jobType] = handler
+}
+
+func handlerFor(jobType string) (Handler, bool) {
+    handlersMu.RLock()
+    defer handlersMu.RUnlock()
+    handler, ok := handlers[jobType]
+    return handler, ok
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct {
+    err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error so the job fails immediately instead of being retried
+func Permanent(err error) error {
+    return permanentError{err}
+}
+
+// Enqueue queues a job of the given type with payload marshalled as JSON
+func Enqueue(jobType string, payload interface{}) error {
+    return enqueue(jobType, nil, payload)
+}
+
+// EnqueueUnique queues a job unless one with the same key is already queued
+// or running, e.g. so a file is not scanned twice concurrently
+func EnqueueUnique(jobType, uniqueKey string, payload interface{}) error {
+    return enqueue(jobType, &uniqueKey, payload)
+}
+
+func enqueue(jobType string, uniqueKey *string, payload interface{}) error {
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    _, err = models.InsertJob(models.Job{
+        Type:        jobType,
+        Payload:     data,
+        UniqueKey:   uniqueKey,
+        MaxAttempts: maxAttempts(),
+        RunAt:       time.Now(),
+    })
+    if err != nil {
+        return fmt.Errorf("enqueueing %s job: %w", jobType, err)
+    }
+    return nil
+}
+
+// Concurrency returns the number of workers a process runs, from
+// WORKER_CONCURRENCY (default 4). Zero disables workers in the API process.
+func Concurrency() int {
+    workers, err := strconv.Atoi(os.Getenv("WORKER_CONCURRENCY"))
+    if err != nil || workers < 0 {
+        return 4
+    }
+    return workers
+}
+
+func maxAttempts() int {
+    attempts, err := strconv.Atoi(os.Getenv("JOB_MAX_ATTEMPTS"))
+    if err != nil || attempts < 1 {
+        return 5
+    }
+    return attempts
+}
+
+// jobLease is how long a claimed job may run before another worker may
+// assume its worker died and claim it again
+func jobLease() time.Duration {
+    lease, err := time.ParseDuration(os.Getenv("JOB_TIMEOUT"))
+    if err != nil || lease <= 0 {
+        return 30 * time.Minute
+    }
+    return lease
+}
+
+const (
+    pollInterval = 2 * time.Second
+    baseBackoff  = 10 * time.Second
+    maxBackoff   = time.Hour
+)
+
+// Backoff returns the delay before retrying a job after its nth failed
+// attempt: 10s, 20s, 40s... capped at an hour, with up to 10% jitter so
+// failures of many jobs do not retry in lockstep.
+func Backoff(attempt int) time.Duration {
+    delay := maxBackoff
+    if attempt < 20 {
+        delay = baseBackoff << (attempt - 1)
+        if delay > maxBackoff {
+            delay = maxBackoff
+        }
+    }
+    return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
+
+// Run starts concurrency workers that process jobs until ctx is cancelled,
+// and returns once they have finished their current jobs.
+func Run(ctx context.Context, concurrency int) {
+    var wg sync.WaitGroup
+    for i := 0; i < concurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            work(ctx)
+        }()
+    }
+    schedule(ctx)
+    wg.Wait()
+}
+
+func work(ctx context.Context) {
+    for ctx.Err() == nil {
+        job, err := models.ClaimJob(jobLease())
+        if err != nil {
+            if err != pgx.ErrNoRows {
+                log.Println("Error claiming job:", err)
+            }
+            select {
+            case <-ctx.Done():
+            case <-time.After(pollInterval):
+            }
+            continue
+        }
+        process(job)
+    }
+}
+
+// process runs a claimed job, holding its lease while it runs, and records
+// the outcome. The outcome is not recorded if another worker claimed the
+// job in the meantime.
+func process(job models.Job) {
+    lease := jobLease()
+    release := holdLease(job, lease, lease/3)
+    err := runJob(job)
+    release()
+
+    if err == nil {
+        if err := models.CompleteJob(job.ID, job.Attempts); err != nil {
+            log.Printf("Error completing job %d: %s", job.ID, err)
+        }
+        return
+    }
+
+    var permanent permanentError
+    if errors.As(err, &permanent) || job.Attempts >= job.MaxAttempts {
+        log.Printf("Job %d (%s) failed permanently after %d attempts: %s", job.ID, job.Type, job.Attempts, err)
+        if err := models.KillJob(job.ID, job.Attempts, err.Error()); err != nil {
+            log.Printf("Error killing job %d: %s", job.ID, err)
+        }
+        return
+    }
+    log.Printf("Job %d (%s) failed, retrying: %s", job.ID, job.Type, err)
+    if err := models.RetryJob(job.ID, job.Attempts, time.Now().Add(Backoff(job.Attempts)), err.Error()); err != nil {
+        log.Printf("Error rescheduling job %d: %s", job.ID, err)
+    }
+}
+
+// extendLease renews a job's lease; a variable so tests can watch renewals
+var extendLease = models.ExtendJobLease
+
+// holdLease renews a running job's lease every interval until the returned
+// function is called, so that jobs running longer than one lease, like
+// large archive extractions, are not claimed by another worker meanwhile
+func holdLease(job models.Job, lease, interval time.Duration) func() {
+    done := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+                if err := extendLease(job.ID, job.Attempts, lease); err != nil {
+                    log.Printf("Error renewing lease of job %d: %s", job.ID, err)
+                }
+            }
+        }
+    }()
+    return func() {
+        close(done)
+        <-stopped
+    }
+}
+
+// runJob dispatches a job to its handler, turning panics into errors
+func runJob(job models.Job) (err error) {
+    handler, ok := handlerFor(job.Type)
+    if !ok {
+        return Permanent(fmt.Errorf("no handler registered for job type %q", job.Type))
+    }
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("panic: %v", r)
+        }
+    }()
+    return handler(job.Payload)
+}
@@ -0,0 +1,108 @@
+package jobs
+
+import (
+    "encoding/json"
+    "errors"
+    "testing"
+    "time"
+    "file-sharing-system/models"
+)
+
+// TestBackoff tests that retry delays double per attempt up to the cap
+func TestBackoff(t *testing.T) {
+    cases := map[int]time.Duration{
+        1:  10 * time.Second,
+        2:  20 * time.Second,
+        4:  80 * time.Second,
+        12: time.Hour,
+        50: time.Hour,
+    }
+    for attempt, expected := range cases {
+        delay := Backoff(attempt)
+        if delay < expected || delay > expected+expected/10 {
+            t.Errorf("Attempt %d: expected %s plus jitter, got %s", attempt, expected, delay)
+        }
+    }
+}
+
+// TestRunJob tests dispatching jobs to their registered handlers
+func TestRunJob(t *testing.T) {
+    var received struct {
+        Name string `json:"name"`
+    }
+    Register("test_echo", func(payload json.RawMessage) error {
+        return json.Unmarshal(payload, &received)
+    })
+    Register("test_panic", func(json.RawMessage) error {
+        panic("boom")
+    })
+
+    if err := runJob(models.Job{Type: "test_echo", Payload: json.RawMessage(`{"name":"report.pdf"}`)}); err != nil || received.Name != "report.pdf" {
+        t.Errorf("Expected payload to reach the handler, got %q (%v)", received.Name, err)
+    }
+    if err := runJob(models.Job{Type: "test_panic"}); err == nil {
+        t.Errorf("Expected a panicking handler to fail the job")
+    }
+
+    var permanent permanentError
+    if err := runJob(models.Job{Type: "test_unknown"}); !errors.As(err, &permanent) {
+        t.Errorf("Expected a permanent failure for an unregistered type, got %v", err)
+    }
+}
+
+// TestBuiltinJobTypes tests that the jobs package registers its job types
+func TestBuiltinJobTypes(t *testing.T) {
+    for _, jobType := range []string{TypeScanFile, TypeThumbnails, TypeRewrapKeys, TypePurgeJobs, TypeSendEmail} {
+        if _, ok := handlerFor(jobType); !ok {
+            t.Errorf("Expected a handler for %s", jobType)
+        }
+    }
+}
+
+// TestFileHandlerInvalidPayload tests that malformed payloads are not retried
+func TestFileHandlerInvalidPayload(t *testing.T) {
+    handler := fileHandler(func(models.File) error { return nil })
+    var permanent permanentError
+    if err := handler(json.RawMessage(`"not an object"`)); !errors.As(err, &permanent) {
+        t.Errorf("Expected a permanent failure, got %v", err)
+    }
+}
+
+// TestHoldLease tests that a running job's lease is renewed by the attempt
+// that claimed it until the job finishes
+func TestHoldLease(t *testing.T) {
+    renewals := make(chan int, 100)
+    extendLease = func(id int64, attempt int, lease time.Duration) error {
+        renewals <- attempt
+        return nil
+    }
+    defer func() { extendLease = models.ExtendJobLease }()
+
+    release := holdLease(models.Job{ID: 1, Attempts: 2}, time.Minute, time.Millisecond)
+    time.Sleep(20 * time.Millisecond)
+    release()
+    n := len(renewals)
+    if n == 0 {
+        t.Fatal("Expected the lease to be renewed while the job runs")
+    }
+    if attempt := <-renewals; attempt != 2 {
+        t.Errorf("Expected renewals by attempt 2, got %d", attempt)
+    }
+    time.Sleep(10 * time.Millisecond)
+    if len(renewals) != n-1 {
+        t.Error("Expected renewals to stop once the job finished")
+    }
+}
+
+// TestFileAccepted tests that accepted files reach every registered hook
+func TestFileAccepted(t *testing.T) {
+    var seen []int
+    OnFileAccepted(func(file models.File) { seen = append(seen, file.ID) })
+    OnFileAccepted(func(file models.File) { seen = append(seen, -file.ID) })
+    defer func() { acceptedHooks = nil }()
+
+    FileAccepted(models.File{ID: 4})
+    if len(seen) != 2 || seen[0] != 4 || seen[1] != -4 {
+        t.Errorf("Expected both hooks to run, got %v", seen)
+    }
+}
@@ -0,0 +1,158 @@
+package jobs
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// TypeScanFile scans a stored file for viruses
+const TypeScanFile = "scan_file"
+
+// TypeRequeueScans queues the scans of pending files that have none, as
+// when queueing failed after the file was recorded
+const TypeRequeueScans = "requeue_scans"
+
+// requeueScansInterval is how often pending files are checked for a scan
+// job, and how long a new file has to get one before it is
+const requeueScansInterval = 10 * time.Minute
+
+// scanKeyPrefix starts the unique key of a file's scan job
+const scanKeyPrefix = "scan:"
+
+// filePayload names the file a job works on
+type filePayload struct {
+    FileID int `json:"file_id"`
+}
+
+func init() {
+    Register(TypeScanFile, fileHandler(ScanFile))
+    Register(TypeRequeueScans, func(json.RawMessage) error {
+        return RequeueScans(time.Now().Add(-requeueScansInterval))
+    })
+    Every(TypeRequeueScans, requeueScansInterval)
+}
+
+// fileHandler adapts a function on a file into a Handler that loads the
+// file named in the payload. Jobs for files deleted since they were queued
+// succeed without doing anything.
+func fileHandler(run func(models.File) error) Handler {
+    return func(payload json.RawMessage) error {
+        var p filePayload
+        if err := json.Unmarshal(payload, &p); err != nil {
+            return Permanent(err)
+        }
+        file, err := models.GetFileByID(strconv.Itoa(p.FileID))
+        if err == pgx.ErrNoRows {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        return run(file)
+    }
+}
+
+// ScanningEnabled reports whether uploads are scanned, i.e. CLAMD_ADDRESS is set
+func ScanningEnabled() bool {
+    return utils.NewClamAVFromEnv() != nil
+}
+
+// AsyncScanning reports whether scans run in the background after the
+// upload is accepted (the default) rather than before it completes
+// (SCAN_MODE=sync).
+func AsyncScanning() bool {
+    return os.Getenv("SCAN_MODE") != "sync"
+}
+
+// ScanObject runs a stored file's content through clamd
+func ScanObject(file models.File) (utils.ScanResult, error) {
+    clamav := utils.NewClamAVFromEnv()
+    if clamav == nil {
+        return utils.ScanResult{}, fmt.Errorf("virus scanning is not configured")
+    }
+
+    content, err := models.OpenContent(file)
+    if err != nil {
+        return utils.ScanResult{}, err
+    }
+    defer content.Close()
+
+    return clamav.Scan(content)
+}
+
+// ScanFile scans a stored file and records the verdict on its row. Clean
+// files are then accepted.
+func ScanFile(file models.File) error {
+    result, err := ScanObject(file)
+    if err != nil {
+        return err
+    }
+    if result.Infected {
+        return models.SetScanStatus(file.ID, models.ScanInfected, result.Signature)
+    }
+    if err := models.SetScanStatus(file.ID, models.ScanClean, ""); err != nil {
+        return err
+    }
+    file.ScanStatus = models.ScanClean
+    FileAccepted(file)
+    return nil
+}
+
+var (
+    acceptedMu    sync.RWMutex
+    acceptedHooks []func(models.File)
+)
+
+// OnFileAccepted registers fn to run for every stored file once it is
+// accepted: when its background scan finds it clean, or as soon as it is
+// stored when it is scanned before being recorded or not scanned at all.
+// Hooks implemented outside the jobs package are registered by main.
+func OnFileAccepted(fn func(models.File)) {
+    acceptedMu.Lock()
+    defer acceptedMu.Unlock()
+    acceptedHooks = append(acceptedHooks, fn)
+}
+
+// FileAccepted runs the hooks registered with OnFileAccepted for a file
+func FileAccepted(file models.File) {
+    acceptedMu.RLock()
+    hooks := acceptedHooks
+    acceptedMu.RUnlock()
+    for _, fn := range hooks {
+        fn(file)
+    }
+}
+
+// EnqueueScan schedules a background scan of a file
+func EnqueueScan(file models.File) error {
+    return EnqueueUnique(TypeScanFile, scanKeyPrefix+strconv.Itoa(file.ID), filePayload{FileID: file.ID})
+}
+
+// RequeueScans queues a scan of every file stored before before that is
+// still pending without a scan job, so that no file stays pending forever
+func RequeueScans(before time.Time) error {
+    if !ScanningEnabled() {
+        return nil
+    }
+    files, err := models.GetUnqueuedScans(scanKeyPrefix, before)
+    if err != nil {
+        return err
+    }
+    for _, file := range files {
+        if err := EnqueueScan(file); err != nil {
+            return err
+        }
+    }
+    if len(files) > 0 {
+        log.Printf("Requeued the virus scans of %d files", len(files))
+    }
+    return nil
+}
@@ -0,0 +1,59 @@
+package jobs
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "os"
+    "time"
+    "file-sharing-system/models"
+)
+
+// periodic is a job type enqueued at a fixed interval
+type periodic struct {
+    jobType  string
+    interval time.Duration
+}
+
+var periodics []periodic
+
+// Every has running workers enqueue a job of jobType every interval. The
+// job type doubles as its unique key, so several worker processes keep at
+// most one of them queued at a time.
+func Every(jobType string, interval time.Duration) {
+    periodics = append(periodics, periodic{jobType, interval})
+}
+
+func schedule(ctx context.Context) {
+    for _, p := range periodics {
+        go func(p periodic) {
+            ticker := time.NewTicker(p.interval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-ctx.Done():
+                    return
+                case <-ticker.C:
+                    if err := EnqueueUnique(p.jobType, p.jobType, struct{}{}); err != nil {
+                        log.Println("Error scheduling job:", err)
+                    }
+                }
+            }
+        }(p)
+    }
+}
+
+// TypePurgeJobs deletes completed jobs older than JOB_RETENTION (default 7 days)
+const TypePurgeJobs = "purge_jobs"
+
+func init() {
+    Register(TypePurgeJobs, func(json.RawMessage) error {
+        retention, err := time.ParseDuration(os.Getenv("JOB_RETENTION"))
+        if err != nil || retention <= 0 {
+            retention = 7 * 24 * time.Hour
+        }
+        _, err = models.PurgeFinishedJobs(time.Now().Add(-retention))
+        return err
+    })
+    Every(TypePurgeJobs, time.Hour)
+}
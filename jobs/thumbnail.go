@@ -0,0 +1,81 @@
+package jobs
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "time"
+    "file-sharing-system/models"
+    "file-sharing-system/utils"
+)
+
+// TypeThumbnails generates the thumbnails of an image file
+const TypeThumbnails = "thumbnails"
+
+func init() {
+    Register(TypeThumbnails, fileHandler(GenerateThumbnails))
+    OnFileAccepted(queueThumbnails)
+}
+
+// queueThumbnails queues the thumbnails of a file once it is accepted, so
+// that only content found clean is ever decoded
+func queueThumbnails(file models.File) {
+    if file.PreviewStatus != models.PreviewPending {
+        return
+    }
+    if err := EnqueueThumbnails(file); err != nil {
+        log.Println("Error queueing thumbnails:", err)
+    }
+}
+
+// GenerateThumbnails decodes a stored image once and stores a JPEG
+// thumbnail for each of utils.ThumbnailSizes as a derived object. Files
+// that are not scanned clean are left alone; they are queued again once
+// they are.
+func GenerateThumbnails(file models.File) error {
+    if !file.ScanAllowsAccess() {
+        return nil
+    }
+    content, err := models.OpenContent(file)
+    if err != nil {
+        return err
+    }
+    img, err := utils.DecodeImage(content)
+    content.Close()
+    if err != nil {
+        // Retrying will not make a corrupt or oversized image decodable
+        models.SetPreviewStatus(file.ID, models.PreviewFailed)
+        return Permanent(err)
+    }
+
+    for _, size := range utils.ThumbnailSizes {
+        var buf bytes.Buffer
+        if err := utils.EncodeThumbnail(&buf, utils.Thumbnail(img, size)); err != nil {
+            models.SetPreviewStatus(file.ID, models.PreviewFailed)
+            return err
+        }
+
+        thumb := models.Thumbnail{
+            FileID:     file.ID,
+            Size:       size,
+            StorageKey: utils.ThumbnailKey(file.StorageKey, size),
+            Bytes:      int64(buf.Len()),
+            CreatedAt:  time.Now(),
+        }
+        _, thumb.KeyID, thumb.WrappedKey, err = models.PutContent(thumb.StorageKey, &buf)
+        if err != nil {
+            return err
+        }
+        if err := models.SaveThumbnail(thumb); err != nil {
+            // The file was most likely deleted while its thumbnails were generated
+            utils.GetStorage().Delete(thumb.StorageKey)
+            return err
+        }
+    }
+    return models.SetPreviewStatus(file.ID, models.PreviewReady)
+}
+
+// EnqueueThumbnails schedules thumbnail generation for a file
+func EnqueueThumbnails(file models.File) error {
+    return EnqueueUnique(TypeThumbnails, fmt.Sprintf("thumbnails:%d", file.ID), filePayload{FileID: file.ID})
+}
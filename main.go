@@ -1,16 +1,32 @@
 package main
 
 import (
+    "context"
+    "encoding/json"
     "log"
     "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
 
     "file-sharing-system/handlers"
+    "file-sharing-system/jobs"
+    "file-sharing-system/models"
     "file-sharing-system/utils"
 
     "github.com/gorilla/mux"
 )
 
+// Usage: file-sharing-system [serve|worker]. serve (the default) runs the
+// API along with WORKER_CONCURRENCY background workers; worker runs only the
+// workers, so they can be scaled separately from the API.
 func main() {
+    command := "serve"
+    if len(os.Args) > 1 {
+        command = os.Args[1]
+    }
+
     // Initialize database connection and Redis
     db := utils.ConnectDB()
     defer db.Close()
@@ -18,18 +34,188 @@ func main() {
     redisClient := utils.ConnectRedis()
     defer redisClient.Close()
 
+    registerJobs()
+
+    switch command {
+    case "serve":
+        serve()
+    case "worker":
+        work()
+    default:
+        log.Fatalf("Unknown command %q, expected serve or worker", command)
+    }
+}
+
+// registerJobs sets up the job types implemented outside the jobs package
+func registerJobs() {
+    // Discard resumable uploads and upload sessions that were abandoned
+    jobs.Register("purge_expired_uploads", func(json.RawMessage) error {
+        return handlers.PurgeExpiredUploads()
+    })
+    jobs.Register("purge_expired_upload_sessions", func(json.RawMessage) error {
+        return handlers.PurgeExpiredUploadSessions()
+    })
+    jobs.Register("purge_expired_s3_uploads", func(json.RawMessage) error {
+        return handlers.PurgeExpiredS3Uploads()
+    })
+    jobs.Register("purge_expired_share_links", func(json.RawMessage) error {
+        return handlers.PurgeExpiredShareLinks()
+    })
+    jobs.Register("purge_webhook_deliveries", func(json.RawMessage) error {
+        return handlers.PurgeWebhookDeliveries()
+    })
+    jobs.Register(handlers.TypeExtractArchive, handlers.ExtractArchive)
+    jobs.Register(handlers.TypeDeliverWebhook, handlers.DeliverWebhook)
+    jobs.OnFileAccepted(handlers.NotifyFileUploaded)
+    jobs.Every("purge_expired_uploads", 10*time.Minute)
+    jobs.Every("purge_expired_upload_sessions", 10*time.Minute)
+    jobs.Every("purge_expired_s3_uploads", 10*time.Minute)
+    jobs.Every("purge_expired_share_links", time.Hour)
+    jobs.Every("purge_webhook_deliveries", 24*time.Hour)
+}
+
+// work processes background jobs until the process is interrupted
+func work() {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    workers := jobs.Concurrency()
+    if workers < 1 {
+        workers = 1
+    }
+    log.Printf("Worker started with %d workers", workers)
+    jobs.Run(ctx, workers)
+}
+
+func serve() {
+    // Run background workers in the API process unless WORKER_CONCURRENCY=0
+    if workers := jobs.Concurrency(); workers > 0 {
+        go jobs.Run(context.Background(), workers)
+    }
+
+    // Wake requests waiting on the event log as events are logged
+    go handlers.ListenForEvents(context.Background())
+
     // Initialize routes
     r := mux.NewRouter()
 
     // Auth routes
-    r.HandleFunc("/register", handlers.Register).Methods("POST")
-    r.HandleFunc("/login", handlers.Login).Methods("POST")
+    r.HandleFunc("/register", handlers.Audit(models.AuditRegister, handlers.Register)).Methods("POST")
+    r.HandleFunc("/login", handlers.Audit(models.AuditLogin, handlers.Login)).Methods("POST")
+
+    // Public share links, which need no authentication
+    r.HandleFunc("/s/{token}", handlers.Audit(models.AuditShareAccess, handlers.DownloadSharedFile)).Methods("GET")
+
+    // WebDAV, with its own authentication so clients can use basic auth
+    dav := r.NewRoute().Subrouter()
+    dav.Use(handlers.AuthenticateDAV)
+    dav.PathPrefix("/dav/").HandlerFunc(handlers.ServeWebDAV)
+    dav.PathPrefix("/dav-org/{org_id}/").HandlerFunc(handlers.ServeWebDAV)
+
+    // Routes below require a valid JWT or API token
+    api := r.NewRoute().Subrouter()
+    api.Use(handlers.Authenticate)
 
     // File routes
-    r.HandleFunc("/upload", handlers.UploadFile).Methods("POST")
-    r.HandleFunc("/files", handlers.GetFiles).Methods("GET")
-    r.HandleFunc("/share/{file_id}", handlers.ShareFile).Methods("GET")
-    
+    api.HandleFunc("/upload", handlers.Audit(models.AuditFileUpload, handlers.UploadFile)).Methods("POST")
+    api.HandleFunc("/files", handlers.GetFiles).Methods("GET")
+    api.HandleFunc("/files/search", handlers.SearchFiles).Methods("GET")
+    api.HandleFunc("/changes", handlers.GetChanges).Methods("GET")
+    api.HandleFunc("/files/{file_id}", handlers.GetFile).Methods("GET")
+    api.HandleFunc("/files/{file_id}", handlers.PatchFile).Methods("PATCH")
+    api.HandleFunc("/files/{file_id}", handlers.Audit(models.AuditFileDelete, handlers.DeleteFile)).Methods("DELETE")
+    api.HandleFunc("/files/{file_id}/download", handlers.Audit(models.AuditFileDownload, handlers.DownloadFile)).Methods("GET")
+    api.HandleFunc("/files/{file_id}/thumbnail", handlers.GetThumbnail).Methods("GET")
+    api.HandleFunc("/share/{file_id}", handlers.Audit(models.AuditShareLinkCreate, handlers.ShareFile)).Methods("GET")
+    api.HandleFunc("/files/{file_id}/links", handlers.Audit(models.AuditShareLinkCreate, handlers.CreateShareLink)).Methods("POST")
+    api.HandleFunc("/files/{file_id}/links", handlers.GetShareLinks).Methods("GET")
+    api.HandleFunc("/files/{file_id}/links/{link_id}", handlers.Audit(models.AuditShareLinkRevoke, handlers.DeleteShareLink)).Methods("DELETE")
+    api.HandleFunc("/archives", handlers.Audit(models.AuditArchiveDownload, handlers.CreateArchive)).Methods("POST")
+    api.HandleFunc("/extractions/{extraction_id}", handlers.GetExtraction).Methods("GET")
+    api.HandleFunc("/folders/archive", handlers.Audit(models.AuditArchiveDownload, handlers.GetFolderArchive)).Methods("GET")
+    api.HandleFunc("/me/usage", handlers.GetUsage).Methods("GET")
+
+    // API tokens and SSH keys
+    api.HandleFunc("/tokens", handlers.CreateAPIToken).Methods("POST")
+    api.HandleFunc("/tokens", handlers.GetAPITokens).Methods("GET")
+    api.HandleFunc("/tokens/{token_id}", handlers.DeleteAPIToken).Methods("DELETE")
+    api.HandleFunc("/ssh-keys", handlers.CreateSSHKey).Methods("POST")
+    api.HandleFunc("/ssh-keys", handlers.GetSSHKeys).Methods("GET")
+    api.HandleFunc("/ssh-keys/{key_id}", handlers.DeleteSSHKey).Methods("DELETE")
+
+    // Outgoing webhooks
+    api.HandleFunc("/webhooks", handlers.CreateWebhook).Methods("POST")
+    api.HandleFunc("/webhooks", handlers.GetWebhooks).Methods("GET")
+    api.HandleFunc("/webhooks/{webhook_id}", handlers.DeleteWebhook).Methods("DELETE")
+    api.HandleFunc("/webhooks/{webhook_id}/deliveries", handlers.GetWebhookDeliveries).Methods("GET")
+    api.HandleFunc("/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver", handlers.RedeliverWebhook).Methods("POST")
+
+    // Sharing with users and groups
+    api.HandleFunc("/files/{file_id}/permissions", handlers.GetFilePermissions).Methods("GET")
+    api.HandleFunc("/files/{file_id}/permissions", handlers.Audit(models.AuditShareGrant, handlers.PutFilePermission)).Methods("PUT")
+    api.HandleFunc("/folders/permissions", handlers.GetFolderPermissions).Methods("GET")
+    api.HandleFunc("/folders/permissions", handlers.Audit(models.AuditShareGrant, handlers.PutFolderPermission)).Methods("PUT")
+    api.HandleFunc("/permissions/{permission_id}", handlers.Audit(models.AuditShareRevoke, handlers.DeletePermission)).Methods("DELETE")
+    api.HandleFunc("/shared-with-me", handlers.SharedWithMe).Methods("GET")
+
+    // Organizations
+    api.HandleFunc("/orgs", handlers.CreateOrg).Methods("POST")
+    api.HandleFunc("/orgs", handlers.GetOrgs).Methods("GET")
+    api.HandleFunc("/orgs/{org_id}", handlers.GetOrg).Methods("GET")
+    api.HandleFunc("/orgs/{org_id}/members", handlers.GetOrgMembers).Methods("GET")
+    api.HandleFunc("/orgs/{org_id}/members/{user_id}", handlers.PutOrgMember).Methods("PUT")
+    api.HandleFunc("/orgs/{org_id}/members/{user_id}", handlers.DeleteOrgMember).Methods("DELETE")
+    api.HandleFunc("/orgs/{org_id}/invitations", handlers.CreateInvitation).Methods("POST")
+    api.HandleFunc("/orgs/{org_id}/invitations", handlers.GetInvitations).Methods("GET")
+    api.HandleFunc("/orgs/{org_id}/invitations/{invitation_id}", handlers.DeleteInvitation).Methods("DELETE")
+    api.HandleFunc("/invitations/{token}", handlers.GetInvitation).Methods("GET")
+    api.HandleFunc("/invitations/{token}/accept", handlers.AcceptInvitation).Methods("POST")
+
+    // Resumable upload routes (tus protocol)
+    r.HandleFunc("/uploads", handlers.TusOptions).Methods("OPTIONS")
+    api.HandleFunc("/uploads", handlers.Audit(models.AuditFileUpload, handlers.CreateUpload)).Methods("POST")
+    api.HandleFunc("/uploads/{upload_id}", handlers.GetUploadOffset).Methods("HEAD")
+    api.HandleFunc("/uploads/{upload_id}", handlers.Audit(models.AuditFileUpload, handlers.PatchUpload)).Methods("PATCH")
+    api.HandleFunc("/uploads/{upload_id}", handlers.TerminateUpload).Methods("DELETE")
+
+    // Chunked parallel upload routes
+    api.HandleFunc("/upload-sessions", handlers.CreateUploadSession).Methods("POST")
+    api.HandleFunc("/upload-sessions/{session_id}/parts", handlers.ListUploadParts).Methods("GET")
+    api.HandleFunc("/upload-sessions/{session_id}/parts/{part_number}", handlers.UploadPart).Methods("PUT")
+    api.HandleFunc("/upload-sessions/{session_id}/complete", handlers.Audit(models.AuditFileUpload, handlers.CompleteUploadSession)).Methods("POST")
+    api.HandleFunc("/upload-sessions/{session_id}", handlers.AbortUploadSession).Methods("DELETE")
+
+    // Administration routes
+    admin := api.PathPrefix("/admin").Subrouter()
+    admin.Use(handlers.RequireAdmin)
+    admin.HandleFunc("/content-policies", handlers.GetContentPolicies).Methods("GET")
+    admin.HandleFunc("/content-policies/{group}", handlers.PutContentPolicy).Methods("PUT")
+    admin.HandleFunc("/content-policies/{group}", handlers.DeleteContentPolicy).Methods("DELETE")
+    admin.HandleFunc("/users/{user_id}/group", handlers.SetUserGroup).Methods("PUT")
+    admin.HandleFunc("/orgs/{org_id}/quota", handlers.SetOrgQuota).Methods("PUT")
+    admin.HandleFunc("/encryption/rotate", handlers.RotateEncryptionKeys).Methods("POST")
+    admin.HandleFunc("/jobs", handlers.GetJobs).Methods("GET")
+    admin.HandleFunc("/jobs/{job_id}/retry", handlers.RetryJob).Methods("POST")
+    admin.HandleFunc("/audit", handlers.GetAuditLog).Methods("GET")
+    admin.HandleFunc("/audit/export", handlers.ExportAuditLog).Methods("GET")
+    admin.HandleFunc("/audit/verify", handlers.VerifyAuditLog).Methods("GET")
+
+    // The S3 gateway listens on its own address when S3_ADDR is set
+    if addr := os.Getenv("S3_ADDR"); addr != "" {
+        go func() {
+            log.Println("S3 gateway started on", addr)
+            log.Fatal(http.ListenAndServe(addr, http.HandlerFunc(handlers.ServeS3)))
+        }()
+    }
+
+    // The SFTP server listens on its own address when SFTP_ADDR is set
+    if addr := os.Getenv("SFTP_ADDR"); addr != "" {
+        go func() {
+            log.Println("SFTP server started on", addr)
+            log.Fatal(handlers.ServeSFTP(addr))
+        }()
+    }
+
     // Start the server
     log.Println("Server started on :8080")
     log.Fatal(http.ListenAndServe(":8080", r))
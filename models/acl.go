@@ -0,0 +1,265 @@
+package models
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// Roles a user can hold on a file, from least to most privileged. Each role
+// includes the permissions of the ones before it: viewers read and
+// download, commenters will also be able to comment, editors change names,
+// folders and details, and owners delete and manage sharing.
+const (
+    RoleViewer    = "viewer"
+    RoleCommenter = "commenter"
+    RoleEditor    = "editor"
+    RoleOwner     = "owner"
+)
+
+// Roles lists the roles in increasing order of privilege
+var Roles = []string{RoleViewer, RoleCommenter, RoleEditor, RoleOwner}
+
+// RoleRank orders roles by privilege; unknown roles and "" rank 0
+func RoleRank(role string) int {
+    for i, r := range Roles {
+        if r == role {
+            return i + 1
+        }
+    }
+    return 0
+}
+
+// roleRankSQL is RoleRank as an SQL expression over a role column
+func roleRankSQL(column string) string {
+    return "COALESCE(array_position(ARRAY['viewer', 'commenter', 'editor', 'owner'], " + column + "), 0)"
+}
+
+// ErrGranteeNotFound is returned when sharing with an email that does not
+// belong to a registered user
+var ErrGranteeNotFound = errors.New("no registered user with that email")
+
+// ErrGranteeIsOwner is returned when sharing files with their owner
+var ErrGranteeIsOwner = errors.New("the owner already has full access")
+
+// ACLEntry grants a user, or every member of a user group, a role on one
+// file (FileID) or on a folder and everything below it (Folder). Folders
+// are those of OwnerID's personal files, or of OrgID's files.
+type ACLEntry struct {
+    ID        int       `json:"id"`
+    OwnerID   int       `json:"-"`
+    OrgID     *int      `json:"org_id,omitempty"`
+    FileID    *int      `json:"file_id,omitempty"`
+    Folder    *string   `json:"folder,omitempty"`
+    UserID    *int      `json:"user_id,omitempty"`
+    Email     string    `json:"email,omitempty"`
+    Group     string    `json:"group,omitempty"`
+    Role      string    `json:"role"`
+    CreatedBy int       `json:"created_by"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+const aclColumns = "a.id, COALESCE(a.owner_id, 0), a.org_id, a.file_id, a.folder, a.user_id, COALESCE(u.email, ''), COALESCE(a.group_name, ''), a.role, a.created_by, a.created_at"
+
+func scanACLEntry(row rowScanner) (ACLEntry, error) {
+    var entry ACLEntry
+    err := row.Scan(&entry.ID, &entry.OwnerID, &entry.OrgID, &entry.FileID, &entry.Folder, &entry.UserID, &entry.Email, &entry.Group, &entry.Role, &entry.CreatedBy, &entry.CreatedAt)
+    return entry, err
+}
+
+// FolderAncestors returns a folder and every folder above it, top first,
+// e.g. "/", "/a" and "/a/b" for "/a/b"
+func FolderAncestors(folder string) []string {
+    ancestors := []string{"/"}
+    path := ""
+    for _, segment := range strings.Split(folder, "/") {
+        if segment == "" {
+            continue
+        }
+        path += "/" + segment
+        ancestors = append(ancestors, path)
+    }
+    return ancestors
+}
+
+// folderTree matches the folder entries of the workspace holding file:
+// its organization's, or else its owner's personal folders
+func folderTree(file File, prefix string, arg func(interface{}) string) string {
+    if file.OrgID != nil {
+        return prefix + "org_id = " + arg(*file.OrgID)
+    }
+    return prefix + "org_id IS NULL AND " + prefix + "owner_id = " + arg(file.UserID)
+}
+
+// FileRole returns the role a user holds on a file: owner of their own
+// personal files; for organization files, owner when they are an admin or
+// owner of the organization or uploaded the file, and editor as any other
+// member. Otherwise, or when it is higher, it is the highest role granted
+// to them or their group on the file or any folder above it. It returns ""
+// when they have no access.
+func FileRole(file File, userID int) (string, error) {
+    if file.OrgID == nil && file.UserID == userID {
+        return RoleOwner, nil
+    }
+
+    args := []interface{}{file.ID, FolderAncestors(file.Folder), userID}
+    arg := argAppender(&args)
+    query := `SELECT COALESCE(max(` + roleRankSQL("role") + `), 0) FROM acl_entries
+        WHERE (file_id = $1 OR (file_id IS NULL AND folder = ANY($2) AND ` + folderTree(file, "", arg) + `))
+          AND (user_id = $3 OR group_name = (SELECT user_group FROM users WHERE id = $3))`
+    if file.OrgID != nil {
+        query = `SELECT GREATEST((` + query + `), COALESCE((SELECT CASE WHEN role IN ('owner', 'admin') OR user_id = ` + arg(file.UserID) + ` THEN 4 ELSE 3 END
+            FROM org_members WHERE org_id = ` + arg(*file.OrgID) + ` AND user_id = $3), 0))`
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var rank int
+    if err := db.QueryRow(context.Background(), query, args...).Scan(&rank); err != nil || rank == 0 {
+        return "", err
+    }
+    return Roles[rank-1], nil
+}
+
+// GrantAccess creates an ACL entry, or changes the role of the existing
+// entry for the same grantee on the same file or folder. A grantee given by
+// Email is resolved to their user ID.
+func GrantAccess(entry ACLEntry) (ACLEntry, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+    ctx := context.Background()
+
+    if entry.Email != "" {
+        var userID int
+        err := db.QueryRow(ctx, "SELECT id FROM users WHERE email = $1", entry.Email).Scan(&userID)
+        if err == pgx.ErrNoRows {
+            return ACLEntry{}, ErrGranteeNotFound
+        }
+        if err != nil {
+            return ACLEntry{}, err
+        }
+        entry.UserID = &userID
+    }
+    if entry.UserID != nil && *entry.UserID == entry.OwnerID {
+        return ACLEntry{}, ErrGranteeIsOwner
+    }
+
+    var group *string
+    if entry.Group != "" {
+        group = &entry.Group
+    }
+    err := db.QueryRow(ctx, `INSERT INTO acl_entries (owner_id, org_id, file_id, folder, user_id, group_name, role, created_by) VALUES (NULLIF($1, 0), $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (COALESCE(owner_id, 0), COALESCE(org_id, 0), COALESCE(file_id, 0), COALESCE(folder, ''), COALESCE(user_id, 0), COALESCE(group_name, ''))
+        DO UPDATE SET role = EXCLUDED.role RETURNING id, created_by, created_at`,
+        entry.OwnerID, entry.OrgID, entry.FileID, entry.Folder, entry.UserID, group, entry.Role, entry.CreatedBy).Scan(&entry.ID, &entry.CreatedBy, &entry.CreatedAt)
+    return entry, err
+}
+
+// GetACLEntry retrieves an ACL entry by its ID
+func GetACLEntry(id int) (ACLEntry, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanACLEntry(db.QueryRow(context.Background(), "SELECT "+aclColumns+" FROM acl_entries a LEFT JOIN users u ON u.id = a.user_id WHERE a.id = $1", id))
+}
+
+// RevokeAccess deletes an ACL entry
+func RevokeAccess(id int) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "DELETE FROM acl_entries WHERE id = $1", id)
+    return err
+}
+
+// GetFileACL lists the entries granting access to a file: those on the file
+// itself and those inherited from the folders above it
+func GetFileACL(file File) ([]ACLEntry, error) {
+    args := []interface{}{file.ID, FolderAncestors(file.Folder)}
+    return queryACL("WHERE a.file_id = $1 OR (a.file_id IS NULL AND a.folder = ANY($2) AND "+folderTree(file, "a.", argAppender(&args))+")", args...)
+}
+
+// GetFolderACL lists the entries granting access to a folder of a user's
+// personal files, or of an organization's files when orgID is set,
+// including those inherited from the folders above it
+func GetFolderACL(ownerID, orgID int, folder string) ([]ACLEntry, error) {
+    tree := File{UserID: ownerID}
+    if orgID != 0 {
+        tree.OrgID = &orgID
+    }
+    args := []interface{}{FolderAncestors(folder)}
+    return queryACL("WHERE a.file_id IS NULL AND a.folder = ANY($1) AND "+folderTree(tree, "a.", argAppender(&args)), args...)
+}
+
+func queryACL(where string, args ...interface{}) ([]ACLEntry, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+aclColumns+" FROM acl_entries a LEFT JOIN users u ON u.id = a.user_id "+where+" ORDER BY a.folder NULLS LAST, a.id", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    entries := []ACLEntry{}
+    for rows.Next() {
+        entry, err := scanACLEntry(rows)
+        if err != nil {
+            return nil, err
+        }
+        entries = append(entries, entry)
+    }
+    return entries, rows.Err()
+}
+
+// SharedFile is a file another user has shared, with the caller's role on it
+type SharedFile struct {
+    File
+    Role  string `json:"role"`
+    Owner string `json:"owner"`
+}
+
+// GetSharedWithUser lists the files of other users, and of organizations
+// the user is not a member of, that a user can access through ACL entries
+// for them or their group, newest first
+func GetSharedWithUser(userID, limit int) ([]SharedFile, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), `WITH grants AS (
+            SELECT * FROM acl_entries WHERE user_id = $1 OR group_name = (SELECT user_group FROM users WHERE id = $1)
+        ), shared AS (
+            SELECT f.id AS shared_id, max(`+roleRankSQL("g.role")+`) AS shared_rank
+            FROM files f JOIN grants g ON g.file_id = f.id
+                OR (g.file_id IS NULL AND (g.folder = '/' OR f.folder = g.folder OR starts_with(f.folder, g.folder || '/'))
+                    AND (g.org_id = f.org_id OR (g.org_id IS NULL AND f.org_id IS NULL AND g.owner_id = f.user_id)))
+            WHERE NOT (f.org_id IS NULL AND f.user_id = $1)
+              AND (f.org_id IS NULL OR f.org_id NOT IN (SELECT org_id FROM org_members WHERE user_id = $1))
+            GROUP BY f.id
+        )
+        SELECT `+fileColumns+`, shared_rank, (SELECT email FROM users WHERE users.id = files.user_id)
+        FROM files JOIN shared ON shared_id = files.id
+        ORDER BY upload_date DESC, id DESC LIMIT $2`, userID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    shared := []SharedFile{}
+    for rows.Next() {
+        var file SharedFile
+        var rank int
+        if err := rows.Scan(append(fileDest(&file.File), &rank, &file.Owner)...); err != nil {
+            return nil, err
+        }
+        if rank > 0 {
+            file.Role = Roles[rank-1]
+        }
+        shared = append(shared, file)
+    }
+    return shared, rows.Err()
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+    "reflect"
+    "testing"
+)
+
+// TestFolderAncestors tests the folders whose ACL entries a file inherits
+func TestFolderAncestors(t *testing.T) {
+    cases := map[string][]string{
+        "/":         {"/"},
+        "/projects": {"/", "/projects"},
+        "/a/b/c":    {"/", "/a", "/a/b", "/a/b/c"},
+    }
+    for folder, expected := range cases {
+        if ancestors := FolderAncestors(folder); !reflect.DeepEqual(ancestors, expected) {
+            t.Errorf("%q: expected %v, got %v", folder, expected, ancestors)
+        }
+    }
+}
+
+// TestRoleRank tests that each role ranks above the ones it includes
+func TestRoleRank(t *testing.T) {
+    for i := 1; i < len(Roles); i++ {
+        if RoleRank(Roles[i]) <= RoleRank(Roles[i-1]) {
+            t.Errorf("Expected %s to rank above %s", Roles[i], Roles[i-1])
+        }
+    }
+    if RoleRank("admin") != 0 || RoleRank("") != 0 {
+        t.Errorf("Expected unknown roles to rank 0")
+    }
+}
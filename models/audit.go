@@ -0,0 +1,310 @@
+package models
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// Outcomes of audited actions
+const (
+    AuditSuccess = "success"
+    AuditFailure = "failure"
+    AuditDenied  = "denied"
+)
+
+// Audited actions
+const (
+    AuditRegister        = "auth.register"
+    AuditLogin           = "auth.login"
+    AuditFileUpload      = "file.upload"
+    AuditFileDownload    = "file.download"
+    AuditFileDelete      = "file.delete"
+    AuditArchiveDownload = "archive.download"
+    AuditShareLinkCreate = "share.link_create"
+    AuditShareLinkRevoke = "share.link_revoke"
+    AuditShareAccess     = "share.access"
+    AuditShareGrant      = "share.grant"
+    AuditShareRevoke     = "share.revoke"
+)
+
+// auditLockKey is the advisory lock appends to the audit log hold, so that
+// entries are chained in the order of their IDs
+const auditLockKey = 0x61756469
+
+// AuditEntry records who did what to which target, from where, and how it
+// turned out. Hash is the SHA-256 of the entry along with PrevHash, the
+// hash of the entry before it, so that changing or removing any entry
+// breaks the chain from there on.
+type AuditEntry struct {
+    ID         int64             `json:"id"`
+    CreatedAt  time.Time         `json:"created_at"`
+    ActorID    *int              `json:"actor_id"`
+    ActorEmail string            `json:"actor_email"`
+    IP         string            `json:"ip"`
+    UserAgent  string            `json:"user_agent"`
+    Action     string            `json:"action"`
+    TargetType string            `json:"target_type"`
+    TargetID   string            `json:"target_id"`
+    Outcome    string            `json:"outcome"`
+    Details    map[string]string `json:"details"`
+    PrevHash   string            `json:"prev_hash"`
+    Hash       string            `json:"hash"`
+}
+
+// auditTextLen caps the bytes kept of each text field of an entry
+const auditTextLen = 512
+
+// cleanAuditText makes client-supplied text storable and hashable as it is:
+// invalid UTF-8 and NUL bytes, which Postgres refuses and JSON rewrites,
+// are replaced or dropped, and long values are cut short
+func cleanAuditText(s string) string {
+    s = strings.ToValidUTF8(strings.ReplaceAll(s, "\x00", ""), "\uFFFD")
+    if len(s) > auditTextLen {
+        // Cutting may split a rune, whose remains are dropped
+        s = strings.ToValidUTF8(s[:auditTextLen], "")
+    }
+    return s
+}
+
+// clean returns the entry with every text field cleaned by cleanAuditText
+func (e AuditEntry) clean() AuditEntry {
+    for _, field := range []*string{&e.ActorEmail, &e.IP, &e.UserAgent, &e.Action, &e.TargetType, &e.TargetID, &e.Outcome} {
+        *field = cleanAuditText(*field)
+    }
+    details := make(map[string]string, len(e.Details))
+    for key, value := range e.Details {
+        details[cleanAuditText(key)] = cleanAuditText(value)
+    }
+    e.Details = details
+    return e
+}
+
+const auditColumns = "id, created_at, actor_id, actor_email, ip, user_agent, action, target_type, target_id, outcome, details, prev_hash, hash"
+
+func scanAuditEntry(row rowScanner) (AuditEntry, error) {
+    var e AuditEntry
+    err := row.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.ActorEmail, &e.IP, &e.UserAgent, &e.Action, &e.TargetType, &e.TargetID, &e.Outcome, &e.Details, &e.PrevHash, &e.Hash)
+    return e, err
+}
+
+// ComputeHash returns the hash of an entry: the hex SHA-256 of its fields,
+// PrevHash included, encoded as JSON with the time in UTC
+func (e AuditEntry) ComputeHash() string {
+    details := e.Details
+    if details == nil {
+        details = map[string]string{}
+    }
+    // Map keys are encoded in sorted order, so the encoding is stable
+    data, _ := json.Marshal(struct {
+        ID         int64             `json:"id"`
+        CreatedAt  string            `json:"created_at"`
+        ActorID    *int              `json:"actor_id"`
+        ActorEmail string            `json:"actor_email"`
+        IP         string            `json:"ip"`
+        UserAgent  string            `json:"user_agent"`
+        Action     string            `json:"action"`
+        TargetType string            `json:"target_type"`
+        TargetID   string            `json:"target_id"`
+        Outcome    string            `json:"outcome"`
+        Details    map[string]string `json:"details"`
+        PrevHash   string            `json:"prev_hash"`
+    }{e.ID, e.CreatedAt.UTC().Format(time.RFC3339Nano), e.ActorID, e.ActorEmail, e.IP, e.UserAgent, e.Action, e.TargetType, e.TargetID, e.Outcome, details, e.PrevHash})
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// AppendAuditEntry adds an entry to the end of the audit log, setting its
+// ID, time and hashes. Text fields are cleaned first, so that whatever a
+// client sent can be stored and verified.
+func AppendAuditEntry(e AuditEntry) (AuditEntry, error) {
+    e = e.clean()
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return AuditEntry{}, err
+    }
+    defer tx.Rollback(ctx)
+
+    if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", auditLockKey); err != nil {
+        return AuditEntry{}, err
+    }
+    err = tx.QueryRow(ctx, "SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&e.PrevHash)
+    if err != nil && err != pgx.ErrNoRows {
+        return AuditEntry{}, err
+    }
+    if err := tx.QueryRow(ctx, "SELECT nextval(pg_get_serial_sequence('audit_log', 'id'))").Scan(&e.ID); err != nil {
+        return AuditEntry{}, err
+    }
+    // Postgres keeps microseconds, and the hash must match what is read back
+    e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+    e.Hash = e.ComputeHash()
+
+    _, err = tx.Exec(ctx, "INSERT INTO audit_log ("+auditColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+        e.ID, e.CreatedAt, e.ActorID, e.ActorEmail, e.IP, e.UserAgent, e.Action, e.TargetType, e.TargetID, e.Outcome, e.Details, e.PrevHash, e.Hash)
+    if err != nil {
+        return AuditEntry{}, err
+    }
+    return e, tx.Commit(ctx)
+}
+
+// AuditFilter selects audit log entries. Action matches exactly, or a
+// family of actions for "file.*". Before selects entries older than the one
+// with that ID, to continue a listing. Entries come newest first unless
+// Ascending is set; Limit 0 returns all of them.
+type AuditFilter struct {
+    ActorID    int
+    ActorEmail string
+    Action     string
+    Outcome    string
+    TargetType string
+    TargetID   string
+    IP         string
+    From       *time.Time
+    To         *time.Time
+    Before     int64
+    Limit      int
+    Ascending  bool
+}
+
+// AuditPage is one page of the audit log, newest first. NextCursor is
+// empty on the last page.
+type AuditPage struct {
+    Entries    []AuditEntry `json:"entries"`
+    NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// EachAuditEntry calls fn with every entry matching filter, in order,
+// without holding them all in memory
+func EachAuditEntry(filter AuditFilter, fn func(AuditEntry) error) error {
+    var args []interface{}
+    arg := argAppender(&args)
+    conditions := []string{"true"}
+    if filter.ActorID != 0 {
+        conditions = append(conditions, "actor_id = "+arg(filter.ActorID))
+    }
+    if filter.ActorEmail != "" {
+        conditions = append(conditions, "lower(actor_email) = "+arg(strings.ToLower(filter.ActorEmail)))
+    }
+    if family, ok := strings.CutSuffix(filter.Action, ".*"); ok {
+        conditions = append(conditions, "action LIKE "+arg(escapeLike(family)+".%"))
+    } else if filter.Action != "" {
+        conditions = append(conditions, "action = "+arg(filter.Action))
+    }
+    for _, match := range []struct{ column, value string }{
+        {"outcome", filter.Outcome}, {"target_type", filter.TargetType}, {"target_id", filter.TargetID}, {"ip", filter.IP},
+    } {
+        if match.value != "" {
+            conditions = append(conditions, match.column+" = "+arg(match.value))
+        }
+    }
+    if filter.From != nil {
+        conditions = append(conditions, "created_at >= "+arg(*filter.From))
+    }
+    if filter.To != nil {
+        conditions = append(conditions, "created_at < "+arg(*filter.To))
+    }
+    direction := "DESC"
+    if filter.Ascending {
+        direction = "ASC"
+    }
+    if filter.Before != 0 {
+        conditions = append(conditions, "id < "+arg(filter.Before))
+    }
+    query := "SELECT " + auditColumns + " FROM audit_log WHERE " + strings.Join(conditions, " AND ") + " ORDER BY id " + direction
+    if filter.Limit > 0 {
+        query += " LIMIT " + arg(filter.Limit)
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        e, err := scanAuditEntry(rows)
+        if err != nil {
+            return err
+        }
+        if err := fn(e); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+// ListAuditEntries returns one page of the entries matching filter
+func ListAuditEntries(filter AuditFilter) (AuditPage, error) {
+    limit := filter.Limit
+    filter.Limit++
+    page := AuditPage{Entries: []AuditEntry{}}
+    err := EachAuditEntry(filter, func(e AuditEntry) error {
+        page.Entries = append(page.Entries, e)
+        return nil
+    })
+    if err != nil {
+        return AuditPage{}, err
+    }
+    if len(page.Entries) > limit {
+        page.Entries = page.Entries[:limit]
+        page.NextCursor = strconv.FormatInt(page.Entries[limit-1].ID, 10)
+    }
+    return page, nil
+}
+
+// AuditVerification is the result of checking the audit log's hash chain.
+// Head is the hash of the last entry: recording it elsewhere lets a later
+// check notice entries removed from the end.
+type AuditVerification struct {
+    Valid    bool   `json:"valid"`
+    Checked  int    `json:"checked"`
+    Head     string `json:"head"`
+    BrokenAt int64  `json:"broken_at,omitempty"`
+    Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyAuditChain recomputes every entry's hash and checks that each one
+// links to the entry before it
+func VerifyAuditChain() (AuditVerification, error) {
+    result := AuditVerification{Valid: true}
+    err := EachAuditEntry(AuditFilter{Ascending: true}, func(e AuditEntry) error {
+        if reason := checkAuditLink(e, result.Head); reason != "" {
+            result.Valid, result.BrokenAt, result.Reason = false, e.ID, reason
+            return errChainBroken
+        }
+        result.Checked++
+        result.Head = e.Hash
+        return nil
+    })
+    if err == errChainBroken {
+        err = nil
+    }
+    return result, err
+}
+
+var errChainBroken = errors.New("audit chain broken")
+
+// checkAuditLink explains why an entry does not follow the entry with hash
+// prev, or returns "" when it does
+func checkAuditLink(e AuditEntry, prev string) string {
+    if e.PrevHash != prev {
+        return "previous hash does not match the entry before it"
+    }
+    if e.ComputeHash() != e.Hash {
+        return "hash does not match the entry's content"
+    }
+    return ""
+}
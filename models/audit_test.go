@@ -0,0 +1,135 @@
+package models
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+    "unicode/utf8"
+)
+
+func auditEntryFixture() AuditEntry {
+    actorID := 3
+    e := AuditEntry{
+        ID:         7,
+        CreatedAt:  time.Date(2026, 3, 1, 12, 30, 0, 123456000, time.UTC),
+        ActorID:    &actorID,
+        ActorEmail: "alice@example.com",
+        IP:         "203.0.113.9",
+        UserAgent:  "curl/8.5.0",
+        Action:     AuditFileDownload,
+        TargetType: "file",
+        TargetID:   "42",
+        Outcome:    AuditSuccess,
+        Details:    map[string]string{"name": "report.pdf", "folder": "/docs"},
+        PrevHash:   "abc",
+    }
+    e.Hash = e.ComputeHash()
+    return e
+}
+
+// TestComputeHash tests that hashes are stable and cover every field
+func TestComputeHash(t *testing.T) {
+    e := auditEntryFixture()
+    if len(e.Hash) != 64 || e.Hash != e.ComputeHash() {
+        t.Fatalf("Unexpected hash %q", e.Hash)
+    }
+
+    // The same instant in another zone hashes the same
+    local := e
+    local.CreatedAt = e.CreatedAt.In(time.FixedZone("UTC+2", 2*60*60))
+    if local.ComputeHash() != e.Hash {
+        t.Error("Expected the hash not to depend on the time zone")
+    }
+
+    otherActor := 4
+    for name, change := range map[string]func(*AuditEntry){
+        "id":          func(e *AuditEntry) { e.ID++ },
+        "created_at":  func(e *AuditEntry) { e.CreatedAt = e.CreatedAt.Add(time.Microsecond) },
+        "actor_id":    func(e *AuditEntry) { e.ActorID = &otherActor },
+        "no actor":    func(e *AuditEntry) { e.ActorID = nil },
+        "actor_email": func(e *AuditEntry) { e.ActorEmail = "mallory@example.com" },
+        "ip":          func(e *AuditEntry) { e.IP = "198.51.100.1" },
+        "user_agent":  func(e *AuditEntry) { e.UserAgent = "" },
+        "action":      func(e *AuditEntry) { e.Action = AuditFileDelete },
+        "target_type": func(e *AuditEntry) { e.TargetType = "folder" },
+        "target_id":   func(e *AuditEntry) { e.TargetID = "43" },
+        "outcome":     func(e *AuditEntry) { e.Outcome = AuditDenied },
+        "details":     func(e *AuditEntry) { e.Details = map[string]string{"name": "other.pdf", "folder": "/docs"} },
+        "prev_hash":   func(e *AuditEntry) { e.PrevHash = "abd" },
+    } {
+        changed := auditEntryFixture()
+        change(&changed)
+        if changed.ComputeHash() == e.Hash {
+            t.Errorf("%s: expected the hash to change", name)
+        }
+    }
+}
+
+// TestComputeHashEmptyDetails tests that entries without details hash the
+// same whether they are read back as nil or empty
+func TestComputeHashEmptyDetails(t *testing.T) {
+    e := auditEntryFixture()
+    e.Details = nil
+    empty := e
+    empty.Details = map[string]string{}
+    if e.ComputeHash() != empty.ComputeHash() {
+        t.Error("Expected nil and empty details to hash the same")
+    }
+}
+
+// TestCleanAudit tests that client-supplied text is made valid UTF-8
+// without NUL bytes and cut short, so that it survives storage and
+// re-encoding with its hash intact
+func TestCleanAudit(t *testing.T) {
+    e := auditEntryFixture()
+    e.UserAgent = "\xff\xfebot\x00"
+    e.ActorEmail = strings.Repeat("é", auditTextLen)
+    e.Details = map[string]string{"user\xff": "name\xc3"}
+    cleaned := e.clean()
+
+    if cleaned.UserAgent != "\uFFFDbot" {
+        t.Errorf("Unexpected user agent %q", cleaned.UserAgent)
+    }
+    if len(cleaned.ActorEmail) > auditTextLen || !utf8.ValidString(cleaned.ActorEmail) {
+        t.Errorf("Expected the email cut to %d bytes of valid UTF-8, got %d bytes", auditTextLen, len(cleaned.ActorEmail))
+    }
+    if cleaned.Details["user\uFFFD"] != "name\uFFFD" {
+        t.Errorf("Unexpected details %q", cleaned.Details)
+    }
+    if e.Details["user\xff"] != "name\xc3" {
+        t.Error("Expected the original details to be left alone")
+    }
+
+    // The entry reads back exactly as it was hashed
+    cleaned.Hash = cleaned.ComputeHash()
+    data, err := json.Marshal(cleaned)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var read AuditEntry
+    if err := json.Unmarshal(data, &read); err != nil {
+        t.Fatal(err)
+    }
+    if read.ComputeHash() != cleaned.Hash {
+        t.Error("Expected the cleaned entry to hash the same once re-encoded")
+    }
+}
+
+// TestCheckAuditLink tests that edited entries and entries that do not
+// follow the one before them are caught
+func TestCheckAuditLink(t *testing.T) {
+    e := auditEntryFixture()
+    if reason := checkAuditLink(e, "abc"); reason != "" {
+        t.Errorf("Expected a valid link, got %q", reason)
+    }
+    if reason := checkAuditLink(e, "abd"); reason == "" {
+        t.Error("Expected a wrong previous hash to be caught")
+    }
+
+    edited := e
+    edited.Outcome = AuditFailure
+    if reason := checkAuditLink(edited, "abc"); reason == "" {
+        t.Error("Expected an edited entry to be caught")
+    }
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+    "context"
+    "errors"
+    "io"
+    "file-sharing-system/utils"
+)
+
+var errEncryptionDisabled = errors.New("file is encrypted but ENCRYPTION_KEYFILE is not set")
+
+// Encrypted reports whether the file's content is encrypted at rest
+func (f File) Encrypted() bool {
+    return f.KeyID != ""
+}
+
+// OpenContent returns a reader for the file's plaintext content
+func OpenContent(file File) (io.ReadCloser, error) {
+    if !file.Encrypted() {
+        return utils.GetStorage().Open(file.StorageKey)
+    }
+    return OpenContentRange(file, 0, file.Size)
+}
+
+// OpenContentRange returns length bytes of the file's plaintext content
+// starting at offset, decrypting only the chunks that cover the range when
+// the file is encrypted at rest.
+func OpenContentRange(file File, offset, length int64) (io.ReadCloser, error) {
+    return openObjectRange(file.StorageKey, file.KeyID, file.WrappedKey, file.Size, offset, length)
+}
+
+// openObjectRange reads a range of an object stored with PutContent, where
+// size is its plaintext size and keyID is empty for unencrypted objects
+func openObjectRange(storageKey, keyID string, wrappedKey []byte, size, offset, length int64) (io.ReadCloser, error) {
+    storage := utils.GetStorage()
+    if keyID == "" {
+        return storage.OpenRange(storageKey, offset, length)
+    }
+
+    provider := utils.GetKeyProvider()
+    if provider == nil {
+        return nil, errEncryptionDisabled
+    }
+    dataKey, err := provider.UnwrapKey(keyID, wrappedKey)
+    if err != nil {
+        return nil, err
+    }
+    return utils.DecryptRange(func(offset, length int64) (io.ReadCloser, error) {
+        return storage.OpenRange(storageKey, offset, length)
+    }, dataKey, size, offset, length)
+}
+
+// PutContent stores r under storageKey, encrypted with a fresh data key when
+// encryption at rest is enabled. It returns the object's URL and the ID of
+// the master key wrapping the data key, which is empty when unencrypted.
+func PutContent(storageKey string, r io.Reader) (url, keyID string, wrappedKey []byte, err error) {
+    if provider := utils.GetKeyProvider(); provider != nil {
+        var dataKey []byte
+        dataKey, keyID, wrappedKey, err = utils.NewDataKey(provider)
+        if err != nil {
+            return "", "", nil, err
+        }
+        if r, err = utils.EncryptStream(r, dataKey); err != nil {
+            return "", "", nil, err
+        }
+    }
+    url, err = utils.GetStorage().Put(storageKey, r)
+    if err != nil {
+        return "", "", nil, err
+    }
+    return url, keyID, wrappedKey, nil
+}
+
+// GetFilesToRewrap lists encrypted files whose data key is wrapped by a
+// master key other than keyID
+func GetFilesToRewrap(keyID string) ([]File, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+fileColumns+" FROM files WHERE key_id <> '' AND key_id <> $1", keyID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var files []File
+    for rows.Next() {
+        file, err := scanFile(rows)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, file)
+    }
+    return files, rows.Err()
+}
+
+// UpdateFileKey replaces a file's wrapped data key after a master key rotation
+func UpdateFileKey(fileID int, keyID string, wrappedKey []byte) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE files SET key_id = $1, wrapped_key = $2 WHERE id = $3", keyID, wrappedKey, fileID)
+    if err == nil {
+        invalidateFile(fileID)
+    }
+    return err
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+    "context"
+    "os"
+    "strings"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// ContentTypePolicy lists the media types a user group may or may not upload.
+// Entries are exact types or wildcards such as "image/*".
+type ContentTypePolicy struct {
+    Group   string   `json:"group"`
+    Allowed []string `json:"allowed"`
+    Blocked []string `json:"blocked"`
+}
+
+// DeploymentContentTypePolicy reads the policy that applies to every user
+// from ALLOWED_CONTENT_TYPES and BLOCKED_CONTENT_TYPES.
+func DeploymentContentTypePolicy() ContentTypePolicy {
+    return ContentTypePolicy{
+        Allowed: splitList(os.Getenv("ALLOWED_CONTENT_TYPES")),
+        Blocked: splitList(os.Getenv("BLOCKED_CONTENT_TYPES")),
+    }
+}
+
+func splitList(s string) []string {
+    var items []string
+    for _, item := range strings.Split(s, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, strings.ToLower(item))
+        }
+    }
+    return items
+}
+
+// Merge combines a group policy with the deployment policy: types blocked by
+// either are blocked, and the group's allow list replaces the deployment's
+// when it has one.
+func (p ContentTypePolicy) Merge(group ContentTypePolicy) ContentTypePolicy {
+    merged := ContentTypePolicy{
+        Group:   group.Group,
+        Allowed: p.Allowed,
+        Blocked: append(append([]string{}, p.Blocked...), group.Blocked...),
+    }
+    if len(group.Allowed) > 0 {
+        merged.Allowed = group.Allowed
+    }
+    return merged
+}
+
+// Allows reports whether a file of the given media type may be uploaded
+func (p ContentTypePolicy) Allows(contentType string) bool {
+    mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+    for _, pattern := range p.Blocked {
+        if matchMediaType(pattern, mediaType) {
+            return false
+        }
+    }
+    if len(p.Allowed) == 0 {
+        return true
+    }
+    for _, pattern := range p.Allowed {
+        if matchMediaType(pattern, mediaType) {
+            return true
+        }
+    }
+    return false
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+    if pattern == "*" || pattern == "*/*" || pattern == mediaType {
+        return true
+    }
+    if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+        return strings.HasPrefix(mediaType, prefix+"/")
+    }
+    return false
+}
+
+// ContentTypePolicyForUser returns the deployment policy merged with the
+// policy of the user's group, if they belong to one.
+func ContentTypePolicyForUser(userID int) (ContentTypePolicy, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    policy := DeploymentContentTypePolicy()
+    var group ContentTypePolicy
+    err := db.QueryRow(context.Background(), `SELECT p.group_name, p.allowed, p.blocked FROM users u
+        JOIN content_type_policies p ON p.group_name = u.user_group WHERE u.id = $1`, userID).Scan(&group.Group, &group.Allowed, &group.Blocked)
+    if err == pgx.ErrNoRows {
+        return policy, nil
+    }
+    if err != nil {
+        return ContentTypePolicy{}, err
+    }
+    return policy.Merge(group), nil
+}
+
+// GetContentTypePolicies lists the per-group policies
+func GetContentTypePolicies() ([]ContentTypePolicy, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT group_name, allowed, blocked FROM content_type_policies ORDER BY group_name")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    policies := []ContentTypePolicy{}
+    for rows.Next() {
+        var policy ContentTypePolicy
+        if err := rows.Scan(&policy.Group, &policy.Allowed, &policy.Blocked); err != nil {
+            return nil, err
+        }
+        policies = append(policies, policy)
+    }
+    return policies, rows.Err()
+}
+
+// SaveContentTypePolicy creates or replaces a group's policy
+func SaveContentTypePolicy(policy ContentTypePolicy) error {
+    if policy.Allowed == nil {
+        policy.Allowed = []string{}
+    }
+    if policy.Blocked == nil {
+        policy.Blocked = []string{}
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), `INSERT INTO content_type_policies (group_name, allowed, blocked) VALUES ($1, $2, $3)
+        ON CONFLICT (group_name) DO UPDATE SET allowed = EXCLUDED.allowed, blocked = EXCLUDED.blocked`,
+        policy.Group, policy.Allowed, policy.Blocked)
+    return err
+}
+
+func DeleteContentTypePolicy(group string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "DELETE FROM content_type_policies WHERE group_name = $1", group)
+    return err
+}
+
+// SetUserGroup assigns a user to a policy group; an empty group removes them from it
+func SetUserGroup(userID int, group string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE users SET user_group = NULLIF($1, '') WHERE id = $2", group, userID)
+    return err
+}
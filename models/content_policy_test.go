@@ -0,0 +1,50 @@
+package models
+
+import (
+    "testing"
+)
+
+// TestContentTypePolicyAllows tests exact, wildcard and blocked media types
+func TestContentTypePolicyAllows(t *testing.T) {
+    policy := ContentTypePolicy{
+        Allowed: []string{"image/*", "application/pdf"},
+        Blocked: []string{"image/svg+xml"},
+    }
+
+    cases := map[string]bool{
+        "image/png":                 true,
+        "application/pdf":           true,
+        "text/plain; charset=utf-8": false,
+        "image/svg+xml":             false,
+    }
+    for contentType, expected := range cases {
+        if allowed := policy.Allows(contentType); allowed != expected {
+            t.Errorf("Expected Allows(%q) = %v", contentType, expected)
+        }
+    }
+
+    if !(ContentTypePolicy{}).Allows("application/x-msdownload") {
+        t.Errorf("Expected an empty policy to allow everything")
+    }
+}
+
+// TestContentTypePolicyMerge tests combining the deployment and group policies
+func TestContentTypePolicyMerge(t *testing.T) {
+    t.Setenv("ALLOWED_CONTENT_TYPES", "")
+    t.Setenv("BLOCKED_CONTENT_TYPES", "application/x-msdownload, application/x-executable")
+    deployment := DeploymentContentTypePolicy()
+
+    group := ContentTypePolicy{Group: "contractors", Blocked: []string{"application/zip"}}
+    merged := deployment.Merge(group)
+    if merged.Allows("application/x-msdownload") || merged.Allows("application/zip") {
+        t.Errorf("Expected types blocked by either policy to be blocked")
+    }
+    if !merged.Allows("image/png") {
+        t.Errorf("Expected unlisted types to be allowed without an allow list")
+    }
+
+    restricted := deployment.Merge(ContentTypePolicy{Allowed: []string{"application/pdf"}})
+    if restricted.Allows("image/png") || !restricted.Allows("application/pdf") {
+        t.Errorf("Expected the group allow list to apply")
+    }
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+    "context"
+    "encoding/json"
+    "strconv"
+    "strings"
+    "time"
+    "file-sharing-system/utils"
+)
+
+// Types of events in the event log. File content never changes in place,
+// so renames and moves are the only updates to a file.
+const (
+    EventCreated           = "created"
+    EventRenamed           = "renamed"
+    EventMoved             = "moved"
+    EventDeleted           = "deleted"
+    EventLinkCreated       = "link_created"
+    EventLinkRevoked       = "link_revoked"
+    EventPermissionGranted = "permission_granted"
+    EventPermissionChanged = "permission_changed"
+    EventPermissionRevoked = "permission_revoked"
+)
+
+// EventsChannel is the Postgres channel each new event's ID is announced on
+const EventsChannel = "events"
+
+// Event is an entry of the event log, appended by triggers on the files,
+// share_links and acl_entries tables. Folder and Name are the file's path
+// after the event, OldFolder and OldName its path before a rename or move.
+// Events on a folder permission have a Folder but no FileID or Name.
+// Details describes the share link or permission of link and permission
+// events.
+type Event struct {
+    ID        int64           `json:"-"`
+    Type      string          `json:"type"`
+    FileID    *int            `json:"file_id,omitempty"`
+    Folder    string          `json:"folder"`
+    Name      string          `json:"name,omitempty"`
+    OldFolder *string         `json:"old_folder,omitempty"`
+    OldName   *string         `json:"old_name,omitempty"`
+    Size      *int64          `json:"size,omitempty"`
+    Checksum  string          `json:"checksum,omitempty"`
+    Details   json.RawMessage `json:"details,omitempty"`
+    CreatedAt time.Time       `json:"created_at"`
+}
+
+// IsFileChange reports whether an event changed the file itself, rather
+// than how it is shared
+func (e Event) IsFileChange() bool {
+    switch e.Type {
+    case EventCreated, EventRenamed, EventMoved, EventDeleted:
+        return true
+    }
+    return false
+}
+
+// Cursor is the position in the log just after the event
+func (e Event) Cursor() string {
+    return strconv.FormatInt(e.ID, 10)
+}
+
+// EventsPage is a run of events in the order they happened. Cursor is
+// passed back to continue after them; HasMore tells whether more events
+// are waiting.
+type EventsPage struct {
+    Events  []Event `json:"events"`
+    Cursor  string  `json:"cursor"`
+    HasMore bool    `json:"has_more"`
+}
+
+// EventsOptions selects events in a user's personal files, or in an
+// organization's files when OrgID is set, that happened after Cursor (the
+// start of the log when empty) in Folder or below it, before or after a
+// move
+type EventsOptions struct {
+    UserID int
+    OrgID  int
+    Folder string
+    Cursor string
+    Limit  int
+}
+
+// ParseEventCursor returns the event ID a cursor points after
+func ParseEventCursor(cursor string) (int64, error) {
+    if cursor == "" {
+        return 0, nil
+    }
+    id, err := strconv.ParseInt(cursor, 10, 64)
+    if err != nil || id < 0 {
+        return 0, ErrInvalidCursor
+    }
+    return id, nil
+}
+
+// GetEvents returns the next page of the event log. Events become visible
+// in the order of their IDs (see events_order in schema.sql), so the page's
+// cursor never skips an event that is committed later.
+func GetEvents(opts EventsOptions) (EventsPage, error) {
+    after, err := ParseEventCursor(opts.Cursor)
+    if err != nil {
+        return EventsPage{}, err
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var args []interface{}
+    arg := argAppender(&args)
+    conditions := []string{
+        scopeCondition(opts.UserID, opts.OrgID, arg),
+        "id > " + arg(after),
+        "(" + treeCondition("folder", opts.Folder, arg) + " OR " + treeCondition("old_folder", opts.Folder, arg) + ")",
+    }
+    query := "SELECT id, type, file_id, folder, COALESCE(name, ''), old_folder, old_name, size, COALESCE(checksum, ''), details, created_at FROM events WHERE " +
+        strings.Join(conditions, " AND ") + " ORDER BY id LIMIT " + arg(opts.Limit+1)
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return EventsPage{}, err
+    }
+    defer rows.Close()
+
+    page := EventsPage{Events: []Event{}, Cursor: strconv.FormatInt(after, 10)}
+    for rows.Next() {
+        var e Event
+        if err := rows.Scan(&e.ID, &e.Type, &e.FileID, &e.Folder, &e.Name, &e.OldFolder, &e.OldName, &e.Size, &e.Checksum, (*[]byte)(&e.Details), &e.CreatedAt); err != nil {
+            return EventsPage{}, err
+        }
+        if len(page.Events) == opts.Limit {
+            page.HasMore = true
+            break
+        }
+        page.Events = append(page.Events, e)
+        page.Cursor = e.Cursor()
+    }
+    return page, rows.Err()
+}
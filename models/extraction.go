@@ -0,0 +1,68 @@
+package models
+
+import (
+    "context"
+    "time"
+    "file-sharing-system/utils"
+)
+
+// Extraction tracks unpacking an uploaded archive into individual files
+// below Folder. ArchiveID is cleared once the archive file is deleted.
+type Extraction struct {
+    ID             int64     `json:"id"`
+    UserID         int       `json:"user_id"`
+    OrgID          *int      `json:"org_id,omitempty"`
+    ArchiveID      *int      `json:"archive_id,omitempty"`
+    ArchiveName    string    `json:"archive_name"`
+    Folder         string    `json:"folder"`
+    Status         string    `json:"status"`
+    FilesExtracted int       `json:"files_extracted"`
+    FilesSkipped   int       `json:"files_skipped"`
+    BytesExtracted int64     `json:"bytes_extracted"`
+    Error          string    `json:"error,omitempty"`
+    CreatedAt      time.Time `json:"created_at"`
+    UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Extraction states
+const (
+    ExtractionQueued  = "queued"
+    ExtractionRunning = "running"
+    ExtractionDone    = "done"
+    ExtractionFailed  = "failed"
+)
+
+const extractionColumns = "id, user_id, org_id, archive_id, archive_name, folder, status, files_extracted, files_skipped, bytes_extracted, error, created_at, updated_at"
+
+func scanExtraction(row rowScanner) (Extraction, error) {
+    var e Extraction
+    err := row.Scan(&e.ID, &e.UserID, &e.OrgID, &e.ArchiveID, &e.ArchiveName, &e.Folder, &e.Status, &e.FilesExtracted, &e.FilesSkipped, &e.BytesExtracted, &e.Error, &e.CreatedAt, &e.UpdatedAt)
+    return e, err
+}
+
+// CreateExtraction records a queued extraction and returns it with its ID
+func CreateExtraction(e Extraction) (Extraction, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanExtraction(db.QueryRow(context.Background(), "INSERT INTO extractions (user_id, org_id, archive_id, archive_name, folder, status) VALUES ($1, $2, $3, $4, $5, $6) RETURNING "+extractionColumns,
+        e.UserID, e.OrgID, e.ArchiveID, e.ArchiveName, e.Folder, ExtractionQueued))
+}
+
+// GetExtraction retrieves an extraction by its ID
+func GetExtraction(id int64) (Extraction, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanExtraction(db.QueryRow(context.Background(), "SELECT "+extractionColumns+" FROM extractions WHERE id = $1", id))
+}
+
+// UpdateExtraction saves an extraction's status and progress
+func UpdateExtraction(e Extraction) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE extractions SET status = $1, files_extracted = $2, files_skipped = $3, bytes_extracted = $4, error = $5, updated_at = now() WHERE id = $6",
+        e.Status, e.FilesExtracted, e.FilesSkipped, e.BytesExtracted, e.Error, e.ID)
+    return err
+}
@@ -1,32 +1,488 @@
 package models
 
 import (
+    "bytes"
     "context"
+    "encoding/gob"
+    "errors"
+    "fmt"
+    "path"
+    "strconv"
+    "strings"
     "file-sharing-system/utils"
     "time"
+    "github.com/jackc/pgx/v4"
 )
 
 type File struct {
-    ID         int       `json:"id"`
-    Name       string    `json:"name"`
-    Size       int64     `json:"size"`
-    URL        string    `json:"url"`
-    UploadDate time.Time `json:"upload_date"`
+    ID          int       `json:"id"`
+    UserID      int       `json:"user_id"`
+    // OrgID is set for files in an organization's workspace, which belong to
+    // the organization rather than to UserID, the member who uploaded them
+    OrgID       *int      `json:"org_id,omitempty"`
+    Name        string    `json:"name"`
+    Size        int64     `json:"size"`
+    ContentType string    `json:"content_type"`
+    URL         string    `json:"url"`
+    StorageKey  string    `json:"-"`
+    Checksum    string    `json:"checksum"`
+    ScanStatus  string    `json:"scan_status"`
+    ScanResult  string    `json:"scan_result,omitempty"`
+    KeyID       string    `json:"-"`
+    WrappedKey  []byte    `json:"-"`
+    UploadDate  time.Time `json:"upload_date"`
+
+    // PreviewStatus tracks thumbnail generation; ThumbnailURL is set by
+    // handlers once thumbnails are ready
+    PreviewStatus string `json:"preview_status"`
+    ThumbnailURL  string `json:"thumbnail_url,omitempty"`
+
+    Tags        []string          `json:"tags"`
+    Description string            `json:"description"`
+    Metadata    map[string]string `json:"metadata"`
+    // Folder is the slash separated path of the folder holding the file, "/" at the top
+    Folder string `json:"folder"`
+    // Version counts edits to the file's name, folder and details; it is the
+    // file's ETag for optimistic concurrency
+    Version int `json:"version"`
+
+    // Files encrypted by the client are stored as opaque ciphertext. The
+    // header and metadata are produced by the client and returned verbatim.
+    ClientEncrypted   bool   `json:"client_encrypted"`
+    EncryptionHeader  []byte `json:"encryption_header,omitempty"`
+    EncryptedMetadata []byte `json:"encrypted_metadata,omitempty"`
+}
+
+// Virus scan states of a file
+const (
+    ScanPending  = "pending"
+    ScanClean    = "clean"
+    ScanInfected = "infected"
+    ScanSkipped  = "skipped"
+)
+
+// Thumbnail generation states of a file
+const (
+    PreviewNone    = "none"
+    PreviewPending = "pending"
+    PreviewReady   = "ready"
+    PreviewFailed  = "failed"
+)
+
+// ScanAllowsAccess reports whether the file may be downloaded or shared:
+// it must have been scanned clean, or scanning must not apply to it.
+func (f File) ScanAllowsAccess() bool {
+    return f.ScanStatus == ScanClean || f.ScanStatus == ScanSkipped
+}
+
+// fileColumns is the column list scanned by scanFile
+const fileColumns = "id, COALESCE(user_id, 0), name, size, content_type, url, storage_key, checksum, scan_status, scan_result, key_id, wrapped_key, upload_date, client_encrypted, encryption_header, encrypted_metadata, preview_status, tags, description, folder, metadata, version, org_id"
+
+// rowScanner is satisfied by both pgx.Row and pgx.Rows
+type rowScanner interface {
+    Scan(dest ...interface{}) error
 }
 
-func SaveFileMetadata(file File) error {
+func scanFile(row rowScanner) (File, error) {
+    var file File
+    err := row.Scan(fileDest(&file)...)
+    return file, err
+}
+
+// fileDest returns the scan destinations for fileColumns, for queries
+// selecting more columns after them
+func fileDest(file *File) []interface{} {
+    return []interface{}{&file.ID, &file.UserID, &file.Name, &file.Size, &file.ContentType, &file.URL, &file.StorageKey, &file.Checksum, &file.ScanStatus, &file.ScanResult, &file.KeyID, &file.WrappedKey, &file.UploadDate, &file.ClientEncrypted, &file.EncryptionHeader, &file.EncryptedMetadata, &file.PreviewStatus, &file.Tags, &file.Description, &file.Folder, &file.Metadata, &file.Version, &file.OrgID}
+}
+
+// SaveFileMetadata stores the file row and charges its size to the owner's
+// usage in one transaction, failing with ErrQuotaExceeded if it doesn't fit.
+// Organization files are charged to the organization.
+// It returns the ID of the new row.
+func SaveFileMetadata(file File) (int, error) {
+    if file.Tags == nil {
+        file.Tags = []string{}
+    }
+    if file.Folder == "" {
+        file.Folder = "/"
+    }
+    if file.Metadata == nil {
+        file.Metadata = map[string]string{}
+    }
+
     db := utils.ConnectDB()
     defer db.Close()
 
-    _, err := db.Exec(context.Background(), "INSERT INTO files (name, size, url, upload_date) VALUES ($1, $2, $3, $4)", file.Name, file.Size, file.URL, file.UploadDate)
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback(ctx)
+
+    var plan string
+    var override *int64
+    var used int64
+    table, owner := usageOwner(file)
+    err = tx.QueryRow(ctx, "SELECT plan, quota_bytes, bytes_used FROM "+table+" WHERE id = $1 FOR UPDATE", owner).Scan(&plan, &override, &used)
+    if err != nil {
+        return 0, err
+    }
+    if used+file.Size > QuotaFor(plan, override) {
+        return 0, ErrQuotaExceeded
+    }
+
+    var id int
+    err = tx.QueryRow(ctx, "INSERT INTO files (user_id, name, size, content_type, url, storage_key, checksum, scan_status, scan_result, key_id, wrapped_key, upload_date, client_encrypted, encryption_header, encrypted_metadata, preview_status, tags, description, folder, metadata, org_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21) RETURNING id",
+        file.UserID, file.Name, file.Size, file.ContentType, file.URL, file.StorageKey, file.Checksum, file.ScanStatus, file.ScanResult, file.KeyID, file.WrappedKey, file.UploadDate, file.ClientEncrypted, file.EncryptionHeader, file.EncryptedMetadata, file.PreviewStatus, file.Tags, file.Description, file.Folder, file.Metadata, file.OrgID).Scan(&id)
+    if err != nil {
+        return 0, err
+    }
+    _, err = tx.Exec(ctx, "UPDATE "+table+" SET bytes_used = bytes_used + $1 WHERE id = $2", file.Size, owner)
+    if err != nil {
+        return 0, err
+    }
+    return id, tx.Commit(ctx)
+}
+
+// fileCacheTTL bounds how long a cached file can outlive a lost invalidation
+const fileCacheTTL = 5 * time.Minute
+
+func fileCacheKey(fileID int) string {
+    return fmt.Sprintf("file:%d", fileID)
+}
+
+// invalidateFile evicts cached copies of files whose rows have changed
+func invalidateFile(fileIDs ...int) {
+    keys := make([]string, len(fileIDs))
+    for i, id := range fileIDs {
+        keys[i] = fileCacheKey(id)
+    }
+    utils.CacheDelete(keys...)
+}
+
+// GetFileByID retrieves a file by its ID, from the cache when possible.
+// Every function changing a file row evicts it from the cache.
+func GetFileByID(fileID string) (File, error) {
+    id, err := strconv.Atoi(fileID)
+    if err != nil {
+        return File{}, err
+    }
+    if cached, ok := utils.CacheGet(fileCacheKey(id)); ok {
+        if file, err := decodeCachedFile(cached); err == nil {
+            return file, nil
+        }
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    file, err := scanFile(db.QueryRow(context.Background(), "SELECT "+fileColumns+" FROM files WHERE id = $1", id))
+    if err != nil {
+        return File{}, err
+    }
+    if cached, err := encodeCachedFile(file); err == nil {
+        utils.CacheSet(fileCacheKey(id), cached, fileCacheTTL)
+    }
+    return file, nil
+}
+
+// Cached files are gob encoded, since the JSON encoding omits storage and key fields
+func encodeCachedFile(file File) ([]byte, error) {
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(file)
+    return buf.Bytes(), err
+}
+
+func decodeCachedFile(data []byte) (File, error) {
+    var file File
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&file); err != nil {
+        return File{}, err
+    }
+    // gob drops empty collections; restore them as scanned from the database
+    if file.Tags == nil {
+        file.Tags = []string{}
+    }
+    if file.Metadata == nil {
+        file.Metadata = map[string]string{}
+    }
+    return file, nil
+}
+
+// usageOwner returns the table and ID of the row whose usage and quota a
+// file counts towards: its organization, or else the user who owns it
+func usageOwner(file File) (string, int) {
+    if file.OrgID != nil {
+        return "organizations", *file.OrgID
+    }
+    return "users", file.UserID
+}
+
+// releaseUsage subtracts a deleted file's size from its owner's usage
+func releaseUsage(ctx context.Context, tx pgx.Tx, file File) error {
+    table, owner := usageOwner(file)
+    _, err := tx.Exec(ctx, "UPDATE "+table+" SET bytes_used = GREATEST(bytes_used - $1, 0) WHERE id = $2", file.Size, owner)
     return err
 }
 
-func GetAllFiles() ([]File, error) {
+// scopeCondition limits a query to a user's personal files, or to an
+// organization's files when orgID is set
+func scopeCondition(userID, orgID int, arg func(interface{}) string) string {
+    if orgID != 0 {
+        return "org_id = " + arg(orgID)
+    }
+    return "user_id = " + arg(userID) + " AND org_id IS NULL"
+}
+
+// fileScope is scopeCondition for the workspace holding file
+func fileScope(file File, arg func(interface{}) string) string {
+    if file.OrgID != nil {
+        return scopeCondition(file.UserID, *file.OrgID, arg)
+    }
+    return scopeCondition(file.UserID, 0, arg)
+}
+
+// DeleteFile removes the file row and releases its size from the owner's usage
+func DeleteFile(file File) error {
     db := utils.ConnectDB()
     defer db.Close()
 
-    rows, err := db.Query(context.Background(), "SELECT id, name, size, url, upload_date FROM files")
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    tag, err := tx.Exec(ctx, "DELETE FROM files WHERE id = $1", file.ID)
+    if err != nil {
+        return err
+    }
+    if tag.RowsAffected() > 0 {
+        if err := releaseUsage(ctx, tx, file); err != nil {
+            return err
+        }
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return err
+    }
+    invalidateFile(file.ID)
+    return nil
+}
+
+// Policies for a rename or move onto the name of another file in the target folder
+const (
+    ConflictFail      = "fail"
+    ConflictSuffix    = "suffix"
+    ConflictOverwrite = "overwrite"
+)
+
+var (
+    // ErrVersionConflict is returned when a file was changed or deleted
+    // since the version being updated was read
+    ErrVersionConflict = errors.New("file was modified concurrently")
+    // ErrNameTaken is returned when a rename or move would clash with
+    // another file under ConflictFail
+    ErrNameTaken = errors.New("a file with that name already exists in the folder")
+)
+
+// FileUpdate is the outcome of UpdateFile. Under ConflictOverwrite, Replaced
+// is the file that was deleted to make room, with its thumbnails, whose
+// stored objects the caller removes.
+type FileUpdate struct {
+    File               File
+    Replaced           *File
+    ReplacedThumbnails []Thumbnail
+}
+
+// UpdateFile saves a file's name, folder, tags, description and metadata,
+// provided the row is still at file.Version. When the file is renamed or
+// moved onto the name of another of the user's files in the target folder,
+// policy decides whether to fail, pick a free "name (n).ext" instead, or
+// delete the other file.
+func UpdateFile(file File, policy string) (FileUpdate, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return FileUpdate{}, err
+    }
+    defer tx.Rollback(ctx)
+
+    var name, folder string
+    err = tx.QueryRow(ctx, "SELECT name, folder FROM files WHERE id = $1 AND version = $2 FOR UPDATE", file.ID, file.Version).Scan(&name, &folder)
+    if err == pgx.ErrNoRows {
+        return FileUpdate{}, ErrVersionConflict
+    }
+    if err != nil {
+        return FileUpdate{}, err
+    }
+
+    var update FileUpdate
+    if name != file.Name || folder != file.Folder {
+        // Serialize renames and moves within the workspace, so two of them
+        // cannot both claim a free name
+        class, key := namesLock(file)
+        if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, $2)", class, key); err != nil {
+            return FileUpdate{}, err
+        }
+        args := []interface{}{file.Folder, file.Name, file.ID}
+        existing, err := scanFile(tx.QueryRow(ctx, "SELECT "+fileColumns+" FROM files WHERE folder = $1 AND name = $2 AND id <> $3 AND "+fileScope(file, argAppender(&args))+" LIMIT 1", args...))
+        switch {
+        case err == pgx.ErrNoRows:
+        case err != nil:
+            return FileUpdate{}, err
+        case policy == ConflictSuffix:
+            if file.Name, err = freeName(ctx, tx, file); err != nil {
+                return FileUpdate{}, err
+            }
+        case policy == ConflictOverwrite:
+            if update.ReplacedThumbnails, err = replaceFile(ctx, tx, existing); err != nil {
+                return FileUpdate{}, err
+            }
+            update.Replaced = &existing
+        default:
+            return FileUpdate{}, ErrNameTaken
+        }
+    }
+
+    err = tx.QueryRow(ctx, "UPDATE files SET name = $1, folder = $2, tags = $3, description = $4, metadata = $5, version = version + 1 WHERE id = $6 RETURNING version",
+        file.Name, file.Folder, file.Tags, file.Description, file.Metadata, file.ID).Scan(&file.Version)
+    if err != nil {
+        return FileUpdate{}, err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return FileUpdate{}, err
+    }
+
+    invalidateFile(file.ID)
+    if update.Replaced != nil {
+        invalidateFile(update.Replaced.ID)
+    }
+    update.File = file
+    return update, nil
+}
+
+// namesLock returns the keys of the advisory lock taken while renaming or
+// moving files in a file's workspace: 1 and the user ID for personal files,
+// 2 and the organization ID for organization files
+func namesLock(file File) (int, int) {
+    if file.OrgID != nil {
+        return 2, *file.OrgID
+    }
+    return 1, file.UserID
+}
+
+// argAppender returns a function adding query arguments to args and
+// returning their placeholders
+func argAppender(args *[]interface{}) func(interface{}) string {
+    return func(value interface{}) string {
+        *args = append(*args, value)
+        return fmt.Sprintf("$%d", len(*args))
+    }
+}
+
+// freeName returns the first "name (n).ext" not taken in the file's target folder
+func freeName(ctx context.Context, tx pgx.Tx, file File) (string, error) {
+    base, _ := splitExt(file.Name)
+    args := []interface{}{file.Folder, escapeLike(base) + " (%", file.ID}
+    rows, err := tx.Query(ctx, "SELECT name FROM files WHERE folder = $1 AND name LIKE $2 AND id <> $3 AND "+fileScope(file, argAppender(&args)), args...)
+    if err != nil {
+        return "", err
+    }
+    defer rows.Close()
+
+    taken := make(map[string]bool)
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return "", err
+        }
+        taken[name] = true
+    }
+    if err := rows.Err(); err != nil {
+        return "", err
+    }
+    return SuffixedName(file.Name, taken), nil
+}
+
+// SuffixedName returns the first of "name (1).ext", "name (2).ext"... that is not taken
+func SuffixedName(name string, taken map[string]bool) string {
+    base, ext := splitExt(name)
+    for n := 1; ; n++ {
+        candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+        if !taken[candidate] {
+            return candidate
+        }
+    }
+}
+
+// splitExt splits a file name before its extension, keeping names like
+// ".env" whole
+func splitExt(name string) (string, string) {
+    ext := path.Ext(name)
+    if ext == name || strings.TrimLeft(name, ".") == "" {
+        return name, ""
+    }
+    return strings.TrimSuffix(name, ext), ext
+}
+
+// replaceFile deletes a file being overwritten by a rename or move and
+// releases its size, returning its thumbnails so their objects can be removed
+func replaceFile(ctx context.Context, tx pgx.Tx, file File) ([]Thumbnail, error) {
+    rows, err := tx.Query(ctx, "SELECT "+thumbnailColumns+" FROM file_thumbnails WHERE file_id = $1", file.ID)
+    if err != nil {
+        return nil, err
+    }
+    var thumbs []Thumbnail
+    for rows.Next() {
+        thumb, err := scanThumbnail(rows)
+        if err != nil {
+            rows.Close()
+            return nil, err
+        }
+        thumbs = append(thumbs, thumb)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    tag, err := tx.Exec(ctx, "DELETE FROM files WHERE id = $1", file.ID)
+    if err != nil {
+        return nil, err
+    }
+    if tag.RowsAffected() > 0 {
+        if err := releaseUsage(ctx, tx, file); err != nil {
+            return nil, err
+        }
+    }
+    return thumbs, nil
+}
+
+// SetScanStatus records the outcome of a virus scan
+func SetScanStatus(fileID int, status, result string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE files SET scan_status = $1, scan_result = $2 WHERE id = $3", status, result, fileID)
+    if err == nil {
+        invalidateFile(fileID)
+    }
+    return err
+}
+
+// GetUnqueuedScans lists the files uploaded before before that are still
+// pending a virus scan but have no scan job at all, whose unique key is
+// keyPrefix followed by the file's ID
+func GetUnqueuedScans(keyPrefix string, before time.Time) ([]File, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+fileColumns+" FROM files WHERE scan_status = $1 AND upload_date < $2 AND NOT EXISTS (SELECT 1 FROM jobs WHERE unique_key = $3::text || files.id)",
+        ScanPending, before, keyPrefix)
     if err != nil {
         return nil, err
     }
@@ -34,24 +490,33 @@ func GetAllFiles() ([]File, error) {
 
     var files []File
     for rows.Next() {
-        var file File
-        if err := rows.Scan(&file.ID, &file.Name, &file.Size, &file.URL, &file.UploadDate); err != nil {
+        file, err := scanFile(rows)
+        if err != nil {
             return nil, err
         }
         files = append(files, file)
     }
-    return files, nil
+    return files, rows.Err()
 }
 
-// GetFileByID retrieves a file by its ID from the database
-func GetFileByID(fileID string) (File, error) {
+// GetFilesByScanStatus lists the files in a scan state, e.g. to requeue pending scans
+func GetFilesByScanStatus(status string) ([]File, error) {
     db := utils.ConnectDB()
     defer db.Close()
 
-    var file File
-    err := db.QueryRow(context.Background(), "SELECT id, name, size, url, upload_date FROM files WHERE id = $1", fileID).Scan(&file.ID, &file.Name, &file.Size, &file.URL, &file.UploadDate)
+    rows, err := db.Query(context.Background(), "SELECT "+fileColumns+" FROM files WHERE scan_status = $1", status)
     if err != nil {
-        return File{}, err
+        return nil, err
     }
-    return file, nil
+    defer rows.Close()
+
+    var files []File
+    for rows.Next() {
+        file, err := scanFile(rows)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, file)
+    }
+    return files, rows.Err()
 }
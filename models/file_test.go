@@ -0,0 +1,60 @@
+package models
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+// TestSuffixedName tests picking a free name for a rename under ConflictSuffix
+func TestSuffixedName(t *testing.T) {
+    cases := []struct {
+        name     string
+        taken    []string
+        expected string
+    }{
+        {"report.pdf", nil, "report (1).pdf"},
+        {"report.pdf", []string{"report (1).pdf", "report (2).pdf"}, "report (3).pdf"},
+        {"report.pdf", []string{"report (2).pdf"}, "report (1).pdf"},
+        {"notes", []string{"notes (1)"}, "notes (2)"},
+        {".env", nil, ".env (1)"},
+        {"archive.tar.gz", nil, "archive.tar (1).gz"},
+    }
+    for _, c := range cases {
+        taken := make(map[string]bool)
+        for _, name := range c.taken {
+            taken[name] = true
+        }
+        if name := SuffixedName(c.name, taken); name != c.expected {
+            t.Errorf("%q with %v taken: expected %q, got %q", c.name, c.taken, c.expected, name)
+        }
+    }
+}
+
+// TestCachedFileRoundTrip tests that cached files keep the fields hidden
+// from JSON and their empty collections
+func TestCachedFileRoundTrip(t *testing.T) {
+    file := File{
+        ID:         7,
+        Name:       "report.pdf",
+        StorageKey: "files/abc",
+        KeyID:      "k1",
+        WrappedKey: []byte{1, 2, 3},
+        UploadDate: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+        Tags:       []string{},
+        Metadata:   map[string]string{},
+        Folder:     "/",
+        Version:    2,
+    }
+    data, err := encodeCachedFile(file)
+    if err != nil {
+        t.Fatalf("Error encoding file: %s", err)
+    }
+    decoded, err := decodeCachedFile(data)
+    if err != nil {
+        t.Fatalf("Error decoding file: %s", err)
+    }
+    if !reflect.DeepEqual(decoded, file) {
+        t.Errorf("Expected %+v, got %+v", file, decoded)
+    }
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+    "context"
+    "fmt"
+    "time"
+    "file-sharing-system/utils"
+)
+
+// workspace is a stand-in file for the workspace of a user's personal
+// files, or of an organization's files when orgID is set
+func workspace(userID, orgID int) File {
+    file := File{UserID: userID}
+    if orgID != 0 {
+        file.OrgID = &orgID
+    }
+    return file
+}
+
+// CreateFolder records an empty folder in a workspace. Creating a folder
+// that was already created is not an error.
+func CreateFolder(userID, orgID int, path string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var orgArg *int
+    if orgID != 0 {
+        orgArg = &orgID
+    }
+    _, err := db.Exec(context.Background(), "INSERT INTO folders (user_id, org_id, path) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", userID, orgArg, path)
+    return err
+}
+
+// FolderExists reports whether a folder of a workspace holds files, at any
+// depth, or was created. The top folder "/" always exists.
+func FolderExists(userID, orgID int, path string) (bool, error) {
+    if path == "/" {
+        return true, nil
+    }
+    var args []interface{}
+    arg := argAppender(&args)
+    query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM files WHERE %s AND %s) OR EXISTS (SELECT 1 FROM folders WHERE %s AND %s)",
+        scopeCondition(userID, orgID, arg), treeCondition("folder", path, arg), scopeCondition(userID, orgID, arg), treeCondition("path", path, arg))
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var exists bool
+    err := db.QueryRow(context.Background(), query, args...).Scan(&exists)
+    return exists, err
+}
+
+// Subfolder is a folder directly inside another, modified when the newest
+// file below it was uploaded
+type Subfolder struct {
+    Name     string
+    Modified time.Time
+}
+
+// GetSubfolders lists the folders directly inside a folder of a workspace,
+// whether they hold files or were created empty, by name
+func GetSubfolders(userID, orgID int, parent string) ([]Subfolder, error) {
+    prefix := parent + "/"
+    if parent == "/" {
+        prefix = "/"
+    }
+    var args []interface{}
+    arg := argAppender(&args)
+    start, like := arg(len(prefix)+1), arg(escapeLike(prefix)+"%")
+    query := fmt.Sprintf(`SELECT name, max(modified) FROM (
+            SELECT split_part(substr(folder, %[1]s), '/', 1) AS name, upload_date AS modified FROM files WHERE %[3]s AND folder LIKE %[2]s
+            UNION ALL
+            SELECT split_part(substr(path, %[1]s), '/', 1), created_at FROM folders WHERE %[4]s AND path LIKE %[2]s
+        ) children WHERE name <> '' GROUP BY name ORDER BY name`,
+        start, like, scopeCondition(userID, orgID, arg), scopeCondition(userID, orgID, arg))
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    folders := []Subfolder{}
+    for rows.Next() {
+        var folder Subfolder
+        if err := rows.Scan(&folder.Name, &folder.Modified); err != nil {
+            return nil, err
+        }
+        folders = append(folders, folder)
+    }
+    return folders, rows.Err()
+}
+
+// GetFilesInFolder lists the files directly in a folder of a workspace, by name
+func GetFilesInFolder(userID, orgID int, folder string) ([]File, error) {
+    var args []interface{}
+    arg := argAppender(&args)
+    query := fmt.Sprintf("SELECT %s FROM files WHERE %s AND folder = %s ORDER BY name, id", fileColumns, scopeCondition(userID, orgID, arg), arg(folder))
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    files := []File{}
+    for rows.Next() {
+        file, err := scanFile(rows)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, file)
+    }
+    return files, rows.Err()
+}
+
+// GetFileByPath returns the file named name in a folder of a workspace, the
+// newest when several share the name. It returns pgx.ErrNoRows when there
+// is none.
+func GetFileByPath(userID, orgID int, folder, name string) (File, error) {
+    var args []interface{}
+    arg := argAppender(&args)
+    query := fmt.Sprintf("SELECT %s FROM files WHERE %s AND folder = %s AND name = %s ORDER BY upload_date DESC, id DESC LIMIT 1",
+        fileColumns, scopeCondition(userID, orgID, arg), arg(folder), arg(name))
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanFile(db.QueryRow(context.Background(), query, args...))
+}
+
+// RenameFolder moves a folder of a workspace, with its files, created
+// folders and folder permissions, from one path to another that must not
+// exist yet
+func RenameFolder(userID, orgID int, from, to string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    class, key := namesLock(workspace(userID, orgID))
+    if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, $2)", class, key); err != nil {
+        return err
+    }
+
+    // Each statement rewrites the start of the paths at and below from
+    statements := []string{
+        "UPDATE files SET folder = $1 || substr(folder, $2), version = version + 1 WHERE %s AND %s RETURNING id",
+        "UPDATE folders SET path = $1 || substr(path, $2) WHERE %s AND %s RETURNING id",
+        "UPDATE acl_entries SET folder = $1 || substr(folder, $2) WHERE file_id IS NULL AND %s AND %s RETURNING id",
+    }
+    var ids []int
+    for i, statement := range statements {
+        args := []interface{}{to, len(from) + 1}
+        arg := argAppender(&args)
+        column, scope := "folder", scopeCondition(userID, orgID, arg)
+        switch i {
+        case 1:
+            column = "path"
+        case 2:
+            scope = folderTree(workspace(userID, orgID), "", arg)
+        }
+        rows, err := tx.Query(ctx, fmt.Sprintf(statement, scope, treeCondition(column, from, arg)), args...)
+        if err != nil {
+            return err
+        }
+        for rows.Next() {
+            var id int
+            if err := rows.Scan(&id); err != nil {
+                rows.Close()
+                return err
+            }
+            if i == 0 {
+                ids = append(ids, id)
+            }
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+    }
+
+    if err := tx.Commit(ctx); err != nil {
+        return err
+    }
+    invalidateFile(ids...)
+    return nil
+}
+
+// DeleteFolders forgets the created folders at and below a folder of a
+// workspace. The files in them are deleted separately.
+func DeleteFolders(userID, orgID int, path string) error {
+    var args []interface{}
+    arg := argAppender(&args)
+    query := fmt.Sprintf("DELETE FROM folders WHERE %s AND %s", scopeCondition(userID, orgID, arg), treeCondition("path", path, arg))
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), query, args...)
+    return err
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// Job is a unit of background work stored in the jobs table
+type Job struct {
+    ID          int64           `json:"id"`
+    Type        string          `json:"type"`
+    Payload     json.RawMessage `json:"payload"`
+    UniqueKey   *string         `json:"unique_key,omitempty"`
+    Status      string          `json:"status"`
+    Attempts    int             `json:"attempts"`
+    MaxAttempts int             `json:"max_attempts"`
+    RunAt       time.Time       `json:"run_at"`
+    LastError   string          `json:"last_error,omitempty"`
+    CreatedAt   time.Time       `json:"created_at"`
+    UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// Job states. Jobs that failed max_attempts times are dead and stay in the
+// table until an administrator retries them.
+const (
+    JobQueued  = "queued"
+    JobRunning = "running"
+    JobDone    = "done"
+    JobDead    = "dead"
+)
+
+// ErrJobLost is returned when a worker updates a job it no longer holds,
+// because its lease expired and another worker claimed the job
+var ErrJobLost = errors.New("job was claimed by another worker")
+
+// ownedJob selects a running job by its ID and the attempt that claimed it
+const ownedJob = "id = $1 AND attempts = $2 AND status = 'running'"
+
+// updateOwnedJob applies an update to a job if the worker running attempt
+// still holds it
+func updateOwnedJob(set string, id int64, attempt int, args ...interface{}) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "UPDATE jobs SET "+set+", updated_at = now() WHERE "+ownedJob, append([]interface{}{id, attempt}, args...)...)
+    if err != nil {
+        return err
+    }
+    if tag.RowsAffected() == 0 {
+        return ErrJobLost
+    }
+    return nil
+}
+
+const jobColumns = "id, type, payload, unique_key, status, attempts, max_attempts, run_at, last_error, created_at, updated_at"
+
+func scanJob(row rowScanner) (Job, error) {
+    var job Job
+    err := row.Scan(&job.ID, &job.Type, &job.Payload, &job.UniqueKey, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt, &job.UpdatedAt)
+    return job, err
+}
+
+// InsertJob queues a job and returns its ID. A job whose unique key matches
+// one already queued or running is not inserted and 0 is returned.
+func InsertJob(job Job) (int64, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var id int64
+    err := db.QueryRow(context.Background(), `INSERT INTO jobs (type, payload, unique_key, max_attempts, run_at) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (unique_key) WHERE status IN ('queued', 'running') DO NOTHING RETURNING id`,
+        job.Type, job.Payload, job.UniqueKey, job.MaxAttempts, job.RunAt).Scan(&id)
+    if err == pgx.ErrNoRows {
+        return 0, nil
+    }
+    return id, err
+}
+
+// ClaimJob locks the next due job for lease, skipping jobs locked by other
+// workers. Running jobs whose lease expired, e.g. because their worker
+// crashed, are claimed again. It returns pgx.ErrNoRows when nothing is due.
+func ClaimJob(lease time.Duration) (Job, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanJob(db.QueryRow(context.Background(), `UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_until = now() + $1, updated_at = now()
+        WHERE id = (
+            SELECT id FROM jobs
+            WHERE (status = 'queued' AND run_at <= now()) OR (status = 'running' AND locked_until < now())
+            ORDER BY run_at
+            FOR UPDATE SKIP LOCKED
+            LIMIT 1
+        ) RETURNING `+jobColumns, lease))
+}
+
+// ExtendJobLease keeps a running job locked for another lease, as long as
+// the worker running attempt still holds it
+func ExtendJobLease(id int64, attempt int, lease time.Duration) error {
+    return updateOwnedJob("locked_until = now() + $3", id, attempt, lease)
+}
+
+// CompleteJob marks the job claimed by attempt as done
+func CompleteJob(id int64, attempt int) error {
+    return updateOwnedJob("status = 'done', locked_until = NULL, last_error = ''", id, attempt)
+}
+
+// RetryJob puts the job claimed by attempt back in the queue to run again
+// at runAt
+func RetryJob(id int64, attempt int, runAt time.Time, lastError string) error {
+    return updateOwnedJob("status = 'queued', run_at = $3, locked_until = NULL, last_error = $4", id, attempt, runAt, lastError)
+}
+
+// KillJob moves the job claimed by attempt, which will not succeed, to the
+// dead letter state
+func KillJob(id int64, attempt int, lastError string) error {
+    return updateOwnedJob("status = 'dead', locked_until = NULL, last_error = $3", id, attempt, lastError)
+}
+
+// GetJob retrieves a job by its ID
+func GetJob(id int64) (Job, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanJob(db.QueryRow(context.Background(), "SELECT "+jobColumns+" FROM jobs WHERE id = $1", id))
+}
+
+// GetJobsByStatus lists the most recently updated jobs in a state
+func GetJobsByStatus(status string, limit int) ([]Job, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+jobColumns+" FROM jobs WHERE status = $1 ORDER BY updated_at DESC LIMIT $2", status, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var jobs []Job
+    for rows.Next() {
+        job, err := scanJob(rows)
+        if err != nil {
+            return nil, err
+        }
+        jobs = append(jobs, job)
+    }
+    return jobs, rows.Err()
+}
+
+// RequeueDeadJob gives a dead job a fresh set of attempts. It returns false
+// when the job is not dead, or when another job with its unique key is
+// already queued.
+func RequeueDeadJob(id int64) (bool, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), `UPDATE jobs SET status = 'queued', attempts = 0, run_at = now(), updated_at = now()
+        WHERE id = $1 AND status = 'dead'
+        AND (unique_key IS NULL OR NOT EXISTS (SELECT 1 FROM jobs other WHERE other.unique_key = jobs.unique_key AND other.status IN ('queued', 'running')))`, id)
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() > 0, nil
+}
+
+// PurgeFinishedJobs deletes jobs that completed before the given time
+func PurgeFinishedJobs(before time.Time) (int64, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM jobs WHERE status = 'done' AND updated_at < $1", before)
+    if err != nil {
+        return 0, err
+    }
+    return tag.RowsAffected(), nil
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+    "file-sharing-system/utils"
+)
+
+// Sort keys of a file listing and the column each orders by
+var listSortColumns = map[string]string{
+    "date": "upload_date",
+    "name": "name",
+    "size": "size",
+}
+
+// ErrInvalidCursor is returned for cursors that are malformed or were
+// issued for a listing with a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions selects one page of a user's personal files, or of an
+// organization's files when OrgID is set. Pages are ordered by Sort
+// ("date", "name" or "size") and then by ID, and continue after the
+// position encoded in Cursor.
+type ListOptions struct {
+    UserID      int
+    OrgID       int
+    Sort        string
+    Descending  bool
+    NamePrefix  string
+    ContentType string
+    Tags        []string
+    Metadata    map[string]string
+    Limit       int
+    Cursor      string
+}
+
+// FilePage is one page of a file listing. NextCursor is empty on the last
+// page; Total counts every file matching the filters.
+type FilePage struct {
+    Files      []File `json:"files"`
+    NextCursor string `json:"next_cursor,omitempty"`
+    Total      int    `json:"total"`
+}
+
+// listCursor is the position after the last file of a page: the value of
+// its sort column and its ID, which breaks ties
+type listCursor struct {
+    Sort       string `json:"s"`
+    Descending bool   `json:"d,omitempty"`
+    Value      string `json:"v"`
+    ID         int    `json:"i"`
+}
+
+func encodeCursor(cursor listCursor) string {
+    data, _ := json.Marshal(cursor)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (listCursor, error) {
+    var cursor listCursor
+    data, err := base64.RawURLEncoding.DecodeString(encoded)
+    if err != nil || json.Unmarshal(data, &cursor) != nil {
+        return listCursor{}, ErrInvalidCursor
+    }
+    return cursor, nil
+}
+
+// sortValue returns the cursor representation of a file's sort column
+func sortValue(file File, sort string) string {
+    switch sort {
+    case "name":
+        return file.Name
+    case "size":
+        return strconv.FormatInt(file.Size, 10)
+    default:
+        return file.UploadDate.UTC().Format(time.RFC3339Nano)
+    }
+}
+
+// contentTypeCondition matches a content type exactly, or a family of types for "image/*"
+func contentTypeCondition(contentType string, arg func(interface{}) string) string {
+    if family, ok := strings.CutSuffix(contentType, "/*"); ok {
+        return "content_type LIKE " + arg(escapeLike(family)+"/%")
+    }
+    return "content_type = " + arg(contentType)
+}
+
+// detailConditions match files carrying all of tags and all of the metadata pairs
+func detailConditions(tags []string, metadata map[string]string, arg func(interface{}) string) []string {
+    var conditions []string
+    if len(tags) > 0 {
+        conditions = append(conditions, "tags @> "+arg(tags)+"::text[]")
+    }
+    if len(metadata) > 0 {
+        conditions = append(conditions, "metadata @> "+arg(metadata)+"::jsonb")
+    }
+    return conditions
+}
+
+// ListFiles returns one page of a user's files using keyset pagination, so
+// every page costs the same however deep into the listing it is.
+func ListFiles(opts ListOptions) (FilePage, error) {
+    column, ok := listSortColumns[opts.Sort]
+    if !ok {
+        return FilePage{}, fmt.Errorf("unknown sort %q", opts.Sort)
+    }
+
+    var args []interface{}
+    arg := argAppender(&args)
+    conditions := []string{scopeCondition(opts.UserID, opts.OrgID, arg)}
+    if opts.NamePrefix != "" {
+        conditions = append(conditions, "lower(name) LIKE "+arg(escapeLike(strings.ToLower(opts.NamePrefix))+"%"))
+    }
+    if opts.ContentType != "" {
+        conditions = append(conditions, contentTypeCondition(opts.ContentType, arg))
+    }
+    conditions = append(conditions, detailConditions(opts.Tags, opts.Metadata, arg)...)
+    filters := strings.Join(conditions, " AND ")
+
+    db := utils.ConnectDB()
+    defer db.Close()
+    ctx := context.Background()
+
+    var page FilePage
+    if err := db.QueryRow(ctx, "SELECT count(*) FROM files WHERE "+filters, args...).Scan(&page.Total); err != nil {
+        return FilePage{}, err
+    }
+
+    direction, comparison := "ASC", ">"
+    if opts.Descending {
+        direction, comparison = "DESC", "<"
+    }
+    if opts.Cursor != "" {
+        cursor, err := decodeCursor(opts.Cursor)
+        if err != nil || cursor.Sort != opts.Sort || cursor.Descending != opts.Descending {
+            return FilePage{}, ErrInvalidCursor
+        }
+        value := arg(cursor.Value)
+        switch opts.Sort {
+        case "date":
+            value += "::timestamptz"
+        case "size":
+            value += "::bigint"
+        }
+        filters += fmt.Sprintf(" AND (%s, id) %s (%s, %s)", column, comparison, value, arg(cursor.ID))
+    }
+
+    // Fetch one extra row to learn whether there is a next page
+    rows, err := db.Query(ctx, fmt.Sprintf("SELECT %s FROM files WHERE %s ORDER BY %s %s, id %s LIMIT %s",
+        fileColumns, filters, column, direction, direction, arg(opts.Limit+1)), args...)
+    if err != nil {
+        return FilePage{}, err
+    }
+    defer rows.Close()
+
+    page.Files = []File{}
+    for rows.Next() {
+        file, err := scanFile(rows)
+        if err != nil {
+            return FilePage{}, err
+        }
+        page.Files = append(page.Files, file)
+    }
+    if err := rows.Err(); err != nil {
+        return FilePage{}, err
+    }
+
+    if len(page.Files) > opts.Limit {
+        page.Files = page.Files[:opts.Limit]
+        last := page.Files[len(page.Files)-1]
+        page.NextCursor = encodeCursor(listCursor{
+            Sort:       opts.Sort,
+            Descending: opts.Descending,
+            Value:      sortValue(last, opts.Sort),
+            ID:         last.ID,
+        })
+    }
+    return page, nil
+}
+
+// ErrTooManyFiles is returned when a folder holds more files than asked for
+var ErrTooManyFiles = errors.New("too many files")
+
+// GetFolderFiles returns the files in a folder of a user's personal files,
+// or of an organization's files when orgID is set, and in every folder
+// below it, ordered by path. It fails with ErrTooManyFiles when there are
+// more than limit.
+func GetFolderFiles(userID, orgID int, folder string, limit int) ([]File, error) {
+    var args []interface{}
+    arg := argAppender(&args)
+    query := fmt.Sprintf("SELECT %s FROM files WHERE %s AND %s ORDER BY folder, name, id LIMIT %s",
+        fileColumns, scopeCondition(userID, orgID, arg), folderCondition(folder, arg), arg(limit+1))
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    files := []File{}
+    for rows.Next() {
+        file, err := scanFile(rows)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, file)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if len(files) > limit {
+        return nil, ErrTooManyFiles
+    }
+    return files, nil
+}
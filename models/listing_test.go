@@ -0,0 +1,64 @@
+package models
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+// TestCursorRoundTrip tests that cursors decode to the position they encode
+func TestCursorRoundTrip(t *testing.T) {
+    cursor := listCursor{Sort: "name", Value: "Report, final.pdf", ID: 42}
+    decoded, err := decodeCursor(encodeCursor(cursor))
+    if err != nil || decoded != cursor {
+        t.Errorf("Expected %+v, got %+v (%v)", cursor, decoded, err)
+    }
+
+    for _, invalid := range []string{"not base64!", "bm90IGpzb24"} {
+        if _, err := decodeCursor(invalid); err != ErrInvalidCursor {
+            t.Errorf("%q: expected ErrInvalidCursor, got %v", invalid, err)
+        }
+    }
+}
+
+// TestSortValue tests the cursor value recorded for each sort order
+func TestSortValue(t *testing.T) {
+    file := File{Name: "a.txt", Size: 1024, UploadDate: time.Date(2026, 3, 1, 12, 0, 0, 123456000, time.FixedZone("CET", 3600))}
+    cases := map[string]string{
+        "name": "a.txt",
+        "size": "1024",
+        "date": "2026-03-01T11:00:00.123456Z",
+    }
+    for sort, expected := range cases {
+        if value := sortValue(file, sort); value != expected {
+            t.Errorf("%s: expected %q, got %q", sort, expected, value)
+        }
+    }
+}
+
+// TestContentTypeCondition tests exact and family content type filters
+func TestContentTypeCondition(t *testing.T) {
+    var args []interface{}
+    arg := func(value interface{}) string {
+        args = append(args, value)
+        return fmt.Sprintf("$%d", len(args))
+    }
+    if condition := contentTypeCondition("image/*", arg); condition != "content_type LIKE $1" || args[0] != "image/%" {
+        t.Errorf("Unexpected family condition %q %v", condition, args)
+    }
+    if condition := contentTypeCondition("application/pdf", arg); condition != "content_type = $2" || args[1] != "application/pdf" {
+        t.Errorf("Unexpected exact condition %q %v", condition, args)
+    }
+}
+
+// TestScopeCondition tests limiting queries to personal or organization files
+func TestScopeCondition(t *testing.T) {
+    var args []interface{}
+    arg := argAppender(&args)
+    if condition := scopeCondition(7, 0, arg); condition != "user_id = $1 AND org_id IS NULL" || args[0] != 7 {
+        t.Errorf("Unexpected personal condition %q %v", condition, args)
+    }
+    if condition := scopeCondition(7, 3, arg); condition != "org_id = $2" || args[1] != 3 {
+        t.Errorf("Unexpected organization condition %q %v", condition, args)
+    }
+}
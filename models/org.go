@@ -0,0 +1,351 @@
+package models
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// Roles of organization members, from least to most privileged. Members
+// edit the organization's files and own the ones they upload, admins own
+// every file and manage members and invitations, and owners also manage
+// other owners.
+const (
+    OrgMember = "member"
+    OrgAdmin  = "admin"
+    OrgOwner  = "owner"
+)
+
+// OrgRoles lists the member roles in increasing order of privilege
+var OrgRoles = []string{OrgMember, OrgAdmin, OrgOwner}
+
+// OrgRoleRank orders member roles by privilege; "" (not a member) ranks 0
+func OrgRoleRank(role string) int {
+    for i, r := range OrgRoles {
+        if r == role {
+            return i + 1
+        }
+    }
+    return 0
+}
+
+var (
+    // ErrLastOwner is returned when a change would leave an organization without an owner
+    ErrLastOwner = errors.New("an organization must keep at least one owner")
+    // ErrInvitationInvalid is returned for invitations that do not exist,
+    // have expired or were already accepted
+    ErrInvitationInvalid = errors.New("invitation is invalid or has expired")
+)
+
+// Organization is a shared workspace. Its files are charged to its own
+// quota; Role is the requesting user's role in it, where relevant.
+type Organization struct {
+    ID         int       `json:"id"`
+    Name       string    `json:"name"`
+    Plan       string    `json:"plan"`
+    QuotaBytes *int64    `json:"-"`
+    BytesUsed  int64     `json:"bytes_used"`
+    CreatedAt  time.Time `json:"created_at"`
+    Role       string    `json:"role,omitempty"`
+}
+
+const orgColumns = "o.id, o.name, o.plan, o.quota_bytes, o.bytes_used, o.created_at"
+
+func scanOrg(row rowScanner, extra ...interface{}) (Organization, error) {
+    var org Organization
+    err := row.Scan(append([]interface{}{&org.ID, &org.Name, &org.Plan, &org.QuotaBytes, &org.BytesUsed, &org.CreatedAt}, extra...)...)
+    return org, err
+}
+
+// CreateOrg creates an organization with ownerID as its first owner
+func CreateOrg(name string, ownerID int) (Organization, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return Organization{}, err
+    }
+    defer tx.Rollback(ctx)
+
+    org, err := scanOrg(tx.QueryRow(ctx, "INSERT INTO organizations AS o (name) VALUES ($1) RETURNING "+orgColumns, name))
+    if err != nil {
+        return Organization{}, err
+    }
+    _, err = tx.Exec(ctx, "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)", org.ID, ownerID, OrgOwner)
+    if err != nil {
+        return Organization{}, err
+    }
+    org.Role = OrgOwner
+    return org, tx.Commit(ctx)
+}
+
+// GetOrg retrieves an organization by its ID
+func GetOrg(orgID int) (Organization, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanOrg(db.QueryRow(context.Background(), "SELECT "+orgColumns+" FROM organizations o WHERE o.id = $1", orgID))
+}
+
+// GetUserOrgs lists the organizations a user belongs to, with their role in each
+func GetUserOrgs(userID int) ([]Organization, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+orgColumns+", m.role FROM organizations o JOIN org_members m ON m.org_id = o.id WHERE m.user_id = $1 ORDER BY o.name, o.id", userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    orgs := []Organization{}
+    for rows.Next() {
+        var role string
+        org, err := scanOrg(rows, &role)
+        if err != nil {
+            return nil, err
+        }
+        org.Role = role
+        orgs = append(orgs, org)
+    }
+    return orgs, rows.Err()
+}
+
+// OrgRole returns a user's role in an organization, or "" when they are not a member
+func OrgRole(orgID, userID int) (string, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var role string
+    err := db.QueryRow(context.Background(), "SELECT role FROM org_members WHERE org_id = $1 AND user_id = $2", orgID, userID).Scan(&role)
+    if err == pgx.ErrNoRows {
+        return "", nil
+    }
+    return role, err
+}
+
+// GetOrgUsage returns the storage usage and effective quota of an organization
+func GetOrgUsage(orgID int) (Usage, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var usage Usage
+    var override *int64
+    err := db.QueryRow(context.Background(), "SELECT plan, quota_bytes, bytes_used, (SELECT COUNT(*) FROM files WHERE org_id = organizations.id) FROM organizations WHERE id = $1", orgID).Scan(&usage.Plan, &override, &usage.BytesUsed, &usage.FileCount)
+    if err != nil {
+        return Usage{}, err
+    }
+    return usage.withQuota(QuotaFor(usage.Plan, override)), nil
+}
+
+// SetOrgPlan changes an organization's plan and per-organization quota
+// override; a nil quota falls back to the plan's quota
+func SetOrgPlan(orgID int, plan string, quota *int64) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "UPDATE organizations SET plan = $1, quota_bytes = $2 WHERE id = $3", plan, quota, orgID)
+    if err == nil && tag.RowsAffected() == 0 {
+        return pgx.ErrNoRows
+    }
+    return err
+}
+
+// OrgMembership is a member of an organization
+type OrgMembership struct {
+    UserID   int       `json:"user_id"`
+    Email    string    `json:"email"`
+    Role     string    `json:"role"`
+    JoinedAt time.Time `json:"joined_at"`
+}
+
+// GetOrgMembers lists an organization's members, owners first
+func GetOrgMembers(orgID int) ([]OrgMembership, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), `SELECT m.user_id, u.email, m.role, m.joined_at FROM org_members m JOIN users u ON u.id = m.user_id
+        WHERE m.org_id = $1 ORDER BY array_position(ARRAY['owner', 'admin', 'member'], m.role), u.email`, orgID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    members := []OrgMembership{}
+    for rows.Next() {
+        var member OrgMembership
+        if err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.JoinedAt); err != nil {
+            return nil, err
+        }
+        members = append(members, member)
+    }
+    return members, rows.Err()
+}
+
+// SetOrgMemberRole changes the role of an existing member, failing with
+// ErrLastOwner when it would demote the only owner
+func SetOrgMemberRole(orgID, userID int, role string) error {
+    return changeMembership(orgID, func(ctx context.Context, tx pgx.Tx) pgx.Row {
+        return tx.QueryRow(ctx, "UPDATE org_members SET role = $1 WHERE org_id = $2 AND user_id = $3 RETURNING role", role, orgID, userID)
+    })
+}
+
+// RemoveOrgMember removes a member, failing with ErrLastOwner for the only
+// owner. The files they uploaded stay with the organization.
+func RemoveOrgMember(orgID, userID int) error {
+    return changeMembership(orgID, func(ctx context.Context, tx pgx.Tx) pgx.Row {
+        return tx.QueryRow(ctx, "DELETE FROM org_members WHERE org_id = $1 AND user_id = $2 RETURNING role", orgID, userID)
+    })
+}
+
+// changeMembership applies a change to one member with the organization's
+// memberships locked, and rolls it back if no owner remains. It returns
+// pgx.ErrNoRows when the user is not a member.
+func changeMembership(orgID int, change func(context.Context, pgx.Tx) pgx.Row) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    if _, err := tx.Exec(ctx, "SELECT 1 FROM organizations WHERE id = $1 FOR UPDATE", orgID); err != nil {
+        return err
+    }
+    var role string
+    if err := change(ctx, tx).Scan(&role); err != nil {
+        return err
+    }
+
+    var owners int
+    if err := tx.QueryRow(ctx, "SELECT count(*) FROM org_members WHERE org_id = $1 AND role = $2", orgID, OrgOwner).Scan(&owners); err != nil {
+        return err
+    }
+    if owners == 0 {
+        return ErrLastOwner
+    }
+    return tx.Commit(ctx)
+}
+
+// OrgInvitation invites an email address to join an organization. It is
+// accepted with a random token of which only a hash is stored.
+type OrgInvitation struct {
+    ID         int        `json:"id"`
+    OrgID      int        `json:"org_id"`
+    OrgName    string     `json:"org_name"`
+    Email      string     `json:"email"`
+    Role       string     `json:"role"`
+    InvitedBy  *int       `json:"invited_by,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+    ExpiresAt  time.Time  `json:"expires_at"`
+    AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+const invitationColumns = "i.id, i.org_id, o.name, i.email, i.role, i.invited_by, i.created_at, i.expires_at, i.accepted_at"
+
+func scanInvitation(row rowScanner) (OrgInvitation, error) {
+    var inv OrgInvitation
+    err := row.Scan(&inv.ID, &inv.OrgID, &inv.OrgName, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt, &inv.AcceptedAt)
+    return inv, err
+}
+
+// HashToken returns the stored form of an invitation token
+func HashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// CreateInvitation records an invitation accepted with token
+func CreateInvitation(inv OrgInvitation, token string) (OrgInvitation, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanInvitation(db.QueryRow(context.Background(), `WITH i AS (
+            INSERT INTO org_invitations (org_id, email, role, token_hash, invited_by, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING *
+        ) SELECT `+invitationColumns+` FROM i JOIN organizations o ON o.id = i.org_id`,
+        inv.OrgID, inv.Email, inv.Role, HashToken(token), inv.InvitedBy, inv.ExpiresAt))
+}
+
+// GetInvitationByToken retrieves a pending, unexpired invitation
+func GetInvitationByToken(token string) (OrgInvitation, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    inv, err := scanInvitation(db.QueryRow(context.Background(), "SELECT "+invitationColumns+" FROM org_invitations i JOIN organizations o ON o.id = i.org_id WHERE i.token_hash = $1 AND i.accepted_at IS NULL AND i.expires_at > now()", HashToken(token)))
+    if err == pgx.ErrNoRows {
+        return OrgInvitation{}, ErrInvitationInvalid
+    }
+    return inv, err
+}
+
+// GetOrgInvitations lists an organization's pending invitations
+func GetOrgInvitations(orgID int) ([]OrgInvitation, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+invitationColumns+" FROM org_invitations i JOIN organizations o ON o.id = i.org_id WHERE i.org_id = $1 AND i.accepted_at IS NULL AND i.expires_at > now() ORDER BY i.created_at", orgID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    invitations := []OrgInvitation{}
+    for rows.Next() {
+        inv, err := scanInvitation(rows)
+        if err != nil {
+            return nil, err
+        }
+        invitations = append(invitations, inv)
+    }
+    return invitations, rows.Err()
+}
+
+// DeleteInvitation withdraws one of an organization's invitations
+func DeleteInvitation(orgID, id int) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM org_invitations WHERE org_id = $1 AND id = $2", orgID, id)
+    if err == nil && tag.RowsAffected() == 0 {
+        return pgx.ErrNoRows
+    }
+    return err
+}
+
+// AcceptInvitation makes the user a member with the invitation's role and
+// marks the invitation used. Users who are already members keep their role.
+func AcceptInvitation(token string, userID int) (OrgInvitation, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    ctx := context.Background()
+    tx, err := db.Begin(ctx)
+    if err != nil {
+        return OrgInvitation{}, err
+    }
+    defer tx.Rollback(ctx)
+
+    inv, err := scanInvitation(tx.QueryRow(ctx, `WITH i AS (
+            UPDATE org_invitations SET accepted_at = now() WHERE token_hash = $1 AND accepted_at IS NULL AND expires_at > now() RETURNING *
+        ) SELECT `+invitationColumns+` FROM i JOIN organizations o ON o.id = i.org_id`, HashToken(token)))
+    if err == pgx.ErrNoRows {
+        return OrgInvitation{}, ErrInvitationInvalid
+    }
+    if err != nil {
+        return OrgInvitation{}, err
+    }
+    _, err = tx.Exec(ctx, "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT (org_id, user_id) DO NOTHING", inv.OrgID, userID, inv.Role)
+    if err != nil {
+        return OrgInvitation{}, err
+    }
+    return inv, tx.Commit(ctx)
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+    "testing"
+)
+
+// TestOrgRoleRank tests that owners outrank admins, who outrank members
+func TestOrgRoleRank(t *testing.T) {
+    if !(OrgRoleRank(OrgOwner) > OrgRoleRank(OrgAdmin) && OrgRoleRank(OrgAdmin) > OrgRoleRank(OrgMember) && OrgRoleRank(OrgMember) > 0) {
+        t.Errorf("Expected owner > admin > member > 0")
+    }
+    if OrgRoleRank("editor") != 0 || OrgRoleRank("") != 0 {
+        t.Errorf("Expected unknown roles to rank 0")
+    }
+}
+
+// TestHashToken tests that invitation tokens are stored as a stable digest
+func TestHashToken(t *testing.T) {
+    hash := HashToken("secret")
+    if hash != HashToken("secret") || hash == HashToken("Secret") || len(hash) != 64 {
+        t.Errorf("Unexpected token hash %q", hash)
+    }
+}
+
+// TestWithQuota tests that the remaining bytes never go below zero
+func TestWithQuota(t *testing.T) {
+    usage := Usage{BytesUsed: 300}.withQuota(1000)
+    if usage.QuotaBytes != 1000 || usage.BytesRemaining != 700 {
+        t.Errorf("Unexpected usage %+v", usage)
+    }
+    if usage = (Usage{BytesUsed: 300}).withQuota(100); usage.BytesRemaining != 0 {
+        t.Errorf("Expected no bytes remaining over quota, got %d", usage.BytesRemaining)
+    }
+}
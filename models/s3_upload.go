@@ -0,0 +1,117 @@
+package models
+
+import (
+    "context"
+    "file-sharing-system/utils"
+    "time"
+)
+
+// S3Upload is a multipart upload started through the S3 gateway. Unlike
+// an UploadSession its size is unknown until it completes, and its parts
+// may have any size.
+type S3Upload struct {
+    ID        string
+    UserID    int
+    Folder    string
+    Name      string
+    CreatedAt time.Time
+    ExpiresAt time.Time
+}
+
+// S3UploadPart is a received part of an S3Upload. ETag is the quoted MD5
+// of the part, as S3 reports it.
+type S3UploadPart struct {
+    PartNumber int
+    Size       int64
+    ETag       string
+    ReceivedAt time.Time
+}
+
+const s3UploadColumns = "id, user_id, folder, name, created_at, expires_at"
+
+func scanS3Upload(row rowScanner) (S3Upload, error) {
+    var u S3Upload
+    err := row.Scan(&u.ID, &u.UserID, &u.Folder, &u.Name, &u.CreatedAt, &u.ExpiresAt)
+    return u, err
+}
+
+func CreateS3Upload(u S3Upload) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "INSERT INTO s3_uploads ("+s3UploadColumns+") VALUES ($1, $2, $3, $4, $5, $6)",
+        u.ID, u.UserID, u.Folder, u.Name, u.CreatedAt, u.ExpiresAt)
+    return err
+}
+
+// GetS3Upload retrieves a multipart upload by its ID
+func GetS3Upload(id string) (S3Upload, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanS3Upload(db.QueryRow(context.Background(), "SELECT "+s3UploadColumns+" FROM s3_uploads WHERE id = $1", id))
+}
+
+// SaveS3UploadPart records a received part, replacing an earlier copy of it
+func SaveS3UploadPart(uploadID string, part S3UploadPart) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), `INSERT INTO s3_upload_parts (upload_id, part_number, size, etag, received_at) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (upload_id, part_number) DO UPDATE SET size = EXCLUDED.size, etag = EXCLUDED.etag, received_at = EXCLUDED.received_at`,
+        uploadID, part.PartNumber, part.Size, part.ETag, part.ReceivedAt)
+    return err
+}
+
+// GetS3UploadParts lists the parts received for an upload in part order
+func GetS3UploadParts(uploadID string) ([]S3UploadPart, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT part_number, size, etag, received_at FROM s3_upload_parts WHERE upload_id = $1 ORDER BY part_number", uploadID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    parts := []S3UploadPart{}
+    for rows.Next() {
+        var part S3UploadPart
+        if err := rows.Scan(&part.PartNumber, &part.Size, &part.ETag, &part.ReceivedAt); err != nil {
+            return nil, err
+        }
+        parts = append(parts, part)
+    }
+    return parts, rows.Err()
+}
+
+// DeleteS3Upload removes an upload together with its part records
+func DeleteS3Upload(id string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "DELETE FROM s3_uploads WHERE id = $1", id)
+    return err
+}
+
+// GetExpiredS3Uploads returns the multipart uploads whose expiry has passed
+func GetExpiredS3Uploads(now time.Time) ([]S3Upload, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+s3UploadColumns+" FROM s3_uploads WHERE expires_at < $1", now)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var uploads []S3Upload
+    for rows.Next() {
+        u, err := scanS3Upload(rows)
+        if err != nil {
+            return nil, err
+        }
+        uploads = append(uploads, u)
+    }
+    return uploads, rows.Err()
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+    "context"
+    "fmt"
+    "regexp"
+    "strings"
+    "time"
+    "file-sharing-system/utils"
+)
+
+// SearchFilter narrows a search of one user's personal files, or of an
+// organization's files when OrgID is set. Zero values disable a filter;
+// ContentType may end in "/*" to match a whole family of types, and Folder
+// matches the folder and everything below it.
+type SearchFilter struct {
+    UserID      int
+    OrgID       int
+    Query       string
+    ContentType string
+    MinSize     *int64
+    MaxSize     *int64
+    From        *time.Time
+    To          *time.Time
+    Folder      string
+    Tags        []string
+    Metadata    map[string]string
+    Limit       int
+}
+
+// SearchResult is a matching file with its relevance and the matching
+// parts of its name and description wrapped in <mark> tags. Highlights are
+// HTML escaped so they can be inserted into a page as is.
+type SearchResult struct {
+    File
+    Rank       float32           `json:"rank"`
+    Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+var searchTerm = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// SearchQuery turns free text into a tsquery matching every word as a
+// prefix, e.g. "q3 repo" becomes "q3:* & repo:*". It returns "" when the
+// text has no words.
+func SearchQuery(text string) string {
+    terms := searchTerm.FindAllString(strings.ToLower(text), -1)
+    for i, term := range terms {
+        terms[i] = term + ":*"
+    }
+    return strings.Join(terms, " & ")
+}
+
+// escapeHTML is the SQL equivalent of html.EscapeString for the characters
+// that matter in highlights; ts_headline skips the entities it produces
+const escapeHTML = "replace(replace(replace(%s, '&', '&amp;'), '<', '&lt;'), '>', '&gt;')"
+
+const headlineOptions = "StartSel=<mark>, StopSel=</mark>, HighlightAll=true"
+
+// SearchFiles returns the user's files matching the filter, best matches
+// first, or newest first when there is no query text.
+func SearchFiles(filter SearchFilter) ([]SearchResult, error) {
+    var args []interface{}
+    arg := argAppender(&args)
+    conditions := []string{scopeCondition(filter.UserID, filter.OrgID, arg)}
+
+    rank, nameHeadline, descriptionHeadline := "0::real", "''", "''"
+    order := "upload_date DESC, id DESC"
+    if query := SearchQuery(filter.Query); query != "" {
+        q := "to_tsquery('simple', " + arg(query) + ")"
+        conditions = append(conditions, "search_vector @@ "+q)
+        rank = "ts_rank_cd(search_vector, " + q + ")"
+        nameHeadline = fmt.Sprintf("ts_headline('simple', "+escapeHTML+", %s, '%s')", "name", q, headlineOptions)
+        descriptionHeadline = fmt.Sprintf("ts_headline('simple', "+escapeHTML+", %s, '%s, MaxFragments=2')", "description", q, headlineOptions)
+        order = "search_rank DESC, upload_date DESC, id DESC"
+    } else if strings.TrimSpace(filter.Query) != "" {
+        // Only punctuation: nothing can match
+        return []SearchResult{}, nil
+    }
+
+    if filter.ContentType != "" {
+        conditions = append(conditions, contentTypeCondition(filter.ContentType, arg))
+    }
+    conditions = append(conditions, detailConditions(filter.Tags, filter.Metadata, arg)...)
+    if filter.MinSize != nil {
+        conditions = append(conditions, "size >= "+arg(*filter.MinSize))
+    }
+    if filter.MaxSize != nil {
+        conditions = append(conditions, "size <= "+arg(*filter.MaxSize))
+    }
+    if filter.From != nil {
+        conditions = append(conditions, "upload_date >= "+arg(*filter.From))
+    }
+    if filter.To != nil {
+        conditions = append(conditions, "upload_date < "+arg(*filter.To))
+    }
+    if filter.Folder != "" && filter.Folder != "/" {
+        conditions = append(conditions, folderCondition(filter.Folder, arg))
+    }
+
+    limit := filter.Limit
+    if limit <= 0 {
+        limit = 20
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    query := fmt.Sprintf("SELECT %s, %s AS search_rank, %s, %s FROM files WHERE %s ORDER BY %s LIMIT %s",
+        fileColumns, rank, nameHeadline, descriptionHeadline, strings.Join(conditions, " AND "), order, arg(limit))
+
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    results := []SearchResult{}
+    for rows.Next() {
+        var result SearchResult
+        var name, description string
+        err := rows.Scan(append(fileDest(&result.File), &result.Rank, &name, &description)...)
+        if err != nil {
+            return nil, err
+        }
+        for field, headline := range map[string]string{"name": name, "description": description} {
+            if strings.Contains(headline, "<mark>") {
+                if result.Highlights == nil {
+                    result.Highlights = make(map[string]string)
+                }
+                result.Highlights[field] = headline
+            }
+        }
+        results = append(results, result)
+    }
+    return results, rows.Err()
+}
+
+// folderCondition matches files in a folder and in the folders below it
+func folderCondition(folder string, arg func(interface{}) string) string {
+    return treeCondition("folder", folder, arg)
+}
+
+// treeCondition matches rows whose folder path column is folder or below it
+func treeCondition(column, folder string, arg func(interface{}) string) string {
+    folder = strings.TrimSuffix(folder, "/")
+    if folder == "" {
+        return "TRUE"
+    }
+    return "(" + column + " = " + arg(folder) + " OR " + column + " LIKE " + arg(escapeLike(folder)+"/%") + ")"
+}
+
+// escapeLike escapes the LIKE wildcards in a literal prefix
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
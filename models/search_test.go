@@ -0,0 +1,28 @@
+package models
+
+import "testing"
+
+// TestSearchQuery tests turning free text into a prefix tsquery
+func TestSearchQuery(t *testing.T) {
+    cases := map[string]string{
+        "quarterly":               "quarterly:*",
+        "Q3 Report":               "q3:* & report:*",
+        "budget_2024.xlsx":        "budget:* & 2024:* & xlsx:*",
+        "it's & (drop) | !table:": "it:* & s:* & drop:* & table:*",
+        "café résumé":             "café:* & résumé:*",
+        "  ":                      "",
+        "!!!":                     "",
+    }
+    for text, expected := range cases {
+        if query := SearchQuery(text); query != expected {
+            t.Errorf("%q: expected %q, got %q", text, expected, query)
+        }
+    }
+}
+
+// TestEscapeLike tests that folder names are matched literally
+func TestEscapeLike(t *testing.T) {
+    if escaped := escapeLike(`/100%_done\`); escaped != `/100\%\_done\\` {
+        t.Errorf("Unexpected escaped pattern %q", escaped)
+    }
+}
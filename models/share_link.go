@@ -0,0 +1,102 @@
+package models
+
+import (
+    "context"
+    "strconv"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// ShareLink is a public link to a file that anyone can download it with
+// until it expires. The link's token is only known when it is created.
+type ShareLink struct {
+    ID            int       `json:"id"`
+    FileID        int       `json:"file_id"`
+    CreatedBy     int       `json:"created_by"`
+    CreatedAt     time.Time `json:"created_at"`
+    ExpiresAt     time.Time `json:"expires_at"`
+    DownloadCount int       `json:"download_count"`
+}
+
+const shareLinkColumns = "id, file_id, created_by, created_at, expires_at, download_count"
+
+func scanShareLink(row rowScanner) (ShareLink, error) {
+    var l ShareLink
+    err := row.Scan(&l.ID, &l.FileID, &l.CreatedBy, &l.CreatedAt, &l.ExpiresAt, &l.DownloadCount)
+    return l, err
+}
+
+// NewShareLinkToken returns a fresh random share link token
+func NewShareLinkToken() string {
+    return utils.RandomID(24)
+}
+
+// CreateShareLink records a share link, storing only its token's hash
+func CreateShareLink(l ShareLink, token string) (ShareLink, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanShareLink(db.QueryRow(context.Background(), "INSERT INTO share_links (file_id, created_by, token_hash, expires_at) VALUES ($1, $2, $3, $4) RETURNING "+shareLinkColumns,
+        l.FileID, l.CreatedBy, HashToken(token), l.ExpiresAt))
+}
+
+// GetShareLinks lists a file's unexpired share links, newest first
+func GetShareLinks(fileID int) ([]ShareLink, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+shareLinkColumns+" FROM share_links WHERE file_id = $1 AND expires_at > now() ORDER BY id DESC", fileID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    links := []ShareLink{}
+    for rows.Next() {
+        l, err := scanShareLink(rows)
+        if err != nil {
+            return nil, err
+        }
+        links = append(links, l)
+    }
+    return links, rows.Err()
+}
+
+// GetFileByShareLink returns the file an unexpired share link points to,
+// along with the link, and counts the download. It returns pgx.ErrNoRows
+// for unknown or expired links.
+func GetFileByShareLink(token string) (File, ShareLink, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    link, err := scanShareLink(db.QueryRow(context.Background(), `UPDATE share_links SET download_count = download_count + 1
+        WHERE token_hash = $1 AND expires_at > now() RETURNING `+shareLinkColumns, HashToken(token)))
+    if err != nil {
+        return File{}, ShareLink{}, err
+    }
+    file, err := GetFileByID(strconv.Itoa(link.FileID))
+    return file, link, err
+}
+
+// DeleteShareLink revokes one of a file's share links, returning
+// pgx.ErrNoRows when the file has no such link
+func DeleteShareLink(fileID, id int) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM share_links WHERE id = $1 AND file_id = $2", id, fileID)
+    if err == nil && tag.RowsAffected() == 0 {
+        return pgx.ErrNoRows
+    }
+    return err
+}
+
+// DeleteExpiredShareLinks removes the share links that expired before cutoff
+func DeleteExpiredShareLinks(cutoff time.Time) (int64, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM share_links WHERE expires_at < $1", cutoff)
+    return tag.RowsAffected(), err
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+    "context"
+    "errors"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// ErrSSHKeyTaken is returned when a public key is already registered
+var ErrSSHKeyTaken = errors.New("this public key is already registered")
+
+// SSHKey is a public key a user signs in to the SFTP server with. PublicKey
+// is in authorized_keys format and Fingerprint is its SHA256 fingerprint.
+type SSHKey struct {
+    ID          int        `json:"id"`
+    UserID      int        `json:"-"`
+    Name        string     `json:"name"`
+    PublicKey   string     `json:"public_key"`
+    Fingerprint string     `json:"fingerprint"`
+    CreatedAt   time.Time  `json:"created_at"`
+    LastUsedAt  *time.Time `json:"last_used_at"`
+}
+
+const sshKeyColumns = "id, user_id, name, public_key, fingerprint, created_at, last_used_at"
+
+func scanSSHKey(row rowScanner) (SSHKey, error) {
+    var k SSHKey
+    err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.PublicKey, &k.Fingerprint, &k.CreatedAt, &k.LastUsedAt)
+    return k, err
+}
+
+// CreateSSHKey registers a public key for a user. A key can only belong to
+// one user, so ErrSSHKeyTaken is returned when it is registered already.
+func CreateSSHKey(k SSHKey) (SSHKey, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    k, err := scanSSHKey(db.QueryRow(context.Background(), "INSERT INTO ssh_keys (user_id, name, public_key, fingerprint) VALUES ($1, $2, $3, $4) ON CONFLICT (fingerprint) DO NOTHING RETURNING "+sshKeyColumns,
+        k.UserID, k.Name, k.PublicKey, k.Fingerprint))
+    if err == pgx.ErrNoRows {
+        return SSHKey{}, ErrSSHKeyTaken
+    }
+    return k, err
+}
+
+// GetSSHKeys lists a user's public keys, newest first
+func GetSSHKeys(userID int) ([]SSHKey, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+sshKeyColumns+" FROM ssh_keys WHERE user_id = $1 ORDER BY id DESC", userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    keys := []SSHKey{}
+    for rows.Next() {
+        k, err := scanSSHKey(rows)
+        if err != nil {
+            return nil, err
+        }
+        keys = append(keys, k)
+    }
+    return keys, rows.Err()
+}
+
+// GetUserBySSHKey returns the owner of a public key, given its fingerprint,
+// and notes that the key was used. It returns pgx.ErrNoRows for unknown keys.
+func GetUserBySSHKey(fingerprint string) (User, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var user User
+    err := db.QueryRow(context.Background(), `UPDATE ssh_keys SET last_used_at = now()
+        FROM users WHERE users.id = ssh_keys.user_id AND fingerprint = $1
+        RETURNING users.id, users.email, users.password`, fingerprint).Scan(&user.ID, &user.Email, &user.Password)
+    return user, err
+}
+
+// DeleteSSHKey removes one of a user's public keys, returning
+// pgx.ErrNoRows when they have no such key
+func DeleteSSHKey(userID, id int) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM ssh_keys WHERE id = $1 AND user_id = $2", id, userID)
+    if err == nil && tag.RowsAffected() == 0 {
+        return pgx.ErrNoRows
+    }
+    return err
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+    "context"
+    "io"
+    "time"
+    "file-sharing-system/utils"
+)
+
+// Thumbnail is a derived image stored alongside a file's content
+type Thumbnail struct {
+    FileID     int
+    Size       int
+    StorageKey string
+    Bytes      int64
+    KeyID      string
+    WrappedKey []byte
+    CreatedAt  time.Time
+}
+
+const thumbnailColumns = "file_id, size, storage_key, bytes, key_id, wrapped_key, created_at"
+
+func scanThumbnail(row rowScanner) (Thumbnail, error) {
+    var thumb Thumbnail
+    err := row.Scan(&thumb.FileID, &thumb.Size, &thumb.StorageKey, &thumb.Bytes, &thumb.KeyID, &thumb.WrappedKey, &thumb.CreatedAt)
+    return thumb, err
+}
+
+// SaveThumbnail records a generated thumbnail, replacing an earlier one of the same size
+func SaveThumbnail(thumb Thumbnail) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), `INSERT INTO file_thumbnails (`+thumbnailColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (file_id, size) DO UPDATE SET storage_key = EXCLUDED.storage_key, bytes = EXCLUDED.bytes, key_id = EXCLUDED.key_id, wrapped_key = EXCLUDED.wrapped_key, created_at = EXCLUDED.created_at`,
+        thumb.FileID, thumb.Size, thumb.StorageKey, thumb.Bytes, thumb.KeyID, thumb.WrappedKey, thumb.CreatedAt)
+    return err
+}
+
+// GetThumbnail retrieves a file's thumbnail of the given size
+func GetThumbnail(fileID, size int) (Thumbnail, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanThumbnail(db.QueryRow(context.Background(), "SELECT "+thumbnailColumns+" FROM file_thumbnails WHERE file_id = $1 AND size = $2", fileID, size))
+}
+
+// GetThumbnails lists a file's thumbnails, e.g. to delete them with the file
+func GetThumbnails(fileID int) ([]Thumbnail, error) {
+    return queryThumbnails("SELECT "+thumbnailColumns+" FROM file_thumbnails WHERE file_id = $1", fileID)
+}
+
+// GetThumbnailsToRewrap lists encrypted thumbnails whose data key is wrapped
+// by a master key other than keyID
+func GetThumbnailsToRewrap(keyID string) ([]Thumbnail, error) {
+    return queryThumbnails("SELECT "+thumbnailColumns+" FROM file_thumbnails WHERE key_id <> '' AND key_id <> $1", keyID)
+}
+
+func queryThumbnails(query string, args ...interface{}) ([]Thumbnail, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var thumbs []Thumbnail
+    for rows.Next() {
+        thumb, err := scanThumbnail(rows)
+        if err != nil {
+            return nil, err
+        }
+        thumbs = append(thumbs, thumb)
+    }
+    return thumbs, rows.Err()
+}
+
+// UpdateThumbnailKey replaces a thumbnail's wrapped data key after a master key rotation
+func UpdateThumbnailKey(thumb Thumbnail, keyID string, wrappedKey []byte) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE file_thumbnails SET key_id = $1, wrapped_key = $2 WHERE file_id = $3 AND size = $4", keyID, wrappedKey, thumb.FileID, thumb.Size)
+    return err
+}
+
+// OpenThumbnail returns a reader for a thumbnail's image
+func OpenThumbnail(thumb Thumbnail) (io.ReadCloser, error) {
+    return openObjectRange(thumb.StorageKey, thumb.KeyID, thumb.WrappedKey, thumb.Bytes, 0, thumb.Bytes)
+}
+
+// SetPreviewStatus records the state of a file's thumbnail generation
+func SetPreviewStatus(fileID int, status string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE files SET preview_status = $1 WHERE id = $2", status, fileID)
+    if err == nil {
+        invalidateFile(fileID)
+    }
+    return err
+}
+
+// GetFilesByPreviewStatus lists the files in a preview state, e.g. to requeue pending thumbnails
+func GetFilesByPreviewStatus(status string) ([]File, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+fileColumns+" FROM files WHERE preview_status = $1", status)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var files []File
+    for rows.Next() {
+        file, err := scanFile(rows)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, file)
+    }
+    return files, rows.Err()
+}
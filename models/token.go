@@ -0,0 +1,209 @@
+package models
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// APITokenPrefix starts every API token, telling them apart from JWTs
+const APITokenPrefix = "fst_"
+
+// APIToken is a long-lived credential a user creates for a client such as
+// a WebDAV mount. The token itself is only known when it is created. Each
+// token also has an S3 access key ID, whose secret is kept for verifying
+// S3 request signatures.
+type APIToken struct {
+    ID          int        `json:"id"`
+    UserID      int        `json:"-"`
+    Name        string     `json:"name"`
+    AccessKeyID string     `json:"access_key_id,omitempty"`
+    CreatedAt   time.Time  `json:"created_at"`
+    LastUsedAt  *time.Time `json:"last_used_at"`
+    ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// Tokens created before the S3 gateway have no access key
+const apiTokenColumns = "id, user_id, name, COALESCE(access_key_id, ''), created_at, last_used_at, expires_at"
+
+func scanAPIToken(row rowScanner) (APIToken, error) {
+    var t APIToken
+    err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.AccessKeyID, &t.CreatedAt, &t.LastUsedAt, &t.ExpiresAt)
+    return t, err
+}
+
+// NewAPIToken returns a fresh random API token
+func NewAPIToken() string {
+    return APITokenPrefix + utils.RandomID(32)
+}
+
+// NewS3Credentials returns a fresh S3 access key ID and secret access key,
+// shaped like AWS ones so that S3 clients accept them
+func NewS3Credentials() (string, string) {
+    return "FSAK" + strings.ToUpper(utils.RandomID(8)), utils.RandomID(20)
+}
+
+// S3Secret is a token's S3 secret access key as stored: wrapped by the
+// master key KeyID when encryption at rest is enabled, or else in Plain
+type S3Secret struct {
+    TokenID int
+    Plain   *string
+    KeyID   string
+    Wrapped []byte
+}
+
+const s3SecretColumns = "id, secret_access_key, secret_key_id, wrapped_secret"
+
+func scanS3Secret(row rowScanner) (S3Secret, error) {
+    var s S3Secret
+    err := row.Scan(&s.TokenID, &s.Plain, &s.KeyID, &s.Wrapped)
+    return s, err
+}
+
+// sealS3Secret wraps a secret access key with the active master key, or
+// keeps it as it is when encryption at rest is disabled
+func sealS3Secret(secret string) (S3Secret, error) {
+    provider := utils.GetKeyProvider()
+    if provider == nil {
+        return S3Secret{Plain: &secret}, nil
+    }
+    keyID := provider.ActiveKeyID()
+    wrapped, err := provider.WrapKey(keyID, []byte(secret))
+    return S3Secret{KeyID: keyID, Wrapped: wrapped}, err
+}
+
+// open returns the secret access key
+func (s S3Secret) open() (string, error) {
+    if s.KeyID == "" {
+        if s.Plain == nil {
+            return "", errors.New("token has no S3 secret")
+        }
+        return *s.Plain, nil
+    }
+    provider := utils.GetKeyProvider()
+    if provider == nil {
+        return "", errors.New("S3 secret is encrypted but ENCRYPTION_KEYFILE is not set")
+    }
+    secret, err := provider.UnwrapKey(s.KeyID, s.Wrapped)
+    return string(secret), err
+}
+
+// CreateAPIToken records a token for a user, storing only its hash, along
+// with the token's S3 secret access key, wrapped by the master key when
+// encryption at rest is enabled
+func CreateAPIToken(t APIToken, token, secretAccessKey string) (APIToken, error) {
+    secret, err := sealS3Secret(secretAccessKey)
+    if err != nil {
+        return APIToken{}, err
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanAPIToken(db.QueryRow(context.Background(), "INSERT INTO api_tokens (user_id, name, token_hash, access_key_id, secret_access_key, secret_key_id, wrapped_secret, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING "+apiTokenColumns,
+        t.UserID, t.Name, HashToken(token), t.AccessKeyID, secret.Plain, secret.KeyID, secret.Wrapped, t.ExpiresAt))
+}
+
+// GetS3Credentials returns the owner and secret access key of an unexpired
+// token's S3 access key and notes that the token was used. It returns
+// pgx.ErrNoRows for unknown access keys.
+func GetS3Credentials(accessKeyID string) (User, string, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var user User
+    var secret S3Secret
+    err := db.QueryRow(context.Background(), `UPDATE api_tokens SET last_used_at = now()
+        FROM users WHERE users.id = api_tokens.user_id AND access_key_id = $1 AND (expires_at IS NULL OR expires_at > now())
+        RETURNING users.id, users.email, users.password, secret_access_key, secret_key_id, wrapped_secret`, accessKeyID).Scan(&user.ID, &user.Email, &user.Password, &secret.Plain, &secret.KeyID, &secret.Wrapped)
+    if err != nil {
+        return User{}, "", err
+    }
+    plain, err := secret.open()
+    return user, plain, err
+}
+
+// GetS3SecretsToRewrap lists S3 secrets that are not wrapped by the master
+// key keyID: those wrapped by another, and those stored before encryption
+// at rest was enabled
+func GetS3SecretsToRewrap(keyID string) ([]S3Secret, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+s3SecretColumns+" FROM api_tokens WHERE secret_key_id <> $1 AND (secret_key_id <> '' OR secret_access_key IS NOT NULL)", keyID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var secrets []S3Secret
+    for rows.Next() {
+        secret, err := scanS3Secret(rows)
+        if err != nil {
+            return nil, err
+        }
+        secrets = append(secrets, secret)
+    }
+    return secrets, rows.Err()
+}
+
+// UpdateS3Secret stores a token's S3 secret wrapped by the master key keyID,
+// dropping any plaintext copy
+func UpdateS3Secret(tokenID int, keyID string, wrapped []byte) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE api_tokens SET secret_access_key = NULL, secret_key_id = $1, wrapped_secret = $2 WHERE id = $3", keyID, wrapped, tokenID)
+    return err
+}
+
+// GetUserByAPIToken returns the owner of an unexpired API token and notes
+// that the token was used. It returns pgx.ErrNoRows for unknown tokens.
+func GetUserByAPIToken(token string) (User, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var user User
+    err := db.QueryRow(context.Background(), `UPDATE api_tokens SET last_used_at = now()
+        FROM users WHERE users.id = api_tokens.user_id AND token_hash = $1 AND (expires_at IS NULL OR expires_at > now())
+        RETURNING users.id, users.email, users.password`, HashToken(token)).Scan(&user.ID, &user.Email, &user.Password)
+    return user, err
+}
+
+// GetAPITokens lists a user's API tokens, newest first
+func GetAPITokens(userID int) ([]APIToken, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = $1 ORDER BY id DESC", userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tokens := []APIToken{}
+    for rows.Next() {
+        t, err := scanAPIToken(rows)
+        if err != nil {
+            return nil, err
+        }
+        tokens = append(tokens, t)
+    }
+    return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes one of a user's API tokens, returning
+// pgx.ErrNoRows when they have no such token
+func DeleteAPIToken(userID, id int) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM api_tokens WHERE id = $1 AND user_id = $2", id, userID)
+    if err == nil && tag.RowsAffected() == 0 {
+        return pgx.ErrNoRows
+    }
+    return err
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+// TestNewAPIToken tests that API tokens carry their prefix and are unique
+func TestNewAPIToken(t *testing.T) {
+    a, b := NewAPIToken(), NewAPIToken()
+    if !strings.HasPrefix(a, APITokenPrefix) || len(a) <= len(APITokenPrefix)+16 {
+        t.Errorf("Unexpected token %q", a)
+    }
+    if a == b {
+        t.Error("Expected tokens to differ")
+    }
+}
+
+// TestS3SecretOpen tests reading secrets stored before encryption at rest,
+// and that wrapped secrets need the keyfile
+func TestS3SecretOpen(t *testing.T) {
+    plain := "secret"
+    if secret, err := (S3Secret{Plain: &plain}).open(); err != nil || secret != "secret" {
+        t.Errorf("Expected the plaintext secret, got %q (%v)", secret, err)
+    }
+    if _, err := (S3Secret{}).open(); err == nil {
+        t.Error("Expected an error for a token without a secret")
+    }
+    if _, err := (S3Secret{KeyID: "2026-01", Wrapped: []byte("sealed")}).open(); err == nil {
+        t.Error("Expected an error for a wrapped secret without a keyfile")
+    }
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+    "context"
+    "file-sharing-system/utils"
+    "time"
+)
+
+// Upload tracks a resumable upload that has not been completed yet
+type Upload struct {
+    ID        string    `json:"id"`
+    UserID    int       `json:"user_id"`
+    Filename  string    `json:"filename"`
+    Length    int64     `json:"length"`
+    Offset    int64     `json:"offset"`
+    Metadata  string    `json:"metadata"`
+    CreatedAt time.Time `json:"created_at"`
+    ExpiresAt time.Time `json:"expires_at"`
+    // OrgID is set for uploads into an organization's workspace
+    OrgID *int `json:"org_id,omitempty"`
+}
+
+const uploadColumns = "id, user_id, filename, length, upload_offset, metadata, created_at, expires_at, org_id"
+
+func scanUpload(row rowScanner) (Upload, error) {
+    var upload Upload
+    err := row.Scan(&upload.ID, &upload.UserID, &upload.Filename, &upload.Length, &upload.Offset, &upload.Metadata, &upload.CreatedAt, &upload.ExpiresAt, &upload.OrgID)
+    return upload, err
+}
+
+func CreateUpload(upload Upload) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "INSERT INTO uploads ("+uploadColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)", upload.ID, upload.UserID, upload.Filename, upload.Length, upload.Offset, upload.Metadata, upload.CreatedAt, upload.ExpiresAt, upload.OrgID)
+    return err
+}
+
+// GetUpload retrieves an upload by its ID
+func GetUpload(id string) (Upload, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanUpload(db.QueryRow(context.Background(), "SELECT "+uploadColumns+" FROM uploads WHERE id = $1", id))
+}
+
+// UpdateUploadOffset records how many bytes of an upload have been received
+func UpdateUploadOffset(id string, offset int64, expiresAt time.Time) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "UPDATE uploads SET upload_offset = $1, expires_at = $2 WHERE id = $3", offset, expiresAt, id)
+    return err
+}
+
+func DeleteUpload(id string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "DELETE FROM uploads WHERE id = $1", id)
+    return err
+}
+
+// GetExpiredUploads returns the uploads whose expiry has passed
+func GetExpiredUploads(now time.Time) ([]Upload, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+uploadColumns+" FROM uploads WHERE expires_at < $1", now)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var uploads []Upload
+    for rows.Next() {
+        upload, err := scanUpload(rows)
+        if err != nil {
+            return nil, err
+        }
+        uploads = append(uploads, upload)
+    }
+    return uploads, rows.Err()
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+    "context"
+    "file-sharing-system/utils"
+    "time"
+)
+
+// UploadSession is a large upload sent as numbered parts in any order
+type UploadSession struct {
+    ID        string    `json:"id"`
+    UserID    int       `json:"user_id"`
+    Filename  string    `json:"filename"`
+    Size      int64     `json:"size"`
+    ChunkSize int64     `json:"chunk_size"`
+    PartCount int       `json:"part_count"`
+    CreatedAt time.Time `json:"created_at"`
+    ExpiresAt time.Time `json:"expires_at"`
+
+    // Set when the parts are ciphertext produced by the client
+    EncryptionHeader  []byte `json:"encryption_header,omitempty"`
+    EncryptedMetadata []byte `json:"encrypted_metadata,omitempty"`
+
+    // OrgID is set for uploads into an organization's workspace
+    OrgID *int `json:"org_id,omitempty"`
+    // Folder is where the file is placed on completion
+    Folder string `json:"folder"`
+}
+
+type UploadPart struct {
+    PartNumber int       `json:"part_number"`
+    Size       int64     `json:"size"`
+    SHA256     string    `json:"sha256"`
+    ReceivedAt time.Time `json:"received_at"`
+}
+
+const uploadSessionColumns = "id, user_id, filename, size, chunk_size, created_at, expires_at, encryption_header, encrypted_metadata, org_id, folder"
+
+func scanUploadSession(row rowScanner) (UploadSession, error) {
+    var session UploadSession
+    err := row.Scan(&session.ID, &session.UserID, &session.Filename, &session.Size, &session.ChunkSize, &session.CreatedAt, &session.ExpiresAt, &session.EncryptionHeader, &session.EncryptedMetadata, &session.OrgID, &session.Folder)
+    session.PartCount = PartCount(session.Size, session.ChunkSize)
+    return session, err
+}
+
+// PartCount returns how many parts of chunkSize bytes make up size bytes
+func PartCount(size, chunkSize int64) int {
+    if size == 0 {
+        return 1
+    }
+    return int((size + chunkSize - 1) / chunkSize)
+}
+
+// PartSize returns the expected size of a part; only the last may be short
+func (s UploadSession) PartSize(partNumber int) int64 {
+    if partNumber == s.PartCount {
+        return s.Size - int64(s.PartCount-1)*s.ChunkSize
+    }
+    return s.ChunkSize
+}
+
+func CreateUploadSession(session UploadSession) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "INSERT INTO upload_sessions ("+uploadSessionColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", session.ID, session.UserID, session.Filename, session.Size, session.ChunkSize, session.CreatedAt, session.ExpiresAt, session.EncryptionHeader, session.EncryptedMetadata, session.OrgID, session.Folder)
+    return err
+}
+
+// GetUploadSession retrieves an upload session by its ID
+func GetUploadSession(id string) (UploadSession, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanUploadSession(db.QueryRow(context.Background(), "SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE id = $1", id))
+}
+
+// SaveUploadPart records a received part, replacing an earlier copy of it
+func SaveUploadPart(sessionID string, part UploadPart) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), `INSERT INTO upload_parts (session_id, part_number, size, sha256, received_at) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (session_id, part_number) DO UPDATE SET size = EXCLUDED.size, sha256 = EXCLUDED.sha256, received_at = EXCLUDED.received_at`,
+        sessionID, part.PartNumber, part.Size, part.SHA256, part.ReceivedAt)
+    return err
+}
+
+// GetUploadParts lists the parts received for a session in part order
+func GetUploadParts(sessionID string) ([]UploadPart, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT part_number, size, sha256, received_at FROM upload_parts WHERE session_id = $1 ORDER BY part_number", sessionID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    parts := []UploadPart{}
+    for rows.Next() {
+        var part UploadPart
+        if err := rows.Scan(&part.PartNumber, &part.Size, &part.SHA256, &part.ReceivedAt); err != nil {
+            return nil, err
+        }
+        parts = append(parts, part)
+    }
+    return parts, rows.Err()
+}
+
+// DeleteUploadSession removes a session together with its part records
+func DeleteUploadSession(id string) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    _, err := db.Exec(context.Background(), "DELETE FROM upload_sessions WHERE id = $1", id)
+    return err
+}
+
+// GetExpiredUploadSessions returns the sessions whose expiry has passed
+func GetExpiredUploadSessions(now time.Time) ([]UploadSession, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE expires_at < $1", now)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var sessions []UploadSession
+    for rows.Next() {
+        session, err := scanUploadSession(rows)
+        if err != nil {
+            return nil, err
+        }
+        sessions = append(sessions, session)
+    }
+    return sessions, rows.Err()
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "os"
+    "strconv"
+    "strings"
+    "file-sharing-system/utils"
+)
+
+// DefaultQuotaBytes is used when neither the user, their plan nor DEFAULT_QUOTA_BYTES sets a quota
+const DefaultQuotaBytes int64 = 1 << 30
+
+// ErrQuotaExceeded is returned when storing a file would take a user over their quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+type Usage struct {
+    Plan           string `json:"plan"`
+    BytesUsed      int64  `json:"bytes_used"`
+    QuotaBytes     int64  `json:"quota_bytes"`
+    BytesRemaining int64  `json:"bytes_remaining"`
+    FileCount      int    `json:"file_count"`
+}
+
+// GetUsage returns the storage usage and effective quota of a user's
+// personal files; organization files count towards the organization
+func GetUsage(userID int) (Usage, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var usage Usage
+    var override *int64
+    err := db.QueryRow(context.Background(), "SELECT plan, quota_bytes, bytes_used, (SELECT COUNT(*) FROM files WHERE user_id = users.id AND org_id IS NULL) FROM users WHERE id = $1", userID).Scan(&usage.Plan, &override, &usage.BytesUsed, &usage.FileCount)
+    if err != nil {
+        return Usage{}, err
+    }
+
+    return usage.withQuota(QuotaFor(usage.Plan, override)), nil
+}
+
+// withQuota fills in the effective quota and the bytes remaining under it
+func (u Usage) withQuota(quota int64) Usage {
+    u.QuotaBytes = quota
+    u.BytesRemaining = quota - u.BytesUsed
+    if u.BytesRemaining < 0 {
+        u.BytesRemaining = 0
+    }
+    return u
+}
+
+// QuotaFor resolves the effective quota: a per-user override wins over the
+// plan quota from QUOTA_PLANS, which wins over DEFAULT_QUOTA_BYTES.
+func QuotaFor(plan string, override *int64) int64 {
+    if override != nil {
+        return *override
+    }
+    if plans, err := ParsePlanQuotas(os.Getenv("QUOTA_PLANS")); err == nil {
+        if quota, ok := plans[plan]; ok {
+            return quota
+        }
+    }
+    if quota, err := ParseSize(os.Getenv("DEFAULT_QUOTA_BYTES")); err == nil && quota > 0 {
+        return quota
+    }
+    return DefaultQuotaBytes
+}
+
+// ParsePlanQuotas parses a plan list such as "free=1GB,pro=100GB"
+func ParsePlanQuotas(s string) (map[string]int64, error) {
+    plans := make(map[string]int64)
+    for _, entry := range strings.Split(s, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        name, size, ok := strings.Cut(entry, "=")
+        if !ok {
+            return nil, fmt.Errorf("invalid plan quota %q", entry)
+        }
+        quota, err := ParseSize(size)
+        if err != nil {
+            return nil, err
+        }
+        plans[strings.TrimSpace(name)] = quota
+    }
+    return plans, nil
+}
+
+// ParseSize parses a byte count with an optional KB/MB/GB/TB suffix (powers of 1024)
+func ParseSize(s string) (int64, error) {
+    s = strings.ToUpper(strings.TrimSpace(s))
+    multiplier := int64(1)
+    for _, unit := range []struct {
+        suffix string
+        size   int64
+    }{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+        if strings.HasSuffix(s, unit.suffix) {
+            s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+            multiplier = unit.size
+            break
+        }
+    }
+    n, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("invalid size %q", s)
+    }
+    if n < 0 {
+        return 0, fmt.Errorf("negative size %q", s)
+    }
+    if n > math.MaxInt64/multiplier {
+        return 0, fmt.Errorf("size %q is too large", s)
+    }
+    return n * multiplier, nil
+}
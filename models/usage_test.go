@@ -0,0 +1,60 @@
+package models
+
+import (
+    "testing"
+)
+
+// TestParseSize tests byte counts with and without unit suffixes
+func TestParseSize(t *testing.T) {
+    cases := map[string]int64{
+        "1024": 1024,
+        "10KB": 10 << 10,
+        "5 MB": 5 << 20,
+        "1gb":  1 << 30,
+        "2TB":  2 << 40,
+        "512B": 512,
+    }
+    for input, expected := range cases {
+        size, err := ParseSize(input)
+        if err != nil {
+            t.Errorf("Unexpected error for %q: %s", input, err)
+        }
+        if size != expected {
+            t.Errorf("Expected %d for %q, got %d", expected, input, size)
+        }
+    }
+
+    if _, err := ParseSize("lots"); err == nil {
+        t.Errorf("Expected error for invalid size")
+    }
+    for _, input := range []string{"9999999999TB", "8388608TB", "9223372036854775807KB"} {
+        if _, err := ParseSize(input); err == nil {
+            t.Errorf("Expected error for %q, which overflows", input)
+        }
+    }
+    if size, err := ParseSize("8388607TB"); err != nil || size != 8388607<<40 {
+        t.Errorf("Expected the largest whole TB count to parse, got %d %v", size, err)
+    }
+}
+
+// TestQuotaFor tests the precedence of user, plan and default quotas
+func TestQuotaFor(t *testing.T) {
+    t.Setenv("QUOTA_PLANS", "free=1GB, pro=100GB")
+    t.Setenv("DEFAULT_QUOTA_BYTES", "2GB")
+
+    override := int64(42)
+    if quota := QuotaFor("pro", &override); quota != 42 {
+        t.Errorf("Expected user override to win, got %d", quota)
+    }
+    if quota := QuotaFor("pro", nil); quota != 100<<30 {
+        t.Errorf("Expected pro plan quota, got %d", quota)
+    }
+    if quota := QuotaFor("enterprise", nil); quota != 2<<30 {
+        t.Errorf("Expected default quota for unknown plan, got %d", quota)
+    }
+
+    t.Setenv("DEFAULT_QUOTA_BYTES", "")
+    if quota := QuotaFor("enterprise", nil); quota != DefaultQuotaBytes {
+        t.Errorf("Expected built-in default quota, got %d", quota)
+    }
+}
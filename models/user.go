@@ -27,3 +27,13 @@ func GetUserByEmail(email string) (User, error) {
     err := db.QueryRow(context.Background(), "SELECT id, email, password FROM users WHERE email = $1", email).Scan(&user.ID, &user.Email, &user.Password)
     return user, err
 }
+
+// IsAdmin reports whether a user may use the administration endpoints
+func IsAdmin(userID int) (bool, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var admin bool
+    err := db.QueryRow(context.Background(), "SELECT is_admin FROM users WHERE id = $1", userID).Scan(&admin)
+    return admin, err
+}
@@ -0,0 +1,269 @@
+package models
+
+import (
+    "context"
+    "encoding/json"
+    "time"
+    "file-sharing-system/utils"
+    "github.com/jackc/pgx/v4"
+)
+
+// Events webhooks can subscribe to
+const (
+    WebhookFileUploaded  = "file.uploaded"
+    WebhookFileDeleted   = "file.deleted"
+    WebhookShareAccessed = "share.accessed"
+)
+
+// WebhookEvents lists the events webhooks can subscribe to
+var WebhookEvents = []string{WebhookFileUploaded, WebhookFileDeleted, WebhookShareAccessed}
+
+// Delivery states: pending until the first attempt, then the outcome of
+// the latest attempt
+const (
+    DeliveryPending   = "pending"
+    DeliveryDelivered = "delivered"
+    DeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint a user registered to be called on events in their
+// personal files, or in an organization's files when OrgID is set. Its
+// secret signs every delivery and is only returned when it is created.
+type Webhook struct {
+    ID        int       `json:"id"`
+    UserID    int       `json:"-"`
+    OrgID     *int      `json:"org_id,omitempty"`
+    URL       string    `json:"url"`
+    Secret    string    `json:"-"`
+    Events    []string  `json:"events"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+const webhookColumns = "id, user_id, org_id, url, secret, events, created_at"
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+    var h Webhook
+    err := row.Scan(&h.ID, &h.UserID, &h.OrgID, &h.URL, &h.Secret, &h.Events, &h.CreatedAt)
+    return h, err
+}
+
+// WebhookDelivery is an event sent, or to be sent, to a webhook, along
+// with every attempt at sending it
+type WebhookDelivery struct {
+    ID          int64            `json:"id"`
+    WebhookID   int              `json:"webhook_id"`
+    Event       string           `json:"event"`
+    Payload     json.RawMessage  `json:"payload"`
+    Status      string           `json:"status"`
+    CreatedAt   time.Time        `json:"created_at"`
+    DeliveredAt *time.Time       `json:"delivered_at"`
+    Attempts    []WebhookAttempt `json:"attempts"`
+}
+
+const webhookDeliveryColumns = "id, webhook_id, event, payload, status, created_at, delivered_at"
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+    var d WebhookDelivery
+    err := row.Scan(&d.ID, &d.WebhookID, &d.Event, (*[]byte)(&d.Payload), &d.Status, &d.CreatedAt, &d.DeliveredAt)
+    return d, err
+}
+
+// WebhookAttempt is one try at sending a delivery. StatusCode is unset
+// when no response came back, and Error explains any failure.
+type WebhookAttempt struct {
+    AttemptedAt time.Time `json:"attempted_at"`
+    StatusCode  *int      `json:"status_code"`
+    Error       string    `json:"error,omitempty"`
+    DurationMS  int       `json:"duration_ms"`
+}
+
+// NewWebhookSecret returns a fresh random signing secret
+func NewWebhookSecret() string {
+    return "whsec_" + utils.RandomID(24)
+}
+
+// CreateWebhook records a webhook
+func CreateWebhook(h Webhook) (Webhook, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanWebhook(db.QueryRow(context.Background(), "INSERT INTO webhooks (user_id, org_id, url, secret, events) VALUES ($1, $2, $3, $4, $5) RETURNING "+webhookColumns,
+        h.UserID, h.OrgID, h.URL, h.Secret, h.Events))
+}
+
+// GetWebhooks lists the webhooks a user registered, newest first
+func GetWebhooks(userID int) ([]Webhook, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), "SELECT "+webhookColumns+" FROM webhooks WHERE user_id = $1 ORDER BY id DESC", userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    return collectWebhooks(rows)
+}
+
+func collectWebhooks(rows pgx.Rows) ([]Webhook, error) {
+    hooks := []Webhook{}
+    for rows.Next() {
+        h, err := scanWebhook(rows)
+        if err != nil {
+            return nil, err
+        }
+        hooks = append(hooks, h)
+    }
+    return hooks, rows.Err()
+}
+
+// GetWebhook returns one of a user's webhooks, or pgx.ErrNoRows when they
+// have no such webhook
+func GetWebhook(userID, id int) (Webhook, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    return scanWebhook(db.QueryRow(context.Background(), "SELECT "+webhookColumns+" FROM webhooks WHERE id = $1 AND user_id = $2", id, userID))
+}
+
+// DeleteWebhook removes one of a user's webhooks along with its
+// deliveries, returning pgx.ErrNoRows when they have no such webhook
+func DeleteWebhook(userID, id int) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM webhooks WHERE id = $1 AND user_id = $2", id, userID)
+    if err == nil && tag.RowsAffected() == 0 {
+        return pgx.ErrNoRows
+    }
+    return err
+}
+
+// GetSubscribedWebhooks returns the webhooks subscribed to event in a
+// user's personal files, or in an organization's files when orgID is set.
+// Organization webhooks only fire while whoever registered them is still a
+// member.
+func GetSubscribedWebhooks(userID, orgID int, event string) ([]Webhook, error) {
+    var args []interface{}
+    arg := argAppender(&args)
+    query := "SELECT " + webhookColumns + " FROM webhooks WHERE " + scopeCondition(userID, orgID, arg) + " AND " + arg(event) + " = ANY(events)"
+    if orgID != 0 {
+        query += " AND EXISTS (SELECT 1 FROM org_members m WHERE m.org_id = webhooks.org_id AND m.user_id = webhooks.user_id)"
+    }
+
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    rows, err := db.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    return collectWebhooks(rows)
+}
+
+// CreateWebhookDelivery records a pending delivery of an event to a webhook
+func CreateWebhookDelivery(webhookID int, event string, payload []byte) (WebhookDelivery, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    d, err := scanWebhookDelivery(db.QueryRow(context.Background(), "INSERT INTO webhook_deliveries (webhook_id, event, payload) VALUES ($1, $2, $3) RETURNING "+webhookDeliveryColumns,
+        webhookID, event, payload))
+    d.Attempts = []WebhookAttempt{}
+    return d, err
+}
+
+// GetWebhookDelivery returns a delivery along with its webhook, or
+// pgx.ErrNoRows when either is gone
+func GetWebhookDelivery(id int64) (WebhookDelivery, Webhook, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+    ctx := context.Background()
+
+    d, err := scanWebhookDelivery(db.QueryRow(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = $1", id))
+    if err != nil {
+        return WebhookDelivery{}, Webhook{}, err
+    }
+    h, err := scanWebhook(db.QueryRow(ctx, "SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", d.WebhookID))
+    return d, h, err
+}
+
+// GetWebhookDeliveries lists a webhook's latest deliveries, newest first,
+// with their attempts
+func GetWebhookDeliveries(webhookID, limit int) ([]WebhookDelivery, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+    ctx := context.Background()
+
+    rows, err := db.Query(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2", webhookID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    deliveries := []WebhookDelivery{}
+    index := map[int64]int{}
+    var ids []int64
+    for rows.Next() {
+        d, err := scanWebhookDelivery(rows)
+        if err != nil {
+            return nil, err
+        }
+        d.Attempts = []WebhookAttempt{}
+        index[d.ID] = len(deliveries)
+        ids = append(ids, d.ID)
+        deliveries = append(deliveries, d)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if len(ids) == 0 {
+        return deliveries, nil
+    }
+
+    rows, err = db.Query(ctx, "SELECT delivery_id, attempted_at, status_code, COALESCE(error, ''), duration_ms FROM webhook_attempts WHERE delivery_id = ANY($1) ORDER BY id", ids)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var deliveryID int64
+        var a WebhookAttempt
+        if err := rows.Scan(&deliveryID, &a.AttemptedAt, &a.StatusCode, &a.Error, &a.DurationMS); err != nil {
+            return nil, err
+        }
+        d := &deliveries[index[deliveryID]]
+        d.Attempts = append(d.Attempts, a)
+    }
+    return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt logs an attempt at a delivery and sets its status
+// to the attempt's outcome
+func RecordWebhookAttempt(deliveryID int64, a WebhookAttempt, delivered bool) error {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    var errorText *string
+    if a.Error != "" {
+        errorText = &a.Error
+    }
+    status := DeliveryFailed
+    if delivered {
+        status = DeliveryDelivered
+    }
+    _, err := db.Exec(context.Background(), `WITH attempt AS (
+            INSERT INTO webhook_attempts (delivery_id, attempted_at, status_code, error, duration_ms) VALUES ($1, $2, $3, $4, $5)
+        )
+        UPDATE webhook_deliveries SET status = $6, delivered_at = CASE WHEN $7 THEN $2 ELSE delivered_at END WHERE id = $1`,
+        deliveryID, a.AttemptedAt, a.StatusCode, errorText, a.DurationMS, status, delivered)
+    return err
+}
+
+// DeleteWebhookDeliveries removes the deliveries made before cutoff
+func DeleteWebhookDeliveries(cutoff time.Time) (int64, error) {
+    db := utils.ConnectDB()
+    defer db.Close()
+
+    tag, err := db.Exec(context.Background(), "DELETE FROM webhook_deliveries WHERE created_at < $1", cutoff)
+    return tag.RowsAffected(), err
+}
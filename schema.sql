@@ -0,0 +1,543 @@
+-- Database schema for the file sharing system.
+-- Every statement is idempotent so the file can be re-applied after upgrades:
+--   psql "$DATABASE_URL" -f schema.sql
+
+CREATE TABLE IF NOT EXISTS users (
+    id       SERIAL PRIMARY KEY,
+    email    TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS files (
+    id          SERIAL PRIMARY KEY,
+    name        TEXT NOT NULL,
+    size        BIGINT NOT NULL,
+    url         TEXT NOT NULL,
+    upload_date TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Storage quotas
+ALTER TABLE users ADD COLUMN IF NOT EXISTS plan TEXT NOT NULL DEFAULT 'free';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_bytes BIGINT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bytes_used BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS storage_key TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS files_user_id_idx ON files (user_id);
+
+-- Resumable (tus) uploads
+CREATE TABLE IF NOT EXISTS uploads (
+    id            TEXT PRIMARY KEY,
+    user_id       INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename      TEXT NOT NULL,
+    length        BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    metadata      TEXT NOT NULL DEFAULT '',
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at    TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS uploads_expires_at_idx ON uploads (expires_at);
+
+-- Chunked parallel upload sessions
+ALTER TABLE files ADD COLUMN IF NOT EXISTS checksum TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id         TEXT PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename   TEXT NOT NULL,
+    size       BIGINT NOT NULL,
+    chunk_size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS upload_parts (
+    session_id  TEXT NOT NULL REFERENCES upload_sessions(id) ON DELETE CASCADE,
+    part_number INTEGER NOT NULL,
+    size        BIGINT NOT NULL,
+    sha256      TEXT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (session_id, part_number)
+);
+
+-- Content type detection and policies
+ALTER TABLE files ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT 'application/octet-stream';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS user_group TEXT;
+
+CREATE TABLE IF NOT EXISTS content_type_policies (
+    group_name TEXT PRIMARY KEY,
+    allowed    TEXT[] NOT NULL DEFAULT '{}',
+    blocked    TEXT[] NOT NULL DEFAULT '{}'
+);
+
+-- Virus scanning
+ALTER TABLE files ADD COLUMN IF NOT EXISTS scan_status TEXT NOT NULL DEFAULT 'skipped';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS scan_result TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS files_scan_status_idx ON files (scan_status) WHERE scan_status = 'pending';
+
+-- Encryption at rest
+ALTER TABLE files ADD COLUMN IF NOT EXISTS key_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+CREATE INDEX IF NOT EXISTS files_key_id_idx ON files (key_id) WHERE key_id <> '';
+
+-- Client-side (end-to-end) encryption
+ALTER TABLE files ADD COLUMN IF NOT EXISTS client_encrypted BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS encryption_header BYTEA;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS encrypted_metadata BYTEA;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS encryption_header BYTEA;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS encrypted_metadata BYTEA;
+
+-- Thumbnails
+ALTER TABLE files ADD COLUMN IF NOT EXISTS preview_status TEXT NOT NULL DEFAULT 'none';
+CREATE INDEX IF NOT EXISTS files_preview_status_idx ON files (preview_status) WHERE preview_status = 'pending';
+
+CREATE TABLE IF NOT EXISTS file_thumbnails (
+    file_id     INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    size        INTEGER NOT NULL,
+    storage_key TEXT NOT NULL,
+    bytes       BIGINT NOT NULL,
+    key_id      TEXT NOT NULL DEFAULT '',
+    wrapped_key BYTEA,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (file_id, size)
+);
+
+-- Background jobs
+CREATE TABLE IF NOT EXISTS jobs (
+    id           BIGSERIAL PRIMARY KEY,
+    type         TEXT NOT NULL,
+    payload      JSONB NOT NULL DEFAULT '{}',
+    unique_key   TEXT,
+    status       TEXT NOT NULL DEFAULT 'queued',
+    attempts     INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 5,
+    run_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ,
+    last_error   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS jobs_runnable_idx ON jobs (run_at) WHERE status IN ('queued', 'running');
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, updated_at);
+-- At most one queued or running job per unique key, e.g. one scan per file
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_unique_key_idx ON jobs (unique_key) WHERE status IN ('queued', 'running');
+
+-- Full-text search over names, tags and descriptions
+ALTER TABLE files ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS folder TEXT NOT NULL DEFAULT '/';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS search_vector TSVECTOR;
+
+-- Punctuation in names and tags separates words, so "q3_report.pdf" matches "report"
+CREATE OR REPLACE FUNCTION files_search_vector(name TEXT, tags TEXT[], description TEXT) RETURNS TSVECTOR AS $$
+    SELECT setweight(to_tsvector('simple', regexp_replace(name, '[^[:alnum:]]+', ' ', 'g')), 'A') ||
+           setweight(to_tsvector('simple', regexp_replace(array_to_string(tags, ' '), '[^[:alnum:]]+', ' ', 'g')), 'B') ||
+           setweight(to_tsvector('simple', description), 'C')
+$$ LANGUAGE SQL STABLE;
+
+CREATE OR REPLACE FUNCTION files_search_vector_update() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_vector := files_search_vector(NEW.name, NEW.tags, NEW.description);
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS files_search_vector_trigger ON files;
+CREATE TRIGGER files_search_vector_trigger BEFORE INSERT OR UPDATE OF name, tags, description ON files
+    FOR EACH ROW EXECUTE FUNCTION files_search_vector_update();
+
+UPDATE files SET search_vector = files_search_vector(name, tags, description) WHERE search_vector IS NULL;
+CREATE INDEX IF NOT EXISTS files_search_idx ON files USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS files_user_folder_idx ON files (user_id, folder);
+
+-- Paginated file listings, one index per sort order
+CREATE INDEX IF NOT EXISTS files_user_date_idx ON files (user_id, upload_date, id);
+CREATE INDEX IF NOT EXISTS files_user_name_idx ON files (user_id, name, id);
+CREATE INDEX IF NOT EXISTS files_user_size_idx ON files (user_id, size, id);
+CREATE INDEX IF NOT EXISTS files_user_lower_name_idx ON files (user_id, lower(name) text_pattern_ops);
+
+-- Tags, descriptions and custom metadata
+ALTER TABLE files ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS files_tags_idx ON files USING GIN (tags);
+CREATE INDEX IF NOT EXISTS files_metadata_idx ON files USING GIN (metadata jsonb_path_ops);
+
+-- Renames and moves: version is the file's ETag for optimistic concurrency
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS files_user_folder_name_idx ON files (user_id, folder, name);
+
+-- Sharing with users and groups: each entry grants a role on one file, or on
+-- a folder of the owner's files and everything below it
+CREATE TABLE IF NOT EXISTS acl_entries (
+    id         SERIAL PRIMARY KEY,
+    owner_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    file_id    INTEGER REFERENCES files(id) ON DELETE CASCADE,
+    folder     TEXT,
+    user_id    INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    group_name TEXT,
+    role       TEXT NOT NULL CHECK (role IN ('viewer', 'commenter', 'editor', 'owner')),
+    created_by INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK ((file_id IS NULL) <> (folder IS NULL)),
+    CHECK ((user_id IS NULL) <> (group_name IS NULL))
+);
+CREATE INDEX IF NOT EXISTS acl_entries_file_idx ON acl_entries (file_id);
+CREATE INDEX IF NOT EXISTS acl_entries_user_idx ON acl_entries (user_id);
+CREATE INDEX IF NOT EXISTS acl_entries_group_idx ON acl_entries (group_name);
+
+-- Organizations: shared workspaces whose files and quota belong to the
+-- organization rather than to the member who uploaded them
+CREATE TABLE IF NOT EXISTS organizations (
+    id          SERIAL PRIMARY KEY,
+    name        TEXT NOT NULL,
+    plan        TEXT NOT NULL DEFAULT 'team',
+    quota_bytes BIGINT,
+    bytes_used  BIGINT NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS org_members (
+    org_id    INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role      TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (org_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS org_members_user_idx ON org_members (user_id);
+
+-- Only a SHA-256 of each invitation token is stored
+CREATE TABLE IF NOT EXISTS org_invitations (
+    id          SERIAL PRIMARY KEY,
+    org_id      INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    email       TEXT NOT NULL,
+    role        TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    token_hash  TEXT NOT NULL UNIQUE,
+    invited_by  INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at  TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ
+);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS files_org_folder_name_idx ON files (org_id, folder, name) WHERE org_id IS NOT NULL;
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE;
+
+-- Folder permissions on an organization's folders belong to the organization
+-- instead of a user
+ALTER TABLE acl_entries ADD COLUMN IF NOT EXISTS org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE acl_entries ALTER COLUMN owner_id DROP NOT NULL;
+DROP INDEX IF EXISTS acl_entries_grantee_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS acl_entries_scope_grantee_idx ON acl_entries
+    (COALESCE(owner_id, 0), COALESCE(org_id, 0), COALESCE(file_id, 0), COALESCE(folder, ''), COALESCE(user_id, 0), COALESCE(group_name, ''));
+
+-- Server-side extraction of uploaded archives, tracked for the status endpoint
+CREATE TABLE IF NOT EXISTS extractions (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    org_id          INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    archive_id      INTEGER REFERENCES files(id) ON DELETE SET NULL,
+    archive_name    TEXT NOT NULL,
+    folder          TEXT NOT NULL DEFAULT '/',
+    status          TEXT NOT NULL DEFAULT 'queued',
+    files_extracted INTEGER NOT NULL DEFAULT 0,
+    files_skipped   INTEGER NOT NULL DEFAULT 0,
+    bytes_extracted BIGINT NOT NULL DEFAULT 0,
+    error           TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Personal API tokens for WebDAV and other clients; only a SHA-256 of each
+-- token is stored
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id           SERIAL PRIMARY KEY,
+    user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name         TEXT NOT NULL,
+    token_hash   TEXT NOT NULL UNIQUE,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ,
+    expires_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens (user_id);
+
+-- Folders created explicitly, e.g. over WebDAV, which exist before any file
+-- is put in them. Folders holding files need no row.
+CREATE TABLE IF NOT EXISTS folders (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    org_id     INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    path       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS folders_personal_path_idx ON folders (user_id, path) WHERE org_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS folders_org_path_idx ON folders (org_id, path) WHERE org_id IS NOT NULL;
+
+-- S3 gateway: every API token doubles as an S3 access key. SigV4 signs
+-- requests with the secret itself, so it is stored rather than hashed.
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS access_key_id TEXT UNIQUE;
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS secret_access_key TEXT;
+-- With encryption at rest, the secret is kept wrapped by the master key
+-- secret_key_id instead, and secret_access_key is NULL
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS secret_key_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS wrapped_secret BYTEA;
+
+CREATE TABLE IF NOT EXISTS s3_uploads (
+    id         TEXT PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    folder     TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS s3_upload_parts (
+    upload_id   TEXT NOT NULL REFERENCES s3_uploads(id) ON DELETE CASCADE,
+    part_number INTEGER NOT NULL,
+    size        BIGINT NOT NULL,
+    etag        TEXT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (upload_id, part_number)
+);
+
+-- SSH public keys users register for signing in to the SFTP server
+CREATE TABLE IF NOT EXISTS ssh_keys (
+    id           SERIAL PRIMARY KEY,
+    user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name         TEXT NOT NULL,
+    public_key   TEXT NOT NULL,
+    fingerprint  TEXT NOT NULL UNIQUE,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS ssh_keys_user_idx ON ssh_keys (user_id);
+
+-- Command-line client: folders for chunked uploads, and expiring public
+-- share links of which only a SHA-256 of each token is stored
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS folder TEXT NOT NULL DEFAULT '/';
+
+CREATE TABLE IF NOT EXISTS share_links (
+    id             SERIAL PRIMARY KEY,
+    file_id        INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    created_by     INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash     TEXT NOT NULL UNIQUE,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at     TIMESTAMPTZ NOT NULL,
+    download_count INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS share_links_file_idx ON share_links (file_id);
+
+-- Event log for sync clients and integrations: triggers append every file
+-- created, renamed, moved or deleted, every share link created or revoked
+-- and every permission granted, changed or revoked, in order. Each event
+-- is announced on the "events" channel, with the workspace it belongs to,
+-- for clients waiting on that workspace's feed.
+DROP TABLE IF EXISTS file_changes;
+
+CREATE TABLE IF NOT EXISTS events (
+    id         BIGSERIAL PRIMARY KEY,
+    type       TEXT NOT NULL,
+    user_id    INTEGER,
+    org_id     INTEGER,
+    file_id    INTEGER,
+    folder     TEXT NOT NULL,
+    name       TEXT,
+    old_folder TEXT,
+    old_name   TEXT,
+    size       BIGINT,
+    checksum   TEXT,
+    details    JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS events_user_idx ON events (user_id, id) WHERE org_id IS NULL;
+CREATE INDEX IF NOT EXISTS events_org_idx ON events (org_id, id) WHERE org_id IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION events_notify() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('events', json_build_object('id', NEW.id, 'user_id', NEW.user_id, 'org_id', NEW.org_id)::text);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+-- IDs are handed out in commit order: a transaction logging events holds
+-- a lock from its first event until it commits, and only then can another
+-- transaction take an ID. A reader that sees an event has therefore seen
+-- every event before it, so a cursor never moves past an event that was
+-- still being written. The ID taken by the column default is discarded.
+CREATE OR REPLACE FUNCTION events_order() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(1702258030);
+    NEW.id := nextval(pg_get_serial_sequence('events', 'id'));
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS events_order_trigger ON events;
+CREATE TRIGGER events_order_trigger BEFORE INSERT ON events
+    FOR EACH ROW EXECUTE FUNCTION events_order();
+
+DROP TRIGGER IF EXISTS events_notify_trigger ON events;
+CREATE TRIGGER events_notify_trigger AFTER INSERT ON events
+    FOR EACH ROW EXECUTE FUNCTION events_notify();
+
+CREATE OR REPLACE FUNCTION files_change_log() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO events (type, user_id, org_id, file_id, folder, name, size, checksum)
+        VALUES ('deleted', OLD.user_id, OLD.org_id, OLD.id, OLD.folder, OLD.name, OLD.size, OLD.checksum);
+        RETURN OLD;
+    END IF;
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO events (type, user_id, org_id, file_id, folder, name, size, checksum)
+        VALUES ('created', NEW.user_id, NEW.org_id, NEW.id, NEW.folder, NEW.name, NEW.size, NEW.checksum);
+    ELSIF NEW.name <> OLD.name OR NEW.folder <> OLD.folder THEN
+        INSERT INTO events (type, user_id, org_id, file_id, folder, name, old_folder, old_name, size, checksum)
+        VALUES (CASE WHEN NEW.folder = OLD.folder THEN 'renamed' ELSE 'moved' END, NEW.user_id, NEW.org_id, NEW.id,
+            NEW.folder, NEW.name, OLD.folder, OLD.name, NEW.size, NEW.checksum);
+    END IF;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS files_change_log_trigger ON files;
+CREATE TRIGGER files_change_log_trigger AFTER INSERT OR UPDATE OF name, folder OR DELETE ON files
+    FOR EACH ROW EXECUTE FUNCTION files_change_log();
+
+-- Links and permissions on a file are logged in its workspace under its
+-- path; links and permissions deleted along with their file are not logged
+CREATE OR REPLACE FUNCTION share_links_event_log() RETURNS TRIGGER AS $$
+DECLARE
+    link share_links;
+    file files;
+BEGIN
+    IF TG_OP = 'DELETE' THEN link := OLD; ELSE link := NEW; END IF;
+    SELECT * INTO file FROM files WHERE id = link.file_id;
+    IF FOUND THEN
+        INSERT INTO events (type, user_id, org_id, file_id, folder, name, details)
+        VALUES (CASE TG_OP WHEN 'INSERT' THEN 'link_created' ELSE 'link_revoked' END, file.user_id, file.org_id, file.id,
+            file.folder, file.name, jsonb_build_object('link_id', link.id, 'created_by', link.created_by, 'expires_at', link.expires_at));
+    END IF;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS share_links_event_log_trigger ON share_links;
+CREATE TRIGGER share_links_event_log_trigger AFTER INSERT OR DELETE ON share_links
+    FOR EACH ROW EXECUTE FUNCTION share_links_event_log();
+
+CREATE OR REPLACE FUNCTION acl_entries_event_log() RETURNS TRIGGER AS $$
+DECLARE
+    entry acl_entries;
+    file files;
+    event_type TEXT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        entry := OLD;
+        event_type := 'permission_revoked';
+    ELSIF TG_OP = 'INSERT' THEN
+        entry := NEW;
+        event_type := 'permission_granted';
+    ELSIF NEW.role <> OLD.role THEN
+        entry := NEW;
+        event_type := 'permission_changed';
+    ELSE
+        RETURN NULL;
+    END IF;
+
+    IF entry.file_id IS NOT NULL THEN
+        SELECT * INTO file FROM files WHERE id = entry.file_id;
+        IF NOT FOUND THEN
+            RETURN NULL;
+        END IF;
+    ELSE
+        file.user_id := entry.owner_id;
+        file.org_id := entry.org_id;
+        file.folder := entry.folder;
+    END IF;
+    INSERT INTO events (type, user_id, org_id, file_id, folder, name, details)
+    VALUES (event_type, file.user_id, file.org_id, entry.file_id, file.folder, file.name, jsonb_strip_nulls(jsonb_build_object(
+        'permission_id', entry.id, 'user_id', entry.user_id, 'group', entry.group_name, 'role', entry.role,
+        'old_role', CASE TG_OP WHEN 'UPDATE' THEN OLD.role END, 'created_by', entry.created_by)));
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS acl_entries_event_log_trigger ON acl_entries;
+CREATE TRIGGER acl_entries_event_log_trigger AFTER INSERT OR UPDATE OF role OR DELETE ON acl_entries
+    FOR EACH ROW EXECUTE FUNCTION acl_entries_event_log();
+
+-- Files from before the log start it off, once
+INSERT INTO events (type, user_id, org_id, file_id, folder, name, size, checksum, created_at)
+SELECT 'created', user_id, org_id, id, folder, name, size, checksum, upload_date FROM files
+WHERE NOT EXISTS (SELECT 1 FROM events) ORDER BY id;
+
+-- Outgoing webhooks: endpoints users subscribe to events in their files or
+-- an organization's files, each delivery of an event to an endpoint, and
+-- every attempt at it. The signing secret is stored, as signing needs it.
+CREATE TABLE IF NOT EXISTS webhooks (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    org_id     INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    url        TEXT NOT NULL,
+    secret     TEXT NOT NULL,
+    events     TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhooks_user_idx ON webhooks (user_id) WHERE org_id IS NULL;
+CREATE INDEX IF NOT EXISTS webhooks_org_idx ON webhooks (org_id) WHERE org_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id           BIGSERIAL PRIMARY KEY,
+    webhook_id   INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event        TEXT NOT NULL,
+    payload      JSONB NOT NULL,
+    status       TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_created_idx ON webhook_deliveries (created_at);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+    id           BIGSERIAL PRIMARY KEY,
+    delivery_id  BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+    attempted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    status_code  INTEGER,
+    error        TEXT,
+    duration_ms  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_idx ON webhook_attempts (delivery_id);
+
+-- Audit log of sign-ins, uploads, downloads, sharing and deletions. Each
+-- entry carries the SHA-256 of its content and of the entry before it, so
+-- altering or removing entries breaks the chain; rows cannot be updated or
+-- deleted.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id          BIGSERIAL PRIMARY KEY,
+    created_at  TIMESTAMPTZ NOT NULL,
+    actor_id    INTEGER,
+    actor_email TEXT NOT NULL DEFAULT '',
+    ip          TEXT NOT NULL DEFAULT '',
+    user_agent  TEXT NOT NULL DEFAULT '',
+    action      TEXT NOT NULL,
+    target_type TEXT NOT NULL DEFAULT '',
+    target_id   TEXT NOT NULL DEFAULT '',
+    outcome     TEXT NOT NULL CHECK (outcome IN ('success', 'failure', 'denied')),
+    details     JSONB NOT NULL DEFAULT '{}',
+    prev_hash   TEXT NOT NULL,
+    hash        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, id);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_created_idx ON audit_log (created_at);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only_trigger ON audit_log;
+CREATE TRIGGER audit_log_append_only_trigger BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
@@ -1,8 +1,11 @@
 package utils
 
 import (
-    "github.com/go-redis/redis/v8"
+    "context"
+    "log"
     "os"
+    "time"
+    "github.com/go-redis/redis/v8"
 )
 
 var redisClient *redis.Client
@@ -14,3 +17,41 @@ func ConnectRedis() *redis.Client {
     })
     return redisClient
 }
+
+// The cache is an optimisation only: without Redis, or when it fails, reads
+// miss and fall through to the database.
+
+// CacheGet returns the value cached under key, reporting false on a miss
+func CacheGet(key string) ([]byte, bool) {
+    if redisClient == nil {
+        return nil, false
+    }
+    value, err := redisClient.Get(context.Background(), key).Bytes()
+    if err != nil {
+        if err != redis.Nil {
+            log.Println("Error reading cache:", err)
+        }
+        return nil, false
+    }
+    return value, true
+}
+
+// CacheSet caches value under key for ttl
+func CacheSet(key string, value []byte, ttl time.Duration) {
+    if redisClient == nil {
+        return
+    }
+    if err := redisClient.Set(context.Background(), key, value, ttl).Err(); err != nil {
+        log.Println("Error writing cache:", err)
+    }
+}
+
+// CacheDelete evicts keys after the data they cache has changed
+func CacheDelete(keys ...string) {
+    if redisClient == nil || len(keys) == 0 {
+        return
+    }
+    if err := redisClient.Del(context.Background(), keys...).Err(); err != nil {
+        log.Println("Error invalidating cache:", err)
+    }
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strings"
+    "time"
+)
+
+// ClamAV talks to a clamd daemon over TCP or a UNIX socket
+type ClamAV struct {
+    Network string
+    Address string
+    Timeout time.Duration
+}
+
+// ScanResult is clamd's verdict for one stream
+type ScanResult struct {
+    Infected  bool
+    Signature string
+}
+
+// clamdChunkSize is the size of the chunks sent with INSTREAM; it must stay
+// below clamd's StreamMaxLength
+const clamdChunkSize = 64 << 10
+
+// NewClamAVFromEnv configures a client from CLAMD_ADDRESS, e.g.
+// "tcp://localhost:3310" or "unix:///var/run/clamav/clamd.ctl". It returns
+// nil when scanning is not configured.
+func NewClamAVFromEnv() *ClamAV {
+    address := os.Getenv("CLAMD_ADDRESS")
+    if address == "" {
+        return nil
+    }
+    timeout, err := time.ParseDuration(os.Getenv("CLAMD_TIMEOUT"))
+    if err != nil || timeout <= 0 {
+        timeout = 5 * time.Minute
+    }
+    if path, ok := strings.CutPrefix(address, "unix://"); ok {
+        return &ClamAV{Network: "unix", Address: path, Timeout: timeout}
+    }
+    return &ClamAV{Network: "tcp", Address: strings.TrimPrefix(address, "tcp://"), Timeout: timeout}
+}
+
+func (c *ClamAV) dial() (net.Conn, error) {
+    conn, err := net.DialTimeout(c.Network, c.Address, 10*time.Second)
+    if err != nil {
+        return nil, err
+    }
+    if c.Timeout > 0 {
+        conn.SetDeadline(time.Now().Add(c.Timeout))
+    }
+    return conn, nil
+}
+
+// Ping checks that clamd is reachable
+func (c *ClamAV) Ping() error {
+    conn, err := c.dial()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+        return err
+    }
+    reply, err := readClamdReply(conn)
+    if err != nil {
+        return err
+    }
+    if reply != "PONG" {
+        return fmt.Errorf("unexpected clamd reply %q", reply)
+    }
+    return nil
+}
+
+// Scan streams r to clamd with the INSTREAM command: each chunk is prefixed
+// with its length as a 4 byte big-endian integer and a zero length chunk
+// ends the stream.
+func (c *ClamAV) Scan(r io.Reader) (ScanResult, error) {
+    conn, err := c.dial()
+    if err != nil {
+        return ScanResult{}, err
+    }
+    defer conn.Close()
+
+    w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+    if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+        return ScanResult{}, err
+    }
+    buf := make([]byte, clamdChunkSize)
+    length := make([]byte, 4)
+    for {
+        n, readErr := r.Read(buf)
+        if n > 0 {
+            binary.BigEndian.PutUint32(length, uint32(n))
+            if _, err := w.Write(length); err != nil {
+                return ScanResult{}, err
+            }
+            if _, err := w.Write(buf[:n]); err != nil {
+                return ScanResult{}, err
+            }
+        }
+        if readErr == io.EOF {
+            break
+        }
+        if readErr != nil {
+            return ScanResult{}, readErr
+        }
+    }
+    binary.BigEndian.PutUint32(length, 0)
+    w.Write(length)
+    if err := w.Flush(); err != nil {
+        return ScanResult{}, err
+    }
+
+    reply, err := readClamdReply(conn)
+    if err != nil {
+        return ScanResult{}, err
+    }
+    return parseClamdReply(reply)
+}
+
+// readClamdReply reads one NUL terminated reply, as requested by the "z" command prefix
+func readClamdReply(conn net.Conn) (string, error) {
+    reply, err := bufio.NewReader(conn).ReadBytes(0)
+    if err != nil && !(err == io.EOF && len(reply) > 0) {
+        return "", err
+    }
+    return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+// parseClamdReply interprets replies such as "stream: OK" and
+// "stream: Win.Test.EICAR_HDB-1 FOUND"
+func parseClamdReply(reply string) (ScanResult, error) {
+    _, verdict, ok := strings.Cut(reply, ": ")
+    if !ok {
+        return ScanResult{}, fmt.Errorf("unexpected clamd reply %q", reply)
+    }
+    switch {
+    case verdict == "OK":
+        return ScanResult{}, nil
+    case strings.HasSuffix(verdict, " FOUND"):
+        return ScanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+    default:
+        return ScanResult{}, fmt.Errorf("clamd error: %s", verdict)
+    }
+}
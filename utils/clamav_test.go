@@ -0,0 +1,127 @@
+package utils
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd accepts connections on l and answers PING and INSTREAM like
+// clamd, reporting the EICAR test string as infected.
+func fakeClamd(t *testing.T, l net.Listener) {
+    t.Helper()
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                command, err := r.ReadString(0)
+                if err != nil {
+                    return
+                }
+                switch command {
+                case "zPING\x00":
+                    conn.Write([]byte("PONG\x00"))
+                case "zINSTREAM\x00":
+                    var data bytes.Buffer
+                    length := make([]byte, 4)
+                    for {
+                        if _, err := io.ReadFull(r, length); err != nil {
+                            return
+                        }
+                        size := binary.BigEndian.Uint32(length)
+                        if size == 0 {
+                            break
+                        }
+                        if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+                            return
+                        }
+                    }
+                    if strings.Contains(data.String(), eicar) {
+                        conn.Write([]byte("stream: Win.Test.EICAR_HDB-1 FOUND\x00"))
+                    } else {
+                        conn.Write([]byte("stream: OK\x00"))
+                    }
+                default:
+                    conn.Write([]byte("UNKNOWN COMMAND\x00"))
+                }
+            }(conn)
+        }
+    }()
+}
+
+// TestClamAVScanTCP tests clean and infected streams over TCP
+func TestClamAVScanTCP(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    fakeClamd(t, l)
+
+    t.Setenv("CLAMD_ADDRESS", "tcp://"+l.Addr().String())
+    clamav := NewClamAVFromEnv()
+
+    if err := clamav.Ping(); err != nil {
+        t.Errorf("Expected PONG, got %s", err)
+    }
+
+    // Larger than one chunk so the stream is split
+    clean := strings.Repeat("quarterly report ", 10000)
+    result, err := clamav.Scan(strings.NewReader(clean))
+    if err != nil {
+        t.Fatalf("Error scanning clean data: %s", err)
+    }
+    if result.Infected {
+        t.Errorf("Expected clean data to pass")
+    }
+
+    result, err = clamav.Scan(strings.NewReader(eicar))
+    if err != nil {
+        t.Fatalf("Error scanning infected data: %s", err)
+    }
+    if !result.Infected || result.Signature != "Win.Test.EICAR_HDB-1" {
+        t.Errorf("Expected EICAR detection, got %+v", result)
+    }
+}
+
+// TestClamAVScanUnix tests scanning over a UNIX socket
+func TestClamAVScanUnix(t *testing.T) {
+    socket := filepath.Join(t.TempDir(), "clamd.sock")
+    l, err := net.Listen("unix", socket)
+    if err != nil {
+        t.Skip("UNIX sockets not available:", err)
+    }
+    defer l.Close()
+    fakeClamd(t, l)
+
+    t.Setenv("CLAMD_ADDRESS", "unix://"+socket)
+    result, err := NewClamAVFromEnv().Scan(strings.NewReader(eicar))
+    if err != nil {
+        t.Fatalf("Error scanning over UNIX socket: %s", err)
+    }
+    if !result.Infected {
+        t.Errorf("Expected EICAR detection over UNIX socket")
+    }
+}
+
+// TestParseClamdReply tests error replies from clamd
+func TestParseClamdReply(t *testing.T) {
+    if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+        t.Errorf("Expected error for malformed reply")
+    }
+    if _, err := parseClamdReply("stream: Can't allocate memory ERROR"); err == nil {
+        t.Errorf("Expected error for clamd error reply")
+    }
+}
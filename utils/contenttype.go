@@ -0,0 +1,116 @@
+package utils
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net/http"
+    "path/filepath"
+    "strings"
+)
+
+// SniffLen is the number of leading bytes DetectContentType looks at
+const SniffLen = 512
+
+// extensionTypes refines types that cannot be told apart from content alone
+var extensionTypes = map[string]string{
+    ".csv":  "text/csv",
+    ".md":   "text/markdown",
+    ".json": "application/json",
+    ".xml":  "application/xml",
+    ".yaml": "application/yaml",
+    ".yml":  "application/yaml",
+    ".js":   "text/javascript",
+    ".css":  "text/css",
+    ".svg":  "image/svg+xml",
+    ".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+    ".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+    ".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+    ".odt":  "application/vnd.oasis.opendocument.text",
+    ".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+    ".jar":  "application/java-archive",
+    ".apk":  "application/vnd.android.package-archive",
+    ".epub": "application/epub+zip",
+    ".doc":  "application/msword",
+    ".xls":  "application/vnd.ms-excel",
+    ".ppt":  "application/vnd.ms-powerpoint",
+    ".exe":  "application/x-msdownload",
+    ".dll":  "application/x-msdownload",
+    ".msi":  "application/x-msi",
+    ".sh":   "application/x-sh",
+    ".bat":  "application/x-bat",
+    ".ps1":  "application/x-powershell",
+}
+
+// executableMagic covers binaries that http.DetectContentType reports as
+// octet-stream. Magic that is too short to be telling on its own comes
+// with a check of the rest of the header.
+var executableMagic = []struct {
+    magic       []byte
+    contentType string
+    check       func(head []byte) bool
+}{
+    {[]byte("MZ"), "application/x-msdownload", isPE},
+    {[]byte("\x7fELF"), "application/x-executable", nil},
+    {[]byte("\xfe\xed\xfa\xce"), "application/x-mach-binary", nil},
+    {[]byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary", nil},
+    {[]byte("\xce\xfa\xed\xfe"), "application/x-mach-binary", nil},
+    {[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary", nil},
+    {[]byte("#!"), "application/x-sh", nil},
+}
+
+// DetectContentType determines a file's media type from its first bytes,
+// falling back to the filename extension only where the content is
+// ambiguous, so a renamed executable is still reported as one.
+func DetectContentType(head []byte, filename string) string {
+    for _, m := range executableMagic {
+        if bytes.HasPrefix(head, m.magic) && (m.check == nil || m.check(head)) {
+            return m.contentType
+        }
+    }
+
+    sniffed := http.DetectContentType(head)
+    mediaType := strings.TrimSpace(strings.Split(sniffed, ";")[0])
+    byExtension, known := extensionTypes[strings.ToLower(filepath.Ext(filename))]
+    if !known {
+        return sniffed
+    }
+
+    switch mediaType {
+    case "application/octet-stream", "text/plain", "text/xml":
+        // Plain text and unknown binaries can be anything the extension says,
+        // except that text must not be relabelled as a binary format
+        if mediaType == "text/plain" && !strings.HasPrefix(byExtension, "text/") && !isTextual(byExtension) {
+            return sniffed
+        }
+        return byExtension
+    case "application/zip":
+        // Office documents, jars and epubs are zip containers
+        if strings.Contains(byExtension, "openxmlformats") || strings.Contains(byExtension, "opendocument") || strings.HasSuffix(byExtension, "+zip") || byExtension == "application/java-archive" || byExtension == "application/vnd.android.package-archive" {
+            return byExtension
+        }
+    }
+    return sniffed
+}
+
+// isPE reports whether an MZ header may lead to a Portable Executable
+// header: e_lfanew, at offset 0x3c, points at the "PE\0\0" signature. A
+// signature beyond the sniffed head cannot be ruled out, so only one seen
+// to be missing clears the file.
+func isPE(head []byte) bool {
+    if len(head) < 0x40 {
+        return false
+    }
+    offset := int64(binary.LittleEndian.Uint32(head[0x3c:]))
+    if offset+4 > int64(len(head)) {
+        return len(head) >= SniffLen
+    }
+    return bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+func isTextual(contentType string) bool {
+    switch contentType {
+    case "application/json", "application/xml", "application/yaml", "image/svg+xml", "application/x-sh", "application/x-bat", "application/x-powershell":
+        return true
+    }
+    return false
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+    "encoding/binary"
+    "testing"
+)
+
+// peHead is the sniffed start of a Portable Executable: an MZ header whose
+// e_lfanew points at the PE signature, which lies beyond the head when the
+// offset is far
+func peHead(offset uint32) []byte {
+    head := make([]byte, SniffLen)
+    copy(head, "MZ\x90\x00\x03")
+    binary.LittleEndian.PutUint32(head[0x3c:], offset)
+    if int(offset)+4 <= len(head) {
+        copy(head[offset:], "PE\x00\x00")
+    }
+    return head
+}
+
+// mzHead is a sniffed head starting with MZ whose e_lfanew points at
+// something other than a PE signature
+func mzHead() []byte {
+    head := peHead(0x80)
+    copy(head[0x80:], "data")
+    return head
+}
+
+// TestDetectContentType tests sniffing with the extension table as a fallback
+func TestDetectContentType(t *testing.T) {
+    cases := []struct {
+        name     string
+        head     []byte
+        filename string
+        expected string
+    }{
+        {"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "photo.png", "image/png"},
+        {"renamed executable", peHead(0x80), "invoice.txt", "application/x-msdownload"},
+        {"executable with a far PE header", peHead(0x400), "invoice.txt", "application/x-msdownload"},
+        {"MZ with another signature", mzHead(), "data.bin", "application/octet-stream"},
+        {"text starting with MZ", []byte("MZ is the postcode area of ...\n"), "notes.txt", "text/plain; charset=utf-8"},
+        {"MZ without a PE header", []byte("MZ\x90\x00\x03\x00\x00\x00"), "data.bin", "application/octet-stream"},
+        {"elf binary", []byte("\x7fELF\x02\x01\x01"), "tool", "application/x-executable"},
+        {"shell script", []byte("#!/bin/sh\necho hi\n"), "run.txt", "application/x-sh"},
+        {"docx container", []byte("PK\x03\x04\x14\x00\x06\x00"), "report.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+        {"plain zip", []byte("PK\x03\x04\x14\x00\x06\x00"), "archive.zip", "application/zip"},
+        {"csv", []byte("name,size\nreport,12\n"), "data.csv", "text/csv"},
+        {"text posing as docx", []byte("just some text"), "notes.docx", "text/plain; charset=utf-8"},
+        {"pdf with wrong extension", []byte("%PDF-1.7\n"), "image.png", "application/pdf"},
+    }
+    for _, c := range cases {
+        if contentType := DetectContentType(c.head, c.filename); contentType != c.expected {
+            t.Errorf("%s: expected %q, got %q", c.name, c.expected, contentType)
+        }
+    }
+}
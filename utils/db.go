@@ -8,10 +8,15 @@ import (
 )
 
 func ConnectDB() *pgxpool.Pool {
-    dbURL := os.Getenv("DATABASE_URL")
-    conn, err := pgxpool.Connect(context.Background(), dbURL)
+    conn, err := OpenDB()
     if err != nil {
         log.Fatal("Unable to connect to database:", err)
     }
     return conn
 }
+
+// OpenDB connects to the database like ConnectDB, but returns the error
+// for callers that can recover from it
+func OpenDB() (*pgxpool.Pool, error) {
+    return pgxpool.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+}
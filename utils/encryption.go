@@ -0,0 +1,307 @@
+package utils
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sync"
+)
+
+// Files are encrypted with a random per-file data key using AES-256-GCM in
+// independent chunks of EncryptionChunkSize plaintext bytes, so any byte range
+// can be decrypted by fetching only the chunks that cover it. Chunk i is
+// sealed with the nonce i||last, where last marks the final chunk, which
+// stops chunks from being reordered or the object from being truncated.
+// The data key itself is stored wrapped by a master key from a KeyProvider.
+
+const (
+    EncryptionChunkSize = 64 << 10
+    sealedChunkSize     = EncryptionChunkSize + 16
+)
+
+// KeyProvider wraps and unwraps data keys with master keys identified by ID.
+// It is the seam for plugging in a KMS instead of the local keyfile.
+type KeyProvider interface {
+    // ActiveKeyID names the master key used to wrap new data keys
+    ActiveKeyID() string
+    WrapKey(keyID string, dataKey []byte) ([]byte, error)
+    UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyProvider holds master keys loaded from a JSON keyfile of the form
+// {"active": "2026-01", "keys": {"2025-07": "<base64>", "2026-01": "<base64>"}}.
+// Retired keys stay in the file until every data key has been rewrapped.
+type LocalKeyProvider struct {
+    active string
+    keys   map[string][]byte
+}
+
+func LoadKeyFile(path string) (*LocalKeyProvider, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var keyfile struct {
+        Active string            `json:"active"`
+        Keys   map[string]string `json:"keys"`
+    }
+    if err := json.Unmarshal(data, &keyfile); err != nil {
+        return nil, fmt.Errorf("invalid keyfile: %w", err)
+    }
+
+    provider := &LocalKeyProvider{active: keyfile.Active, keys: make(map[string][]byte)}
+    for id, encoded := range keyfile.Keys {
+        key, err := base64.StdEncoding.DecodeString(encoded)
+        if err != nil || len(key) != 32 {
+            return nil, fmt.Errorf("master key %q must be 32 bytes of base64", id)
+        }
+        provider.keys[id] = key
+    }
+    if _, ok := provider.keys[provider.active]; !ok {
+        return nil, fmt.Errorf("active master key %q not found in keyfile", provider.active)
+    }
+    return provider, nil
+}
+
+func (p *LocalKeyProvider) ActiveKeyID() string {
+    return p.active
+}
+
+func (p *LocalKeyProvider) aead(keyID string) (cipher.AEAD, error) {
+    key, ok := p.keys[keyID]
+    if !ok {
+        return nil, fmt.Errorf("unknown master key %q", keyID)
+    }
+    return newGCM(key)
+}
+
+// WrapKey seals a data key as nonce||ciphertext, bound to the master key ID
+func (p *LocalKeyProvider) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+    aead, err := p.aead(keyID)
+    if err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    return aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+    aead, err := p.aead(keyID)
+    if err != nil {
+        return nil, err
+    }
+    if len(wrapped) < aead.NonceSize() {
+        return nil, errors.New("wrapped key too short")
+    }
+    return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+var (
+    keyProvider     KeyProvider
+    keyProviderOnce sync.Once
+)
+
+// GetKeyProvider returns the master key provider configured with
+// ENCRYPTION_KEYFILE, or nil when encryption at rest is disabled.
+func GetKeyProvider() KeyProvider {
+    keyProviderOnce.Do(func() {
+        path := os.Getenv("ENCRYPTION_KEYFILE")
+        if path == "" {
+            return
+        }
+        provider, err := LoadKeyFile(path)
+        if err != nil {
+            log.Fatal("Unable to load encryption keyfile:", err)
+        }
+        keyProvider = provider
+    })
+    return keyProvider
+}
+
+// NewDataKey generates a random AES-256 data key and wraps it with the active master key
+func NewDataKey(provider KeyProvider) (dataKey []byte, keyID string, wrapped []byte, err error) {
+    dataKey = make([]byte, 32)
+    if _, err := rand.Read(dataKey); err != nil {
+        return nil, "", nil, err
+    }
+    keyID = provider.ActiveKeyID()
+    wrapped, err = provider.WrapKey(keyID, dataKey)
+    return dataKey, keyID, wrapped, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+func chunkNonce(index int64, last bool) []byte {
+    nonce := make([]byte, 12)
+    binary.BigEndian.PutUint64(nonce, uint64(index))
+    if last {
+        nonce[8] = 1
+    }
+    return nonce
+}
+
+func chunkCount(size int64) int64 {
+    if size == 0 {
+        return 1
+    }
+    return (size + EncryptionChunkSize - 1) / EncryptionChunkSize
+}
+
+// EncryptedSize returns the stored size of a plaintext of size bytes
+func EncryptedSize(size int64) int64 {
+    return size + chunkCount(size)*(sealedChunkSize-EncryptionChunkSize)
+}
+
+// EncryptStream returns a reader producing the chunked ciphertext of r
+func EncryptStream(r io.Reader, dataKey []byte) (io.Reader, error) {
+    aead, err := newGCM(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    return &encryptReader{
+        src:   bufio.NewReaderSize(r, EncryptionChunkSize),
+        aead:  aead,
+        plain: make([]byte, EncryptionChunkSize),
+    }, nil
+}
+
+type encryptReader struct {
+    src    *bufio.Reader
+    aead   cipher.AEAD
+    plain  []byte
+    sealed []byte
+    out    []byte
+    index  int64
+    done   bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+    for len(e.out) == 0 {
+        if e.done {
+            return 0, io.EOF
+        }
+        n, err := io.ReadFull(e.src, e.plain)
+        last := err == io.EOF || err == io.ErrUnexpectedEOF
+        if err != nil && !last {
+            return 0, err
+        }
+        if !last {
+            // A full chunk is the last one only if nothing follows it
+            if _, err := e.src.Peek(1); err == io.EOF {
+                last = true
+            } else if err != nil {
+                return 0, err
+            }
+        }
+        e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.index, last), e.plain[:n], nil)
+        e.out = e.sealed
+        e.index++
+        e.done = last
+    }
+    n := copy(p, e.out)
+    e.out = e.out[n:]
+    return n, nil
+}
+
+// DecryptRange returns length plaintext bytes starting at offset of an
+// object encrypted with EncryptStream, where size is the plaintext size.
+// open is called once with the ciphertext range covering those bytes.
+func DecryptRange(open func(offset, length int64) (io.ReadCloser, error), dataKey []byte, size, offset, length int64) (io.ReadCloser, error) {
+    if offset < 0 || length < 0 || offset+length > size {
+        return nil, fmt.Errorf("range %d+%d outside of %d bytes", offset, length, size)
+    }
+    if length == 0 {
+        return io.NopCloser(bytes.NewReader(nil)), nil
+    }
+    aead, err := newGCM(dataKey)
+    if err != nil {
+        return nil, err
+    }
+
+    first := offset / EncryptionChunkSize
+    last := (offset + length - 1) / EncryptionChunkSize
+    cipherStart := first * sealedChunkSize
+    cipherEnd := (last + 1) * sealedChunkSize
+    if total := EncryptedSize(size); cipherEnd > total {
+        cipherEnd = total
+    }
+    src, err := open(cipherStart, cipherEnd-cipherStart)
+    if err != nil {
+        return nil, err
+    }
+
+    return &decryptReader{
+        src:       src,
+        aead:      aead,
+        sealed:    make([]byte, sealedChunkSize),
+        index:     first,
+        lastIndex: chunkCount(size) - 1,
+        skip:      offset - first*EncryptionChunkSize,
+        remaining: length,
+    }, nil
+}
+
+type decryptReader struct {
+    src       io.ReadCloser
+    aead      cipher.AEAD
+    sealed    []byte
+    plain     []byte
+    out       []byte
+    index     int64
+    lastIndex int64
+    skip      int64
+    remaining int64
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+    for len(d.out) == 0 {
+        if d.remaining == 0 {
+            return 0, io.EOF
+        }
+        n, err := io.ReadFull(d.src, d.sealed)
+        if err != nil && err != io.ErrUnexpectedEOF {
+            if err == io.EOF {
+                return 0, io.ErrUnexpectedEOF
+            }
+            return 0, err
+        }
+        d.plain, err = d.aead.Open(d.plain[:0], chunkNonce(d.index, d.index == d.lastIndex), d.sealed[:n], nil)
+        if err != nil {
+            return 0, fmt.Errorf("decrypting chunk %d: %w", d.index, err)
+        }
+        d.index++
+
+        d.out = d.plain[d.skip:]
+        d.skip = 0
+        if int64(len(d.out)) > d.remaining {
+            d.out = d.out[:d.remaining]
+        }
+        d.remaining -= int64(len(d.out))
+    }
+    n := copy(p, d.out)
+    d.out = d.out[n:]
+    return n, nil
+}
+
+func (d *decryptReader) Close() error {
+    return d.src.Close()
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func encrypt(t *testing.T, plaintext, dataKey []byte) []byte {
+    t.Helper()
+    stream, err := EncryptStream(bytes.NewReader(plaintext), dataKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ciphertext, err := io.ReadAll(stream)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return ciphertext
+}
+
+func decryptRange(ciphertext, dataKey []byte, size, offset, length int64) ([]byte, error) {
+    reader, err := DecryptRange(func(offset, length int64) (io.ReadCloser, error) {
+        return io.NopCloser(bytes.NewReader(ciphertext[offset : offset+length])), nil
+    }, dataKey, size, offset, length)
+    if err != nil {
+        return nil, err
+    }
+    defer reader.Close()
+    return io.ReadAll(reader)
+}
+
+// TestEncryptRoundTrip tests whole-file encryption for sizes around chunk boundaries
+func TestEncryptRoundTrip(t *testing.T) {
+    dataKey := make([]byte, 32)
+    rand.Read(dataKey)
+
+    for _, size := range []int{0, 1, EncryptionChunkSize - 1, EncryptionChunkSize, EncryptionChunkSize + 1, 3*EncryptionChunkSize + 5} {
+        plaintext := make([]byte, size)
+        rand.Read(plaintext)
+
+        ciphertext := encrypt(t, plaintext, dataKey)
+        if int64(len(ciphertext)) != EncryptedSize(int64(size)) {
+            t.Errorf("Size %d: expected %d ciphertext bytes, got %d", size, EncryptedSize(int64(size)), len(ciphertext))
+        }
+        decrypted, err := decryptRange(ciphertext, dataKey, int64(size), 0, int64(size))
+        if err != nil {
+            t.Fatalf("Size %d: error decrypting: %s", size, err)
+        }
+        if !bytes.Equal(decrypted, plaintext) {
+            t.Errorf("Size %d: decrypted content differs", size)
+        }
+    }
+}
+
+// TestDecryptRange tests decrypting ranges that start and end inside chunks
+func TestDecryptRange(t *testing.T) {
+    dataKey := make([]byte, 32)
+    rand.Read(dataKey)
+    plaintext := make([]byte, 3*EncryptionChunkSize+100)
+    rand.Read(plaintext)
+    ciphertext := encrypt(t, plaintext, dataKey)
+    size := int64(len(plaintext))
+
+    ranges := [][2]int64{
+        {0, 10},
+        {EncryptionChunkSize - 5, 10},
+        {EncryptionChunkSize + 3, 2 * EncryptionChunkSize},
+        {size - 1, 1},
+        {size - 150, 150},
+    }
+    for _, rng := range ranges {
+        decrypted, err := decryptRange(ciphertext, dataKey, size, rng[0], rng[1])
+        if err != nil {
+            t.Fatalf("Range %v: error decrypting: %s", rng, err)
+        }
+        if !bytes.Equal(decrypted, plaintext[rng[0]:rng[0]+rng[1]]) {
+            t.Errorf("Range %v: decrypted content differs", rng)
+        }
+    }
+}
+
+// TestDecryptDetectsTampering tests that modified or truncated ciphertext is rejected
+func TestDecryptDetectsTampering(t *testing.T) {
+    dataKey := make([]byte, 32)
+    rand.Read(dataKey)
+    plaintext := bytes.Repeat([]byte("x"), 2*EncryptionChunkSize)
+    ciphertext := encrypt(t, plaintext, dataKey)
+
+    tampered := append([]byte{}, ciphertext...)
+    tampered[10] ^= 1
+    if _, err := decryptRange(tampered, dataKey, int64(len(plaintext)), 0, int64(len(plaintext))); err == nil {
+        t.Errorf("Expected error for modified ciphertext")
+    }
+
+    // Dropping the final chunk must not pass as a shorter file
+    truncated := ciphertext[:sealedChunkSize]
+    if _, err := decryptRange(truncated, dataKey, EncryptionChunkSize, 0, EncryptionChunkSize); err == nil {
+        t.Errorf("Expected error for truncated ciphertext")
+    }
+}
+
+// TestLocalKeyProvider tests wrapping data keys and rotating the active master key
+func TestLocalKeyProvider(t *testing.T) {
+    oldKey, newKey := make([]byte, 32), make([]byte, 32)
+    rand.Read(oldKey)
+    rand.Read(newKey)
+    path := filepath.Join(t.TempDir(), "keys.json")
+    keyfile := fmt.Sprintf(`{"active":"2026-01","keys":{"2025-07":%q,"2026-01":%q}}`,
+        base64.StdEncoding.EncodeToString(oldKey), base64.StdEncoding.EncodeToString(newKey))
+    if err := os.WriteFile(path, []byte(keyfile), 0o600); err != nil {
+        t.Fatal(err)
+    }
+
+    provider, err := LoadKeyFile(path)
+    if err != nil {
+        t.Fatalf("Error loading keyfile: %s", err)
+    }
+    dataKey, keyID, wrapped, err := NewDataKey(provider)
+    if err != nil {
+        t.Fatalf("Error creating data key: %s", err)
+    }
+    if keyID != "2026-01" {
+        t.Errorf("Expected active key ID, got %q", keyID)
+    }
+
+    unwrapped, err := provider.UnwrapKey(keyID, wrapped)
+    if err != nil || !bytes.Equal(unwrapped, dataKey) {
+        t.Errorf("Expected to unwrap the data key, got error %v", err)
+    }
+    if _, err := provider.UnwrapKey("2025-07", wrapped); err == nil {
+        t.Errorf("Expected error unwrapping with the wrong master key")
+    }
+
+    // Keys wrapped under a retired master key can still be unwrapped and rewrapped
+    retired, _ := provider.WrapKey("2025-07", dataKey)
+    unwrapped, err = provider.UnwrapKey("2025-07", retired)
+    if err != nil || !bytes.Equal(unwrapped, dataKey) {
+        t.Errorf("Expected to unwrap with the retired master key, got error %v", err)
+    }
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/smtp"
+    "os"
+    "strings"
+)
+
+var errHeaderInjection = errors.New("email address or subject contains a line break")
+
+// SendMail sends a plain text email through the SMTP server at SMTP_ADDR
+// (host:port) from SMTP_FROM, authenticating with SMTP_USERNAME and
+// SMTP_PASSWORD when they are set. Without SMTP_ADDR the message is logged
+// instead, which is enough for development.
+func SendMail(to, subject, body string) error {
+    if strings.ContainsAny(to+subject, "\r\n") {
+        return errHeaderInjection
+    }
+
+    addr := os.Getenv("SMTP_ADDR")
+    if addr == "" {
+        log.Printf("SMTP_ADDR is not set, not sending email to %s: %s\n%s", to, subject, body)
+        return nil
+    }
+    from := os.Getenv("SMTP_FROM")
+
+    var auth smtp.Auth
+    if username := os.Getenv("SMTP_USERNAME"); username != "" {
+        host, _, _ := net.SplitHostPort(addr)
+        auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+    }
+
+    message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+        from, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+    return smtp.SendMail(addr, auth, from, []string{to}, []byte(message))
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+    "testing"
+)
+
+// TestSendMailRejectsHeaderInjection tests that addresses and subjects cannot add headers
+func TestSendMailRejectsHeaderInjection(t *testing.T) {
+    t.Setenv("SMTP_ADDR", "")
+    if err := SendMail("bob@example.com\r\nBcc: eve@example.com", "Hello", "Body"); err != errHeaderInjection {
+        t.Errorf("Expected errHeaderInjection for the address, got %v", err)
+    }
+    if err := SendMail("bob@example.com", "Hello\nBcc: eve@example.com", "Body"); err != errHeaderInjection {
+        t.Errorf("Expected errHeaderInjection for the subject, got %v", err)
+    }
+    if err := SendMail("bob@example.com", "Hello", "Line one\nLine two"); err != nil {
+        t.Errorf("Unexpected error logging an email: %s", err)
+    }
+}
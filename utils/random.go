@@ -0,0 +1,15 @@
+package utils
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+)
+
+// RandomID returns a random hex string built from n bytes of crypto/rand output
+func RandomID(n int) string {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(b)
+}
@@ -1,41 +1,106 @@
 package utils
 
 import (
-    "bytes"
     "fmt"
     "io"
     "log"
+    "os"
+    "strings"
     "github.com/aws/aws-sdk-go/aws"
     "github.com/aws/aws-sdk-go/aws/session"
     "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-func UploadToS3(file io.Reader, filename string) (string, error) {
-    // Convert io.Reader to io.ReadSeeker using a buffer
-    buf := new(bytes.Buffer)
-    if _, err := io.Copy(buf, file); err != nil {
-        return "", err
+func s3Bucket() string {
+    if bucket := os.Getenv("AWS_S3_BUCKET"); bucket != "" {
+        return bucket
     }
-    fileReadSeeker := bytes.NewReader(buf.Bytes())
+    return "your-s3-bucket-name"
+}
 
+// s3ACL is the canned ACL applied to new objects. It defaults to private,
+// so files are only served through the API; deployments that link to
+// objects directly can set AWS_S3_ACL=public-read, which encryption at rest
+// makes useless.
+func s3ACL() string {
+    if acl := os.Getenv("AWS_S3_ACL"); acl != "" {
+        return acl
+    }
+    return "private"
+}
+
+func newS3Client() *s3.S3 {
+    region := os.Getenv("AWS_REGION")
+    if region == "" {
+        region = "us-east-1"
+    }
     s3session := session.Must(session.NewSession(&aws.Config{
-        Region: aws.String("us-east-1"),
+        Region: aws.String(region),
     }))
-    s3svc := s3.New(s3session)
+    return s3.New(s3session)
+}
 
-    bucket := "your-s3-bucket-name"
-    key := fmt.Sprintf("uploads/%s", filename)
+// S3Storage stores objects in an S3 bucket
+type S3Storage struct {
+    Bucket string
+    ACL    string
+}
 
-    _, err := s3svc.PutObject(&s3.PutObjectInput{
-        Body:   fileReadSeeker,
-        Bucket: aws.String(bucket),
+// Put streams the object to S3, switching to a multipart upload for large files
+func (s *S3Storage) Put(key string, file io.Reader) (string, error) {
+    uploader := s3manager.NewUploaderWithClient(newS3Client(), func(u *s3manager.Uploader) {
+        u.PartSize = 16 << 20
+    })
+    _, err := uploader.Upload(&s3manager.UploadInput{
+        Body:   file,
+        Bucket: aws.String(s.Bucket),
         Key:    aws.String(key),
-        ACL:    aws.String("public-read"),
+        ACL:    aws.String(s.ACL),
     })
     if err != nil {
         log.Println("Error uploading to S3:", err)
         return "", err
     }
 
-    return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucket, key), nil
+    return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.Bucket, key), nil
+}
+
+func (s *S3Storage) Open(key string) (io.ReadCloser, error) {
+    out, err := newS3Client().GetObject(&s3.GetObjectInput{
+        Bucket: aws.String(s.Bucket),
+        Key:    aws.String(key),
+    })
+    if err != nil {
+        log.Println("Error downloading from S3:", err)
+        return nil, err
+    }
+    return out.Body, nil
+}
+
+func (s *S3Storage) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+    if length == 0 {
+        return io.NopCloser(strings.NewReader("")), nil
+    }
+    out, err := newS3Client().GetObject(&s3.GetObjectInput{
+        Bucket: aws.String(s.Bucket),
+        Key:    aws.String(key),
+        Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+    })
+    if err != nil {
+        log.Println("Error downloading from S3:", err)
+        return nil, err
+    }
+    return out.Body, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+    _, err := newS3Client().DeleteObject(&s3.DeleteObjectInput{
+        Bucket: aws.String(s.Bucket),
+        Key:    aws.String(key),
+    })
+    if err != nil {
+        log.Println("Error deleting from S3:", err)
+    }
+    return err
 }
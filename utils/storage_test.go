@@ -0,0 +1,55 @@
+package utils
+
+import (
+    "io"
+    "os"
+    "strings"
+    "testing"
+)
+
+// TestLocalStorage tests storing, reading and deleting objects on disk
+func TestLocalStorage(t *testing.T) {
+    store := &LocalStorage{Dir: t.TempDir()}
+
+    if _, err := store.Put("uploads/1/report.txt", strings.NewReader("quarterly numbers")); err != nil {
+        t.Fatalf("Error storing object: %s", err)
+    }
+
+    reader, err := store.Open("uploads/1/report.txt")
+    if err != nil {
+        t.Fatalf("Error opening object: %s", err)
+    }
+    content, _ := io.ReadAll(reader)
+    reader.Close()
+    if string(content) != "quarterly numbers" {
+        t.Errorf("Expected stored content, got %q", content)
+    }
+
+    if err := store.Delete("uploads/1/report.txt"); err != nil {
+        t.Errorf("Error deleting object: %s", err)
+    }
+    if _, err := store.Open("uploads/1/report.txt"); !os.IsNotExist(err) {
+        t.Errorf("Expected object to be gone, got %v", err)
+    }
+}
+
+// TestLocalStorageRejectsTraversal tests that keys cannot escape the storage directory
+func TestLocalStorageRejectsTraversal(t *testing.T) {
+    store := &LocalStorage{Dir: t.TempDir()}
+
+    if _, err := store.Put("../outside.txt", strings.NewReader("x")); err == nil {
+        t.Errorf("Expected error for key outside the storage directory")
+    }
+}
+
+// TestS3ACL tests that objects are private unless configured otherwise
+func TestS3ACL(t *testing.T) {
+    t.Setenv("AWS_S3_ACL", "")
+    if acl := s3ACL(); acl != "private" {
+        t.Errorf("Expected private objects by default, got %q", acl)
+    }
+    t.Setenv("AWS_S3_ACL", "public-read")
+    if acl := s3ACL(); acl != "public-read" {
+        t.Errorf("Expected the configured ACL, got %q", acl)
+    }
+}
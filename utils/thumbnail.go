@@ -0,0 +1,93 @@
+package utils
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    _ "image/gif"
+    "image/jpeg"
+    _ "image/png"
+    "io"
+    "golang.org/x/image/draw"
+    _ "golang.org/x/image/webp"
+)
+
+// ThumbnailSizes are the bounding boxes, in pixels, thumbnails are generated for
+var ThumbnailSizes = []int{128, 256, 512}
+
+const DefaultThumbnailSize = 256
+
+// maxThumbnailPixels refuses to decode images whose dimensions would take
+// an excessive amount of memory, such as decompression bombs
+const maxThumbnailPixels = 50_000_000
+
+var errImageTooLarge = errors.New("image dimensions too large to thumbnail")
+
+var thumbnailTypes = map[string]bool{
+    "image/jpeg": true,
+    "image/png":  true,
+    "image/gif":  true,
+    "image/webp": true,
+}
+
+// CanThumbnail reports whether thumbnails can be generated for a content type
+func CanThumbnail(contentType string) bool {
+    return thumbnailTypes[contentType]
+}
+
+// ValidThumbnailSize reports whether size is one of ThumbnailSizes
+func ValidThumbnailSize(size int) bool {
+    for _, s := range ThumbnailSizes {
+        if s == size {
+            return true
+        }
+    }
+    return false
+}
+
+// ThumbnailKey returns the storage key of a thumbnail derived from the object under storageKey
+func ThumbnailKey(storageKey string, size int) string {
+    return fmt.Sprintf("thumbnails/%s/%d.jpg", storageKey, size)
+}
+
+// DecodeImage decodes a JPEG, PNG, GIF (first frame) or WebP image after
+// checking from its header that it is not unreasonably large.
+func DecodeImage(r io.Reader) (image.Image, error) {
+    // Keep the bytes DecodeConfig consumes so they can be replayed to Decode
+    var header bytes.Buffer
+    config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+    if err != nil {
+        return nil, err
+    }
+    if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+        return nil, errImageTooLarge
+    }
+    img, _, err := image.Decode(io.MultiReader(&header, r))
+    return img, err
+}
+
+// Thumbnail scales img to fit within a size x size box, keeping its aspect
+// ratio and never enlarging it. Transparent areas are flattened onto white.
+func Thumbnail(img image.Image, size int) image.Image {
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    if width > size || height > size {
+        if width >= height {
+            width, height = size, max(1, height*size/width)
+        } else {
+            width, height = max(1, width*size/height), size
+        }
+    }
+
+    thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+    draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+    draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+    return thumb
+}
+
+// EncodeThumbnail writes a thumbnail as JPEG
+func EncodeThumbnail(w io.Writer, thumb image.Image) error {
+    return jpeg.Encode(w, thumb, &jpeg.Options{Quality: 80})
+}
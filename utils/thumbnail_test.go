@@ -0,0 +1,120 @@
+package utils
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/binary"
+    "hash/crc32"
+    "image"
+    "image/color"
+    "image/gif"
+    "image/jpeg"
+    "image/png"
+    "testing"
+)
+
+// tinyWebP is a 1x1 lossless WebP image
+const tinyWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func testImage(width, height int) image.Image {
+    img := image.NewRGBA(image.Rect(0, 0, width, height))
+    for x := 0; x < width; x++ {
+        img.Set(x, 0, color.RGBA{R: 255, A: 255})
+    }
+    return img
+}
+
+// TestDecodeImageFormats tests decoding each supported format
+func TestDecodeImageFormats(t *testing.T) {
+    var pngData, jpegData, gifData bytes.Buffer
+    png.Encode(&pngData, testImage(40, 30))
+    jpeg.Encode(&jpegData, testImage(40, 30), nil)
+    gif.Encode(&gifData, testImage(40, 30), nil)
+    webpData, _ := base64.StdEncoding.DecodeString(tinyWebP)
+
+    cases := map[string]struct {
+        data          []byte
+        width, height int
+    }{
+        "png":  {pngData.Bytes(), 40, 30},
+        "jpeg": {jpegData.Bytes(), 40, 30},
+        "gif":  {gifData.Bytes(), 40, 30},
+        "webp": {webpData, 1, 1},
+    }
+    for name, c := range cases {
+        img, err := DecodeImage(bytes.NewReader(c.data))
+        if err != nil {
+            t.Errorf("%s: error decoding: %s", name, err)
+            continue
+        }
+        if img.Bounds().Dx() != c.width || img.Bounds().Dy() != c.height {
+            t.Errorf("%s: expected %dx%d, got %v", name, c.width, c.height, img.Bounds())
+        }
+    }
+
+    if _, err := DecodeImage(bytes.NewReader([]byte("%PDF-1.7"))); err == nil {
+        t.Errorf("Expected error decoding a non-image")
+    }
+}
+
+// TestDecodeImageTooLarge tests that huge dimensions are refused from the header alone
+func TestDecodeImageTooLarge(t *testing.T) {
+    // A PNG signature and IHDR chunk claiming 100000x100000 pixels, with no image data
+    ihdr := make([]byte, 13)
+    binary.BigEndian.PutUint32(ihdr[0:], 100000)
+    binary.BigEndian.PutUint32(ihdr[4:], 100000)
+    ihdr[8], ihdr[9] = 8, 6
+    var data bytes.Buffer
+    data.WriteString("\x89PNG\r\n\x1a\n")
+    binary.Write(&data, binary.BigEndian, uint32(len(ihdr)))
+    data.WriteString("IHDR")
+    data.Write(ihdr)
+    binary.Write(&data, binary.BigEndian, crc32.ChecksumIEEE(append([]byte("IHDR"), ihdr...)))
+
+    if _, err := DecodeImage(&data); err != errImageTooLarge {
+        t.Errorf("Expected errImageTooLarge, got %v", err)
+    }
+}
+
+// TestThumbnail tests scaling to fit the bounding box without enlarging
+func TestThumbnail(t *testing.T) {
+    cases := []struct {
+        width, height, size, expectedWidth, expectedHeight int
+    }{
+        {1024, 768, 256, 256, 192},
+        {600, 1200, 128, 64, 128},
+        {100, 50, 256, 100, 50},
+        {5000, 1, 128, 128, 1},
+    }
+    for _, c := range cases {
+        thumb := Thumbnail(testImage(c.width, c.height), c.size)
+        if thumb.Bounds().Dx() != c.expectedWidth || thumb.Bounds().Dy() != c.expectedHeight {
+            t.Errorf("%dx%d in %d: expected %dx%d, got %v", c.width, c.height, c.size, c.expectedWidth, c.expectedHeight, thumb.Bounds())
+        }
+    }
+
+    var out bytes.Buffer
+    if err := EncodeThumbnail(&out, Thumbnail(testImage(300, 200), 128)); err != nil {
+        t.Fatal(err)
+    }
+    if _, format, err := image.Decode(&out); err != nil || format != "jpeg" {
+        t.Errorf("Expected a JPEG thumbnail, got %q (%v)", format, err)
+    }
+}
+
+// TestCanThumbnail tests which content types get thumbnails
+func TestCanThumbnail(t *testing.T) {
+    for _, contentType := range []string{"image/jpeg", "image/png", "image/gif", "image/webp"} {
+        if !CanThumbnail(contentType) {
+            t.Errorf("Expected thumbnails for %s", contentType)
+        }
+    }
+    for _, contentType := range []string{"image/svg+xml", "application/pdf", "application/octet-stream"} {
+        if CanThumbnail(contentType) {
+            t.Errorf("Expected no thumbnails for %s", contentType)
+        }
+    }
+    if !ValidThumbnailSize(DefaultThumbnailSize) || ValidThumbnailSize(100) {
+        t.Errorf("Unexpected thumbnail size validation")
+    }
+}